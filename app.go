@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"hoyobar/service"
+	"hoyobar/storage"
+	"hoyobar/util/dbmetrics"
+	"hoyobar/util/funcs"
+	"hoyobar/util/idgen"
+	"hoyobar/util/mycache"
+	"log"
+)
+
+// databases, storages and services, shared by the server and commands
+type app struct {
+	config    conf.Config
+	dbMetrics *dbmetrics.Plugin
+	dbRouter  *storage.DBRouter
+	cluster   *storage.Cluster
+	cache     mycache.Cache
+	breaker   *mycache.BreakerCache // nil if redis is not used
+
+	userStorage storage.UserStorage
+	postStorage storage.PostStorage
+
+	userService     *service.UserService
+	postService     *service.PostService
+	likeService     *service.LikeService
+	reactionService *service.ReactionService
+	searchService   *service.SearchService
+	tagService      *service.TagService
+}
+
+// serving: connect replicas and keep shard maps refreshed, commands read from primary with maps loaded once.
+// background jobs of services are started by the server.
+func newApp(config conf.Config, serving bool) *app {
+	idgen.Init("2020-01-01", 0)
+	a := &app{config: config}
+
+	a.cache, a.breaker = initCache(config, serving)
+
+	db, dbMetrics := initDB(config)
+	a.dbMetrics = dbMetrics
+	a.dbRouter = storage.NewDBRouter(db)
+	if serving {
+		a.dbRouter.WithReplicas(
+			initReplicas(config, dbMetrics),
+			config.DB.Replica.StickyWindow,
+			config.DB.Replica.MaxLag,
+		).WithWriteTracker(storage.NewCacheWriteTracker(a.cache, config.DB.Replica.StickyWindow))
+		funcs.Go(func() { a.dbRouter.Run(context.Background(), config.DB.Replica.CheckInterval) })
+	}
+	a.cluster = initCluster(config, a.dbRouter, dbMetrics)
+	if config.DB.AutoMigrate {
+		if err := initMigrator(a.cluster).Up(context.Background()); err != nil {
+			log.Fatalf("fails to migrate db: %v\n", err)
+		}
+	}
+
+	if err := storage.RecordShardN(context.Background(), a.cluster, model.ShardGroupPost, config.Sharding.PostShardN); err != nil {
+		log.Fatalf("fails to check post shards: %v\n", err)
+	}
+	userShards := initShardRouter(config, a.cluster, model.ShardGroupUser)
+	if serving {
+		funcs.Go(func() { userShards.Run(context.Background(), config.Sharding.MapRefresh) })
+	}
+
+	a.userStorage = storage.NewUserStorageMySQL(userShards)
+	a.postStorage = storage.NewPostStorageMySQL(a.cluster)
+	replyStorage := storage.NewPostReplyStorageMySQL(a.cluster)
+	likeStorage := storage.NewLikeStorageMySQL(db)
+	reactionStorage := storage.NewReactionStorageMySQL(db)
+	tagStorage := storage.NewTagStorageMySQL(db)
+	sessionStorage := storage.NewSessionStorageMySQL(db)
+
+	a.userService = service.NewUserService(a.cache, a.userStorage, sessionStorage)
+	postCache := service.NewPostCache(a.cache, a.postStorage)
+	hotService := service.NewHotService(a.cache, a.postStorage, postCache)
+	a.likeService = service.NewLikeService(a.cache, likeStorage, a.postStorage, replyStorage, postCache, hotService)
+	a.reactionService = service.NewReactionService(a.cache, reactionStorage, a.postStorage, replyStorage)
+	// the index file is locked by the server, commands index into memory only,
+	// the server drops deleted docs when reading them from db
+	var indexPath string
+	if serving {
+		indexPath = config.Search.IndexPath
+	}
+	a.searchService = service.NewSearchService(initSearchIndex(indexPath, true), a.postStorage, replyStorage)
+	a.tagService = service.NewTagService(a.cache, tagStorage, a.userStorage)
+	a.postService = service.NewPostService(
+		a.cache, a.userService, a.userStorage, a.postStorage, replyStorage, postCache,
+		a.likeService, hotService, a.reactionService, a.searchService, a.tagService,
+	)
+	return a
+}
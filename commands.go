@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"hoyobar/service"
+	"hoyobar/storage"
+	"hoyobar/util/funcs"
+	"hoyobar/util/mycache/keys"
+	"hoyobar/util/myerr"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// a command of the binary: "hoyobar <name> [flags] <args>", every command has --config and --set
+type command struct {
+	name string // words after the binary name, e.g. "user set-role"
+	args string // positional arguments, for usage
+	help string
+	// define flags of the command, the returned function runs it after flags are parsed
+	define func(fs *flag.FlagSet) func(config conf.Config, args []string) error
+}
+
+// the first one is run if no command is given
+var commands = []*command{
+	{name: "serve", help: "start the server", define: defineServe},
+	{name: "migrate", args: "up|down|status|to <version>", help: "apply or revert schema migrations", define: defineMigrate},
+	{name: "reshard user", args: "<shard_n>", help: "move user tables to shard_n shards by consistent hashing, the server keeps running", define: defineReshardUser},
+	{name: "user create-admin", help: "create an admin, the password is read from stdin if not given", define: defineCreateAdmin},
+	{name: "user set-role", args: "admin|user", help: "set role of a user", define: defineSetRole},
+	{name: "user lock", help: "lock a user, it can not log in and its tokens are rejected", define: defineSetLocked(true)},
+	{name: "user unlock", help: "unlock a user", define: defineSetLocked(false)},
+	{name: "post delete", args: "<post_id>", help: "delete a post, its replies are hidden with it", define: defineDeletePost},
+	{name: "cache flush", args: "[prefix...]", help: `delete cache keys of prefixes, e.g. "post" for hoyobar:post:*`, define: defineFlushCache},
+	{name: "reindex search", help: "rebuild the search index from db, the server must be stopped, it locks the index file", define: defineReindexSearch},
+	{name: "check consistency", help: "compare like nums of posts and replies with their likes", define: defineCheckConsistency},
+}
+
+// wrong arguments, the usage of the command is printed
+var errUsage = errors.New("wrong arguments")
+
+func runCommand(args []string) {
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "--help") {
+		printUsage()
+		return
+	}
+	cmd, args := findCommand(args)
+	if cmd == nil {
+		printUsage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("hoyobar "+cmd.name, flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "path of the config file")
+	var sets setFlags
+	fs.Var(&sets, "set", "override a field of the config, e.g. --set app.port=9090, repeatable")
+	run := cmd.define(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: hoyobar %v [flags] %v\n%v\n", cmd.name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	args = parseFlags(fs, args)
+	config := readConfig(conf.Source{Path: *configPath, Sets: sets})
+	err := run(config, args)
+	if err == errUsage {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		if e, ok := err.(*myerr.MyError); ok && e.Cause() != nil {
+			log.Fatalf("%v fails: %v, cause: %v\n", cmd.name, e, e.Cause())
+		}
+		log.Fatalf("%v fails: %v\n", cmd.name, err)
+	}
+	// cache writes and indexing are done in background
+	if !funcs.Wait(config.App.Timeout.Default) {
+		log.Println("background tasks are not done before exit, the cache may be stale until it expires")
+	}
+}
+
+// the command named by the first words of args, and the rest of args.
+// serve if args is empty or starts with a flag.
+func findCommand(args []string) (*command, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return commands[0], args
+	}
+	var found *command
+	var n int
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(words) <= n || len(words) > len(args) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == cmd.name {
+			found, n = cmd, len(words)
+		}
+	}
+	return found, args[n:]
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: hoyobar [command] [--config config.yaml] [--set path=value] [flags] [args]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-20s %v\n", cmd.name, cmd.help)
+	}
+	fmt.Fprintln(os.Stderr, `run "hoyobar <command> -h" for flags of a command`)
+}
+
+// flags may be after positional args, e.g. "migrate to 3 --config prod.yaml", the positional args are returned
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = fs.Parse(args) // exits on error
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// repeated --set
+type setFlags []string
+
+func (s *setFlags) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *setFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// commands write to the cache of the server only if it is shared
+func warnLocalCache(config conf.Config) {
+	if config.Cache.Type == "memory" {
+		log.Println("cache.type is memory, the cache of the running server is not changed, it may be stale until it expires")
+	}
+}
+
+func defineServe(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+	return func(config conf.Config, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		serve(config)
+		return nil
+	}
+}
+
+func defineMigrate(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+	return func(config conf.Config, args []string) error {
+		var version int64
+		switch {
+		case len(args) == 1 && (args[0] == "up" || args[0] == "down" || args[0] == "status"):
+		case len(args) == 2 && args[0] == "to":
+			var err error
+			if version, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return errUsage
+			}
+		default:
+			return errUsage
+		}
+		db, dbMetrics := initDB(config)
+		migrator := initMigrator(initCluster(config, storage.NewDBRouter(db), dbMetrics))
+		ctx := context.Background()
+		switch args[0] {
+		case "up":
+			return migrator.Up(ctx)
+		case "down":
+			return migrator.Down(ctx)
+		case "to":
+			return migrator.To(ctx, version)
+		}
+		list, err := migrator.Status(ctx)
+		for _, s := range list {
+			state := "pending"
+			if s.Applied == s.Targets {
+				state = "applied"
+			} else if s.Applied > 0 {
+				state = "partial"
+			}
+			fmt.Printf("%04d_%-30s %-8s %v/%v\n", s.Version, s.Name, state, s.Applied, s.Targets)
+		}
+		return err
+	}
+}
+
+func defineReshardUser(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+	return func(config conf.Config, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		shardN, err := strconv.Atoi(args[0])
+		if err != nil || shardN <= 0 {
+			return errUsage
+		}
+		db, dbMetrics := initDB(config)
+		cluster := initCluster(config, storage.NewDBRouter(db), dbMetrics)
+		shards := initShardRouter(config, cluster, model.ShardGroupUser)
+		// processes reload shard maps every MapRefresh, they must see a step before the next one
+		settle := 3 * config.Sharding.MapRefresh
+		if err := shards.Reshard(context.Background(), shardN, config.Sharding.VNodes, settle); err != nil {
+			return err
+		}
+		log.Printf("%v resharded to %v shards\n", model.ShardGroupUser, shardN)
+		return nil
+	}
+}
+
+func defineCreateAdmin(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+	info := &service.RegisterInfo{}
+	fs.StringVar(&info.Username, "username", "", "email or phone")
+	fs.StringVar(&info.Nickname, "nickname", "", "nickname")
+	fs.StringVar(&info.Password, "password", "", "password, left in shell history, read from stdin if empty")
+	return func(config conf.Config, args []string) error {
+		if len(args) > 0 || info.Username == "" || info.Nickname == "" {
+			return errUsage
+		}
+		if info.Password == "" {
+			fmt.Fprint(os.Stderr, "password: ")
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return errUsage
+			}
+			info.Password = strings.TrimSpace(line)
+		}
+		a := newApp(config, false)
+		userBasic, err := a.userService.CreateAdmin(context.Background(), info)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("admin %v created, user_id = %v\n", userBasic.Nickname, userBasic.UserID)
+		return nil
+	}
+}
+
+// flags choosing a user by one of user ID, username and nickname
+func defineUserFlags(fs *flag.FlagSet) func(ctx context.Context, a *app) (int64, error) {
+	userID := fs.Int64("id", 0, "user ID")
+	username := fs.String("username", "", "email or phone")
+	nickname := fs.String("nickname", "", "nickname")
+	return func(ctx context.Context, a *app) (int64, error) {
+		var id int64
+		var err error
+		switch {
+		case *userID != 0 && *username == "" && *nickname == "":
+			return *userID, nil
+		case *userID == 0 && *username != "" && *nickname == "":
+			id, err = a.userService.UsernameToUserID(ctx, *username)
+		case *userID == 0 && *username == "" && *nickname != "":
+			id, err = a.userService.NicknameToUserID(ctx, *nickname)
+		default:
+			return 0, errUsage
+		}
+		if err == nil && id == 0 {
+			err = myerr.ErrUserNotFound
+		}
+		return id, err
+	}
+}
+
+func defineSetRole(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+	chooseUser := defineUserFlags(fs)
+	return func(config conf.Config, args []string) error {
+		if len(args) != 1 || (args[0] != "admin" && args[0] != "user") {
+			return errUsage
+		}
+		role := model.RoleAdmin
+		if args[0] == "user" {
+			role = ""
+		}
+		ctx := context.Background()
+		a := newApp(config, false)
+		userID, err := chooseUser(ctx, a)
+		if err != nil {
+			return err
+		}
+		if err := a.userService.SetRole(ctx, userID, role); err != nil {
+			return err
+		}
+		fmt.Printf("role of user %v is set to %v\n", userID, args[0])
+		return nil
+	}
+}
+
+func defineSetLocked(locked bool) func(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+	return func(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+		chooseUser := defineUserFlags(fs)
+		return func(config conf.Config, args []string) error {
+			if len(args) > 0 {
+				return errUsage
+			}
+			ctx := context.Background()
+			a := newApp(config, false)
+			userID, err := chooseUser(ctx, a)
+			if err != nil {
+				return err
+			}
+			if err := a.userService.SetLocked(ctx, userID, locked); err != nil {
+				return err
+			}
+			warnLocalCache(config)
+			if locked {
+				fmt.Printf("user %v is locked\n", userID)
+			} else {
+				fmt.Printf("user %v is unlocked\n", userID)
+			}
+			return nil
+		}
+	}
+}
+
+func defineDeletePost(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+	return func(config conf.Config, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		postID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return errUsage
+		}
+		a := newApp(config, false)
+		if err := a.postService.Delete(context.Background(), postID); err != nil {
+			return err
+		}
+		warnLocalCache(config)
+		fmt.Printf("post %v is deleted\n", postID)
+		return nil
+	}
+}
+
+func defineFlushCache(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+	all := fs.Bool("all", false, "delete all keys of the app, including auth tokens, the nickname search index is rebuilt by the server in background")
+	return func(config conf.Config, args []string) error {
+		if *all == (len(args) > 0) {
+			return errUsage
+		}
+		if config.Cache.Type == "memory" {
+			return errors.New("cache.type is memory, the cache is in the server process, restart it instead")
+		}
+		prefixes := []string{keys.Key("")} // "hoyobar:"
+		if !*all {
+			prefixes = prefixes[:0]
+			for _, arg := range args {
+				prefixes = append(prefixes, keys.Key(arg)+":")
+			}
+		}
+		cache, _ := initCache(config, false)
+		for _, prefix := range prefixes {
+			n, err := cache.DelPrefix(context.Background(), prefix)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%v keys of %v* deleted\n", n, prefix)
+		}
+		return nil
+	}
+}
+
+func defineReindexSearch(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+	return func(config conf.Config, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		db, dbMetrics := initDB(config)
+		cluster := initCluster(config, storage.NewDBRouter(db), dbMetrics)
+		searchService := service.NewSearchService(
+			initSearchIndex(config.Search.IndexPath, false),
+			storage.NewPostStorageMySQL(cluster),
+			storage.NewPostReplyStorageMySQL(cluster),
+		)
+		log.Println("rebuilding search index")
+		if err := searchService.Rebuild(context.Background()); err != nil {
+			return err
+		}
+		log.Println("search index rebuilt")
+		return nil
+	}
+}
+
+func defineCheckConsistency(fs *flag.FlagSet) func(config conf.Config, args []string) error {
+	fix := fs.Bool("fix", false, "overwrite drifted like nums with the counts")
+	return func(config conf.Config, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		a := newApp(config, false)
+		drifts, err := a.likeService.Check(context.Background(), *fix)
+		for _, d := range drifts {
+			fmt.Printf("%v %v: like_num %v, %v likes\n", d.TargetType, d.TargetID, d.LikeNum, d.Likes)
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(drifts) == 0:
+			fmt.Println("like nums are consistent")
+		case *fix:
+			fmt.Printf("%v like nums fixed\n", len(drifts))
+		default:
+			fmt.Printf("%v like nums drifted, run with --fix to overwrite them\n", len(drifts))
+		}
+		return nil
+	}
+}
@@ -2,81 +2,353 @@
 package conf
 
 import (
+	"errors"
 	"io"
-	"io/ioutil"
 	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
-var Global *Config
+var global atomic.Value // *Config
+
+// the config loaded by Load, nil before it. Fields tagged `reload:"true"` are replaced on Reload,
+// so read them from Global() on every use instead of keeping them.
+func Global() *Config {
+	config, _ := global.Load().(*Config)
+	return config
+}
+
+// shards [From, To] are in the database, the address of db.type is set,
+// ranges with the same address share one connection pool
+type ShardDB struct {
+	From     int    `yaml:"from"`
+	To       int    `yaml:"to"`
+	MySQL    string `yaml:"mysql"`                  // "host:port", user/pass/db_name are the same as main
+	Postgres string `yaml:"postgres" secret:"true"` // DSN
+	Sqlite3  string `yaml:"sqlite3"`                // DSN
+}
 
 type Config struct {
 	DB struct {
-		Type string `yaml:"type"`
+		Type string `yaml:"type"` // "mysql", "postgres" or "sqlite3"
 
 		MySQL struct {
 			Host   string `yaml:"host"`
 			Port   string `yaml:"port"`
 			User   string `yaml:"user"`
-			Pass   string `yaml:"pass"`
+			Pass   string `yaml:"pass" secret:"true"`
 			DBName string `yaml:"db_name"`
+			DSN    string `yaml:"dsn" secret:"true"` // overrides the fields above, replicas and shards replace its address
 		} `yaml:"mysql"`
 
+		Postgres struct {
+			DSN string `yaml:"dsn" secret:"true"`
+		} `yaml:"postgres"`
+
 		Sqlite3 struct {
 			DSN string `yaml:"dsn"`
 		} `yaml:"sqlite3"`
 
-		AutoMigrate bool `yaml:"auto_migrate"`
+		// read replicas of PostStorage and UserStorage
+		Replica struct {
+			MySQL         []string      `yaml:"mysql"`                  // "host:port", user/pass/db_name are the same as primary
+			Postgres      []string      `yaml:"postgres" secret:"true"` // DSNs
+			Sqlite3       []string      `yaml:"sqlite3"`                // DSNs
+			StickyWindow  time.Duration `yaml:"sticky_window"`          // reads of a user go to primary after the user writes
+			MaxLag        time.Duration `yaml:"max_lag"`                // replicas lagging more are skipped
+			CheckInterval time.Duration `yaml:"check_interval"`         // of health and lag
+		} `yaml:"replica"`
+
+		// ranges of shards in other databases, shards not in any range are in the main database
+		Shards struct {
+			User []ShardDB `yaml:"user"`
+			Post []ShardDB `yaml:"post"` // posts and replies
+		} `yaml:"shards"`
+
+		AutoMigrate   bool          `yaml:"auto_migrate"`   // runs "migrate up" at startup
+		SlowThreshold time.Duration `yaml:"slow_threshold"` // statements slower than it are logged, negative disables the log
+		RedactColumns []string      `yaml:"redact_columns"` // values hidden in logs
 	} `yaml:"db"`
 
 	Redis struct {
-		Addr     string `yaml:"addr"`
-		Username string `yaml:"username"`
-		Password string `yaml:"password"`
-		DB       int    `yaml:"db"`
+		Mode     string   `yaml:"mode"`  // "standalone", "sentinel" or "cluster"
+		Addr     string   `yaml:"addr"`  // of "standalone"
+		Addrs    []string `yaml:"addrs"` // sentinels of "sentinel", seed nodes of "cluster"
+		Username string   `yaml:"username"`
+		Password string   `yaml:"password" secret:"true"`
+		DB       int      `yaml:"db"` // not supported by "cluster"
+
+		Sentinel struct {
+			MasterName string `yaml:"master_name"`
+			Username   string `yaml:"username"`
+			Password   string `yaml:"password" secret:"true"`
+		} `yaml:"sentinel"`
+
+		TLS struct {
+			Enable             bool   `yaml:"enable"`
+			CAFile             string `yaml:"ca_file"` // empty means system roots
+			ServerName         string `yaml:"server_name"`
+			InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+		} `yaml:"tls"`
+
+		PoolSize     int           `yaml:"pool_size"` // per node, 0 means 10 * GOMAXPROCS
+		MinIdleConns int           `yaml:"min_idle_conns"`
+		PoolTimeout  time.Duration `yaml:"pool_timeout"` // wait for a free connection
+		DialTimeout  time.Duration `yaml:"dial_timeout"`
+		ReadTimeout  time.Duration `yaml:"read_timeout"`
+		WriteTimeout time.Duration `yaml:"write_timeout"`
 	} `yaml:"redis"`
 
+	Cache struct {
+		Type       string `yaml:"type"`        // "redis", "memory" (single process only) or "tiered"
+		MaxEntries int    `yaml:"max_entries"` // of "memory", sorted sets are not counted
+		L1         struct {
+			MaxEntries int           `yaml:"max_entries"`
+			TTL        time.Duration `yaml:"ttl"`
+			Prefixes   []string      `yaml:"prefixes"` // keys cached in L1, e.g. "user" for "hoyobar:user:*"
+		} `yaml:"l1"` // per-process cache in front of redis, for "tiered"
+		Breaker struct {
+			MaxFailures int           `yaml:"max_failures"` // consecutive errors to open the breaker
+			Cooldown    time.Duration `yaml:"cooldown"`     // how long calls fail fast before a trial
+		} `yaml:"breaker"` // around redis, for "redis" and "tiered"
+	} `yaml:"cache"`
+
 	Sharding struct {
-		UserShardN int `yaml:"user_shard_n"`
+		UserShardN int           `yaml:"user_shard_n"` // only before the first resharding, then the shard map in db is used
+		PostShardN int           `yaml:"post_shard_n"` // posts by board, replies by post
+		VNodes     int           `yaml:"vnodes"`       // points of each shard on the hash ring, for resharding
+		MapRefresh time.Duration `yaml:"map_refresh"`  // how often shard maps are reloaded from db
 	} `yaml:"sharding"`
 
+	Search struct {
+		IndexPath       string        `yaml:"index_path"`                      // local file of the index, empty means not persisted
+		FlushInterval   time.Duration `yaml:"flush_interval"`                  // how often the index is written to disk
+		RecencyHalfLife time.Duration `yaml:"recency_half_life" reload:"true"` // recency boost halves every half life
+		RecencyWeight   float64       `yaml:"recency_weight" reload:"true"`    // a brand new doc scores (1 + weight)x
+	} `yaml:"search"`
+
 	App struct {
 		Port              string `yaml:"port"`
-		CheckUserIsAuthor bool   `yaml:"check_user_is_author"`
-		DefaultPageSize   int    `yaml:"default_page_size"`
-		MaxPageSize       int    `yaml:"max_page_size"`
+		CheckUserIsAuthor bool   `yaml:"check_user_is_author" reload:"true"`
+		DefaultPageSize   int    `yaml:"default_page_size" reload:"true"`
+		MaxPageSize       int    `yaml:"max_page_size" reload:"true"`
 		Expire            struct {
-			AuthToken time.Duration `yaml:"auth_token_expire"`
-			UserInfo  time.Duration `yaml:"user_info"`
-			PostInfo  time.Duration `yaml:"post_info"`
+			AuthToken time.Duration `yaml:"auth_token" reload:"true"`
+			UserInfo  time.Duration `yaml:"user_info" reload:"true"`
+			PostInfo  time.Duration `yaml:"post_info" reload:"true"`
+			NotFound  time.Duration `yaml:"not_found" reload:"true"` // negative entries of user lookups
+			Jitter    float64       `yaml:"jitter" reload:"true"`    // see mycache.RandomExpire
+			DBSession time.Duration `yaml:"db_session"`              // tokens issued while cache is unavailable, 0 disables
 		} `yaml:"expire"`
 		Timeout struct {
-			Default time.Duration `yaml:"default"`
+			Default time.Duration            `yaml:"default"`
+			Routes  map[string]time.Duration `yaml:"routes"` // "METHOD /path" -> timeout, overrides default
 		} `yaml:"timeout"`
-		BcrytpCost int `yaml:"bcrypt_cost"`
+		BcrytpCost int `yaml:"bcrypt_cost" reload:"true"`
+		SubReply   struct {
+			PreviewN int  `yaml:"preview_n"` // sub-replies shown inline with each floor
+			BumpPost bool `yaml:"bump_post"` // whether a sub-reply updates post's reply_time
+		} `yaml:"sub_reply" reload:"true"`
+		Like struct {
+			FlushInterval     time.Duration `yaml:"flush_interval"`     // write like nums back to db
+			ReconcileInterval time.Duration `yaml:"reconcile_interval"` // recount all like nums
+			BatchSize         int           `yaml:"batch_size" reload:"true"`
+		} `yaml:"like"`
+		Hot struct {
+			// scores are stored, so weights and decay need a restart and only apply to scores updated later
+			ReplyWeight    float64       `yaml:"reply_weight"`
+			LikeWeight     float64       `yaml:"like_weight"`
+			Decay          time.Duration `yaml:"decay"`                         // a post needs 10x activity to rank the same as one created Decay later
+			TopN           int           `yaml:"top_n" reload:"true"`           // size of hot post list per board
+			SnapshotExpire time.Duration `yaml:"snapshot_expire" reload:"true"` // how long a hot post cursor is valid
+			ReplyTopN      int           `yaml:"reply_top_n" reload:"true"`     // hot replies pinned above floors
+		} `yaml:"hot"`
+		NicknameSearch struct {
+			CandidateN int `yaml:"candidate_n"` // matches read before ranking
+		} `yaml:"nickname_search" reload:"true"`
+		Reaction struct {
+			Default []string           `yaml:"default"` // allowed emojis of boards not in Boards
+			Boards  map[int64][]string `yaml:"boards"`  // board ID -> allowed emojis
+		} `yaml:"reaction" reload:"true"`
+		Timeline struct {
+			Size int `yaml:"size"` // latest created/replied posts kept in cache per board
+		} `yaml:"timeline" reload:"true"`
+		Tag struct {
+			MaxN        int           `yaml:"max_n"`        // max tags of a post
+			CloudWindow time.Duration `yaml:"cloud_window"` // tags of posts created in the window are counted
+			CloudSize   int           `yaml:"cloud_size"`
+			CloudExpire time.Duration `yaml:"cloud_expire"`
+		} `yaml:"tag" reload:"true"`
 	} `yaml:"app"`
-}
 
-func FromYAML(r io.Reader) Config {
-	data, err := ioutil.ReadAll(r)
-	if err != nil {
-		log.Fatalf("fails to read config from yaml: %v\n", err)
-	}
+	// "path.of.field": file, string fields read from files, e.g. mounted secrets
+	SecretFiles map[string]string `yaml:"secret_files"`
+}
 
+// decode strictly, unknown keys are errors. Defaults are not assigned, see Load.
+func FromYAML(r io.Reader) (Config, error) {
 	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		log.Fatalf("fails to unmarshal config from yaml: %v\n", err)
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	err := dec.Decode(&config)
+	if e, ok := err.(*yaml.TypeError); ok {
+		// types of nested fields are anonymous structs, too long to read
+		msgs := make([]string, len(e.Errors))
+		for i, msg := range e.Errors {
+			if j := strings.Index(msg, " in type struct {"); j >= 0 {
+				msg = msg[:j]
+			}
+			msgs[i] = msg
+		}
+		return config, errors.New(strings.Join(msgs, "; "))
 	}
-	assigneDefaults(&config)
-	return config
+	if err != nil && err != io.EOF {
+		return config, err
+	}
+	return config, nil
 }
 
+// defaults of fields not set, invalid values are left to Validate
 func assigneDefaults(config *Config) {
-	if config.App.Timeout.Default <= 0 {
+	if config.Sharding.UserShardN == 0 {
+		config.Sharding.UserShardN = 1
+	}
+	if config.Sharding.PostShardN == 0 {
+		config.Sharding.PostShardN = 1
+	}
+	if config.Sharding.VNodes == 0 {
+		config.Sharding.VNodes = 64
+	}
+	if config.Sharding.MapRefresh == 0 {
+		config.Sharding.MapRefresh = 10 * time.Second
+	}
+	if config.DB.SlowThreshold == 0 {
+		config.DB.SlowThreshold = 200 * time.Millisecond
+	}
+	if config.DB.Replica.StickyWindow == 0 {
+		config.DB.Replica.StickyWindow = 5 * time.Second
+	}
+	if config.DB.Replica.CheckInterval == 0 {
+		config.DB.Replica.CheckInterval = time.Second
+	}
+	if config.DB.Replica.MaxLag == 0 {
+		config.DB.Replica.MaxLag = 2 * config.DB.Replica.CheckInterval
+	}
+	if config.DB.RedactColumns == nil {
+		config.DB.RedactColumns = []string{"password", "phone", "email"}
+	}
+	if config.Redis.Mode == "" {
+		config.Redis.Mode = "standalone"
+	}
+	if config.Redis.DialTimeout == 0 {
+		config.Redis.DialTimeout = 5 * time.Second
+	}
+	if config.Redis.ReadTimeout == 0 {
+		config.Redis.ReadTimeout = 3 * time.Second
+	}
+	if config.Redis.WriteTimeout == 0 {
+		config.Redis.WriteTimeout = config.Redis.ReadTimeout
+	}
+	if config.Cache.Type == "" {
+		config.Cache.Type = "redis"
+	}
+	if config.Cache.MaxEntries == 0 {
+		config.Cache.MaxEntries = 100000
+	}
+	if config.Cache.L1.MaxEntries == 0 {
+		config.Cache.L1.MaxEntries = 10000
+	}
+	if config.Cache.L1.TTL == 0 {
+		config.Cache.L1.TTL = 10 * time.Second
+	}
+	if config.Cache.L1.Prefixes == nil {
+		config.Cache.L1.Prefixes = []string{"user"}
+	}
+	if config.Cache.Breaker.MaxFailures == 0 {
+		config.Cache.Breaker.MaxFailures = 5
+	}
+	if config.Cache.Breaker.Cooldown == 0 {
+		config.Cache.Breaker.Cooldown = 10 * time.Second
+	}
+	if config.App.Timeout.Default == 0 {
 		// default timeout is 1 min
 		config.App.Timeout.Default = time.Minute
 		log.Println("Use default timeout: 1 min")
 	}
+	if config.App.Port == "" {
+		config.App.Port = "8080"
+	}
+	if config.App.DefaultPageSize == 0 {
+		config.App.DefaultPageSize = 20
+	}
+	if config.App.MaxPageSize == 0 {
+		config.App.MaxPageSize = config.App.DefaultPageSize
+	}
+	if config.App.BcrytpCost == 0 {
+		config.App.BcrytpCost = 10
+	}
+	if config.App.Expire.AuthToken == 0 {
+		config.App.Expire.AuthToken = 10 * time.Hour
+	}
+	if config.App.Expire.UserInfo == 0 {
+		config.App.Expire.UserInfo = 15 * 24 * time.Hour
+	}
+	if config.App.Expire.PostInfo == 0 {
+		config.App.Expire.PostInfo = 7 * 24 * time.Hour
+	}
+	if config.App.Expire.NotFound == 0 {
+		config.App.Expire.NotFound = time.Minute
+	}
+	if config.App.Timeline.Size == 0 {
+		config.App.Timeline.Size = 1000
+	}
+	if config.App.Like.FlushInterval == 0 {
+		config.App.Like.FlushInterval = 5 * time.Second
+	}
+	if config.App.Like.ReconcileInterval == 0 {
+		config.App.Like.ReconcileInterval = time.Hour
+	}
+	if config.App.Like.BatchSize == 0 {
+		config.App.Like.BatchSize = 500
+	}
+	if config.App.Hot.ReplyWeight == 0 && config.App.Hot.LikeWeight == 0 {
+		config.App.Hot.ReplyWeight = 1
+		config.App.Hot.LikeWeight = 0.5
+	}
+	if config.App.Hot.Decay == 0 {
+		config.App.Hot.Decay = 12 * time.Hour
+	}
+	if config.App.Hot.TopN == 0 {
+		config.App.Hot.TopN = 500
+	}
+	if config.App.Hot.SnapshotExpire == 0 {
+		config.App.Hot.SnapshotExpire = 10 * time.Minute
+	}
+	if config.Search.FlushInterval == 0 {
+		config.Search.FlushInterval = 5 * time.Minute
+	}
+	if config.Search.RecencyHalfLife == 0 {
+		config.Search.RecencyHalfLife = 30 * 24 * time.Hour
+	}
+	if config.App.NicknameSearch.CandidateN == 0 {
+		config.App.NicknameSearch.CandidateN = 200
+	}
+	if len(config.App.Reaction.Default) == 0 {
+		config.App.Reaction.Default = []string{"👍", "❤️", "😂", "😮", "😢", "😡"}
+	}
+	if config.App.Tag.MaxN == 0 {
+		config.App.Tag.MaxN = 5
+	}
+	if config.App.Tag.CloudWindow == 0 {
+		config.App.Tag.CloudWindow = 30 * 24 * time.Hour
+	}
+	if config.App.Tag.CloudSize == 0 {
+		config.App.Tag.CloudSize = 50
+	}
+	if config.App.Tag.CloudExpire == 0 {
+		config.App.Tag.CloudExpire = 10 * time.Minute
+	}
 }
@@ -0,0 +1,237 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "HOYOBAR_"
+
+// where the config is read from, kept for Reload
+type Source struct {
+	Path string   // yaml file
+	Sets []string // "path=value" from command line, e.g. "app.port=9090"
+}
+
+var loaded Source
+
+// Load reads the config in layers, later ones override earlier ones:
+//  1. the yaml file, unknown keys are errors
+//  2. secret_files, "path.of.field": file
+//  3. HOYOBAR_PATH_OF_FIELD environment variables, and HOYOBAR_PATH_OF_FIELD_FILE of string fields
+//  4. Sets
+//
+// then fields not set get defaults and the whole config is validated.
+// The config is exposed by Global.
+func Load(src Source) (*Config, error) {
+	config, err := read(src)
+	if err != nil {
+		return nil, err
+	}
+	loaded = src
+	global.Store(config)
+	return config, nil
+}
+
+// Reload reads the config again from the source of Load. Changes of fields tagged `reload:"true"`
+// take effect, changes of other fields need a restart and their paths are returned.
+// An invalid config is not applied.
+func Reload() (restart []string, err error) {
+	next, err := read(loaded)
+	if err != nil {
+		return nil, err
+	}
+	nextFields := map[string]field{}
+	walk(reflect.ValueOf(next).Elem(), "", false, func(f field) {
+		nextFields[f.path] = f
+	})
+	config := *Global()
+	walk(reflect.ValueOf(&config).Elem(), "", false, func(f field) {
+		nf := nextFields[f.path]
+		if reflect.DeepEqual(f.value.Interface(), nf.value.Interface()) {
+			return
+		}
+		if f.reload {
+			f.value.Set(nf.value)
+		} else {
+			restart = append(restart, f.path)
+		}
+	})
+	global.Store(&config)
+	return restart, nil
+}
+
+func read(src Source) (*Config, error) {
+	f, err := os.Open(src.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config, err := FromYAML(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src.Path, err)
+	}
+
+	fields := map[string]field{}
+	walk(reflect.ValueOf(&config).Elem(), "", false, func(f field) {
+		fields[f.path] = f
+	})
+	for path, file := range config.SecretFiles {
+		f, ok := fields[path]
+		if !ok || f.value.Kind() != reflect.String {
+			return nil, fmt.Errorf("secret_files: %q is not a string field", path)
+		}
+		if err := setFromFile(f, file); err != nil {
+			return nil, fmt.Errorf("secret_files: %w", err)
+		}
+	}
+	for _, f := range fields {
+		name := envName(f.path)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := set(f, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if f.value.Kind() != reflect.String {
+			continue
+		}
+		if file, ok := os.LookupEnv(name + "_FILE"); ok {
+			if err := setFromFile(f, file); err != nil {
+				return nil, fmt.Errorf("%s_FILE: %w", name, err)
+			}
+		}
+	}
+	for _, s := range src.Sets {
+		path, value, ok := cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("--set %s: want path=value", s)
+		}
+		f, ok := fields[path]
+		if !ok {
+			return nil, fmt.Errorf("--set %s: unknown field %q", s, path)
+		}
+		if err := set(f, value); err != nil {
+			return nil, fmt.Errorf("--set %s: %w", s, err)
+		}
+	}
+
+	assigneDefaults(&config)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// a copy with secret fields replaced by "***", for logs
+func (c Config) Redacted() Config {
+	redact(reflect.ValueOf(&c).Elem())
+	return c
+}
+
+// a field not of struct type, slices and maps are fields as a whole
+type field struct {
+	path   string // yaml keys joined by ".", e.g. "app.expire.auth_token"
+	value  reflect.Value
+	reload bool // tagged `reload:"true"` itself or in a tagged struct
+}
+
+func walk(v reflect.Value, prefix string, reload bool, fn func(field)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" || key == "secret_files" {
+			continue
+		}
+		path := prefix + key
+		r := reload || sf.Tag.Get("reload") == "true"
+		if sf.Type.Kind() == reflect.Struct && sf.Type.PkgPath() == "" {
+			walk(v.Field(i), path+".", r, fn)
+			continue
+		}
+		fn(field{path: path, value: v.Field(i), reload: r})
+	}
+}
+
+// "app.expire.auth_token" -> "HOYOBAR_APP_EXPIRE_AUTH_TOKEN"
+func envName(path string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// strings are taken as is, other values are yaml, e.g. "10s", "[a, b]" or "{1: [a]}"
+func set(f field, value string) error {
+	if f.value.Kind() == reflect.String {
+		f.value.SetString(value)
+		return nil
+	}
+	v := reflect.New(f.value.Type())
+	if err := yaml.Unmarshal([]byte(value), v.Interface()); err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.value.Set(v.Elem())
+	return nil
+}
+
+func setFromFile(f field, file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.value.SetString(strings.TrimRight(string(b), "\r\n"))
+	return nil
+}
+
+func redact(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).Tag.Get("secret") == "true" {
+				mask(v.Field(i))
+			} else {
+				redact(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Struct || v.Len() == 0 {
+			return
+		}
+		// elements are shared with the original
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(s, v)
+		v.Set(s)
+		for i := 0; i < s.Len(); i++ {
+			redact(s.Index(i))
+		}
+	}
+}
+
+func mask(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() > 0 {
+			v.SetString("***")
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < s.Len(); i++ {
+			mask(s.Index(i))
+		}
+		v.Set(s)
+	}
+}
+
+// strings.Cut of go 1.18
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
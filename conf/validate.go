@@ -0,0 +1,217 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// "METHOD /path" of app.timeout.routes
+var routeKey = regexp.MustCompile(`^[A-Z]+ /\S*$`)
+
+// problems of a config, all reported at once
+type problems []string
+
+func (p *problems) add(path string, format string, args ...interface{}) {
+	*p = append(*p, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (p *problems) oneOf(path, value string, values ...string) {
+	for _, v := range values {
+		if value == v {
+			return
+		}
+	}
+	p.add(path, "%q is not one of %s", value, strings.Join(values, ", "))
+}
+
+func (p *problems) required(path, value string) {
+	if value == "" {
+		p.add(path, "required")
+	}
+}
+
+func (p *problems) positive(path string, value float64) {
+	if value <= 0 {
+		p.add(path, "must be positive, got %v", value)
+	}
+}
+
+func (p *problems) duration(path string, value time.Duration) {
+	if value <= 0 {
+		p.add(path, "must be positive, got %v", value)
+	}
+}
+
+func (p *problems) nonNegative(path string, value float64) {
+	if value < 0 {
+		p.add(path, "must not be negative, got %v", value)
+	}
+}
+
+// Validate checks every field, defaults should be assigned before
+func (c *Config) Validate() error {
+	var p problems
+	c.validateDB(&p)
+	c.validateCache(&p)
+	c.validateApp(&p)
+
+	p.positive("sharding.user_shard_n", float64(c.Sharding.UserShardN))
+	p.positive("sharding.post_shard_n", float64(c.Sharding.PostShardN))
+	p.positive("sharding.vnodes", float64(c.Sharding.VNodes))
+	p.duration("sharding.map_refresh", c.Sharding.MapRefresh)
+
+	p.duration("search.flush_interval", c.Search.FlushInterval)
+	p.duration("search.recency_half_life", c.Search.RecencyHalfLife)
+	p.nonNegative("search.recency_weight", c.Search.RecencyWeight)
+
+	if len(p) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(p, "\n  "))
+	}
+	return nil
+}
+
+func (c *Config) validateDB(p *problems) {
+	db := c.DB
+	p.oneOf("db.type", db.Type, "mysql", "postgres", "sqlite3")
+	switch db.Type {
+	case "mysql":
+		if db.MySQL.DSN == "" {
+			p.required("db.mysql.host", db.MySQL.Host)
+			p.required("db.mysql.user", db.MySQL.User)
+			p.required("db.mysql.db_name", db.MySQL.DBName)
+			if _, err := strconv.ParseUint(db.MySQL.Port, 10, 16); err != nil {
+				p.add("db.mysql.port", "%q is not a port", db.MySQL.Port)
+			}
+		}
+	case "postgres":
+		p.required("db.postgres.dsn", db.Postgres.DSN)
+	case "sqlite3":
+		p.required("db.sqlite3.dsn", db.Sqlite3.DSN)
+	}
+	p.duration("db.replica.sticky_window", db.Replica.StickyWindow)
+	p.duration("db.replica.max_lag", db.Replica.MaxLag)
+	p.duration("db.replica.check_interval", db.Replica.CheckInterval)
+	validateShards(p, "db.shards.user", db.Type, db.Shards.User, -1)
+	validateShards(p, "db.shards.post", db.Type, db.Shards.Post, c.Sharding.PostShardN)
+}
+
+// n: number of shards, -1 if unknown, e.g. user shards change by resharding
+func validateShards(p *problems, path, dbType string, ranges []ShardDB, n int) {
+	for i, r := range ranges {
+		at := fmt.Sprintf("%s[%d]", path, i)
+		if r.From < 0 || r.To < r.From {
+			p.add(at, "wrong range [%v, %v]", r.From, r.To)
+		}
+		if n >= 0 && r.To >= n {
+			p.add(at, "shard %v is out of sharding.post_shard_n %v", r.To, n)
+		}
+		addr := map[string]string{"mysql": r.MySQL, "postgres": r.Postgres, "sqlite3": r.Sqlite3}[dbType]
+		if addr == "" {
+			p.add(at, "no %s address", dbType)
+		}
+	}
+}
+
+func (c *Config) validateCache(p *problems) {
+	p.oneOf("cache.type", c.Cache.Type, "redis", "memory", "tiered")
+	p.positive("cache.max_entries", float64(c.Cache.MaxEntries))
+	p.positive("cache.l1.max_entries", float64(c.Cache.L1.MaxEntries))
+	p.duration("cache.l1.ttl", c.Cache.L1.TTL)
+	p.positive("cache.breaker.max_failures", float64(c.Cache.Breaker.MaxFailures))
+	p.duration("cache.breaker.cooldown", c.Cache.Breaker.Cooldown)
+	if c.Cache.Type == "memory" {
+		return
+	}
+
+	rc := c.Redis
+	p.oneOf("redis.mode", rc.Mode, "standalone", "sentinel", "cluster")
+	switch rc.Mode {
+	case "standalone":
+		p.required("redis.addr", rc.Addr)
+	case "sentinel":
+		p.required("redis.sentinel.master_name", rc.Sentinel.MasterName)
+		if len(rc.Addrs) == 0 {
+			p.add("redis.addrs", "required by sentinel")
+		}
+	case "cluster":
+		if len(rc.Addrs) == 0 {
+			p.add("redis.addrs", "required by cluster")
+		}
+		if rc.DB != 0 {
+			p.add("redis.db", "must be 0 for cluster, got %v", rc.DB)
+		}
+	}
+	p.nonNegative("redis.db", float64(rc.DB))
+	if rc.TLS.Enable && rc.TLS.CAFile != "" {
+		if _, err := os.Stat(rc.TLS.CAFile); err != nil {
+			p.add("redis.tls.ca_file", "%v", err)
+		}
+	}
+	p.nonNegative("redis.pool_size", float64(rc.PoolSize))
+	p.nonNegative("redis.min_idle_conns", float64(rc.MinIdleConns))
+	p.nonNegative("redis.pool_timeout", float64(rc.PoolTimeout))
+	p.duration("redis.dial_timeout", rc.DialTimeout)
+	p.duration("redis.read_timeout", rc.ReadTimeout)
+	p.duration("redis.write_timeout", rc.WriteTimeout)
+}
+
+func (c *Config) validateApp(p *problems) {
+	app := c.App
+	if port, err := strconv.ParseUint(app.Port, 10, 16); err != nil || port == 0 {
+		p.add("app.port", "%q is not a port", app.Port)
+	}
+	p.positive("app.default_page_size", float64(app.DefaultPageSize))
+	if app.MaxPageSize < app.DefaultPageSize {
+		p.add("app.max_page_size", "%v is less than default_page_size %v", app.MaxPageSize, app.DefaultPageSize)
+	}
+	if app.BcrytpCost < 4 || app.BcrytpCost > 31 {
+		p.add("app.bcrypt_cost", "must be in [4, 31], got %v", app.BcrytpCost)
+	}
+
+	p.duration("app.expire.auth_token", app.Expire.AuthToken)
+	p.duration("app.expire.user_info", app.Expire.UserInfo)
+	p.duration("app.expire.post_info", app.Expire.PostInfo)
+	p.duration("app.expire.not_found", app.Expire.NotFound)
+	if app.Expire.Jitter < 0 || app.Expire.Jitter >= 1 {
+		p.add("app.expire.jitter", "must be in [0, 1), got %v", app.Expire.Jitter)
+	}
+	p.nonNegative("app.expire.db_session", float64(app.Expire.DBSession))
+
+	p.duration("app.timeout.default", app.Timeout.Default)
+	for route, timeout := range app.Timeout.Routes {
+		at := fmt.Sprintf("app.timeout.routes[%s]", route)
+		if !routeKey.MatchString(route) {
+			p.add(at, `want "METHOD /path"`)
+		}
+		p.duration(at, timeout)
+	}
+
+	p.nonNegative("app.sub_reply.preview_n", float64(app.SubReply.PreviewN))
+	p.duration("app.like.flush_interval", app.Like.FlushInterval)
+	p.duration("app.like.reconcile_interval", app.Like.ReconcileInterval)
+	p.positive("app.like.batch_size", float64(app.Like.BatchSize))
+
+	p.nonNegative("app.hot.reply_weight", app.Hot.ReplyWeight)
+	p.nonNegative("app.hot.like_weight", app.Hot.LikeWeight)
+	p.duration("app.hot.decay", app.Hot.Decay)
+	p.positive("app.hot.top_n", float64(app.Hot.TopN))
+	p.duration("app.hot.snapshot_expire", app.Hot.SnapshotExpire)
+	p.nonNegative("app.hot.reply_top_n", float64(app.Hot.ReplyTopN))
+
+	p.positive("app.nickname_search.candidate_n", float64(app.NicknameSearch.CandidateN))
+	for board, emojis := range app.Reaction.Boards {
+		if len(emojis) == 0 {
+			p.add(fmt.Sprintf("app.reaction.boards[%v]", board), "no emojis")
+		}
+	}
+	p.positive("app.timeline.size", float64(app.Timeline.Size))
+
+	p.positive("app.tag.max_n", float64(app.Tag.MaxN))
+	p.duration("app.tag.cloud_window", app.Tag.CloudWindow)
+	p.positive("app.tag.cloud_size", float64(app.Tag.CloudSize))
+	p.duration("app.tag.cloud_expire", app.Tag.CloudExpire)
+}
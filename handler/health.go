@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"hoyobar/util/dbmetrics"
+	"hoyobar/util/mycache"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type HealthHandler struct {
+	Breaker   *mycache.BreakerCache // nil if the cache has no breaker
+	DBMetrics *dbmetrics.Plugin
+	DBStatus  func(ctx context.Context) []dbmetrics.DBStatus // pings the main database and shard databases
+}
+
+func (h *HealthHandler) AddRoute(r *gin.RouterGroup) {
+	r.GET("/health", gin.HandlerFunc(h.Health))
+	r.GET("/metrics", gin.HandlerFunc(h.Metrics))
+}
+
+// "degraded" if the cache is skipped, the app still serves from db,
+// or if a database is down, the app still serves shards in other databases
+func (h *HealthHandler) Health(c *gin.Context) {
+	status, cacheState := "ok", "none"
+	if h.Breaker != nil {
+		state := h.Breaker.State()
+		cacheState = state.String()
+		if state != mycache.BreakerClosed {
+			status = "degraded"
+		}
+	}
+	var dbs []dbmetrics.DBStatus
+	if h.DBStatus != nil {
+		dbs = h.DBStatus(c)
+	}
+	for _, db := range dbs {
+		if !db.Up {
+			status = "degraded"
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": status,
+		"cache":  gin.H{"breaker": cacheState},
+		"db":     dbs,
+	})
+}
+
+// prometheus text format
+func (h *HealthHandler) Metrics(c *gin.Context) {
+	var sb strings.Builder
+	if h.Breaker != nil {
+		state, stats := h.Breaker.State(), h.Breaker.Stats()
+		sb.WriteString("# HELP hoyobar_cache_breaker_state 0 closed, 1 open, 2 half open\n")
+		sb.WriteString("# TYPE hoyobar_cache_breaker_state gauge\n")
+		fmt.Fprintf(&sb, "hoyobar_cache_breaker_state %d\n", state)
+		sb.WriteString("# TYPE hoyobar_cache_breaker_opened_total counter\n")
+		fmt.Fprintf(&sb, "hoyobar_cache_breaker_opened_total %d\n", stats.Opened)
+		sb.WriteString("# TYPE hoyobar_cache_breaker_failures_total counter\n")
+		fmt.Fprintf(&sb, "hoyobar_cache_breaker_failures_total %d\n", stats.Failures)
+		sb.WriteString("# TYPE hoyobar_cache_breaker_rejected_total counter\n")
+		fmt.Fprintf(&sb, "hoyobar_cache_breaker_rejected_total %d\n", stats.Rejected)
+		sb.WriteString("# TYPE hoyobar_cache_breaker_replayed_total counter\n")
+		fmt.Fprintf(&sb, "hoyobar_cache_breaker_replayed_total %d\n", stats.Replayed)
+	}
+	if h.DBStatus != nil {
+		writeDBStatus(&sb, h.DBStatus(c))
+	}
+	if h.DBMetrics != nil {
+		writeDBMetrics(&sb, h.DBMetrics.Stats())
+	}
+	c.String(http.StatusOK, sb.String())
+}
+
+func writeDBStatus(sb *strings.Builder, dbs []dbmetrics.DBStatus) {
+	metrics := []struct {
+		name  string
+		help  string
+		value func(s dbmetrics.DBStatus) int64
+	}{
+		{"hoyobar_db_up", "1 if the database answers ping", func(s dbmetrics.DBStatus) int64 {
+			if s.Up {
+				return 1
+			}
+			return 0
+		}},
+		{"hoyobar_db_open_connections", "open connections in the pool", func(s dbmetrics.DBStatus) int64 { return int64(s.Pool.OpenConnections) }},
+		{"hoyobar_db_in_use_connections", "connections in use", func(s dbmetrics.DBStatus) int64 { return int64(s.Pool.InUse) }},
+		{"hoyobar_db_wait_count", "connections waited for, since the process started", func(s dbmetrics.DBStatus) int64 { return s.Pool.WaitCount }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(sb, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(sb, "# TYPE %s gauge\n", m.name)
+		for _, db := range dbs {
+			fmt.Fprintf(sb, "%s{db=%q,shards=%q} %d\n", m.name, db.Name, db.Shards, m.value(db))
+		}
+	}
+}
+
+func writeDBMetrics(sb *strings.Builder, stats []dbmetrics.TableStat) {
+	metrics := []struct {
+		name  string
+		help  string
+		value func(s dbmetrics.Stat) string
+	}{
+		{"hoyobar_db_statements_total", "statements by table and op", func(s dbmetrics.Stat) string { return fmt.Sprint(s.Count) }},
+		{"hoyobar_db_errors_total", "failed statements, not found is not counted", func(s dbmetrics.Stat) string { return fmt.Sprint(s.Errors) }},
+		{"hoyobar_db_rows_total", "rows affected or returned", func(s dbmetrics.Stat) string { return fmt.Sprint(s.Rows) }},
+		{"hoyobar_db_slow_statements_total", "statements over db.slow_threshold", func(s dbmetrics.Stat) string { return fmt.Sprint(s.Slow) }},
+		{"hoyobar_db_statement_seconds_total", "total latency", func(s dbmetrics.Stat) string { return fmt.Sprintf("%.6f", s.Seconds) }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(sb, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(sb, "# TYPE %s counter\n", m.name)
+		for _, stat := range stats {
+			fmt.Fprintf(sb, "%s{db=%q,table=%q,op=%q} %s\n", m.name, stat.DB, stat.Table, stat.Op, m.value(stat.Stat))
+		}
+	}
+}
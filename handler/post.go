@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"hoyobar/conf"
 	"hoyobar/service"
 	"hoyobar/util/myerr"
@@ -11,8 +12,11 @@ import (
 )
 
 type PostHandler struct {
-	PostService *service.PostService
-	UserService *service.UserService
+	PostService     *service.PostService
+	UserService     *service.UserService
+	LikeService     *service.LikeService
+	ReactionService *service.ReactionService
+	TagService      *service.TagService
 }
 
 func (p *PostHandler) AddRoute(r *gin.RouterGroup) {
@@ -21,6 +25,15 @@ func (p *PostHandler) AddRoute(r *gin.RouterGroup) {
 	r.GET("/detail", gin.HandlerFunc(p.Detail))
 	r.GET("/list", gin.HandlerFunc(p.List))
 	r.GET("/reply/list", gin.HandlerFunc(p.ListReply))
+	r.GET("/reply/sub/list", gin.HandlerFunc(p.ListSubReply))
+	r.POST("/reply/delete", gin.HandlerFunc(p.DeleteReply))
+	r.POST("/like", gin.HandlerFunc(p.Like))
+	r.POST("/unlike", gin.HandlerFunc(p.Unlike))
+	r.POST("/reaction", gin.HandlerFunc(p.React))
+	r.GET("/reaction/allowed", gin.HandlerFunc(p.AllowedReactions))
+	r.GET("/tag/cloud", gin.HandlerFunc(p.TagCloud))
+	r.POST("/tag/rename", gin.HandlerFunc(p.RenameTag))
+	r.POST("/tag/merge", gin.HandlerFunc(p.MergeTag))
 }
 
 func (p *PostHandler) userID(c *gin.Context) int64 {
@@ -37,11 +50,17 @@ func (p *PostHandler) Create(c *gin.Context) {
 		c.Error(myerr.ErrNotLogin) // nolint:errcheck
 		return
 	}
-	if conf.Global.App.CheckUserIsAuthor && userID != req.AuthorID {
+	if conf.Global().App.CheckUserIsAuthor && userID != req.AuthorID {
 		c.Error(myerr.ErrAuth.WithEmsg("无操作权限")) // nolint:errcheck
 	}
 
-	postID, err := p.PostService.Create(c, req.AuthorID, req.Title, req.Content)
+	postID, err := p.PostService.Create(c, &service.PostInfo{
+		AuthorID: req.AuthorID,
+		BoardID:  req.BoardID,
+		Title:    req.Title,
+		Content:  req.Content,
+		Tags:     req.Tags,
+	})
 	if err != nil {
 		c.Error(err) // nolint:errcheck
 		return
@@ -61,11 +80,17 @@ func (p *PostHandler) Reply(c *gin.Context) {
 		c.Error(myerr.ErrNotLogin) // nolint:errcheck
 		return
 	}
-	if conf.Global.App.CheckUserIsAuthor && userID != req.AuthorID {
+	if conf.Global().App.CheckUserIsAuthor && userID != req.AuthorID {
 		c.Error(myerr.ErrAuth.WithEmsg("无操作权限")) // nolint:errcheck
 	}
 
-	replyID, err := p.PostService.Reply(c, req.AuthorID, req.PostID, req.Content)
+	replyID, err := p.PostService.Reply(c, &service.ReplyInfo{
+		AuthorID:      req.AuthorID,
+		PostID:        req.PostID,
+		ParentID:      req.ParentID,
+		ReplyToUserID: req.ReplyToUserID,
+		Content:       req.Content,
+	})
 	if err != nil {
 		c.Error(err) // nolint:errcheck
 		return
@@ -81,7 +106,7 @@ func (p *PostHandler) Detail(c *gin.Context) {
 		c.Error(myerr.ErrBadReqBody.WithEmsg("不合法的帖子ID")) // nolint:errcheck
 		return
 	}
-	detail, err := p.PostService.Detail(c, postID)
+	detail, err := p.PostService.Detail(c, p.userID(c), postID)
 	if err != nil {
 		c.Error(err) // nolint:errcheck
 		return
@@ -99,11 +124,18 @@ func (p *PostHandler) List(c *gin.Context) {
 	pageSizeStr := c.Query("page_size")
 	var pageSize int
 	if pageSizeStr == "" {
-		pageSize = conf.Global.App.DefaultPageSize
+		pageSize = conf.Global().App.DefaultPageSize
 	} else if pageSize, err = strconv.Atoi(pageSizeStr); err != nil {
 		c.Error(myerr.ErrBadReqBody.WithEmsg("不合法的页大小")) // nolint:errcheck
 	}
-	list, err := p.PostService.List(c, order, cursor, pageSize)
+	var boardID int64
+	if boardIDStr := c.Query("board_id"); boardIDStr != "" {
+		if boardID, err = strconv.ParseInt(boardIDStr, 10, 64); err != nil {
+			c.Error(myerr.ErrBadReqBody.WithCause(err).WithEmsg("不合法的版块")) // nolint:errcheck
+			return
+		}
+	}
+	list, err := p.PostService.List(c, p.userID(c), boardID, c.Query("tag"), order, cursor, pageSize)
 	if err != nil {
 		c.Error(err) // nolint:errcheck
 		return
@@ -122,14 +154,169 @@ func (p *PostHandler) ListReply(c *gin.Context) {
 	pageSizeStr := c.Query("page_size")
 	var pageSize int
 	if pageSizeStr == "" {
-		pageSize = conf.Global.App.DefaultPageSize
+		pageSize = conf.Global().App.DefaultPageSize
 	} else if pageSize, err = strconv.Atoi(pageSizeStr); err != nil {
 		c.Error(myerr.ErrBadReqBody.WithEmsg("不合法的页大小")) // nolint:errcheck
 	}
-	list, err := p.PostService.ListReply(c, postID, cursor, pageSize)
+	filter := &service.ReplyFilter{}
+	if authorIDStr := c.Query("author_id"); authorIDStr != "" {
+		if filter.AuthorID, err = strconv.ParseInt(authorIDStr, 10, 64); err != nil {
+			c.Error(myerr.ErrBadReqBody.WithCause(err).WithEmsg("不合法的用户")) // nolint:errcheck
+			return
+		}
+	}
+	filter.OnlyPoster, _ = strconv.ParseBool(c.Query("only_poster"))
+	list, err := p.PostService.ListReply(c, p.userID(c), postID, filter, cursor, pageSize)
 	if err != nil {
 		c.Error(err) // nolint:errcheck
 		return
 	}
 	c.JSON(http.StatusOK, list)
 }
+
+func (p *PostHandler) ListSubReply(c *gin.Context) {
+	var err error
+	replyID, err := strconv.ParseInt(c.Query("reply_id"), 10, 64)
+	if err != nil {
+		c.Error(myerr.ErrBadReqBody.WithCause(err).WithEmsg("不合法的回复")) // nolint:errcheck
+		return
+	}
+	cursor := c.Query("cursor")
+	pageSizeStr := c.Query("page_size")
+	var pageSize int
+	if pageSizeStr == "" {
+		pageSize = conf.Global().App.DefaultPageSize
+	} else if pageSize, err = strconv.Atoi(pageSizeStr); err != nil {
+		c.Error(myerr.ErrBadReqBody.WithEmsg("不合法的页大小")) // nolint:errcheck
+		return
+	}
+	list, err := p.PostService.ListSubReply(c, p.userID(c), replyID, cursor, pageSize)
+	if err != nil {
+		c.Error(err) // nolint:errcheck
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func (p *PostHandler) DeleteReply(c *gin.Context) {
+	req := &PostReplyDeleteReq{}
+	if failBindJSON(c, req) {
+		return
+	}
+	userID := p.userID(c)
+	if userID == 0 {
+		c.Error(myerr.ErrNotLogin) // nolint:errcheck
+		return
+	}
+	err := p.PostService.DeleteReply(c, userID, req.ReplyID)
+	if err != nil {
+		c.Error(err) // nolint:errcheck
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"reply_id": strconv.FormatInt(req.ReplyID, 10),
+	})
+}
+
+func (p *PostHandler) Like(c *gin.Context) {
+	p.toggleLike(c, p.LikeService.Like)
+}
+
+func (p *PostHandler) Unlike(c *gin.Context) {
+	p.toggleLike(c, p.LikeService.Unlike)
+}
+
+func (p *PostHandler) toggleLike(c *gin.Context, toggle func(context.Context, int64, string, int64) (*service.LikeState, error)) {
+	req := &LikeReq{}
+	if failBindJSON(c, req) {
+		return
+	}
+	userID := p.userID(c)
+	if userID == 0 {
+		c.Error(myerr.ErrNotLogin) // nolint:errcheck
+		return
+	}
+	state, err := toggle(c, userID, req.TargetType, req.TargetID)
+	if err != nil {
+		c.Error(err) // nolint:errcheck
+		return
+	}
+	c.JSON(http.StatusOK, state)
+}
+
+func (p *PostHandler) React(c *gin.Context) {
+	req := &ReactionReq{}
+	if failBindJSON(c, req) {
+		return
+	}
+	userID := p.userID(c)
+	if userID == 0 {
+		c.Error(myerr.ErrNotLogin) // nolint:errcheck
+		return
+	}
+	state, err := p.ReactionService.Toggle(c, userID, req.TargetType, req.TargetID, req.Emoji)
+	if err != nil {
+		c.Error(err) // nolint:errcheck
+		return
+	}
+	c.JSON(http.StatusOK, state)
+}
+
+func (p *PostHandler) AllowedReactions(c *gin.Context) {
+	var boardID int64
+	var err error
+	if boardIDStr := c.Query("board_id"); boardIDStr != "" {
+		if boardID, err = strconv.ParseInt(boardIDStr, 10, 64); err != nil {
+			c.Error(myerr.ErrBadReqBody.WithCause(err).WithEmsg("不合法的版块")) // nolint:errcheck
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"emojis": service.AllowedReactions(boardID),
+	})
+}
+
+func (p *PostHandler) TagCloud(c *gin.Context) {
+	var boardID int64
+	var err error
+	if boardIDStr := c.Query("board_id"); boardIDStr != "" {
+		if boardID, err = strconv.ParseInt(boardIDStr, 10, 64); err != nil {
+			c.Error(myerr.ErrBadReqBody.WithCause(err).WithEmsg("不合法的版块")) // nolint:errcheck
+			return
+		}
+	}
+	cloud, err := p.TagService.Cloud(c, boardID)
+	if err != nil {
+		c.Error(err) // nolint:errcheck
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"tags": cloud,
+	})
+}
+
+func (p *PostHandler) RenameTag(c *gin.Context) {
+	p.moveTag(c, p.TagService.Rename)
+}
+
+func (p *PostHandler) MergeTag(c *gin.Context) {
+	p.moveTag(c, p.TagService.Merge)
+}
+
+func (p *PostHandler) moveTag(c *gin.Context, move func(ctx context.Context, userID int64, from string, to string) error) {
+	req := &TagMoveReq{}
+	if failBindJSON(c, req) {
+		return
+	}
+	userID := p.userID(c)
+	if userID == 0 {
+		c.Error(myerr.ErrNotLogin) // nolint:errcheck
+		return
+	}
+	err := move(c, userID, req.From, req.To)
+	if err != nil {
+		c.Error(err) // nolint:errcheck
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
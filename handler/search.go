@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"hoyobar/conf"
+	"hoyobar/service"
+	"hoyobar/util/myerr"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SearchHandler struct {
+	SearchService *service.SearchService
+}
+
+func (s *SearchHandler) AddRoute(r *gin.RouterGroup) {
+	r.GET("", gin.HandlerFunc(s.Search))
+}
+
+func (s *SearchHandler) Search(c *gin.Context) {
+	var err error
+	args := &service.SearchArgs{
+		Text: c.Query("q"),
+		Type: c.Query("type"),
+	}
+	if args.Type != "" && args.Type != "post" && args.Type != "reply" {
+		c.Error(myerr.ErrBadReqBody.WithEmsg("不合法的搜索类型")) // nolint:errcheck
+		return
+	}
+	if boardIDStr := c.Query("board_id"); boardIDStr != "" {
+		if args.BoardID, err = strconv.ParseInt(boardIDStr, 10, 64); err != nil {
+			c.Error(myerr.ErrBadReqBody.WithCause(err).WithEmsg("不合法的版块")) // nolint:errcheck
+			return
+		}
+	}
+	if authorIDStr := c.Query("author_id"); authorIDStr != "" {
+		if args.AuthorID, err = strconv.ParseInt(authorIDStr, 10, 64); err != nil {
+			c.Error(myerr.ErrBadReqBody.WithCause(err).WithEmsg("不合法的用户")) // nolint:errcheck
+			return
+		}
+	}
+	// time range [start_time, end_time), RFC3339 format
+	if startTimeStr := c.Query("start_time"); startTimeStr != "" {
+		if args.StartTime, err = time.Parse(time.RFC3339, startTimeStr); err != nil {
+			c.Error(myerr.ErrBadReqBody.WithCause(err).WithEmsg("不合法的开始时间")) // nolint:errcheck
+			return
+		}
+	}
+	if endTimeStr := c.Query("end_time"); endTimeStr != "" {
+		if args.EndTime, err = time.Parse(time.RFC3339, endTimeStr); err != nil {
+			c.Error(myerr.ErrBadReqBody.WithCause(err).WithEmsg("不合法的结束时间")) // nolint:errcheck
+			return
+		}
+	}
+	cursor := c.Query("cursor")
+	pageSizeStr := c.Query("page_size")
+	var pageSize int
+	if pageSizeStr == "" {
+		pageSize = conf.Global().App.DefaultPageSize
+	} else if pageSize, err = strconv.Atoi(pageSizeStr); err != nil {
+		c.Error(myerr.ErrBadReqBody.WithEmsg("不合法的页大小")) // nolint:errcheck
+		return
+	}
+	result, err := s.SearchService.Search(c, args, cursor, pageSize)
+	if err != nil {
+		c.Error(err) // nolint:errcheck
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"fmt"
+	"hoyobar/conf"
 	"hoyobar/service"
 	"hoyobar/util/myerr"
 	"net/http"
@@ -19,6 +20,8 @@ func (u *UserHandler) AddRoute(r *gin.RouterGroup) {
 	r.POST("/verify", gin.HandlerFunc(u.VerifyAccount))
 	r.POST("/register", gin.HandlerFunc(u.Register))
 	r.POST("/login", gin.HandlerFunc(u.Login))
+	r.POST("/nickname", gin.HandlerFunc(u.ChangeNickname))
+	r.GET("/search", gin.HandlerFunc(u.SearchNickname))
 }
 
 func (u *UserHandler) CheckOnline(c *gin.Context) {
@@ -89,6 +92,47 @@ func (u *UserHandler) Login(c *gin.Context) {
 	})
 }
 
+func (u *UserHandler) ChangeNickname(c *gin.Context) {
+	req := &UserNicknameReq{}
+	if failBindJSON(c, req) {
+		return
+	}
+	userID := c.GetInt64("user_id")
+	if userID == 0 {
+		c.Error(myerr.ErrNotLogin) // nolint:errcheck
+		return
+	}
+	if err := u.UserService.ChangeNickname(c, userID, req.Nickname); err != nil {
+		c.Error(err) // nolint:errcheck
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"nickname": req.Nickname,
+		"user_id":  strconv.FormatInt(userID, 10),
+	})
+}
+
+// search users by nickname, for @mention autocomplete
+func (u *UserHandler) SearchNickname(c *gin.Context) {
+	var err error
+	limitStr := c.Query("limit")
+	var limit int
+	if limitStr == "" {
+		limit = conf.Global().App.DefaultPageSize
+	} else if limit, err = strconv.Atoi(limitStr); err != nil {
+		c.Error(myerr.ErrBadReqBody.WithEmsg("不合法的数量")) // nolint:errcheck
+		return
+	}
+	list, err := u.UserService.SearchNickname(c, c.Query("q"), limit)
+	if err != nil {
+		c.Error(err) // nolint:errcheck
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"list": list,
+	})
+}
+
 // func (u *UserHandler) GetUserInfo(c *gin.Context) {
 //     userID := c.Query("user_id")
 //     if userID == "" {
@@ -38,19 +38,47 @@ type UserRegisterReq struct {
 	Vcode    string `validate:"required"`
 }
 
+type UserNicknameReq struct {
+	Nickname string `validate:"required,min=1,max=20"`
+}
+
 type UserLoginReq struct {
 	Username string `validate:"required"`
 	Password string `validate:"required"`
 }
 
 type PostCreateReq struct {
-	AuthorID int64  `json:"author_id,string" validate:"required"`
-	Title    string `validate:"required,min=1,max=50"`
-	Content  string `validate:"required,min=1,max=2000"`
+	AuthorID int64    `json:"author_id,string" validate:"required"`
+	BoardID  int64    `json:"board_id,string"`
+	Title    string   `validate:"required,min=1,max=50"`
+	Content  string   `validate:"required,min=1,max=2000"`
+	Tags     []string `json:"tags"`
 }
 
 type PostReplyReq struct {
-	AuthorID int64  `json:"author_id,string" validate:"required"`
-	PostID   int64  `json:"post_id,string" validate:"required"`
-	Content  string `json:"content" validate:"required,min=1,max=1000"`
+	AuthorID      int64  `json:"author_id,string" validate:"required"`
+	PostID        int64  `json:"post_id,string" validate:"required"`
+	ParentID      int64  `json:"parent_id,string"`
+	ReplyToUserID int64  `json:"reply_to_user_id,string"`
+	Content       string `json:"content" validate:"required,min=1,max=1000"`
+}
+
+type PostReplyDeleteReq struct {
+	ReplyID int64 `json:"reply_id,string" validate:"required"`
+}
+
+type LikeReq struct {
+	TargetType string `json:"target_type" validate:"required,oneof=post reply"`
+	TargetID   int64  `json:"target_id,string" validate:"required"`
+}
+
+type ReactionReq struct {
+	TargetType string `json:"target_type" validate:"required,oneof=post reply"`
+	TargetID   int64  `json:"target_id,string" validate:"required"`
+	Emoji      string `json:"emoji" validate:"required,max=32"`
+}
+
+type TagMoveReq struct {
+	From string `json:"from" validate:"required,max=50"`
+	To   string `json:"to" validate:"required,max=50"`
 }
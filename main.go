@@ -1,79 +1,121 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"hoyobar/conf"
 	"hoyobar/handler"
 	"hoyobar/middleware"
 	"hoyobar/model"
-	"hoyobar/service"
+	"hoyobar/search"
 	"hoyobar/storage"
-	"hoyobar/util/idgen"
+	"hoyobar/util/ctxuser"
+	"hoyobar/util/dbmetrics"
+	"hoyobar/util/funcs"
 	"hoyobar/util/mycache"
+	"hoyobar/util/mycache/keys"
 	"hoyobar/util/myerr"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	// "github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 func main() {
 	rand.Seed(time.Now().Unix())
-	startApp(readConfig())
+	runCommand(os.Args[1:])
 }
 
-func readConfig() conf.Config {
-	filePath := "config.yaml"
-	log.Println("read config from", filePath)
-	r, err := os.Open(filePath)
+func readConfig(src conf.Source) conf.Config {
+	log.Println("read config from", src.Path)
+	config, err := conf.Load(src)
 	if err != nil {
-		log.Fatalf("fails to open config file %s, err: %v\n", filePath, err)
+		log.Fatalf("fails to load config: %v\n", err)
 	}
-	config := conf.FromYAML(r)
-	conf.Global = &config
-	fmt.Printf("config: %#v\n", config)
-	return config
+	fmt.Printf("config: %#v\n", config.Redacted())
+	return *config
 }
 
-func startApp(config conf.Config) {
-	idgen.Init("2020-01-01", 0)
-
-	db := initDB(config)
-	if conf.Global.DB.AutoMigrate {
-		model.Migrate(db)
+// fields tagged `reload:"true"` take effect on SIGHUP, the old config is kept if the new one is invalid
+func reloadOnSignal() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		restart, err := conf.Reload()
+		if err != nil {
+			log.Printf("fails to reload config, keep the current one: %v\n", err)
+			continue
+		}
+		log.Println("config reloaded")
+		if len(restart) > 0 {
+			log.Printf("changes of %v take effect after restart\n", strings.Join(restart, ", "))
+		}
 	}
+}
+
+func serve(config conf.Config) {
+	a := newApp(config, true)
+	r := newRouter(a)
 
-	cache := initCache(config)
+	funcs.Go(func() { a.userService.Run(context.Background()) })
+	funcs.Go(func() { a.likeService.Run(context.Background()) })
+	funcs.Go(func() { a.searchService.Run(context.Background()) })
+	funcs.Go(reloadOnSignal)
 
+	err := r.Run(fmt.Sprintf(":%v", config.App.Port))
+	if err != nil {
+		log.Fatalf("app exit with err: %v\n", err)
+	}
+}
+
+// routes of the API and health checks, background jobs of services are not started
+func newRouter(a *app) *gin.Engine {
 	r := gin.Default()
 	r.ContextWithFallback = true
 	// pprof.Register(r)
 	r.Use(cors.Default())
 	api := r.Group("/api")
 	api.Use(
+		middleware.RequestID(),
 		middleware.ErrorHandler(),
-		middleware.Timeout(conf.Global.App.Timeout.Default),
+		middleware.Timeout(conf.Global().App.Timeout.Default, conf.Global().App.Timeout.Routes),
+		// writes of users for read-your-writes are looked up once per request
+		func(c *gin.Context) {
+			c.Request = c.Request.WithContext(storage.WithWriteMemo(c.Request.Context()))
+			c.Next()
+		},
 	)
 
 	var (
-		userHandler handler.Handler
-		postHandler handler.Handler
+		healthHandler handler.Handler
+		userHandler   handler.Handler
+		postHandler   handler.Handler
+		searchHandler handler.Handler
 	)
 
-	userStorage := storage.NewUserStorageMySQL(db)
-	postStorage := storage.NewPostStorageMySQL(db)
-	replyStorage := storage.NewPostReplyStorageMySQL(db)
+	healthHandler = &handler.HealthHandler{Breaker: a.breaker, DBMetrics: a.dbMetrics, DBStatus: a.cluster.Status}
+	healthHandler.AddRoute(r.Group(""))
 
 	// user API
-	userService := service.NewUserService(cache, userStorage)
+	userService := a.userService
 	api.Use(middleware.ReadAuthToken(func(authToken string, c *gin.Context) {
 		log.Println("found auth token, checking user")
 		userID, err := userService.AuthTokenToUserID(c, authToken)
@@ -96,64 +138,335 @@ func startApp(config conf.Config) {
 			return
 		}
 		c.Set("user_id", userID)
+		// for layers below handlers, e.g. read-your-writes of storage
+		c.Request = c.Request.WithContext(ctxuser.With(c.Request.Context(), userID))
 	}))
 	userHandler = &handler.UserHandler{UserService: userService} // must be pointer, why?
 	userHandler.AddRoute(api.Group("/user"))
 
 	// post API
-	postService := service.NewPostService(cache, userStorage, postStorage, replyStorage)
 	postHandler = &handler.PostHandler{
-		PostService: postService,
-		UserService: userService,
+		PostService:     a.postService,
+		UserService:     userService,
+		LikeService:     a.likeService,
+		ReactionService: a.reactionService,
+		TagService:      a.tagService,
 	}
 	postHandler.AddRoute(api.Group("/post"))
 
-	err := r.Run(fmt.Sprintf(":%v", config.App.Port))
+	// search API
+	searchHandler = &handler.SearchHandler{SearchService: a.searchService}
+	searchHandler.AddRoute(api.Group("/search"))
+	return r
+}
+
+func initShardRouter(config conf.Config, cluster *storage.Cluster, name string) *storage.ShardRouter {
+	shards := storage.NewShardRouter(cluster, name)
+	if err := shards.Load(context.Background(), config.Sharding.UserShardN); err != nil {
+		log.Fatalf("fails to load shard map %v: %v\n", name, err)
+	}
+	return shards
+}
+
+func initMigrator(cluster *storage.Cluster) *storage.Migrator {
+	migrator, err := storage.NewMigrator(cluster)
 	if err != nil {
-		log.Fatalf("app exit with err: %v\n", err)
+		log.Fatalf("fails to load migrations: %v\n", err)
 	}
+	return migrator
 }
 
-func initSqlite3(config conf.Config) *gorm.DB {
-	db, err := gorm.Open(sqlite.Open(config.DB.Sqlite3.DSN), &gorm.Config{})
+// path: empty for an index only in memory
+// load: read the index file, false to start from an empty index for a rebuild
+func initSearchIndex(path string, load bool) search.Index {
+	index, err := search.NewMemoryIndex(path, load)
+	if err != nil {
+		log.Fatalf("fails to load search index: %v\n", err)
+	}
+	return index
+}
+
+func gormConfig() *gorm.Config {
+	return &gorm.Config{
+		// statements are logged by dbmetrics with sensitive values redacted
+		Logger: logger.Default.LogMode(logger.Silent),
+		// created_at and updated_at in the precision of page cursors on all db types
+		NowFunc: model.Now,
+	}
+}
+
+func initSqlite3(dsn string) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(dsn), gormConfig())
 	if err != nil {
 		log.Fatalf("fails to connect sqlite db: %v\n", err)
 	}
 	return db
 }
 
-func initMySQL(config conf.Config) *gorm.DB {
+// addr: "host:port", may be a replica or a shard of the one in config, empty for the one in config
+func initMySQL(config conf.Config, addr string) *gorm.DB {
 	var err error
+	dsn := mysqlDSN(config, addr)
+	db, err := gorm.Open(mysql.Open(dsn), gormConfig())
+	if err != nil {
+		// the DSN has the password
+		name := addr
+		if cfg, e := mysqldriver.ParseDSN(dsn); e == nil {
+			name = cfg.Addr + "/" + cfg.DBName
+		}
+		log.Fatalf("fails to connect database %v, err=%v\n", name, err)
+	}
+	return db
+}
+
+// db.mysql.dsn with the address replaced, or the one composed by other fields
+func mysqlDSN(config conf.Config, addr string) string {
 	c := config.DB.MySQL
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		c.User, c.Pass, c.Host, c.Port, c.DBName)
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if c.DSN == "" {
+		if addr == "" {
+			addr = c.Host + ":" + c.Port
+		}
+		return fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+			c.User, c.Pass, addr, c.DBName)
+	}
+	if addr == "" {
+		return c.DSN
+	}
+	cfg, err := mysqldriver.ParseDSN(c.DSN)
+	if err != nil {
+		log.Fatalf("wrong mysql dsn: %v\n", err)
+	}
+	cfg.Addr = addr
+	return cfg.FormatDSN()
+}
+
+func initPostgres(dsn string) *gorm.DB {
+	db, err := gorm.Open(postgres.Open(dsn), gormConfig())
 	if err != nil {
-		log.Fatalf("fails to connect database %q, err=%v\n", dsn, err)
+		// the dsn may have the password
+		log.Fatalf("fails to connect postgres db %v: %v\n", postgresName(dsn), err)
 	}
 	return db
 }
 
-func initDB(config conf.Config) *gorm.DB {
+// "host:port/dbname" of the dsn, for logs and metrics
+func postgresName(dsn string) string {
+	cfg, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		log.Fatalf("wrong postgres dsn: %v\n", err)
+	}
+	return fmt.Sprintf("%v:%v/%v", cfg.Host, cfg.Port, cfg.Database)
+}
+
+// addr: "host:port" of mysql, DSN of postgres and sqlite3
+func openDB(config conf.Config, addr string) *gorm.DB {
+	switch config.DB.Type {
+	case "mysql":
+		return initMySQL(config, addr)
+	case "postgres":
+		return initPostgres(addr)
+	case "sqlite3":
+		return initSqlite3(addr)
+	}
+	log.Fatalln("not recoginize db type:", config.DB.Type)
+	return nil
+}
+
+// name of the database at addr, for logs and metrics
+func dbName(config conf.Config, addr string) string {
+	if config.DB.Type == "postgres" {
+		return postgresName(addr)
+	}
+	return addr
+}
+
+func initDB(config conf.Config) (*gorm.DB, *dbmetrics.Plugin) {
 	log.Printf("connect db with type %v \n", config.DB.Type)
-	var db *gorm.DB
+	var addr string
+	switch config.DB.Type {
+	case "postgres":
+		addr = config.DB.Postgres.DSN
+	case "sqlite3":
+		addr = config.DB.Sqlite3.DSN
+	}
+	db := openDB(config, addr)
+	plugin := dbmetrics.New(config.DB.SlowThreshold, config.DB.RedactColumns)
+	if err := db.Use(plugin.For("main")); err != nil {
+		log.Fatalf("fails to register db metrics: %v\n", err)
+	}
+	return db, plugin
+}
+
+// replica name -> db, with the same type as primary
+func initReplicas(config conf.Config, plugin *dbmetrics.Plugin) map[string]*gorm.DB {
+	var addrs []string
 	switch config.DB.Type {
 	case "mysql":
-		db = initMySQL(config)
+		addrs = config.DB.Replica.MySQL
+	case "postgres":
+		addrs = config.DB.Replica.Postgres
 	case "sqlite3":
-		db = initSqlite3(config)
+		addrs = config.DB.Replica.Sqlite3
 	}
-	if db == nil {
-		log.Fatalln("not recoginize db type:", config.DB.Type)
+	replicas := make(map[string]*gorm.DB)
+	for _, addr := range addrs {
+		name := dbName(config, addr)
+		log.Printf("connect db replica %v \n", name)
+		db := openDB(config, addr)
+		if err := db.Use(plugin.For(name)); err != nil {
+			log.Fatalf("fails to register db metrics: %v\n", err)
+		}
+		replicas[name] = db
 	}
-	return db
+	return replicas
 }
 
-func initCache(config conf.Config) mycache.Cache {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     conf.Global.Redis.Addr,
-		Username: conf.Global.Redis.Username,
-		Password: conf.Global.Redis.Password,
-	})
-	return mycache.NewRedisCache(rdb)
+// shard ranges in config with their databases, of the same type as main, each address is connected once
+func initCluster(config conf.Config, main *storage.DBRouter, plugin *dbmetrics.Plugin) *storage.Cluster {
+	cluster := storage.NewCluster(main)
+	dbs := make(map[string]*gorm.DB)
+	addRanges := func(group string, ranges []conf.ShardDB) {
+		for _, r := range ranges {
+			var addr string
+			switch config.DB.Type {
+			case "mysql":
+				addr = r.MySQL
+			case "postgres":
+				addr = r.Postgres
+			case "sqlite3":
+				addr = r.Sqlite3
+			}
+			if addr == "" {
+				log.Fatalf("no %v address of %v shards [%v, %v]\n", config.DB.Type, group, r.From, r.To)
+			}
+			name := dbName(config, addr)
+			db, ok := dbs[name]
+			if !ok {
+				log.Printf("connect shard db %v \n", name)
+				db = openDB(config, addr)
+				if err := db.Use(plugin.For(name)); err != nil {
+					log.Fatalf("fails to register db metrics: %v\n", err)
+				}
+				dbs[name] = db
+			}
+			if err := cluster.AddRange(group, int64(r.From), int64(r.To), name, db); err != nil {
+				log.Fatalf("fails to add shard range: %v\n", err)
+			}
+		}
+	}
+	addRanges(model.ShardGroupUser, config.DB.Shards.User)
+	addRanges(model.ShardGroupPost, config.DB.Shards.Post)
+	return cluster
+}
+
+// breaker is nil if redis is not used.
+// serving: keep L1 of tiered cache in sync with other processes, commands only publish their writes.
+func initCache(config conf.Config, serving bool) (cache mycache.Cache, breaker *mycache.BreakerCache) {
+	log.Printf("use cache with type %v \n", config.Cache.Type)
+	if config.Cache.Type == "memory" {
+		return mycache.NewMemoryCache(config.Cache.MaxEntries), nil
+	}
+	rdb := initRedis(config)
+	breaker = mycache.NewBreakerCache(
+		mycache.NewRedisCache(rdb),
+		config.Cache.Breaker.MaxFailures,
+		config.Cache.Breaker.Cooldown,
+	)
+	switch config.Cache.Type {
+	case "redis":
+		return breaker, breaker
+	case "tiered":
+		l1 := config.Cache.L1
+		prefixes := make([]string, len(l1.Prefixes))
+		for i, prefix := range l1.Prefixes {
+			prefixes[i] = keys.Key(prefix) + ":"
+		}
+		// writes on this process evict L1 entries of other processes
+		bus := mycache.NewRedisBus(rdb, keys.InvalidateChannel())
+		// L1 still serves while the breaker is open
+		tiered := mycache.NewTieredCache(breaker, l1.MaxEntries, l1.TTL, prefixes, bus)
+		if serving {
+			funcs.Go(func() { tiered.Run(context.Background()) })
+		}
+		return tiered, breaker
+	}
+	log.Fatalln("not recoginize cache type:", config.Cache.Type)
+	return nil, nil
+}
+
+func initRedis(config conf.Config) redis.UniversalClient {
+	rc := config.Redis
+	log.Printf("connect redis with mode %v \n", rc.Mode)
+	var tlsConfig *tls.Config
+	if rc.TLS.Enable {
+		tlsConfig = &tls.Config{
+			ServerName:         rc.TLS.ServerName,
+			InsecureSkipVerify: rc.TLS.InsecureSkipVerify,
+		}
+		if rc.TLS.CAFile != "" {
+			pem, err := ioutil.ReadFile(rc.TLS.CAFile)
+			if err != nil {
+				log.Fatalf("fails to read redis CA file: %v\n", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				log.Fatalf("no certificate found in redis CA file %v\n", rc.TLS.CAFile)
+			}
+		}
+	}
+	// with ContextTimeoutEnabled, cancelled requests stop waiting for redis
+	switch rc.Mode {
+	case "standalone":
+		return redis.NewClient(&redis.Options{
+			Addr:                  rc.Addr,
+			Username:              rc.Username,
+			Password:              rc.Password,
+			DB:                    rc.DB,
+			TLSConfig:             tlsConfig,
+			PoolSize:              rc.PoolSize,
+			MinIdleConns:          rc.MinIdleConns,
+			PoolTimeout:           rc.PoolTimeout,
+			DialTimeout:           rc.DialTimeout,
+			ReadTimeout:           rc.ReadTimeout,
+			WriteTimeout:          rc.WriteTimeout,
+			ContextTimeoutEnabled: true,
+		})
+	case "sentinel":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:            rc.Sentinel.MasterName,
+			SentinelAddrs:         rc.Addrs,
+			SentinelUsername:      rc.Sentinel.Username,
+			SentinelPassword:      rc.Sentinel.Password,
+			Username:              rc.Username,
+			Password:              rc.Password,
+			DB:                    rc.DB,
+			TLSConfig:             tlsConfig,
+			PoolSize:              rc.PoolSize,
+			MinIdleConns:          rc.MinIdleConns,
+			PoolTimeout:           rc.PoolTimeout,
+			DialTimeout:           rc.DialTimeout,
+			ReadTimeout:           rc.ReadTimeout,
+			WriteTimeout:          rc.WriteTimeout,
+			ContextTimeoutEnabled: true,
+		})
+	case "cluster":
+		if rc.DB != 0 {
+			log.Fatalf("redis cluster only supports db 0, got %v\n", rc.DB)
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:                 rc.Addrs,
+			Username:              rc.Username,
+			Password:              rc.Password,
+			TLSConfig:             tlsConfig,
+			PoolSize:              rc.PoolSize,
+			MinIdleConns:          rc.MinIdleConns,
+			PoolTimeout:           rc.PoolTimeout,
+			DialTimeout:           rc.DialTimeout,
+			ReadTimeout:           rc.ReadTimeout,
+			WriteTimeout:          rc.WriteTimeout,
+			ContextTimeoutEnabled: true,
+		})
+	}
+	log.Fatalln("not recoginize redis mode:", rc.Mode)
+	return nil
 }
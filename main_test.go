@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hoyobar/conf"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API tests run against each db type: sqlite3 always, mysql and postgres if their DSNs are set, e.g.
+//
+//	HOYOBAR_TEST_MYSQL_DSN="root:password@tcp(localhost:3306)/hoyobar_test?parseTime=True"
+//	HOYOBAR_TEST_POSTGRES_DSN="host=localhost port=5432 user=postgres password=password dbname=hoyobar_test sslmode=disable"
+//
+// the databases are migrated by the tests, accounts and boards of each run are new, so they need not be empty.
+func TestAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	backends := []struct {
+		dbType string
+		dsnEnv string
+	}{
+		{dbType: "sqlite3"},
+		{dbType: "mysql", dsnEnv: "HOYOBAR_TEST_MYSQL_DSN"},
+		{dbType: "postgres", dsnEnv: "HOYOBAR_TEST_POSTGRES_DSN"},
+	}
+	for _, backend := range backends {
+		backend := backend
+		t.Run(backend.dbType, func(t *testing.T) {
+			dsn := filepath.Join(t.TempDir(), "hoyobar.db")
+			if backend.dsnEnv != "" {
+				dsn = os.Getenv(backend.dsnEnv)
+				if dsn == "" {
+					t.Skipf("%v is not set", backend.dsnEnv)
+				}
+			}
+			config, err := conf.Load(conf.Source{Path: "config.yaml", Sets: []string{
+				"db.type=" + backend.dbType,
+				fmt.Sprintf("db.%v.dsn=%v", backend.dbType, dsn),
+				"db.auto_migrate=true",
+				"cache.type=memory",
+			}})
+			if err != nil {
+				t.Fatalf("fail to load config: %v", err)
+			}
+			api := &apiClient{t: t, router: newRouter(newApp(*config, false))}
+			t.Run("user", api.testUser)
+			t.Run("post", api.testPost)
+		})
+	}
+}
+
+type apiClient struct {
+	t      *testing.T
+	router http.Handler
+	token  string // of the logged in user
+	userID string
+}
+
+// error code of the response, "" if ok
+func (c *apiClient) call(t *testing.T, method string, path string, req interface{}, res interface{}) string {
+	t.Helper()
+	var body bytes.Buffer
+	if req != nil {
+		if err := json.NewEncoder(&body).Encode(req); err != nil {
+			t.Fatalf("fail to encode request: %v", err)
+		}
+	}
+	httpReq := httptest.NewRequest(method, "/api"+path, &body)
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		httpReq.Header.Set("Auth", c.token)
+	}
+	w := httptest.NewRecorder()
+	c.router.ServeHTTP(w, httpReq)
+	if w.Code != http.StatusOK {
+		var e struct {
+			Ecode string `json:"ecode"`
+			Emsg  string `json:"emsg"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Ecode == "" {
+			t.Fatalf("%v %v: status %v, body %v", method, path, w.Code, w.Body.String())
+		}
+		return e.Ecode
+	}
+	if res != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+			t.Fatalf("%v %v: fail to decode %v: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return ""
+}
+
+// fails the test if the call is not ok
+func (c *apiClient) mustCall(t *testing.T, method string, path string, req interface{}, res interface{}) {
+	t.Helper()
+	if ecode := c.call(t, method, path, req, res); ecode != "" {
+		t.Fatalf("%v %v: ecode %v", method, path, ecode)
+	}
+}
+
+type authRes struct {
+	AuthToken string `json:"auth_token"`
+	UserID    string `json:"user_id"`
+}
+
+func (c *apiClient) testUser(t *testing.T) {
+	suffix := strconv.FormatInt(time.Now().UnixNano()%1e8, 10)
+	email := "api" + suffix + "@test.com"
+	register := map[string]string{"username": email, "nickname": "api" + suffix, "password": "pass1234", "vcode": "123456"}
+	var registered authRes
+	c.mustCall(t, "POST", "/user/register", register, &registered)
+	if registered.AuthToken == "" || registered.UserID == "" {
+		t.Fatalf("register: %+v", registered)
+	}
+
+	// duplicate accounts and nicknames are rejected
+	if ecode := c.call(t, "POST", "/user/register", register, nil); ecode != "3001" {
+		t.Errorf("register twice: ecode %q, want 3001", ecode)
+	}
+	register["username"] = "other" + email
+	if ecode := c.call(t, "POST", "/user/register", register, nil); ecode != "3001" {
+		t.Errorf("register a taken nickname: ecode %q, want 3001", ecode)
+	}
+
+	if ecode := c.call(t, "POST", "/user/login", map[string]string{"username": email, "password": "wrong1234"}, nil); ecode != "2001" {
+		t.Errorf("login with a wrong password: ecode %q, want 2001", ecode)
+	}
+	var loggedIn authRes
+	c.mustCall(t, "POST", "/user/login", map[string]string{"username": email, "password": "pass1234"}, &loggedIn)
+	if loggedIn.UserID != registered.UserID || loggedIn.AuthToken == "" {
+		t.Fatalf("login: %+v, registered %+v", loggedIn, registered)
+	}
+	c.token, c.userID = loggedIn.AuthToken, loggedIn.UserID
+}
+
+type postListRes struct {
+	List []struct {
+		PostID   string `json:"post_id"`
+		ReplyNum int64  `json:"reply_num"`
+		LikeNum  int64  `json:"like_num"`
+	} `json:"list"`
+	Cursor string `json:"cursor"`
+}
+
+type replyListRes struct {
+	List []struct {
+		ReplyID string `json:"reply_id"`
+	} `json:"list"`
+	Cursor string `json:"cursor"`
+}
+
+func (c *apiClient) testPost(t *testing.T) {
+	if c.token == "" {
+		t.Skip("not logged in")
+	}
+	// posts created in the same millisecond are ordered by post_id across pages
+	boardID := strconv.FormatInt(time.Now().UnixNano()%1e9+1000, 10)
+	var postIDs []string
+	for i := 0; i < 5; i++ {
+		var res struct {
+			PostID string `json:"post_id"`
+		}
+		c.mustCall(t, "POST", "/post/create", map[string]string{
+			"author_id": c.userID, "board_id": boardID, "title": fmt.Sprintf("post %v", i), "content": "content",
+		}, &res)
+		postIDs = append(postIDs, res.PostID)
+	}
+	if got, want := c.listPosts(t, boardID, "create_time"), reversed(postIDs); !reflect.DeepEqual(got, want) {
+		t.Errorf("list by create time: %v, want %v", got, want)
+	}
+
+	var replyIDs []string
+	for i := 0; i < 5; i++ {
+		var res struct {
+			ReplyID string `json:"reply_id"`
+		}
+		c.mustCall(t, "POST", "/post/reply", map[string]string{
+			"author_id": c.userID, "post_id": postIDs[0], "content": fmt.Sprintf("reply %v", i),
+		}, &res)
+		replyIDs = append(replyIDs, res.ReplyID)
+	}
+	if got, want := c.listReplies(t, postIDs[0]), reversed(replyIDs); !reflect.DeepEqual(got, want) {
+		t.Errorf("list replies: %v, want %v", got, want)
+	}
+	if got := c.listPosts(t, boardID, "reply_time"); len(got) != len(postIDs) || got[0] != postIDs[0] {
+		t.Errorf("list by reply time: %v, want %v first", got, postIDs[0])
+	}
+
+	// reply_num is updated by "reply_num + ?" in db
+	if n := c.replyNum(t, postIDs[0]); n != 5 {
+		t.Errorf("reply_num after 5 replies: %v", n)
+	}
+	c.mustCall(t, "POST", "/post/reply/delete", map[string]string{"reply_id": replyIDs[0]}, nil)
+	if n := c.replyNum(t, postIDs[0]); n != 4 {
+		t.Errorf("reply_num after deleting a reply: %v", n)
+	}
+
+	// a user replied to must be in the floor
+	subReply := map[string]string{"author_id": c.userID, "post_id": postIDs[0], "content": "sub-reply", "reply_to_user_id": c.userID}
+	if ecode := c.call(t, "POST", "/post/reply", subReply, nil); ecode != "1000" {
+		t.Errorf("reply to a user without a floor: ecode %q, want 1000", ecode)
+	}
+	subReply["parent_id"] = replyIDs[1]
+	c.mustCall(t, "POST", "/post/reply", subReply, nil)
+	subReply["reply_to_user_id"] = "1"
+	if ecode := c.call(t, "POST", "/post/reply", subReply, nil); ecode != "1000" {
+		t.Errorf("reply to a user not in the floor: ecode %q, want 1000", ecode)
+	}
+
+	// the duplicate like is rejected by the unique index and ignored
+	like := map[string]string{"target_type": "post", "target_id": postIDs[1]}
+	var state struct {
+		LikeNum int64 `json:"like_num"`
+		Liked   bool  `json:"liked"`
+	}
+	c.mustCall(t, "POST", "/post/like", like, &state)
+	c.mustCall(t, "POST", "/post/like", like, &state)
+	if state.LikeNum != 1 || !state.Liked {
+		t.Errorf("like twice: %+v", state)
+	}
+}
+
+// post IDs of all pages of 2
+func (c *apiClient) listPosts(t *testing.T, boardID string, order string) []string {
+	var postIDs []string
+	cursor := ""
+	for {
+		query := url.Values{"board_id": {boardID}, "order": {order}, "page_size": {"2"}, "cursor": {cursor}}
+		var res postListRes
+		ecode := c.call(t, "GET", "/post/list?"+query.Encode(), nil, &res)
+		if ecode == "3004" {
+			return postIDs
+		}
+		if ecode != "" {
+			t.Fatalf("list posts: ecode %v", ecode)
+		}
+		for _, post := range res.List {
+			postIDs = append(postIDs, post.PostID)
+		}
+		if len(postIDs) > 10 {
+			t.Fatalf("list posts: too many pages, %v", postIDs)
+		}
+		cursor = res.Cursor
+	}
+}
+
+// reply IDs of all pages of 2
+func (c *apiClient) listReplies(t *testing.T, postID string) []string {
+	var replyIDs []string
+	cursor := ""
+	for {
+		query := url.Values{"post_id": {postID}, "page_size": {"2"}, "cursor": {cursor}}
+		var res replyListRes
+		ecode := c.call(t, "GET", "/post/reply/list?"+query.Encode(), nil, &res)
+		if ecode == "3004" {
+			return replyIDs
+		}
+		if ecode != "" {
+			t.Fatalf("list replies: ecode %v", ecode)
+		}
+		for _, reply := range res.List {
+			replyIDs = append(replyIDs, reply.ReplyID)
+		}
+		if len(replyIDs) > 10 {
+			t.Fatalf("list replies: too many pages, %v", replyIDs)
+		}
+		cursor = res.Cursor
+	}
+}
+
+func (c *apiClient) replyNum(t *testing.T, postID string) int64 {
+	var res struct {
+		ReplyNum int64 `json:"reply_num"`
+	}
+	c.mustCall(t, "GET", "/post/detail?post_id="+postID, nil, &res)
+	return res.ReplyNum
+}
+
+func reversed(ids []string) []string {
+	res := make([]string, len(ids))
+	for i, id := range ids {
+		res[len(ids)-1-i] = id
+	}
+	return res
+}
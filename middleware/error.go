@@ -1,7 +1,10 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"hoyobar/util/myerr"
+	"hoyobar/util/reqid"
 	"log"
 	"net/http"
 
@@ -14,8 +17,11 @@ func ErrorHandler() gin.HandlerFunc {
 		if len(c.Errors) > 0 {
 			e := c.Errors[0]
 			err := e.Err
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = myerr.ErrTimeout.WithCause(err)
+			}
 			if myErr, ok := err.(*myerr.MyError); ok {
-				log.Printf("error: %v, cause: %v\n", myErr, myErr.Cause())
+				log.Printf("error: %v, cause: %v, request_id: %v\n", myErr, myErr.Cause(), reqid.From(c.Request.Context()))
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"ecode": myErr.Ecode,
 					"emsg":  myErr.Emsg,
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"hoyobar/util/reqid"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// put request ID into Request.Context(), use the one from client (e.g. a proxy) if any
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = strings.ReplaceAll(uuid.NewString(), "-", "")
+		}
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(reqid.With(c.Request.Context(), id))
+		c.Next()
+	}
+}
@@ -10,9 +10,14 @@ import (
 // make gin.Context.Request.Context() be with timeout.
 // users should use Request.Context() to leverage Timeout.
 // if gin engine's ContextWithFallback == true, then *gin.Context can be used too.
-func Timeout(timeout time.Duration) gin.HandlerFunc {
+// routeTimeouts: "METHOD /full/path" -> timeout, routes not in it use the default timeout.
+func Timeout(timeout time.Duration, routeTimeouts map[string]time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		d, ok := routeTimeouts[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			d = timeout
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
 		defer cancel()
 		c.Request = c.Request.WithContext(ctx)
 		c.Next() // must call it to make cancel func called after all work done
@@ -0,0 +1,11 @@
+package model
+
+// a single row written to the primary periodically, its value read from a replica tells the replication lag
+type Heartbeat struct {
+	ID     uint64 `gorm:"primarykey"`
+	BeatAt int64  // unix ms
+}
+
+func (Heartbeat) TableName() string {
+	return "replica_heartbeat"
+}
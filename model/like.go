@@ -0,0 +1,18 @@
+package model
+
+const (
+	LikeTargetPost  = "post"
+	LikeTargetReply = "reply"
+)
+
+// a user likes a post or a reply, at most one row per (target, user)
+type Like struct {
+	Model
+	TargetID   int64  `gorm:"uniqueIndex:idx_target_id_user_id,priority:1"`
+	UserID     int64  `gorm:"uniqueIndex:idx_target_id_user_id,priority:2;index"`
+	TargetType string `gorm:"size:10"`
+}
+
+func (Like) TableName() string {
+	return "content_like"
+}
@@ -0,0 +1,142 @@
+package model
+
+import (
+	"embed"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Migrations are SQL files in migrations/<dialect>/, named "<version>_<name>.<scope>.<up|down>.sql",
+// e.g. "0002_add_user_bio.user.up.sql". Statements end with ";" at the end of a line.
+// In files of a shard scope, ShardPlaceholder is replaced by the shard index, e.g. "user{shard}".
+//
+//go:embed migrations
+var migrationFS embed.FS
+
+const (
+	MigrationScopeMain = "main" // tables not sharded, in the main database, other scopes are shard groups
+	ShardPlaceholder   = "{shard}"
+)
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(\w+)\.(up|down)\.sql$`)
+
+// a version of the schema, with statements of each scope
+type Migration struct {
+	Version int64
+	Name    string
+	Up      map[string][]string // by scope
+	Down    map[string][]string
+}
+
+// a migration applied to a target, in the database of the target
+type SchemaMigration struct {
+	ID        uint64 `gorm:"primarykey"`
+	Version   int64  `gorm:"uniqueIndex:idx_version_target,priority:1"`
+	Target    string `gorm:"uniqueIndex:idx_version_target,priority:2;size:50"` // "main", or a shard, e.g. "user3"
+	Name      string `gorm:"size:100"`
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migration"
+}
+
+// held by the process migrating, at most one row in the main database
+type MigrationLock struct {
+	ID       uint64    `gorm:"primarykey"`
+	Owner    string    `gorm:"size:100"` // "host:pid"
+	ExpireAt time.Time // the lock can be taken over after it, if the owner died
+}
+
+func (MigrationLock) TableName() string {
+	return "schema_migration_lock"
+}
+
+// Migrations of the dialect (gorm's Dialector.Name()), ordered by version
+func Migrations(dialect string) ([]*Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := migrationFS.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Errorf("no migrations for %v", dialect)
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		segs := migrationFileRe.FindStringSubmatch(entry.Name())
+		if segs == nil {
+			return nil, errors.Errorf("wrong migration file name %v", entry.Name())
+		}
+		version, _ := strconv.ParseInt(segs[1], 10, 64)
+		name, scope, direction := segs[2], segs[3], segs[4]
+		if scope != MigrationScopeMain && scope != ShardGroupUser && scope != ShardGroupPost {
+			return nil, errors.Errorf("unknown scope of migration file %v", entry.Name())
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name, Up: map[string][]string{}, Down: map[string][]string{}}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, errors.Errorf("version %v has names %v and %v", version, m.Name, name)
+		}
+		content, err := migrationFS.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to read %v", entry.Name())
+		}
+		if direction == "up" {
+			m.Up[scope] = splitStatements(string(content))
+		} else {
+			m.Down[scope] = splitStatements(string(content))
+		}
+	}
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		for scope := range m.Up {
+			if _, ok := m.Down[scope]; !ok {
+				return nil, errors.Errorf("no down migration of version %v for %v", m.Version, scope)
+			}
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// statements of the shard, or of the main database if shardIdx < 0
+func ShardStatements(statements []string, shardIdx int64) []string {
+	if shardIdx < 0 {
+		return statements
+	}
+	res := make([]string, len(statements))
+	for i, statement := range statements {
+		res[i] = strings.ReplaceAll(statement, ShardPlaceholder, strconv.FormatInt(shardIdx, 10))
+	}
+	return res
+}
+
+// split by ";" at the end of lines, "--" comment lines are dropped
+func splitStatements(content string) []string {
+	var statements []string
+	var sb strings.Builder
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(sb.String()), ";"))
+			sb.Reset()
+		}
+	}
+	if s := strings.TrimSpace(sb.String()); s != "" {
+		statements = append(statements, s)
+	}
+	return statements
+}
@@ -0,0 +1,90 @@
+CREATE TABLE IF NOT EXISTS `content_like` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `target_id` bigint,
+  `user_id` bigint,
+  `target_type` varchar(10),
+  PRIMARY KEY (`id`),
+  INDEX `idx_content_like_created_at` (`created_at`),
+  INDEX `idx_content_like_deleted_at` (`deleted_at`),
+  INDEX `idx_content_like_updated_at` (`updated_at`),
+  INDEX `idx_content_like_user_id` (`user_id`),
+  UNIQUE INDEX `idx_target_id_user_id` (`target_id`,`user_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `content_reaction` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `target_id` bigint,
+  `user_id` bigint,
+  `emoji` varchar(32),
+  `target_type` varchar(10),
+  PRIMARY KEY (`id`),
+  INDEX `idx_content_reaction_created_at` (`created_at`),
+  INDEX `idx_content_reaction_deleted_at` (`deleted_at`),
+  INDEX `idx_content_reaction_updated_at` (`updated_at`),
+  INDEX `idx_content_reaction_user_id` (`user_id`),
+  UNIQUE INDEX `idx_target_id_user_id_emoji` (`target_id`,`user_id`,`emoji`)
+);
+
+CREATE TABLE IF NOT EXISTS `post_tag` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `post_id` bigint,
+  `tag` varchar(50),
+  `board_id` bigint,
+  PRIMARY KEY (`id`),
+  INDEX `idx_board_id_created_at` (`board_id`,`created_at`),
+  UNIQUE INDEX `idx_post_id_tag` (`post_id`,`tag`),
+  INDEX `idx_post_tag_created_at` (`created_at`),
+  INDEX `idx_post_tag_deleted_at` (`deleted_at`),
+  INDEX `idx_post_tag_updated_at` (`updated_at`),
+  INDEX `idx_tag_created_at_post_id` (`tag`,`created_at`,`post_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `user_session` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `token` varchar(32),
+  `user_id` bigint,
+  `expire_at` datetime(3) NULL,
+  PRIMARY KEY (`id`),
+  INDEX `idx_user_session_created_at` (`created_at`),
+  INDEX `idx_user_session_deleted_at` (`deleted_at`),
+  INDEX `idx_user_session_expire_at` (`expire_at`),
+  UNIQUE INDEX `idx_user_session_token` (`token`),
+  INDEX `idx_user_session_updated_at` (`updated_at`),
+  INDEX `idx_user_session_user_id` (`user_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `replica_heartbeat` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `beat_at` bigint,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE IF NOT EXISTS `shard_map` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `name` varchar(20),
+  `version` bigint,
+  `kind` varchar(10),
+  `shard_n` bigint,
+  `v_nodes` bigint,
+  `state` varchar(10),
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `idx_name_version` (`name`,`version`),
+  INDEX `idx_shard_map_created_at` (`created_at`),
+  INDEX `idx_shard_map_deleted_at` (`deleted_at`),
+  INDEX `idx_shard_map_updated_at` (`updated_at`)
+);
@@ -0,0 +1,52 @@
+CREATE TABLE IF NOT EXISTS `post{shard}` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `post_id` bigint,
+  `board_id` bigint,
+  `reply_time` datetime(3) NULL,
+  `reply_num` bigint,
+  `like_num` bigint,
+  `hot_score` double,
+  `author_id` bigint,
+  `title` varchar(50),
+  `content` longtext,
+  PRIMARY KEY (`id`),
+  INDEX `idx_post{shard}_author_id` (`author_id`),
+  INDEX `idx_post{shard}_board_id_created_at_post_id` (`board_id`,`created_at`,`post_id`),
+  INDEX `idx_post{shard}_board_id_hot_score_post_id` (`board_id`,`hot_score`,`post_id`),
+  INDEX `idx_post{shard}_board_id_reply_time_post_id` (`board_id`,`reply_time`,`post_id`),
+  INDEX `idx_post{shard}_created_at_post_id` (`created_at`,`post_id`),
+  INDEX `idx_post{shard}_created_at` (`created_at`),
+  INDEX `idx_post{shard}_deleted_at` (`deleted_at`),
+  INDEX `idx_post{shard}_hot_score_post_id` (`hot_score`,`post_id`),
+  UNIQUE INDEX `idx_post{shard}_post_id` (`post_id`),
+  INDEX `idx_post{shard}_reply_time_post_id` (`reply_time`,`post_id`),
+  INDEX `idx_post{shard}_updated_at` (`updated_at`)
+);
+
+CREATE TABLE IF NOT EXISTS `post_reply{shard}` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `reply_id` bigint,
+  `author_id` bigint,
+  `post_id` bigint,
+  `parent_id` bigint,
+  `reply_to_user_id` bigint,
+  `sub_reply_num` bigint,
+  `like_num` bigint,
+  `content` longtext,
+  PRIMARY KEY (`id`),
+  INDEX `idx_post_reply{shard}_author_id` (`author_id`),
+  INDEX `idx_post_reply{shard}_created_at` (`created_at`),
+  INDEX `idx_post_reply{shard}_deleted_at` (`deleted_at`),
+  INDEX `idx_post_reply{shard}_parent_id_created_at` (`parent_id`,`created_at`,`reply_id`),
+  INDEX `idx_post_reply{shard}_post_id_author_id_created_at` (`post_id`,`author_id`,`created_at`),
+  INDEX `idx_post_reply{shard}_post_id_like_num` (`post_id`,`like_num`),
+  INDEX `idx_post_reply{shard}_post_id` (`post_id`),
+  UNIQUE INDEX `idx_post_reply{shard}_reply_id` (`reply_id`),
+  INDEX `idx_post_reply{shard}_updated_at` (`updated_at`)
+);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS `user_nickname{shard}`;
+DROP TABLE IF EXISTS `user_phone{shard}`;
+DROP TABLE IF EXISTS `user_email{shard}`;
+DROP TABLE IF EXISTS `user{shard}`;
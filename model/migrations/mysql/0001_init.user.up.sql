@@ -0,0 +1,64 @@
+CREATE TABLE IF NOT EXISTS `user{shard}` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `user_id` bigint,
+  `email` varchar(320),
+  `phone` varchar(30),
+  `nickname` varchar(50),
+  `password` varchar(100),
+  `role` varchar(20),
+  `avatar` varchar(255),
+  `level` bigint DEFAULT 1,
+  PRIMARY KEY (`id`),
+  INDEX `idx_user{shard}_created_at` (`created_at`),
+  INDEX `idx_user{shard}_deleted_at` (`deleted_at`),
+  INDEX `idx_user{shard}_updated_at` (`updated_at`),
+  UNIQUE INDEX `idx_user{shard}_user_id` (`user_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `user_email{shard}` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `email` varchar(320),
+  `user_id` bigint,
+  PRIMARY KEY (`id`),
+  INDEX `idx_user_email{shard}_created_at` (`created_at`),
+  INDEX `idx_user_email{shard}_deleted_at` (`deleted_at`),
+  UNIQUE INDEX `idx_user_email{shard}_email` (`email`),
+  INDEX `idx_user_email{shard}_updated_at` (`updated_at`),
+  UNIQUE INDEX `idx_user_email{shard}_user_id` (`user_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `user_phone{shard}` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `phone` varchar(30),
+  `user_id` bigint,
+  PRIMARY KEY (`id`),
+  INDEX `idx_user_phone{shard}_created_at` (`created_at`),
+  INDEX `idx_user_phone{shard}_deleted_at` (`deleted_at`),
+  UNIQUE INDEX `idx_user_phone{shard}_phone` (`phone`),
+  INDEX `idx_user_phone{shard}_updated_at` (`updated_at`),
+  UNIQUE INDEX `idx_user_phone{shard}_user_id` (`user_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `user_nickname{shard}` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `nickname` varchar(50),
+  `user_id` bigint,
+  PRIMARY KEY (`id`),
+  INDEX `idx_user_nickname{shard}_created_at` (`created_at`),
+  INDEX `idx_user_nickname{shard}_deleted_at` (`deleted_at`),
+  UNIQUE INDEX `idx_user_nickname{shard}_nickname` (`nickname`),
+  INDEX `idx_user_nickname{shard}_updated_at` (`updated_at`),
+  UNIQUE INDEX `idx_user_nickname{shard}_user_id` (`user_id`)
+);
@@ -0,0 +1 @@
+ALTER TABLE `user{shard}` DROP COLUMN `locked`;
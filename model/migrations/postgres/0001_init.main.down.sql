@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS "shard_map";
+DROP TABLE IF EXISTS "replica_heartbeat";
+DROP TABLE IF EXISTS "user_session";
+DROP TABLE IF EXISTS "post_tag";
+DROP TABLE IF EXISTS "content_reaction";
+DROP TABLE IF EXISTS "content_like";
@@ -0,0 +1,90 @@
+CREATE TABLE IF NOT EXISTS "content_like" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "target_id" bigint,
+  "user_id" bigint,
+  "target_type" varchar(10),
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_content_like_created_at" ON "content_like" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_content_like_deleted_at" ON "content_like" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_content_like_updated_at" ON "content_like" ("updated_at");
+CREATE INDEX IF NOT EXISTS "idx_content_like_user_id" ON "content_like" ("user_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_target_id_user_id" ON "content_like" ("target_id","user_id");
+
+CREATE TABLE IF NOT EXISTS "content_reaction" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "target_id" bigint,
+  "user_id" bigint,
+  "emoji" varchar(32),
+  "target_type" varchar(10),
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_content_reaction_created_at" ON "content_reaction" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_content_reaction_deleted_at" ON "content_reaction" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_content_reaction_updated_at" ON "content_reaction" ("updated_at");
+CREATE INDEX IF NOT EXISTS "idx_content_reaction_user_id" ON "content_reaction" ("user_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_target_id_user_id_emoji" ON "content_reaction" ("target_id","user_id","emoji");
+
+CREATE TABLE IF NOT EXISTS "post_tag" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "post_id" bigint,
+  "tag" varchar(50),
+  "board_id" bigint,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_board_id_created_at" ON "post_tag" ("board_id","created_at");
+CREATE INDEX IF NOT EXISTS "idx_post_tag_created_at" ON "post_tag" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_post_tag_deleted_at" ON "post_tag" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_post_tag_updated_at" ON "post_tag" ("updated_at");
+CREATE INDEX IF NOT EXISTS "idx_tag_created_at_post_id" ON "post_tag" ("tag","created_at","post_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_post_id_tag" ON "post_tag" ("post_id","tag");
+
+CREATE TABLE IF NOT EXISTS "user_session" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "token" varchar(32),
+  "user_id" bigint,
+  "expire_at" timestamptz,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_user_session_created_at" ON "user_session" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_user_session_deleted_at" ON "user_session" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_user_session_expire_at" ON "user_session" ("expire_at");
+CREATE INDEX IF NOT EXISTS "idx_user_session_updated_at" ON "user_session" ("updated_at");
+CREATE INDEX IF NOT EXISTS "idx_user_session_user_id" ON "user_session" ("user_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_user_session_token" ON "user_session" ("token");
+
+CREATE TABLE IF NOT EXISTS "replica_heartbeat" (
+  "id" bigserial,
+  "beat_at" bigint,
+  PRIMARY KEY ("id")
+);
+
+CREATE TABLE IF NOT EXISTS "shard_map" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "name" varchar(20),
+  "version" bigint,
+  "kind" varchar(10),
+  "shard_n" bigint,
+  "v_nodes" bigint,
+  "state" varchar(10),
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_shard_map_created_at" ON "shard_map" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_shard_map_deleted_at" ON "shard_map" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_shard_map_updated_at" ON "shard_map" ("updated_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_name_version" ON "shard_map" ("name","version");
@@ -0,0 +1,52 @@
+CREATE TABLE IF NOT EXISTS "post{shard}" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "post_id" bigint,
+  "board_id" bigint,
+  "reply_time" timestamptz,
+  "reply_num" bigint,
+  "like_num" bigint,
+  "hot_score" decimal,
+  "author_id" bigint,
+  "title" varchar(50),
+  "content" text,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_post{shard}_author_id" ON "post{shard}" ("author_id");
+CREATE INDEX IF NOT EXISTS "idx_post{shard}_board_id_created_at_post_id" ON "post{shard}" ("board_id","created_at","post_id");
+CREATE INDEX IF NOT EXISTS "idx_post{shard}_board_id_hot_score_post_id" ON "post{shard}" ("board_id","hot_score","post_id");
+CREATE INDEX IF NOT EXISTS "idx_post{shard}_board_id_reply_time_post_id" ON "post{shard}" ("board_id","reply_time","post_id");
+CREATE INDEX IF NOT EXISTS "idx_post{shard}_created_at" ON "post{shard}" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_post{shard}_created_at_post_id" ON "post{shard}" ("created_at","post_id");
+CREATE INDEX IF NOT EXISTS "idx_post{shard}_deleted_at" ON "post{shard}" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_post{shard}_hot_score_post_id" ON "post{shard}" ("hot_score","post_id");
+CREATE INDEX IF NOT EXISTS "idx_post{shard}_reply_time_post_id" ON "post{shard}" ("reply_time","post_id");
+CREATE INDEX IF NOT EXISTS "idx_post{shard}_updated_at" ON "post{shard}" ("updated_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_post{shard}_post_id" ON "post{shard}" ("post_id");
+
+CREATE TABLE IF NOT EXISTS "post_reply{shard}" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "reply_id" bigint,
+  "author_id" bigint,
+  "post_id" bigint,
+  "parent_id" bigint,
+  "reply_to_user_id" bigint,
+  "sub_reply_num" bigint,
+  "like_num" bigint,
+  "content" text,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_post_reply{shard}_author_id" ON "post_reply{shard}" ("author_id");
+CREATE INDEX IF NOT EXISTS "idx_post_reply{shard}_created_at" ON "post_reply{shard}" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_post_reply{shard}_deleted_at" ON "post_reply{shard}" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_post_reply{shard}_parent_id_created_at" ON "post_reply{shard}" ("parent_id","created_at","reply_id");
+CREATE INDEX IF NOT EXISTS "idx_post_reply{shard}_post_id" ON "post_reply{shard}" ("post_id");
+CREATE INDEX IF NOT EXISTS "idx_post_reply{shard}_post_id_author_id_created_at" ON "post_reply{shard}" ("post_id","author_id","created_at");
+CREATE INDEX IF NOT EXISTS "idx_post_reply{shard}_post_id_like_num" ON "post_reply{shard}" ("post_id","like_num");
+CREATE INDEX IF NOT EXISTS "idx_post_reply{shard}_updated_at" ON "post_reply{shard}" ("updated_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_post_reply{shard}_reply_id" ON "post_reply{shard}" ("reply_id");
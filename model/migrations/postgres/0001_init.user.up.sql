@@ -0,0 +1,64 @@
+CREATE TABLE IF NOT EXISTS "user{shard}" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "user_id" bigint,
+  "email" varchar(320),
+  "phone" varchar(30),
+  "nickname" varchar(50),
+  "password" varchar(100),
+  "role" varchar(20),
+  "avatar" varchar(255),
+  "level" bigint DEFAULT 1,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_user{shard}_created_at" ON "user{shard}" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_user{shard}_deleted_at" ON "user{shard}" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_user{shard}_updated_at" ON "user{shard}" ("updated_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_user{shard}_user_id" ON "user{shard}" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "user_email{shard}" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "email" varchar(320),
+  "user_id" bigint,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_user_email{shard}_created_at" ON "user_email{shard}" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_user_email{shard}_deleted_at" ON "user_email{shard}" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_user_email{shard}_updated_at" ON "user_email{shard}" ("updated_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_user_email{shard}_email" ON "user_email{shard}" ("email");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_user_email{shard}_user_id" ON "user_email{shard}" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "user_phone{shard}" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "phone" varchar(30),
+  "user_id" bigint,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_user_phone{shard}_created_at" ON "user_phone{shard}" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_user_phone{shard}_deleted_at" ON "user_phone{shard}" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_user_phone{shard}_updated_at" ON "user_phone{shard}" ("updated_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_user_phone{shard}_phone" ON "user_phone{shard}" ("phone");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_user_phone{shard}_user_id" ON "user_phone{shard}" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "user_nickname{shard}" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "nickname" varchar(50),
+  "user_id" bigint,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_user_nickname{shard}_created_at" ON "user_nickname{shard}" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_user_nickname{shard}_deleted_at" ON "user_nickname{shard}" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_user_nickname{shard}_updated_at" ON "user_nickname{shard}" ("updated_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_user_nickname{shard}_nickname" ON "user_nickname{shard}" ("nickname");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_user_nickname{shard}_user_id" ON "user_nickname{shard}" ("user_id");
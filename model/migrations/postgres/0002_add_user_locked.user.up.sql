@@ -0,0 +1 @@
+ALTER TABLE "user{shard}" ADD COLUMN "locked" boolean NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `post_reply{shard}`;
+DROP TABLE IF EXISTS `post{shard}`;
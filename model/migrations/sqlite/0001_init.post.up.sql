@@ -0,0 +1,52 @@
+CREATE TABLE IF NOT EXISTS `post{shard}` (
+  `id` integer,
+  `created_at` datetime,
+  `updated_at` datetime,
+  `deleted_at` datetime,
+  `post_id` integer,
+  `board_id` integer,
+  `reply_time` datetime,
+  `reply_num` integer,
+  `like_num` integer,
+  `hot_score` real,
+  `author_id` integer,
+  `title` text,
+  `content` text,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_post{shard}_author_id` ON `post{shard}` (`author_id`);
+CREATE INDEX IF NOT EXISTS `idx_post{shard}_board_id_created_at_post_id` ON `post{shard}` (`board_id`,`created_at`,`post_id`);
+CREATE INDEX IF NOT EXISTS `idx_post{shard}_board_id_hot_score_post_id` ON `post{shard}` (`board_id`,`hot_score`,`post_id`);
+CREATE INDEX IF NOT EXISTS `idx_post{shard}_board_id_reply_time_post_id` ON `post{shard}` (`board_id`,`reply_time`,`post_id`);
+CREATE INDEX IF NOT EXISTS `idx_post{shard}_created_at_post_id` ON `post{shard}` (`created_at`,`post_id`);
+CREATE INDEX IF NOT EXISTS `idx_post{shard}_created_at` ON `post{shard}` (`created_at`);
+CREATE INDEX IF NOT EXISTS `idx_post{shard}_deleted_at` ON `post{shard}` (`deleted_at`);
+CREATE INDEX IF NOT EXISTS `idx_post{shard}_hot_score_post_id` ON `post{shard}` (`hot_score`,`post_id`);
+CREATE INDEX IF NOT EXISTS `idx_post{shard}_reply_time_post_id` ON `post{shard}` (`reply_time`,`post_id`);
+CREATE INDEX IF NOT EXISTS `idx_post{shard}_updated_at` ON `post{shard}` (`updated_at`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_post{shard}_post_id` ON `post{shard}` (`post_id`);
+
+CREATE TABLE IF NOT EXISTS `post_reply{shard}` (
+  `id` integer,
+  `created_at` datetime,
+  `updated_at` datetime,
+  `deleted_at` datetime,
+  `reply_id` integer,
+  `author_id` integer,
+  `post_id` integer,
+  `parent_id` integer,
+  `reply_to_user_id` integer,
+  `sub_reply_num` integer,
+  `like_num` integer,
+  `content` text,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_post_reply{shard}_author_id` ON `post_reply{shard}` (`author_id`);
+CREATE INDEX IF NOT EXISTS `idx_post_reply{shard}_created_at` ON `post_reply{shard}` (`created_at`);
+CREATE INDEX IF NOT EXISTS `idx_post_reply{shard}_deleted_at` ON `post_reply{shard}` (`deleted_at`);
+CREATE INDEX IF NOT EXISTS `idx_post_reply{shard}_parent_id_created_at` ON `post_reply{shard}` (`parent_id`,`created_at`,`reply_id`);
+CREATE INDEX IF NOT EXISTS `idx_post_reply{shard}_post_id_author_id_created_at` ON `post_reply{shard}` (`post_id`,`author_id`,`created_at`);
+CREATE INDEX IF NOT EXISTS `idx_post_reply{shard}_post_id_like_num` ON `post_reply{shard}` (`post_id`,`like_num`);
+CREATE INDEX IF NOT EXISTS `idx_post_reply{shard}_post_id` ON `post_reply{shard}` (`post_id`);
+CREATE INDEX IF NOT EXISTS `idx_post_reply{shard}_updated_at` ON `post_reply{shard}` (`updated_at`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_post_reply{shard}_reply_id` ON `post_reply{shard}` (`reply_id`);
@@ -0,0 +1,64 @@
+CREATE TABLE IF NOT EXISTS `user{shard}` (
+  `id` integer,
+  `created_at` datetime,
+  `updated_at` datetime,
+  `deleted_at` datetime,
+  `user_id` integer,
+  `email` text,
+  `phone` text,
+  `nickname` text,
+  `password` text,
+  `role` text,
+  `avatar` text,
+  `level` integer DEFAULT 1,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_user{shard}_created_at` ON `user{shard}` (`created_at`);
+CREATE INDEX IF NOT EXISTS `idx_user{shard}_deleted_at` ON `user{shard}` (`deleted_at`);
+CREATE INDEX IF NOT EXISTS `idx_user{shard}_updated_at` ON `user{shard}` (`updated_at`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_user{shard}_user_id` ON `user{shard}` (`user_id`);
+
+CREATE TABLE IF NOT EXISTS `user_email{shard}` (
+  `id` integer,
+  `created_at` datetime,
+  `updated_at` datetime,
+  `deleted_at` datetime,
+  `email` text,
+  `user_id` integer,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_user_email{shard}_created_at` ON `user_email{shard}` (`created_at`);
+CREATE INDEX IF NOT EXISTS `idx_user_email{shard}_deleted_at` ON `user_email{shard}` (`deleted_at`);
+CREATE INDEX IF NOT EXISTS `idx_user_email{shard}_updated_at` ON `user_email{shard}` (`updated_at`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_user_email{shard}_email` ON `user_email{shard}` (`email`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_user_email{shard}_user_id` ON `user_email{shard}` (`user_id`);
+
+CREATE TABLE IF NOT EXISTS `user_phone{shard}` (
+  `id` integer,
+  `created_at` datetime,
+  `updated_at` datetime,
+  `deleted_at` datetime,
+  `phone` text,
+  `user_id` integer,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_user_phone{shard}_created_at` ON `user_phone{shard}` (`created_at`);
+CREATE INDEX IF NOT EXISTS `idx_user_phone{shard}_deleted_at` ON `user_phone{shard}` (`deleted_at`);
+CREATE INDEX IF NOT EXISTS `idx_user_phone{shard}_updated_at` ON `user_phone{shard}` (`updated_at`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_user_phone{shard}_phone` ON `user_phone{shard}` (`phone`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_user_phone{shard}_user_id` ON `user_phone{shard}` (`user_id`);
+
+CREATE TABLE IF NOT EXISTS `user_nickname{shard}` (
+  `id` integer,
+  `created_at` datetime,
+  `updated_at` datetime,
+  `deleted_at` datetime,
+  `nickname` text,
+  `user_id` integer,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_user_nickname{shard}_created_at` ON `user_nickname{shard}` (`created_at`);
+CREATE INDEX IF NOT EXISTS `idx_user_nickname{shard}_deleted_at` ON `user_nickname{shard}` (`deleted_at`);
+CREATE INDEX IF NOT EXISTS `idx_user_nickname{shard}_updated_at` ON `user_nickname{shard}` (`updated_at`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_user_nickname{shard}_nickname` ON `user_nickname{shard}` (`nickname`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_user_nickname{shard}_user_id` ON `user_nickname{shard}` (`user_id`);
@@ -0,0 +1,2 @@
+-- DROP COLUMN needs sqlite 3.35+
+ALTER TABLE `user{shard}` DROP COLUMN `locked`;
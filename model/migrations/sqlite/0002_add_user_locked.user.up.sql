@@ -0,0 +1 @@
+ALTER TABLE `user{shard}` ADD COLUMN `locked` numeric NOT NULL DEFAULT false;
@@ -1,18 +1,64 @@
 package model
 
-import "time"
+import (
+	"hoyobar/conf"
+	"hoyobar/util/idgen"
+	"hoyobar/util/myhash"
+	"strconv"
+	"time"
 
+	"gorm.io/gorm"
+)
+
+// index names are prefixed by the shard table (composite), as they must be unique in a sqlite database
 type Post struct {
 	Model
-	PostID    int64     `gorm:"uniqueIndex;index:idx_reply_time_post_id,priority:2;index:idx_created_at_post_id,priority:2"`
-	CreatedAt time.Time `gorm:"index:idx_created_at_post_id,priority:1"`
-	ReplyTime time.Time `gorm:"index:idx_reply_time_post_id,priority:1"`
+	PostID    int64     `gorm:"uniqueIndex;index:,composite:reply_time_post_id,priority:2;index:,composite:created_at_post_id,priority:2;index:,composite:board_id_created_at_post_id,priority:3;index:,composite:board_id_reply_time_post_id,priority:3;index:,composite:board_id_hot_score_post_id,priority:3;index:,composite:hot_score_post_id,priority:2"`
+	BoardID   int64     `gorm:"index:,composite:board_id_created_at_post_id,priority:1;index:,composite:board_id_reply_time_post_id,priority:1;index:,composite:board_id_hot_score_post_id,priority:1"`
+	CreatedAt time.Time `gorm:"index:,composite:created_at_post_id,priority:1;index:,composite:board_id_created_at_post_id,priority:2"`
+	ReplyTime time.Time `gorm:"index:,composite:reply_time_post_id,priority:1;index:,composite:board_id_reply_time_post_id,priority:2"`
 	ReplyNum  int64
-	AuthorID  int64  `gorm:"index"`
-	Title     string `gorm:"size:50"`
+	LikeNum   int64
+	HotScore  float64 `gorm:"index:,composite:board_id_hot_score_post_id,priority:2;index:,composite:hot_score_post_id,priority:1"` // see service.HotScore
+	AuthorID  int64   `gorm:"index"`
+	Title     string  `gorm:"size:50"`
 	Content   string
 }
 
 func (Post) TableName() string {
 	return "post"
 }
+
+// Posts are sharded by board, so a board list is read from one shard.
+// The post ID is generated to hash into the shard of its board (see NewPostID),
+// so the shard is also known from the post ID alone.
+func TableOfPost(post *Post, postID int64) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Table(PostShardTable(PostShardIdx(postID)))
+	}
+}
+
+// all posts of the board are in this shard
+func TableOfBoard(boardID int64) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Table(PostShardTable(BoardShardIdx(boardID)))
+	}
+}
+
+func PostShardTable(shardIdx int64) string {
+	return Post{}.TableName() + strconv.FormatInt(shardIdx, 10)
+}
+
+// index of the shard table where the post and its replies are stored
+func PostShardIdx(postID int64) int64 {
+	return myhash.HashSnowflakeID(postID, int64(conf.Global().Sharding.PostShardN))
+}
+
+func BoardShardIdx(boardID int64) int64 {
+	return myhash.HashSnowflakeID(boardID, int64(conf.Global().Sharding.PostShardN))
+}
+
+// ID of a new post in the board, it is in the shard of the board
+func NewPostID(boardID int64) int64 {
+	return idgen.NewInShard(BoardShardIdx(boardID), int64(conf.Global().Sharding.PostShardN))
+}
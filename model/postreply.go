@@ -1,13 +1,46 @@
 package model
 
+import (
+	"hoyobar/conf"
+	"hoyobar/util/idgen"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
 type PostReply struct {
 	Model
-	ReplyID  int64 `gorm:"uniqueIndex"`
-	AuthorID int64 `gorm:"index"`
-	PostID   int64 `gorm:"index"`
-	Content  string
+	ReplyID   int64     `gorm:"uniqueIndex;index:,composite:parent_id_created_at,priority:3"`
+	AuthorID  int64     `gorm:"index;index:,composite:post_id_author_id_created_at,priority:2"`
+	PostID    int64     `gorm:"index;index:,composite:post_id_author_id_created_at,priority:1;index:,composite:post_id_like_num,priority:1"`
+	CreatedAt time.Time `gorm:"index:,composite:parent_id_created_at,priority:2;index:,composite:post_id_author_id_created_at,priority:3"`
+	// ParentID is the floor this reply belongs to, 0 means it is a floor itself
+	ParentID      int64 `gorm:"index:,composite:parent_id_created_at,priority:1"`
+	ReplyToUserID int64
+	SubReplyNum   int64
+	LikeNum       int64 `gorm:"index:,composite:post_id_like_num,priority:2"`
+	Content       string
 }
 
 func (PostReply) TableName() string {
 	return "post_reply"
 }
+
+// Replies are sharded by post ID, so a thread is in one shard, the same shard index as the post.
+// The reply ID is generated to hash into the shard of its post (see NewReplyID),
+// so id may be either the post ID or the reply ID (or the parent reply ID).
+func TableOfPostReply(reply *PostReply, id int64) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Table(PostReplyShardTable(PostShardIdx(id)))
+	}
+}
+
+func PostReplyShardTable(shardIdx int64) string {
+	return PostReply{}.TableName() + strconv.FormatInt(shardIdx, 10)
+}
+
+// ID of a new reply of the post, it is in the shard of the post
+func NewReplyID(postID int64) int64 {
+	return idgen.NewInShard(PostShardIdx(postID), int64(conf.Global().Sharding.PostShardN))
+}
@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// a tag of a post, tags are normalized before stored
+type PostTag struct {
+	Model
+	PostID    int64     `gorm:"uniqueIndex:idx_post_id_tag,priority:1;index:idx_tag_created_at_post_id,priority:3"`
+	Tag       string    `gorm:"uniqueIndex:idx_post_id_tag,priority:2;index:idx_tag_created_at_post_id,priority:1;size:50"`
+	BoardID   int64     `gorm:"index:idx_board_id_created_at,priority:1"`
+	CreatedAt time.Time `gorm:"index:idx_tag_created_at_post_id,priority:2;index:idx_board_id_created_at,priority:2"` // same as the post
+}
+
+func (PostTag) TableName() string {
+	return "post_tag"
+}
@@ -0,0 +1,14 @@
+package model
+
+// a user reacts to a post or a reply with an emoji, at most one row per (target, user, emoji)
+type Reaction struct {
+	Model
+	TargetID   int64  `gorm:"uniqueIndex:idx_target_id_user_id_emoji,priority:1"`
+	UserID     int64  `gorm:"uniqueIndex:idx_target_id_user_id_emoji,priority:2;index"`
+	Emoji      string `gorm:"uniqueIndex:idx_target_id_user_id_emoji,priority:3;size:32"`
+	TargetType string `gorm:"size:10"` // same as Like.TargetType
+}
+
+func (Reaction) TableName() string {
+	return "content_reaction"
+}
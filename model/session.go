@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// an auth token kept in db, issued while the cache is unavailable
+type Session struct {
+	Model
+	Token    string    `gorm:"uniqueIndex;size:32"`
+	UserID   int64     `gorm:"index"`
+	ExpireAt time.Time `gorm:"index"`
+}
+
+func (Session) TableName() string {
+	return "user_session"
+}
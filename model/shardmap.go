@@ -0,0 +1,33 @@
+package model
+
+const (
+	// groups of sharded tables, a group may be spread over databases by shard ranges
+	ShardGroupUser = "user" // user, user_email, user_phone and user_nickname, placed by a shard map
+	ShardGroupPost = "post" // post and post_reply, see TableOfPost
+
+	// legacy placement by myhash.HashSnowflakeID and myhash.HashString, rows are orphaned if the shard count changes
+	ShardMapKindModulo = "modulo"
+	// consistent hashing by hashring.Ring, a new shard takes its part from every old shard
+	ShardMapKindRing = "ring"
+
+	ShardMapStateCopying  = "copying"   // rows are being copied to the new version, which is not used yet
+	ShardMapStateDualRead = "dual_read" // writes go to the new version, reads try the new one and then the active one
+	ShardMapStateActive   = "active"    // the version in use
+	ShardMapStateRetired  = "retired"
+)
+
+// a recorded version of how rows of a group of sharded tables are placed.
+// At most one version is active, and at most one newer version is being resharded to.
+type ShardMap struct {
+	Model
+	Name    string `gorm:"uniqueIndex:idx_name_version,priority:1;size:20"`
+	Version int64  `gorm:"uniqueIndex:idx_name_version,priority:2"`
+	Kind    string `gorm:"size:10"`
+	ShardN  int
+	VNodes  int    // of each shard, for ShardMapKindRing
+	State   string `gorm:"size:10"`
+}
+
+func (ShardMap) TableName() string {
+	return "shard_map"
+}
@@ -2,8 +2,6 @@ package model
 
 import (
 	"database/sql"
-	"hoyobar/conf"
-	"hoyobar/util/myhash"
 	"strconv"
 
 	"gorm.io/gorm"
@@ -16,16 +14,23 @@ type User struct {
 	Phone    sql.NullString `gorm:"size:30"`
 	Nickname string         `gorm:"size:50"`
 	Password string         `gorm:"size:100"`
+	Role     string         `gorm:"size:20"`  // empty for normal users
+	Avatar   string         `gorm:"size:255"` // url of avatar image, empty for the default one
+	Level    int            `gorm:"default:1"`
+	Locked   bool           `gorm:"not null;default:false"` // locked users can not log in, their tokens are rejected
 }
 
+const (
+	RoleAdmin = "admin"
+)
+
 func (User) TableName() string {
 	return "user"
 }
 
-func TableOfUser(user *User, userID int64) func(db *gorm.DB) *gorm.DB {
+// shardIdx is from storage.ShardRouter
+func TableOfUser(shardIdx int64) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
-		shardIdx := myhash.HashSnowflakeID(userID, int64(conf.Global.Sharding.UserShardN))
-		tableName := user.TableName() + strconv.FormatInt(shardIdx, 10)
-		return db.Table(tableName)
+		return db.Table(User{}.TableName() + strconv.FormatInt(shardIdx, 10))
 	}
 }
@@ -1,8 +1,6 @@
 package model
 
 import (
-	"hoyobar/conf"
-	"hoyobar/util/myhash"
 	"strconv"
 
 	"gorm.io/gorm"
@@ -18,10 +16,9 @@ func (UserEmail) TableName() string {
 	return "user_email"
 }
 
-func TableOfUserEmail(useremail *UserEmail, email string) func(db *gorm.DB) *gorm.DB {
+// shardIdx is from storage.ShardRouter
+func TableOfUserEmail(shardIdx int64) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
-		shardIdx := myhash.HashString(email, int64(conf.Global.Sharding.UserShardN))
-		tableName := useremail.TableName() + strconv.FormatInt(shardIdx, 10)
-		return db.Table(tableName)
+		return db.Table(UserEmail{}.TableName() + strconv.FormatInt(shardIdx, 10))
 	}
 }
@@ -1,8 +1,6 @@
 package model
 
 import (
-	"hoyobar/conf"
-	"hoyobar/util/myhash"
 	"strconv"
 
 	"gorm.io/gorm"
@@ -18,10 +16,9 @@ func (UserNickname) TableName() string {
 	return "user_nickname"
 }
 
-func TableOfUserNickname(userNickname *UserNickname, nickname string) func(db *gorm.DB) *gorm.DB {
+// shardIdx is from storage.ShardRouter
+func TableOfUserNickname(shardIdx int64) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
-		shardIdx := myhash.HashString(nickname, int64(conf.Global.Sharding.UserShardN))
-		tableName := userNickname.TableName() + strconv.FormatInt(shardIdx, 10)
-		return db.Table(tableName)
+		return db.Table(UserNickname{}.TableName() + strconv.FormatInt(shardIdx, 10))
 	}
 }
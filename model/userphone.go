@@ -1,8 +1,6 @@
 package model
 
 import (
-	"hoyobar/conf"
-	"hoyobar/util/myhash"
 	"strconv"
 
 	"gorm.io/gorm"
@@ -18,10 +16,9 @@ func (UserPhone) TableName() string {
 	return "user_phone"
 }
 
-func TableOfUserPhone(userphone *UserPhone, phone string) func(db *gorm.DB) *gorm.DB {
+// shardIdx is from storage.ShardRouter
+func TableOfUserPhone(shardIdx int64) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
-		shardIdx := myhash.HashString(phone, int64(conf.Global.Sharding.UserShardN))
-		tableName := userphone.TableName() + strconv.FormatInt(shardIdx, 10)
-		return db.Table(tableName)
+		return db.Table(UserPhone{}.TableName() + strconv.FormatInt(shardIdx, 10))
 	}
 }
@@ -1 +0,0 @@
-CREATE DATABASE `hoyobar_test`;
@@ -2,5 +2,5 @@
 
 gofmt -l -w -s . && \
 goimports -l -w . && \
-go run main.go
+go run . serve
 
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package search
+
+import (
+	"os"
+	"syscall"
+)
+
+// lock path exclusively until the process exits, fails if it is locked by another process
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,8 @@
+package search
+
+import "os"
+
+// not locked on windows, the server should be stopped before "reindex search"
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+}
@@ -0,0 +1,308 @@
+package search
+
+import (
+	"context"
+	"encoding/gob"
+	"hoyobar/conf"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BM25 params
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// format of terms, an index of an older version needs "reindex search"
+const indexVersion = 2 // CJK unigrams
+
+// MemoryIndex is an in-process inverted index, persisted to a local file by Flush.
+// The file is locked by one process, so a rebuild can not be overwritten by a running server.
+type MemoryIndex struct {
+	mu    sync.RWMutex
+	path  string   // empty means not persisted
+	lock  *os.File // held open, closing it releases the lock
+	data  indexData
+	dirty bool
+}
+
+var _ Index = (*MemoryIndex)(nil)
+
+// the persisted part of MemoryIndex
+type indexData struct {
+	Version  int
+	Docs     map[int64]*docMeta
+	Postings map[string]map[int64]int // term -> doc ID -> term frequency
+	TotalLen int64                    // sum of Len of all docs
+}
+
+type docMeta struct {
+	Type      string
+	PostID    int64
+	BoardID   int64
+	AuthorID  int64
+	CreatedAt time.Time
+	Len       int      // number of tokens
+	Terms     []string // distinct terms, for deletion
+}
+
+// load index from path if the file exists and load is true, path == "" means an index not persisted.
+// load is false for a rebuild, the file is replaced on Flush, so it may be of any version or broken.
+func NewMemoryIndex(path string, load bool) (*MemoryIndex, error) {
+	idx := &MemoryIndex{
+		path: path,
+		data: newIndexData(),
+	}
+	if path == "" {
+		return idx, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, errors.Wrapf(err, "fail to create dir of search index")
+	}
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, errors.Wrapf(err, "search index %v is used by another process, e.g. a running server", path)
+	}
+	idx.lock = lock
+	if !load {
+		return idx, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		lock.Close()
+		return nil, errors.Wrapf(err, "fail to open search index %v", path)
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&idx.data); err != nil {
+		lock.Close()
+		return nil, errors.Wrapf(err, "fail to decode search index %v, rebuild it by \"reindex search\"", path)
+	}
+	if idx.data.Version != indexVersion {
+		log.Printf("search index %v is of version %v, single-character CJK queries need \"reindex search\"\n", path, idx.data.Version)
+	}
+	return idx, nil
+}
+
+func newIndexData() indexData {
+	return indexData{
+		Version:  indexVersion,
+		Docs:     make(map[int64]*docMeta),
+		Postings: make(map[string]map[int64]int),
+	}
+}
+
+// Add implements Index
+func (m *MemoryIndex) Add(ctx context.Context, doc *Document) error {
+	// title matches weigh more, so title tokens are counted twice
+	titleTokens := Tokenize(doc.Title)
+	tokens := append(append(titleTokens, titleTokens...), Tokenize(doc.Content)...)
+	tfs := make(map[string]int)
+	for _, token := range tokens {
+		tfs[token]++
+	}
+	meta := &docMeta{
+		Type:      doc.Type,
+		PostID:    doc.PostID,
+		BoardID:   doc.BoardID,
+		AuthorID:  doc.AuthorID,
+		CreatedAt: doc.CreatedAt,
+		Len:       len(tokens),
+		Terms:     make([]string, 0, len(tfs)),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteLocked(doc.DocID)
+	for term, tf := range tfs {
+		postings, ok := m.data.Postings[term]
+		if !ok {
+			postings = make(map[int64]int)
+			m.data.Postings[term] = postings
+		}
+		postings[doc.DocID] = tf
+		meta.Terms = append(meta.Terms, term)
+	}
+	m.data.Docs[doc.DocID] = meta
+	m.data.TotalLen += int64(meta.Len)
+	m.dirty = true
+	return nil
+}
+
+// Delete implements Index
+func (m *MemoryIndex) Delete(ctx context.Context, docID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteLocked(docID)
+	return nil
+}
+
+func (m *MemoryIndex) deleteLocked(docID int64) {
+	meta, ok := m.data.Docs[docID]
+	if !ok {
+		return
+	}
+	for _, term := range meta.Terms {
+		postings := m.data.Postings[term]
+		delete(postings, docID)
+		if len(postings) == 0 {
+			delete(m.data.Postings, term)
+		}
+	}
+	delete(m.data.Docs, docID)
+	m.data.TotalLen -= int64(meta.Len)
+	m.dirty = true
+}
+
+// Search implements Index.
+// A document matches if it contains all terms of the query text,
+// the score is BM25 boosted by recency.
+func (m *MemoryIndex) Search(ctx context.Context, query *Query) ([]Hit, int, error) {
+	terms := distinct(QueryTerms(query.Text))
+	if len(terms) == 0 {
+		return nil, 0, nil
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// start from the rarest term to check fewer docs
+	sort.Slice(terms, func(i, j int) bool {
+		return len(m.data.Postings[terms[i]]) < len(m.data.Postings[terms[j]])
+	})
+	docN := float64(len(m.data.Docs))
+	avgLen := 1.0
+	if docN > 0 {
+		avgLen = math.Max(float64(m.data.TotalLen)/docN, 1)
+	}
+	halfLife := conf.Global().Search.RecencyHalfLife.Hours()
+	recencyWeight := conf.Global().Search.RecencyWeight
+	now := time.Now()
+
+	var hits []Hit
+	for docID, tf := range m.data.Postings[terms[0]] {
+		meta := m.data.Docs[docID]
+		if !matchFilter(meta, query) {
+			continue
+		}
+		score := 0.0
+		matched := true
+		for i, term := range terms {
+			postings := m.data.Postings[term]
+			if i > 0 {
+				if tf, matched = postings[docID]; !matched {
+					break
+				}
+			}
+			idf := math.Log(1 + (docN-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+			norm := float64(tf) * (bm25K1 + 1) /
+				(float64(tf) + bm25K1*(1-bm25B+bm25B*float64(meta.Len)/avgLen))
+			score += idf * norm
+		}
+		if !matched {
+			continue
+		}
+		ageHours := math.Max(now.Sub(meta.CreatedAt).Hours(), 0)
+		score *= 1 + recencyWeight*math.Pow(0.5, ageHours/halfLife)
+		hits = append(hits, Hit{DocID: docID, Type: meta.Type, PostID: meta.PostID, Score: score})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].DocID > hits[j].DocID
+	})
+	total := len(hits)
+	if query.Offset >= total {
+		return nil, total, nil
+	}
+	end := total
+	if query.Limit > 0 && query.Offset+query.Limit < total {
+		end = query.Offset + query.Limit
+	}
+	return hits[query.Offset:end], total, nil
+}
+
+func matchFilter(meta *docMeta, query *Query) bool {
+	if query.Type != "" && meta.Type != query.Type {
+		return false
+	}
+	if query.BoardID != 0 && meta.BoardID != query.BoardID {
+		return false
+	}
+	if query.AuthorID != 0 && meta.AuthorID != query.AuthorID {
+		return false
+	}
+	if !query.StartTime.IsZero() && meta.CreatedAt.Before(query.StartTime) {
+		return false
+	}
+	if !query.EndTime.IsZero() && !meta.CreatedAt.Before(query.EndTime) {
+		return false
+	}
+	return true
+}
+
+// Reset implements Index
+func (m *MemoryIndex) Reset(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = newIndexData()
+	m.dirty = true
+	return nil
+}
+
+// Flush implements Index, the file is replaced atomically
+func (m *MemoryIndex) Flush(ctx context.Context) error {
+	if m.path == "" {
+		return nil
+	}
+	// hold the write lock, so no update is lost between encoding and clearing dirty
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return errors.Wrapf(err, "fail to create dir of search index")
+	}
+	tmpPath := m.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrapf(err, "fail to create search index file")
+	}
+	if err := gob.NewEncoder(f).Encode(&m.data); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "fail to encode search index")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "fail to write search index file")
+	}
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		return errors.Wrapf(err, "fail to replace search index file")
+	}
+	m.dirty = false
+	return nil
+}
+
+func distinct(tokens []string) []string {
+	seen := make(map[string]bool, len(tokens))
+	res := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if !seen[token] {
+			seen[token] = true
+			res = append(res, token)
+		}
+	}
+	return res
+}
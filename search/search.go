@@ -0,0 +1,57 @@
+// full-text search over posts and replies
+package search
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	DocTypePost  = "post"
+	DocTypeReply = "reply"
+)
+
+// Document is a searchable post or reply.
+// For a post, DocID == PostID; for a reply, DocID is the reply ID.
+type Document struct {
+	DocID     int64
+	Type      string
+	PostID    int64
+	BoardID   int64
+	AuthorID  int64
+	Title     string // empty for replies
+	Content   string
+	CreatedAt time.Time
+}
+
+// Query of a search, zero value of a filter means no filter
+type Query struct {
+	Text      string
+	Type      string // DocTypePost or DocTypeReply
+	BoardID   int64
+	AuthorID  int64
+	StartTime time.Time
+	EndTime   time.Time
+	Offset    int
+	Limit     int
+}
+
+type Hit struct {
+	DocID  int64
+	Type   string
+	PostID int64
+	Score  float64
+}
+
+// Index is implemented by the in-process index, an external engine can be plugged in later.
+type Index interface {
+	// add or replace a document
+	Add(ctx context.Context, doc *Document) error
+	Delete(ctx context.Context, docID int64) error
+	// hits ordered by relevance and recency, total is the number of all matched documents
+	Search(ctx context.Context, query *Query) (hits []Hit, total int, err error)
+	// remove all documents, used before rebuilding
+	Reset(ctx context.Context) error
+	// persist the index, no-op if it is not needed
+	Flush(ctx context.Context) error
+}
@@ -0,0 +1,71 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Tokenize splits a document into index terms.
+// Latin letters and digits are split into lower-case words,
+// runs of CJK characters are split into single characters and overlapping bigrams
+// ("帖子回复" -> "帖", "子", "回", "复", "帖子", "子回", "回复"), so a one-character query also matches.
+func Tokenize(text string) []string {
+	return tokenize(text, true)
+}
+
+// QueryTerms splits query text into terms, CJK runs are only split into bigrams,
+// which are more precise, a single CJK character is kept as it is.
+func QueryTerms(text string) []string {
+	return tokenize(text, false)
+}
+
+func tokenize(text string, unigrams bool) []string {
+	var tokens []string
+	var word []rune
+	var cjk []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		switch {
+		case len(cjk) == 1:
+			tokens = append(tokens, string(cjk))
+		case len(cjk) > 1:
+			if unigrams {
+				for _, r := range cjk {
+					tokens = append(tokens, string(r))
+				}
+			}
+			for i := 0; i+1 < len(cjk); i++ {
+				tokens = append(tokens, string(cjk[i:i+2]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, unicode.ToLower(r))
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return tokens
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r)
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"hoyobar/storage"
+	"hoyobar/util/funcs"
+	"hoyobar/util/mycache"
+	"hoyobar/util/mycache/keys"
+	"hoyobar/util/myerr"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// start time of the recency part of hot score, same as snowflake epoch
+var hotEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+// HotScore ranks a post by activity and recency.
+// Activity is on log scale and recency grows linearly with created time,
+// so a post needs 10x activity to rank the same as one created conf.App.Hot.Decay later,
+// which means posts gaining replies and likes faster (higher velocity) rank higher.
+// The score only changes with activity, never with the passing of time,
+// so it can be stored and compared in db and cache.
+func HotScore(replyNum, likeNum int64, createdAt time.Time) float64 {
+	c := conf.Global().App.Hot
+	activity := c.ReplyWeight*float64(replyNum) + c.LikeWeight*float64(likeNum)
+	if activity < 0 {
+		activity = 0
+	}
+	recency := float64(createdAt.Unix()-hotEpoch) / c.Decay.Seconds()
+	return math.Log10(1+activity) + recency
+}
+
+// HotService maintains hot post lists in cache, one sorted set per board.
+// Pages are served from a snapshot of the list, so scores changed during paging do not
+// make posts repeated or skipped.
+type HotService struct {
+	cache       mycache.Cache
+	postStorage storage.PostStorage
+	postCache   *PostCache
+}
+
+func NewHotService(cache mycache.Cache, postStorage storage.PostStorage, postCache *PostCache) *HotService {
+	if conf.Global() == nil {
+		log.Fatalf("conf.Global is not initialized")
+	}
+	return &HotService{
+		cache:       cache,
+		postStorage: postStorage,
+		postCache:   postCache,
+	}
+}
+
+// recompute hot scores of posts in background
+func (h *HotService) Refresh(postIDs ...int64) {
+	funcs.Go(func() {
+		timeout := conf.Global().App.Timeout.Default
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		postMs, err := h.postStorage.FetchByPostIDs(ctx, postIDs)
+		if err != nil {
+			log.Printf("fails to refresh hot score, post_ids = %v, err = %v\n", postIDs, err)
+			return
+		}
+		for _, postM := range postMs {
+			h.update(ctx, postM)
+		}
+	})
+}
+
+func (h *HotService) update(ctx context.Context, postM *model.Post) {
+	score := HotScore(postM.ReplyNum, postM.LikeNum, postM.CreatedAt)
+	if err := h.postStorage.UpdateHotScore(ctx, postM.PostID, score); err != nil {
+		log.Printf("fails to update hot score, post_id = %v, err = %v\n", postM.PostID, err)
+	} else {
+		h.postCache.InvalidateCounters(ctx, postM.PostID)
+	}
+	h.addToList(ctx, 0, postM.PostID, score)
+	if postM.BoardID != 0 {
+		h.addToList(ctx, postM.BoardID, postM.PostID, score)
+	}
+}
+
+// remove a deleted post from the hot lists, snapshots taken before keep it until they expire
+func (h *HotService) Remove(ctx context.Context, postM *model.Post) error {
+	for _, boardID := range timelineBoards(postM.BoardID) {
+		if err := h.cache.ZRem(ctx, keys.PostHot(boardID), funcs.Itoa(postM.PostID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *HotService) addToList(ctx context.Context, boardID int64, postID int64, score float64) {
+	key := keys.PostHot(boardID)
+	if err := h.cache.ZAdd(ctx, key, score, funcs.Itoa(postID)); err != nil {
+		// a post missing in the middle breaks the list, rebuild it on next read
+		_ = h.cache.Del(ctx, key, keys.PostHotReady(boardID))
+		return
+	}
+	// only keep top n
+	_ = h.cache.ZRemRangeByRank(ctx, key, 0, -int64(conf.Global().App.Hot.TopN)-1)
+}
+
+// prefix of cursors paging hot posts in db, used when the cache is unavailable
+const hotDBCursorPrefix = "db:"
+
+// page hot posts of a board, boardID 0 means all boards.
+// cursor: empty for the first page, which takes a new snapshot.
+// pages are read from db without a snapshot if the cache is unavailable.
+func (h *HotService) List(ctx context.Context, boardID int64, cursor string, cnt int) (list []*model.Post, newCursor string, err error) {
+	if strings.HasPrefix(cursor, hotDBCursorPrefix) {
+		return h.listDB(ctx, boardID, strings.TrimPrefix(cursor, hotDBCursorPrefix), cnt)
+	}
+	var snapshotID string
+	var offset int
+	var postIDs []int64
+	if cursor == "" {
+		postIDs, err = h.topPostIDs(ctx, boardID)
+		if err != nil {
+			return nil, "", err
+		}
+		snapshotID = strings.ReplaceAll(uuid.NewString(), "-", "")
+		value, _ := json.Marshal(postIDs)
+		err = h.cache.Set(ctx, keys.PostHotSnapshot(snapshotID), string(value), conf.Global().App.Hot.SnapshotExpire)
+		if err != nil {
+			log.Printf("fails to write hot post snapshot, read from db: %v\n", err)
+			return h.listDB(ctx, boardID, "", cnt)
+		}
+	} else {
+		snapshotID, offset, err = decomposeHotCursor(cursor)
+		if err != nil {
+			return nil, "", myerr.ErrBadReqBody.WithCause(err).WithEmsg("不合法的游标")
+		}
+		value, err := h.cache.Get(ctx, keys.PostHotSnapshot(snapshotID))
+		if err != nil {
+			// the snapshot is lost if the cache is unavailable, the client starts over from db
+			return nil, "", myerr.ErrResourceNotFound.WithCause(err).WithEmsg("列表已过期，请刷新")
+		}
+		if err = json.Unmarshal([]byte(value), &postIDs); err != nil {
+			return nil, "", myerr.OtherErrWarpf(err, "fail to parse hot post snapshot")
+		}
+	}
+
+	if offset >= len(postIDs) {
+		return nil, cursor, nil
+	}
+	end := funcs.Min(offset+cnt, len(postIDs))
+	pagePostIDs := postIDs[offset:end]
+	list, err = h.postCache.FetchMany(ctx, pagePostIDs)
+	if err != nil {
+		return nil, "", myerr.OtherErrWarpf(err, "fail to query hot posts")
+	}
+	return list, composeHotCursor(snapshotID, end), nil
+}
+
+// page hot posts in db, a post whose score changes between pages may be repeated or skipped
+func (h *HotService) listDB(ctx context.Context, boardID int64, cursor string, cnt int) (list []*model.Post, newCursor string, err error) {
+	filter := &storage.PostFilter{BoardID: boardID}
+	list, newCursor, err = h.postStorage.List(ctx, filter, storage.PostOrderHotDesc, cursor, cnt)
+	if err != nil {
+		return nil, "", myerr.OtherErrWarpf(err, "fail to query hot posts")
+	}
+	return list, hotDBCursorPrefix + newCursor, nil
+}
+
+// read hot post IDs from cache, the list is rebuilt from db if it is not built or missing,
+// e.g. it only has posts updated after the cache is flushed.
+func (h *HotService) topPostIDs(ctx context.Context, boardID int64) ([]int64, error) {
+	topN := conf.Global().App.Hot.TopN
+	key := keys.PostHot(boardID)
+	var members []string
+	_, err := h.cache.Get(ctx, keys.PostHotReady(boardID))
+	if err == nil {
+		members, err = h.cache.ZRevRange(ctx, key, 0, int64(topN)-1)
+	}
+	if err == nil && len(members) > 0 {
+		postIDs := make([]int64, 0, len(members))
+		for _, member := range members {
+			if postID, err := funcs.Atoi(member); err == nil {
+				postIDs = append(postIDs, postID)
+			}
+		}
+		return postIDs, nil
+	}
+
+	postIDs := make([]int64, 0, topN)
+	filter := &storage.PostFilter{BoardID: boardID}
+	cursor := ""
+	built := true
+	for len(postIDs) < topN {
+		postMs, newCursor, err := h.postStorage.List(ctx, filter, storage.PostOrderHotDesc, cursor, topN-len(postIDs))
+		if err != nil {
+			return nil, myerr.OtherErrWarpf(err, "fail to query hot posts")
+		}
+		if len(postMs) == 0 {
+			break
+		}
+		for _, postM := range postMs {
+			postIDs = append(postIDs, postM.PostID)
+			if built && h.cache.ZAdd(ctx, key, postM.HotScore, funcs.Itoa(postM.PostID)) != nil {
+				built = false
+				_ = h.cache.Del(ctx, key)
+			}
+		}
+		cursor = newCursor
+	}
+	if built {
+		// posts updated during the rebuild are added too, only keep top n
+		_ = h.cache.ZRemRangeByRank(ctx, key, 0, -int64(topN)-1)
+		_ = h.cache.Set(ctx, keys.PostHotReady(boardID), "1", 0)
+	}
+	return postIDs, nil
+}
+
+func composeHotCursor(snapshotID string, offset int) string {
+	return snapshotID + "_" + strconv.Itoa(offset)
+}
+
+func decomposeHotCursor(cursor string) (snapshotID string, offset int, err error) {
+	segs := strings.SplitN(cursor, "_", 2)
+	if len(segs) != 2 {
+		return "", 0, fmt.Errorf("wrong hot cursor format: %v", cursor)
+	}
+	offset, err = strconv.Atoi(segs[1])
+	if err != nil || offset < 0 {
+		return "", 0, fmt.Errorf("wrong hot cursor format, expect second part a non-negative int, got %v", segs[1])
+	}
+	return segs[0], offset, nil
+}
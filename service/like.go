@@ -0,0 +1,377 @@
+package service
+
+import (
+	"context"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"hoyobar/storage"
+	"hoyobar/util/mycache"
+	"hoyobar/util/mycache/keys"
+	"hoyobar/util/myerr"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LikeService keeps like nums in cache and writes them back to db in batches.
+// A like num in db is always recounted from the like table rather than incremented,
+// so a lost or repeated write back does not make it drift.
+type LikeService struct {
+	cache        mycache.Cache
+	likeStorage  storage.LikeStorage
+	postStorage  storage.PostStorage
+	replyStorage storage.PostReplyStorage
+	postCache    *PostCache
+	hotService   *HotService
+
+	mu    sync.Mutex
+	dirty map[int64]string // target ID -> target type, waiting to write back
+}
+
+func NewLikeService(
+	cache mycache.Cache,
+	likeStorage storage.LikeStorage,
+	postStorage storage.PostStorage,
+	replyStorage storage.PostReplyStorage,
+	postCache *PostCache,
+	hotService *HotService,
+) *LikeService {
+	if conf.Global() == nil {
+		log.Fatalf("conf.Global is not initialized")
+	}
+	return &LikeService{
+		cache:        cache,
+		likeStorage:  likeStorage,
+		postStorage:  postStorage,
+		replyStorage: replyStorage,
+		postCache:    postCache,
+		hotService:   hotService,
+		dirty:        make(map[int64]string),
+	}
+}
+
+type LikeState struct {
+	LikeNum int64 `json:"like_num"`
+	Liked   bool  `json:"liked"`
+}
+
+// like a post or a reply, liking twice is a no-op
+func (l *LikeService) Like(ctx context.Context, userID int64, targetType string, targetID int64) (*LikeState, error) {
+	return l.toggle(ctx, userID, targetType, targetID, true)
+}
+
+// cancel a like, unliking a not liked target is a no-op
+func (l *LikeService) Unlike(ctx context.Context, userID int64, targetType string, targetID int64) (*LikeState, error) {
+	return l.toggle(ctx, userID, targetType, targetID, false)
+}
+
+func (l *LikeService) toggle(ctx context.Context, userID int64, targetType string, targetID int64, like bool) (*LikeState, error) {
+	if err := l.checkTarget(ctx, targetType, targetID); err != nil {
+		return nil, err
+	}
+
+	var changed bool
+	var err error
+	var delta int64
+	if like {
+		changed, err = l.likeStorage.Create(ctx, &model.Like{
+			TargetID:   targetID,
+			UserID:     userID,
+			TargetType: targetType,
+		})
+		delta = 1
+	} else {
+		changed, err = l.likeStorage.Delete(ctx, targetID, userID)
+		delta = -1
+	}
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to write like of %v %v", targetType, targetID)
+	}
+
+	var likeNum int64
+	if changed {
+		l.markDirty(targetType, targetID)
+		likeNum, err = l.cache.IncrBy(ctx, keys.LikeNum(targetID), delta)
+	} else {
+		likeNum, err = l.cache.GetInt64(ctx, keys.LikeNum(targetID))
+	}
+	if err != nil {
+		// like_num in db is written back later, count the likes instead.
+		// the counter is not cached here, a concurrent toggle may count before this one and cache after it,
+		// it is loaded on next read and overwritten by the write back.
+		likeNums, err := l.likeStorage.CountByTargets(ctx, []int64{targetID})
+		if err != nil {
+			return nil, myerr.OtherErrWarpf(err, "fail to count likes of %v %v", targetType, targetID)
+		}
+		likeNum = likeNums[targetID]
+	}
+	return &LikeState{LikeNum: likeNum, Liked: like}, nil
+}
+
+// return ErrResourceNotFound if target not exists
+func (l *LikeService) checkTarget(ctx context.Context, targetType string, targetID int64) error {
+	switch targetType {
+	case model.LikeTargetPost:
+		postM, err := l.postStorage.FetchByPostID(ctx, targetID)
+		if err != nil {
+			return myerr.OtherErrWarpf(err, "fail to query post %v", targetID)
+		}
+		if postM == nil {
+			return myerr.ErrResourceNotFound.WithEmsg("帖子不存在")
+		}
+		return nil
+	case model.LikeTargetReply:
+		replyM, err := l.replyStorage.FetchByReplyID(ctx, targetID)
+		if err != nil {
+			return myerr.OtherErrWarpf(err, "fail to query reply %v", targetID)
+		}
+		if replyM == nil {
+			return myerr.ErrResourceNotFound.WithEmsg("回复不存在")
+		}
+		return nil
+	default:
+		return myerr.ErrBadReqBody.WithEmsg("不支持点赞的内容")
+	}
+}
+
+// read like nums from cache.
+// dbLikeNums: target ID -> like num in db, used and cached if missing in cache.
+func (l *LikeService) LikeNums(ctx context.Context, dbLikeNums map[int64]int64) map[int64]int64 {
+	likeNums := make(map[int64]int64, len(dbLikeNums))
+	if len(dbLikeNums) == 0 {
+		return likeNums
+	}
+	targetIDs := make([]int64, 0, len(dbLikeNums))
+	cacheKeys := make([]string, 0, len(dbLikeNums))
+	for targetID := range dbLikeNums {
+		targetIDs = append(targetIDs, targetID)
+		cacheKeys = append(cacheKeys, keys.LikeNum(targetID))
+	}
+
+	values, err := l.cache.MGet(ctx, cacheKeys...)
+	if err != nil || len(values) != len(targetIDs) {
+		values = make([]interface{}, len(targetIDs)) // treat all as missing
+	}
+	expire := conf.Global().App.Expire.PostInfo
+	for i, targetID := range targetIDs {
+		if s, ok := values[i].(string); ok {
+			if likeNum, err := strconv.ParseInt(s, 10, 64); err == nil {
+				likeNums[targetID] = likeNum
+				continue
+			}
+		}
+		likeNums[targetID] = dbLikeNums[targetID]
+		_ = l.cache.SetInt64(ctx, keys.LikeNum(targetID), dbLikeNums[targetID], expire)
+	}
+	return likeNums
+}
+
+// which targets are liked by the user, userID == 0 means not login
+func (l *LikeService) LikedBy(ctx context.Context, userID int64, targetIDs []int64) map[int64]bool {
+	if userID == 0 {
+		return map[int64]bool{}
+	}
+	liked, err := l.likeStorage.LikedTargets(ctx, userID, targetIDs)
+	if err != nil {
+		// minor err, show as not liked
+		log.Printf("fails to query liked targets, user_id = %v, err = %v\n", userID, err)
+		return map[int64]bool{}
+	}
+	return liked
+}
+
+func (l *LikeService) markDirty(targetType string, targetID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dirty[targetID] = targetType
+}
+
+// run the write back and reconcile jobs until ctx is done
+func (l *LikeService) Run(ctx context.Context) {
+	flushTicker := time.NewTicker(conf.Global().App.Like.FlushInterval)
+	defer flushTicker.Stop()
+	reconcileTicker := time.NewTicker(conf.Global().App.Like.ReconcileInterval)
+	defer reconcileTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.Flush(context.Background())
+			return
+		case <-flushTicker.C:
+			l.Flush(ctx)
+		case <-reconcileTicker.C:
+			if err := l.Reconcile(ctx); err != nil {
+				log.Printf("fails to reconcile like nums: %v\n", err)
+			}
+		}
+	}
+}
+
+// recount like nums of changed targets, write them to db and cache
+func (l *LikeService) Flush(ctx context.Context) {
+	l.mu.Lock()
+	dirty := l.dirty
+	l.dirty = make(map[int64]string)
+	l.mu.Unlock()
+	if len(dirty) == 0 {
+		return
+	}
+
+	byType := make(map[string][]int64)
+	for targetID, targetType := range dirty {
+		byType[targetType] = append(byType[targetType], targetID)
+	}
+	batchSize := conf.Global().App.Like.BatchSize
+	for targetType, targetIDs := range byType {
+		for start := 0; start < len(targetIDs); start += batchSize {
+			end := start + batchSize
+			if end > len(targetIDs) {
+				end = len(targetIDs)
+			}
+			batch := targetIDs[start:end]
+			if err := l.syncLikeNums(ctx, targetType, batch, true); err != nil {
+				log.Printf("fails to write back like nums, retry later: %v\n", err)
+				for _, targetID := range batch {
+					l.markDirty(targetType, targetID)
+				}
+			}
+		}
+	}
+}
+
+// recount like nums of all posts and replies to repair drift, e.g. changes lost on crash
+func (l *LikeService) Reconcile(ctx context.Context) error {
+	l.Flush(ctx)
+	return l.eachTargets(ctx, func(targetType string, targetIDs []int64) error {
+		return l.syncLikeNums(ctx, targetType, targetIDs, false)
+	})
+}
+
+// a like num in db different from the count of likes
+type LikeDrift struct {
+	TargetType string
+	TargetID   int64
+	LikeNum    int64 // in db
+	Likes      int64 // counted
+}
+
+// compare like nums of all posts and replies with their likes, and overwrite the drifted ones if fix.
+// changes not written back yet by running processes are drifts too, until App.Like.FlushInterval.
+func (l *LikeService) Check(ctx context.Context, fix bool) ([]LikeDrift, error) {
+	l.Flush(ctx)
+	var drifts []LikeDrift
+	err := l.eachTargets(ctx, func(targetType string, targetIDs []int64) error {
+		likeNums := make(map[int64]int64, len(targetIDs))
+		switch targetType {
+		case model.LikeTargetPost:
+			postMs, err := l.postStorage.FetchByPostIDs(ctx, targetIDs)
+			if err != nil {
+				return myerr.OtherErrWarpf(err, "fail to query posts")
+			}
+			for _, postM := range postMs {
+				likeNums[postM.PostID] = postM.LikeNum
+			}
+		case model.LikeTargetReply:
+			replyMs, err := l.replyStorage.FetchByReplyIDs(ctx, targetIDs)
+			if err != nil {
+				return myerr.OtherErrWarpf(err, "fail to query replies")
+			}
+			for _, replyM := range replyMs {
+				likeNums[replyM.ReplyID] = replyM.LikeNum
+			}
+		}
+		counts, err := l.likeStorage.CountByTargets(ctx, targetIDs)
+		if err != nil {
+			return myerr.OtherErrWarpf(err, "fail to count likes")
+		}
+		var drifted []int64
+		for _, targetID := range targetIDs {
+			if likeNums[targetID] != counts[targetID] {
+				drifts = append(drifts, LikeDrift{
+					TargetType: targetType,
+					TargetID:   targetID,
+					LikeNum:    likeNums[targetID],
+					Likes:      counts[targetID],
+				})
+				drifted = append(drifted, targetID)
+			}
+		}
+		if !fix || len(drifted) == 0 {
+			return nil
+		}
+		return l.syncLikeNums(ctx, targetType, drifted, false)
+	})
+	return drifts, err
+}
+
+// call f with IDs of all posts and replies in batches
+func (l *LikeService) eachTargets(ctx context.Context, f func(targetType string, targetIDs []int64) error) error {
+	batchSize := conf.Global().App.Like.BatchSize
+	listers := map[string]func(ctx context.Context, afterID int64, cnt int) ([]int64, error){
+		model.LikeTargetPost:  l.postStorage.ListIDs,
+		model.LikeTargetReply: l.replyStorage.ListIDs,
+	}
+	for targetType, listIDs := range listers {
+		var afterID int64
+		for {
+			targetIDs, err := listIDs(ctx, afterID, batchSize)
+			if err != nil {
+				return myerr.OtherErrWarpf(err, "fail to list %v", targetType)
+			}
+			if len(targetIDs) == 0 {
+				break
+			}
+			if err := f(targetType, targetIDs); err != nil {
+				return err
+			}
+			afterID = targetIDs[len(targetIDs)-1]
+		}
+	}
+	return nil
+}
+
+// recount like nums and write them to db.
+// forceCache: overwrite cache, otherwise only the cached ones are overwritten.
+func (l *LikeService) syncLikeNums(ctx context.Context, targetType string, targetIDs []int64, forceCache bool) error {
+	likeNums, err := l.likeStorage.CountByTargets(ctx, targetIDs)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to count likes")
+	}
+	switch targetType {
+	case model.LikeTargetPost:
+		err = l.postStorage.UpdateLikeNum(ctx, likeNums)
+		if err == nil {
+			// cached posts carry the like num of db, used when the counter is missing
+			l.postCache.InvalidateCounters(ctx, targetIDs...)
+		}
+		if err == nil && forceCache {
+			l.hotService.Refresh(targetIDs...)
+		}
+	case model.LikeTargetReply:
+		err = l.replyStorage.UpdateLikeNum(ctx, likeNums)
+	}
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to update like num of %v", targetType)
+	}
+
+	cacheKeys := make([]string, len(targetIDs))
+	for i, targetID := range targetIDs {
+		cacheKeys[i] = keys.LikeNum(targetID)
+	}
+	var cached []interface{}
+	if !forceCache {
+		cached, err = l.cache.MGet(ctx, cacheKeys...)
+		if err != nil || len(cached) != len(targetIDs) {
+			return nil
+		}
+	}
+	expire := conf.Global().App.Expire.PostInfo
+	for i, targetID := range targetIDs {
+		if !forceCache && cached[i] == nil {
+			continue
+		}
+		_ = l.cache.SetInt64(ctx, cacheKeys[i], likeNums[targetID], expire)
+	}
+	return nil
+}
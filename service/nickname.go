@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"hoyobar/conf"
+	"hoyobar/storage"
+	"hoyobar/util/funcs"
+	"hoyobar/util/mycache"
+	"hoyobar/util/mycache/keys"
+	"hoyobar/util/myerr"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Nicknames are indexed in a lexicographical sorted set for prefix and substring search.
+// Every suffix of a lower-cased nickname is a member "suffix\x00nickname\x00userID",
+// so a substring of the nickname is a prefix of some member.
+
+const (
+	nicknameIndexSep         = "\x00"
+	nicknameRebuildBatchSize = 500
+)
+
+type UserSummary struct {
+	UserID   int64  `json:"user_id,string"`
+	Nickname string `json:"nickname"`
+	Avatar   string `json:"avatar"`
+	Level    int    `json:"level"`
+}
+
+func nicknameIndexMembers(userID int64, nickname string) []string {
+	lower := strings.ToLower(nickname)
+	members := make([]string, 0, utf8.RuneCountInString(lower))
+	for i := range lower { // i is at the start of each rune
+		members = append(members, lower[i:]+nicknameIndexSep+nickname+nicknameIndexSep+funcs.Itoa(userID))
+	}
+	return members
+}
+
+// add the nickname to search index in background
+func (u *UserService) indexNickname(userID int64, nickname string) {
+	funcs.Go(func() {
+		timeout := conf.Global().App.Timeout.Default
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		for _, member := range nicknameIndexMembers(userID, nickname) {
+			if err := u.cache.ZAdd(ctx, keys.NicknameIndex(), 0, member); err != nil {
+				// the index is incomplete, rebuild it when the cache is back
+				_ = u.cache.Del(ctx, keys.NicknameIndexReady())
+				return
+			}
+		}
+	})
+}
+
+// add nicknames of all users to the search index, then mark it ready.
+// the index is not complete before, e.g. users registered before it existed, or after the cache is flushed.
+// a nickname changed during the rebuild may be added back, search results show the current nicknames anyway.
+func (u *UserService) RebuildNicknameIndex(ctx context.Context) error {
+	after := ""
+	for {
+		nicknameMs, err := u.userStorage.ListNicknames(ctx, after, nicknameRebuildBatchSize)
+		if err != nil {
+			return myerr.OtherErrWarpf(err, "fail to list nicknames")
+		}
+		if len(nicknameMs) == 0 {
+			break
+		}
+		for _, nicknameM := range nicknameMs {
+			for _, member := range nicknameIndexMembers(nicknameM.UserID, nicknameM.Nickname) {
+				if err := u.cache.ZAdd(ctx, keys.NicknameIndex(), 0, member); err != nil {
+					return myerr.OtherErrWarpf(err, "fail to index nickname %q", nicknameM.Nickname)
+				}
+			}
+		}
+		after = nicknameMs[len(nicknameMs)-1].Nickname
+	}
+	if err := u.cache.Set(ctx, keys.NicknameIndexReady(), "1", 0); err != nil {
+		return myerr.OtherErrWarpf(err, "fail to mark nickname index ready")
+	}
+	return nil
+}
+
+// rebuild the search index in background if it is not ready, one rebuild at a time in a process
+func (u *UserService) ensureNicknameIndex() {
+	if !atomic.CompareAndSwapInt32(&u.nicknameRebuilding, 0, 1) {
+		return
+	}
+	funcs.Go(func() {
+		defer atomic.StoreInt32(&u.nicknameRebuilding, 0)
+		ctx := context.Background()
+		if _, err := u.cache.Get(ctx, keys.NicknameIndexReady()); err != mycache.ErrNotFound {
+			return
+		}
+		log.Println("rebuilding nickname index")
+		if err := u.RebuildNicknameIndex(ctx); err != nil {
+			log.Printf("fails to rebuild nickname index: %v\n", errors.Unwrap(err))
+			return
+		}
+		log.Println("nickname index rebuilt")
+	})
+}
+
+// remove the nickname from search index in background
+func (u *UserService) unindexNickname(userID int64, nickname string) {
+	funcs.Go(func() {
+		timeout := conf.Global().App.Timeout.Default
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_ = u.cache.ZRem(ctx, keys.NicknameIndex(), nicknameIndexMembers(userID, nickname)...)
+	})
+}
+
+// search users whose nickname contains keyword, case-insensitive.
+// exact matches rank first, then prefix matches, then the others; ties are broken by activity.
+func (u *UserService) SearchNickname(ctx context.Context, keyword string, limit int) ([]UserSummary, error) {
+	keyword = strings.TrimSpace(keyword)
+	if keyword == "" {
+		return nil, myerr.ErrBadReqBody.WithEmsg("搜索内容不能为空")
+	}
+	limit = funcs.Clip(limit, 1, conf.Global().App.MaxPageSize)
+	candidateN := conf.Global().App.NicknameSearch.CandidateN
+
+	candidates := make(map[int64]string) // user ID -> nickname
+	lower := strings.ToLower(keyword)
+	var members []string
+	_, err := u.cache.Get(ctx, keys.NicknameIndexReady())
+	if err == mycache.ErrNotFound {
+		u.ensureNicknameIndex()
+	} else if err == nil {
+		members, err = u.cache.ZRangeByLex(ctx, keys.NicknameIndex(),
+			"["+lower, "["+lower+"\xff", 0, int64(candidateN))
+	}
+	if err == nil {
+		for _, member := range members {
+			segs := strings.SplitN(member, nicknameIndexSep, 3)
+			if len(segs) != 3 {
+				continue
+			}
+			userID, err := funcs.Atoi(segs[2])
+			if err != nil {
+				continue
+			}
+			candidates[userID] = segs[1]
+		}
+	} else {
+		// index is not ready or cache is unavailable, fallback to db
+		log.Printf("fails to search nickname in cache, fallback to db, err = %v\n", err)
+		nicknameMs, err := u.userStorage.SearchNickname(ctx, keyword, candidateN)
+		if err != nil {
+			return nil, myerr.OtherErrWarpf(err, "fail to search nickname %q", keyword)
+		}
+		for _, nicknameM := range nicknameMs {
+			candidates[nicknameM.UserID] = nicknameM.Nickname
+		}
+	}
+	if len(candidates) == 0 {
+		return []UserSummary{}, nil
+	}
+
+	list := make([]UserSummary, 0, len(candidates))
+	userIDs := make([]string, 0, len(candidates))
+	for userID, nickname := range candidates {
+		list = append(list, UserSummary{UserID: userID, Nickname: nickname})
+		userIDs = append(userIDs, funcs.Itoa(userID))
+	}
+	activity := make(map[int64]float64, len(candidates))
+	if scores, err := u.cache.ZMScore(ctx, keys.UserActivity(), userIDs...); err == nil {
+		for i, score := range scores {
+			userID, _ := funcs.Atoi(userIDs[i])
+			activity[userID] = score
+		}
+	}
+	relevance := func(nickname string) int {
+		switch lowerNickname := strings.ToLower(nickname); {
+		case lowerNickname == lower:
+			return 2
+		case strings.HasPrefix(lowerNickname, lower):
+			return 1
+		default:
+			return 0
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		ri, rj := relevance(list[i].Nickname), relevance(list[j].Nickname)
+		if ri != rj {
+			return ri > rj
+		}
+		ai, aj := activity[list[i].UserID], activity[list[j].UserID]
+		if ai != aj {
+			return ai > aj
+		}
+		return list[i].Nickname < list[j].Nickname
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	summaryUserIDs := make([]int64, len(list))
+	for i := range list {
+		summaryUserIDs[i] = list[i].UserID
+	}
+	summaries := u.Summaries(ctx, summaryUserIDs)
+	for i := range list {
+		if summary, ok := summaries[list[i].UserID]; ok {
+			list[i] = summary
+		}
+	}
+	return list, nil
+}
+
+func (u *UserService) ChangeNickname(ctx context.Context, userID int64, nickname string) error {
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" {
+		return myerr.ErrBadReqBody.WithEmsg("昵称不能为空")
+	}
+	userModel, err := u.userStorage.FetchByUserID(ctx, userID)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to find user")
+	}
+	if userModel == nil {
+		return myerr.ErrUserNotFound
+	}
+	oldNickname := userModel.Nickname
+	if oldNickname == nickname {
+		return nil
+	}
+	existUserID, err := u.NicknameToUserID(ctx, nickname)
+	if err != nil {
+		return err
+	}
+	if existUserID != 0 {
+		return myerr.ErrDupUser.WithEmsg("该昵称已被占用")
+	}
+
+	err = u.userStorage.UpdateNickname(ctx, userID, oldNickname, nickname)
+	if errors.Is(err, storage.ErrDuplicate) {
+		return myerr.ErrDupUser.WithEmsg("该昵称已被占用")
+	}
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to update nickname of user %v", userID).
+			WithEmsg("修改昵称失败")
+	}
+	u.forgetUserIDs(ctx, keys.NicknameToUserID(oldNickname), keys.NicknameToUserID(nickname))
+	userModel.Nickname = nickname
+	u.writeCacheUserIDs(ctx, userID, userNameKeys(userModel)...)
+	u.writeCacheUserBasic(ctx, *userBasicOf(userModel))
+	u.unindexNickname(userID, oldNickname)
+	u.indexNickname(userID, nickname)
+	return nil
+}
@@ -6,8 +6,8 @@ import (
 	"hoyobar/model"
 	"hoyobar/storage"
 	"hoyobar/util/funcs"
-	"hoyobar/util/idgen"
 	"hoyobar/util/mycache"
+	"hoyobar/util/mycache/keys"
 	"hoyobar/util/myerr"
 	"log"
 	"strings"
@@ -15,39 +15,67 @@ import (
 )
 
 type PostService struct {
-	cache        mycache.Cache
-	userStorage  storage.UserStorage
-	postStorage  storage.PostStorage
-	replyStorage storage.PostReplyStorage
+	cache           mycache.Cache
+	userService     *UserService
+	userStorage     storage.UserStorage
+	postStorage     storage.PostStorage
+	replyStorage    storage.PostReplyStorage
+	postCache       *PostCache
+	likeService     *LikeService
+	hotService      *HotService
+	reactionService *ReactionService
+	searchService   *SearchService
+	tagService      *TagService
 }
 
 func NewPostService(
 	cache mycache.Cache,
+	userService *UserService,
 	userStorage storage.UserStorage,
 	postStorage storage.PostStorage,
 	replyStorage storage.PostReplyStorage,
+	postCache *PostCache,
+	likeService *LikeService,
+	hotService *HotService,
+	reactionService *ReactionService,
+	searchService *SearchService,
+	tagService *TagService,
 ) *PostService {
-	if conf.Global == nil {
+	if conf.Global() == nil {
 		log.Fatalf("conf.Global is not initialized")
 	}
 	postService := &PostService{
-		cache:        cache,
-		userStorage:  userStorage,
-		postStorage:  postStorage,
-		replyStorage: replyStorage,
+		cache:           cache,
+		userService:     userService,
+		userStorage:     userStorage,
+		postStorage:     postStorage,
+		replyStorage:    replyStorage,
+		postCache:       postCache,
+		likeService:     likeService,
+		hotService:      hotService,
+		reactionService: reactionService,
+		searchService:   searchService,
+		tagService:      tagService,
 	}
 	return postService
 }
 
 type PostDetail struct {
-	PostID         int64     `json:"post_id,string"`
-	AuthorID       int64     `json:"author_id,string"`
-	AuthorNickname string    `json:"author_nickname"`
-	Title          string    `json:"title"`
-	Content        string    `json:"content"`
-	CreatedTime    time.Time `json:"created_at"`
-	ReplyTime      time.Time `json:"reply_time"`
-	ReplyNum       int64     `json:"reply_num"`
+	PostID         int64           `json:"post_id,string"`
+	BoardID        int64           `json:"board_id,string"`
+	AuthorID       int64           `json:"author_id,string"`
+	AuthorNickname string          `json:"author_nickname"`
+	AuthorAvatar   string          `json:"author_avatar"`
+	AuthorLevel    int             `json:"author_level"`
+	Title          string          `json:"title"`
+	Content        string          `json:"content"`
+	CreatedTime    time.Time       `json:"created_at"`
+	ReplyTime      time.Time       `json:"reply_time"`
+	ReplyNum       int64           `json:"reply_num"`
+	LikeNum        int64           `json:"like_num"`
+	Liked          bool            `json:"liked"` // liked by current user
+	Reactions      []ReactionCount `json:"reactions"`
+	Tags           []string        `json:"tags"`
 }
 
 type PostList struct {
@@ -56,69 +84,144 @@ type PostList struct {
 }
 
 type ReplyDetail struct {
-	ReplyID   int64     `json:"reply_id,string"`
-	AuthorID  int64     `json:"author_id,string"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"created_at"`
+	ReplyID         int64           `json:"reply_id,string"`
+	AuthorID        int64           `json:"author_id,string"`
+	AuthorNickname  string          `json:"author_nickname"`
+	AuthorAvatar    string          `json:"author_avatar"`
+	AuthorLevel     int             `json:"author_level"`
+	ParentID        int64           `json:"parent_id,string,omitempty"`
+	ReplyToUserID   int64           `json:"reply_to_user_id,string,omitempty"`
+	ReplyToNickname string          `json:"reply_to_nickname,omitempty"`
+	Content         string          `json:"content"`
+	CreatedAt       time.Time       `json:"created_at"`
+	SubReplyNum     int64           `json:"sub_reply_num"`
+	LikeNum         int64           `json:"like_num"`
+	Liked           bool            `json:"liked"` // liked by current user
+	Reactions       []ReactionCount `json:"reactions"`
+	SubReplies      []ReplyDetail   `json:"sub_replies,omitempty"`
+}
+
+type PostInfo struct {
+	AuthorID int64
+	BoardID  int64 // 0 means no board
+	Title    string
+	Content  string
+	Tags     []string // optional, explicit tags, hashtags in title and content are added too
+}
+
+type ReplyInfo struct {
+	AuthorID      int64
+	PostID        int64
+	ParentID      int64 // optional, reply to a floor
+	ReplyToUserID int64 // optional, the user replied to in a floor
+	Content       string
 }
 
 type ReplyList struct {
-	List   []ReplyDetail `json:"list"`
-	Cursor string        `json:"cursor"`
+	HotList []ReplyDetail `json:"hot_list,omitempty"` // most liked floors, only in the first page
+	List    []ReplyDetail `json:"list"`
+	Cursor  string        `json:"cursor"`
 }
 
-func (p *PostService) Create(ctx context.Context, authorID int64, title string, content string) (postID int64, err error) {
-	postID = idgen.New()
+func (p *PostService) Create(ctx context.Context, args *PostInfo) (postID int64, err error) {
+	authorID := args.AuthorID
+	tags, err := p.tagService.tagsOfPost(args.Tags, args.Title, args.Content)
+	if err != nil {
+		return 0, err
+	}
+	postID = model.NewPostID(args.BoardID)
 	postM := model.Post{
 		PostID:    postID,
+		BoardID:   args.BoardID,
 		AuthorID:  authorID,
-		Title:     title,
-		Content:   content,
-		ReplyTime: time.Now(),
+		Title:     args.Title,
+		Content:   args.Content,
+		ReplyTime: model.Now(),
 		ReplyNum:  0,
 	}
 	err = p.postStorage.Create(ctx, &postM)
 	if err != nil {
 		return 0, myerr.OtherErrWarpf(err, "fail to create post data")
 	}
+	err = p.tagService.save(ctx, &postM, tags)
+	if err != nil {
+		// minor err, log and ignore
+		log.Printf("fails to save post tags, post_id = %v: %v\n", postID, err)
+	}
+	p.postCache.AddToTimelines(ctx, &postM)
+	p.hotService.Refresh(postID)
+	p.searchService.IndexPost(&postM)
+	p.addUserActivity(ctx, authorID)
 	return postID, nil
 }
 
-func (p *PostService) Detail(ctx context.Context, postID int64) (detail *PostDetail, err error) {
-	postM, err := p.postStorage.FetchByPostID(ctx, postID)
+// record a post or reply of the user, for ranking in nickname search
+func (p *PostService) addUserActivity(ctx context.Context, userID int64) {
+	_ = p.cache.ZIncrBy(ctx, keys.UserActivity(), 1, funcs.Itoa(userID))
+}
+
+// viewerID: current user, 0 if not login
+func (p *PostService) Detail(ctx context.Context, viewerID int64, postID int64) (detail *PostDetail, err error) {
+	postM, err := p.postCache.Fetch(ctx, postID)
 	if err != nil {
 		return nil, myerr.OtherErrWarpf(err, "fail to query post %v", postID)
 	}
 	if postM == nil {
 		return nil, myerr.ErrResourceNotFound.WithEmsg("帖子不存在")
 	}
-	var authorNickname string
-	author, err := p.userStorage.FetchByUserID(ctx, postM.AuthorID)
-	if err != nil && author != nil {
-		authorNickname = author.Nickname
-	}
-	return &PostDetail{
-		PostID:         postID,
-		AuthorID:       postM.AuthorID,
-		AuthorNickname: authorNickname,
-		Title:          postM.Title,
-		Content:        postM.Content,
-		CreatedTime:    postM.CreatedAt,
-		ReplyTime:      postM.ReplyTime,
-		ReplyNum:       postM.ReplyNum,
-	}, nil
+	details := []PostDetail{{
+		PostID:      postID,
+		BoardID:     postM.BoardID,
+		AuthorID:    postM.AuthorID,
+		Title:       postM.Title,
+		Content:     postM.Content,
+		CreatedTime: postM.CreatedAt,
+		ReplyTime:   postM.ReplyTime,
+		ReplyNum:    postM.ReplyNum,
+		LikeNum:     postM.LikeNum,
+	}}
+	p.fillPostInteractions(ctx, viewerID, details)
+	return &details[0], nil
 }
 
-// order: one of "create_time" and "reply_time", desc order
+// viewerID: current user, 0 if not login
+// boardID: only posts in the board, 0 means all boards
+// tag: only posts with the tag, "" means no filter. only supports "create_time" order
+// order: one of "create_time", "reply_time" and "hot", desc order
 // cursor: the cursor returned by last call with the same params
-func (p *PostService) List(ctx context.Context, order string, cursor string, pageSize int) (list *PostList, err error) {
+func (p *PostService) List(ctx context.Context, viewerID int64, boardID int64, tag string, order string, cursor string, pageSize int) (list *PostList, err error) {
 	if pageSize <= 0 {
 		return nil, myerr.ErrBadReqBody.WithEmsg("页为空")
 	}
-	pageSize = funcs.Min(pageSize, conf.Global.App.MaxPageSize)
-	postMs, newCursor, err := p.postStorage.List(ctx, order, cursor, pageSize)
-	if err != nil {
-		return nil, myerr.OtherErrWarpf(err, "fail to query posts")
+	pageSize = funcs.Min(pageSize, conf.Global().App.MaxPageSize)
+	if tag != "" {
+		tag = NormalizeTag(tag)
+		if tag == "" {
+			return nil, myerr.ErrBadReqBody.WithEmsg("不合法的标签")
+		}
+		if order != storage.PostOrderCreateTimeDesc {
+			return nil, myerr.ErrBadReqBody.WithEmsg("按标签筛选时只支持按发帖时间排序")
+		}
+	}
+	var postMs []*model.Post
+	var newCursor string
+	if order == storage.PostOrderHotDesc {
+		postMs, newCursor, err = p.hotService.List(ctx, boardID, cursor, pageSize)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ok := false
+		if tag == "" {
+			postMs, newCursor, ok = p.postCache.ListTimeline(ctx, boardID, order, cursor, pageSize)
+		}
+		if !ok {
+			filter := &storage.PostFilter{BoardID: boardID, Tag: tag}
+			postMs, newCursor, err = p.postStorage.List(ctx, filter, order, cursor, pageSize)
+			if err != nil {
+				return nil, myerr.OtherErrWarpf(err, "fail to query posts")
+			}
+		}
 	}
 	if len(postMs) == 0 {
 		return nil, myerr.ErrNoMoreEntry.WithEmsg("没有更多帖子了")
@@ -127,20 +230,58 @@ func (p *PostService) List(ctx context.Context, order string, cursor string, pag
 	for _, post := range postMs {
 		list.List = append(list.List, PostDetail{
 			PostID:      post.PostID,
+			BoardID:     post.BoardID,
 			AuthorID:    post.AuthorID,
 			Title:       post.Title,
 			Content:     post.Content,
 			CreatedTime: post.CreatedAt,
 			ReplyTime:   post.ReplyTime,
 			ReplyNum:    post.ReplyNum,
+			LikeNum:     post.LikeNum,
 		})
 	}
+	p.fillPostInteractions(ctx, viewerID, list.List)
 	return list, nil
 }
 
-func (p *PostService) Reply(ctx context.Context, authorID int64, postID int64, content string) (replyID int64, err error) {
+// check the user replied to in the floor of parent is its author or has written a sub-reply in it
+func (p *PostService) checkReplyTo(ctx context.Context, parent *model.PostReply, userID int64) error {
+	floorID := parent.ReplyID
+	inFloor := parent.AuthorID == userID
+	if parent.ParentID != 0 {
+		floorID = parent.ParentID
+		if !inFloor {
+			floor, err := p.replyStorage.FetchByReplyID(ctx, floorID)
+			if err != nil {
+				return myerr.OtherErrWarpf(err, "fail to query reply %v", floorID)
+			}
+			inFloor = floor != nil && floor.AuthorID == userID
+		}
+	}
+	if !inFloor {
+		var err error
+		inFloor, err = p.replyStorage.HasSubReplyBy(ctx, floorID, userID)
+		if err != nil {
+			return myerr.OtherErrWarpf(err, "fail to query sub-replies of reply %v", floorID)
+		}
+	}
+	if !inFloor {
+		return myerr.ErrBadReqBody.WithEmsg("回复的用户不在该楼层中")
+	}
+	userExist, err := p.userStorage.HasUser(ctx, userID)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to query user %v", userID)
+	}
+	if !userExist {
+		return myerr.ErrResourceNotFound.WithEmsg("回复的用户不存在")
+	}
+	return nil
+}
+
+func (p *PostService) Reply(ctx context.Context, args *ReplyInfo) (replyID int64, err error) {
+	authorID, postID := args.AuthorID, args.PostID
 	// check params
-	content = strings.TrimSpace(content)
+	content := strings.TrimSpace(args.Content)
 	if content == "" {
 		return 0, myerr.ErrBadReqBody.WithEmsg("内容不能为空")
 	}
@@ -151,68 +292,365 @@ func (p *PostService) Reply(ctx context.Context, authorID int64, postID int64, c
 	if !userExist {
 		return 0, myerr.ErrResourceNotFound.WithEmsg("用户不存在")
 	}
-	postExist, err := p.postStorage.HasPost(ctx, postID)
+	postM, err := p.postCache.Fetch(ctx, postID)
 	if err != nil {
-		return 0, err
+		return 0, myerr.OtherErrWarpf(err, "fail to query post %v", postID)
 	}
-	if !postExist {
+	if postM == nil {
 		return 0, myerr.ErrResourceNotFound.WithEmsg("帖子不存在")
 	}
+	if args.ReplyToUserID != 0 && args.ParentID == 0 {
+		return 0, myerr.ErrBadReqBody.WithEmsg("只有楼中楼回复可以指定回复的用户")
+	}
 
 	// create reply
 	replyM := model.PostReply{
-		ReplyID:  idgen.New(),
-		AuthorID: authorID,
-		PostID:   postID,
-		Content:  content,
+		ReplyID:       model.NewReplyID(postID),
+		AuthorID:      authorID,
+		PostID:        postID,
+		ReplyToUserID: args.ReplyToUserID,
+		Content:       content,
+	}
+	if args.ParentID != 0 {
+		parent, err := p.replyStorage.FetchByReplyID(ctx, args.ParentID)
+		if err != nil {
+			return 0, myerr.OtherErrWarpf(err, "fail to query reply %v", args.ParentID)
+		}
+		if parent == nil || parent.PostID != postID {
+			return 0, myerr.ErrResourceNotFound.WithEmsg("回复不存在")
+		}
+		replyM.ParentID = parent.ReplyID
+		if parent.ParentID != 0 {
+			// reply to a sub-reply, it still belongs to the floor
+			replyM.ParentID = parent.ParentID
+			if replyM.ReplyToUserID == 0 {
+				replyM.ReplyToUserID = parent.AuthorID
+			}
+		}
+		if args.ReplyToUserID != 0 {
+			if err := p.checkReplyTo(ctx, parent, args.ReplyToUserID); err != nil {
+				return 0, err
+			}
+		}
 	}
 	err = p.replyStorage.Create(ctx, &replyM)
 	if err != nil {
 		return 0, myerr.OtherErrWarpf(err, "fail to create post reply")
 	}
+	p.searchService.IndexReply(&replyM, postM.BoardID)
+	p.addUserActivity(ctx, authorID)
+
+	if replyM.ParentID != 0 {
+		err = p.replyStorage.IncrementSubReplyNum(ctx, replyM.ParentID, 1)
+		if err != nil {
+			// minor err, log and ignore
+			log.Printf("fails to update sub-reply num, reply_id = %v\n", replyM.ParentID)
+		}
+		if conf.Global().App.SubReply.BumpPost {
+			replyTime, err := p.postStorage.UpdateReplyTime(ctx, postID)
+			if err != nil {
+				log.Printf("fails to update reply time, post_id = %v\n", postID)
+			}
+			p.postCache.InvalidateReply(ctx, postID)
+			if err == nil {
+				p.postCache.TouchReplied(ctx, postM, replyTime)
+			}
+		}
+		return replyM.ReplyID, nil
+	}
 
 	// update post's reply time
-	err = p.postStorage.IncrementReplyNum(ctx, postID, 1)
+	replyTime, err := p.postStorage.IncrementReplyNum(ctx, postID, 1)
 	if err != nil {
 		// minor err, log and ignore
 		log.Printf("fails to update reply time, post_id = %v\n", postID)
 	}
+	p.postCache.InvalidateReply(ctx, postID)
+	if err == nil {
+		// scored with the stored time, so the timeline agrees with the db order
+		p.postCache.TouchReplied(ctx, postM, replyTime)
+	}
+	p.hotService.Refresh(postID)
 
 	return replyM.ReplyID, nil
 }
 
-func (p *PostService) ListReply(ctx context.Context, postID int64, cursor string, pageSize int) (list *ReplyList, err error) {
+type ReplyFilter struct {
+	AuthorID   int64 // only floors written by this user, 0 means no filter
+	OnlyPoster bool  // only floors written by the post's author ("只看楼主"), overrides AuthorID
+}
+
+// viewerID: current user, 0 if not login
+// filter: optional, nil means all floors
+func (p *PostService) ListReply(ctx context.Context, viewerID int64, postID int64, filter *ReplyFilter, cursor string, pageSize int) (list *ReplyList, err error) {
 	// check params
 	if pageSize <= 0 {
 		return nil, myerr.ErrBadReqBody.WithEmsg("页为空")
 	}
-	pageSize = funcs.Min(pageSize, conf.Global.App.MaxPageSize)
+	pageSize = funcs.Min(pageSize, conf.Global().App.MaxPageSize)
 
-	postExist, err := p.postStorage.HasPost(ctx, postID)
+	postM, err := p.postCache.Fetch(ctx, postID)
 	if err != nil {
-		return nil, err
+		return nil, myerr.OtherErrWarpf(err, "fail to query post %v", postID)
 	}
-	if !postExist {
+	if postM == nil {
 		return nil, myerr.ErrResourceNotFound.WithEmsg("帖子不存在")
 	}
+	var authorID int64
+	if filter != nil && filter.OnlyPoster {
+		authorID = postM.AuthorID
+	} else if filter != nil {
+		authorID = filter.AuthorID
+	}
 
 	// find replies
-	replies, newCursor, err := p.replyStorage.List(ctx, postID, storage.PostReplyOrderCreateTimeDesc, cursor, pageSize)
+	var replies []*model.PostReply
+	var newCursor string
+	order := storage.PostReplyOrderCreateTimeDesc
+	if authorID != 0 {
+		replies, newCursor, err = p.replyStorage.ListByAuthor(ctx, postID, authorID, order, cursor, pageSize)
+	} else {
+		replies, newCursor, err = p.replyStorage.List(ctx, postID, order, cursor, pageSize)
+	}
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to query post reply")
+	}
 	if len(replies) == 0 {
 		return nil, myerr.ErrNoMoreEntry
 	}
+
+	list = &ReplyList{Cursor: newCursor}
+	var withSub []int64
+	for _, reply := range replies {
+		if reply.SubReplyNum > 0 {
+			withSub = append(withSub, reply.ReplyID)
+		}
+	}
+	subReplies, err := p.replyStorage.ListSubPreview(ctx, postID, withSub, conf.Global().App.SubReply.PreviewN)
 	if err != nil {
-		return nil, myerr.OtherErrWarpf(err, "fail to query post reply")
+		// minor err, the floors are still readable
+		log.Printf("fails to query sub-replies, post_id = %v, err = %v\n", postID, err)
+	}
+	for _, reply := range replies {
+		detail := replyDetailOf(reply)
+		for _, subReply := range subReplies[reply.ReplyID] {
+			detail.SubReplies = append(detail.SubReplies, replyDetailOf(subReply))
+		}
+		list.List = append(list.List, detail)
+	}
+	if cursor == "" && authorID == 0 {
+		list.HotList = p.hotReplies(ctx, postID)
+	}
+	p.fillReplyInteractions(ctx, viewerID, postM.BoardID, list.HotList, list.List)
+	return list, nil
+}
+
+// most liked floors of a post, pinned above the normal floor list
+func (p *PostService) hotReplies(ctx context.Context, postID int64) []ReplyDetail {
+	topN := conf.Global().App.Hot.ReplyTopN
+	if topN <= 0 {
+		return nil
+	}
+	replies, err := p.replyStorage.ListHot(ctx, postID, topN)
+	if err != nil {
+		// minor err, the floors are still readable
+		log.Printf("fails to query hot replies, post_id = %v, err = %v\n", postID, err)
+		return nil
+	}
+	hotList := make([]ReplyDetail, 0, len(replies))
+	for _, reply := range replies {
+		hotList = append(hotList, replyDetailOf(reply))
+	}
+	return hotList
+}
+
+// list sub-replies under a floor in chronological order
+func (p *PostService) ListSubReply(ctx context.Context, viewerID int64, replyID int64, cursor string, pageSize int) (list *ReplyList, err error) {
+	// check params
+	if pageSize <= 0 {
+		return nil, myerr.ErrBadReqBody.WithEmsg("页为空")
+	}
+	pageSize = funcs.Min(pageSize, conf.Global().App.MaxPageSize)
+
+	floor, err := p.replyStorage.FetchByReplyID(ctx, replyID)
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to query reply %v", replyID)
+	}
+	if floor == nil || floor.ParentID != 0 {
+		return nil, myerr.ErrResourceNotFound.WithEmsg("回复不存在")
+	}
+	postM, err := p.postCache.Fetch(ctx, floor.PostID)
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to query post %v", floor.PostID)
+	}
+	if postM == nil {
+		return nil, myerr.ErrResourceNotFound.WithEmsg("帖子不存在")
+	}
+
+	replies, newCursor, err := p.replyStorage.ListSub(ctx, replyID, storage.PostReplyOrderCreateTimeAsc, cursor, pageSize)
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to query sub-reply")
+	}
+	if len(replies) == 0 {
+		return nil, myerr.ErrNoMoreEntry
 	}
 
 	list = &ReplyList{Cursor: newCursor}
 	for _, reply := range replies {
-		list.List = append(list.List, ReplyDetail{
-			ReplyID:   reply.ReplyID,
-			AuthorID:  reply.AuthorID,
-			Content:   reply.Content,
-			CreatedAt: reply.CreatedAt,
-		})
+		list.List = append(list.List, replyDetailOf(reply))
 	}
+	p.fillReplyInteractions(ctx, viewerID, postM.BoardID, list.List)
 	return list, nil
 }
+
+// delete a reply written by userID, deleting a floor hides its sub-replies
+func (p *PostService) DeleteReply(ctx context.Context, userID int64, replyID int64) error {
+	replyM, err := p.replyStorage.FetchByReplyID(ctx, replyID)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to query reply %v", replyID)
+	}
+	if replyM == nil {
+		return myerr.ErrResourceNotFound.WithEmsg("回复不存在")
+	}
+	if replyM.AuthorID != userID {
+		return myerr.ErrAuth.WithEmsg("无操作权限")
+	}
+	deleted, err := p.replyStorage.Delete(ctx, replyID)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to delete reply %v", replyID)
+	}
+	if deleted == 0 {
+		// deleted by a concurrent request, which updated the counters
+		return nil
+	}
+	// sub-replies left in index are dropped when reading from db
+	p.searchService.Remove(replyID)
+	if replyM.ParentID == 0 {
+		// reply_num counts floors, sub-replies deleted with the floor were never counted
+		_, err = p.postStorage.IncrementReplyNum(ctx, replyM.PostID, -1)
+		if err != nil {
+			// minor err, log and ignore
+			log.Printf("fails to update reply num, post_id = %v\n", replyM.PostID)
+		}
+		p.postCache.InvalidateReply(ctx, replyM.PostID)
+		p.hotService.Refresh(replyM.PostID)
+	} else {
+		err = p.replyStorage.IncrementSubReplyNum(ctx, replyM.ParentID, -1)
+		if err != nil {
+			// minor err, log and ignore
+			log.Printf("fails to update sub-reply num, reply_id = %v\n", replyM.ParentID)
+		}
+	}
+	return nil
+}
+
+// delete a post, for operators, so there is no permission check.
+// its replies are left in db, they are hidden with the post.
+func (p *PostService) Delete(ctx context.Context, postID int64) error {
+	postM, err := p.postStorage.FetchByPostID(ctx, postID)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to query post %v", postID)
+	}
+	if postM == nil {
+		return myerr.ErrResourceNotFound.WithEmsg("帖子不存在")
+	}
+	err = p.postStorage.Delete(ctx, postID)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to delete post %v", postID)
+	}
+	// replies left in index are dropped when reading from db
+	p.searchService.Remove(postID)
+	if err := p.postCache.Remove(ctx, postM); err != nil {
+		return myerr.OtherErrWarpf(err, "fail to remove post %v from cache, it is shown until the cache expires", postID)
+	}
+	if err := p.hotService.Remove(ctx, postM); err != nil {
+		return myerr.OtherErrWarpf(err, "fail to remove post %v from hot lists", postID)
+	}
+	return nil
+}
+
+func replyDetailOf(reply *model.PostReply) ReplyDetail {
+	return ReplyDetail{
+		ReplyID:       reply.ReplyID,
+		AuthorID:      reply.AuthorID,
+		ParentID:      reply.ParentID,
+		ReplyToUserID: reply.ReplyToUserID,
+		Content:       reply.Content,
+		CreatedAt:     reply.CreatedAt,
+		SubReplyNum:   reply.SubReplyNum,
+		LikeNum:       reply.LikeNum,
+	}
+}
+
+// fill authors, likes, reactions and tags, LikeNum of details should be the one in db
+func (p *PostService) fillPostInteractions(ctx context.Context, viewerID int64, details []PostDetail) {
+	dbLikeNums := make(map[int64]int64, len(details))
+	boardIDs := make(map[int64]int64, len(details))
+	postIDs := make([]int64, 0, len(details))
+	authorIDs := make([]int64, 0, len(details))
+	for _, detail := range details {
+		dbLikeNums[detail.PostID] = detail.LikeNum
+		boardIDs[detail.PostID] = detail.BoardID
+		postIDs = append(postIDs, detail.PostID)
+		authorIDs = append(authorIDs, detail.AuthorID)
+	}
+	authors := p.userService.Summaries(ctx, authorIDs)
+	likeNums := p.likeService.LikeNums(ctx, dbLikeNums)
+	liked := p.likeService.LikedBy(ctx, viewerID, postIDs)
+	reactions := p.reactionService.Summaries(ctx, viewerID, boardIDs)
+	tags := p.tagService.tagsOfPosts(ctx, postIDs)
+	for i := range details {
+		author := authors[details[i].AuthorID]
+		details[i].AuthorNickname = author.Nickname
+		details[i].AuthorAvatar = author.Avatar
+		details[i].AuthorLevel = author.Level
+		details[i].LikeNum = likeNums[details[i].PostID]
+		details[i].Liked = liked[details[i].PostID]
+		details[i].Reactions = reactions[details[i].PostID]
+		details[i].Tags = tags[details[i].PostID]
+		if details[i].Tags == nil {
+			details[i].Tags = []string{}
+		}
+	}
+}
+
+// fill authors, likes and reactions of replies and their sub-replies in a board,
+// LikeNum of details should be the one in db
+func (p *PostService) fillReplyInteractions(ctx context.Context, viewerID int64, boardID int64, lists ...[]ReplyDetail) {
+	dbLikeNums := make(map[int64]int64)
+	boardIDs := make(map[int64]int64)
+	replyIDs := make([]int64, 0)
+	userIDs := make([]int64, 0)
+	walkReplyDetails(lists, func(detail *ReplyDetail) {
+		dbLikeNums[detail.ReplyID] = detail.LikeNum
+		boardIDs[detail.ReplyID] = boardID
+		replyIDs = append(replyIDs, detail.ReplyID)
+		userIDs = append(userIDs, detail.AuthorID)
+		if detail.ReplyToUserID != 0 {
+			userIDs = append(userIDs, detail.ReplyToUserID)
+		}
+	})
+	users := p.userService.Summaries(ctx, userIDs)
+	likeNums := p.likeService.LikeNums(ctx, dbLikeNums)
+	liked := p.likeService.LikedBy(ctx, viewerID, replyIDs)
+	reactions := p.reactionService.Summaries(ctx, viewerID, boardIDs)
+	walkReplyDetails(lists, func(detail *ReplyDetail) {
+		author := users[detail.AuthorID]
+		detail.AuthorNickname = author.Nickname
+		detail.AuthorAvatar = author.Avatar
+		detail.AuthorLevel = author.Level
+		detail.ReplyToNickname = users[detail.ReplyToUserID].Nickname
+		detail.LikeNum = likeNums[detail.ReplyID]
+		detail.Liked = liked[detail.ReplyID]
+		detail.Reactions = reactions[detail.ReplyID]
+	})
+}
+
+func walkReplyDetails(lists [][]ReplyDetail, f func(detail *ReplyDetail)) {
+	for _, details := range lists {
+		for i := range details {
+			f(&details[i])
+			walkReplyDetails([][]ReplyDetail{details[i].SubReplies}, f)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"hoyobar/storage"
+	"hoyobar/util/funcs"
+	"hoyobar/util/mycache"
+	"hoyobar/util/mycache/keys"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PostCache is a read-through cache of posts, and the latest created/replied timelines of boards.
+//
+// A post is cached in 4 parts: basic info, content, reply num and reply time.
+// Replies only invalidate the last two, so the large content is rarely rewritten.
+// Basic info holds like num and hot score too, it is invalidated when they are written back.
+//
+// A timeline is a sorted set of post IDs scored by time in ms, trimmed to App.Timeline.Size.
+// Posts are only added at the newest end, and only the oldest end is trimmed,
+// so the set always contains every post newer than its oldest member,
+// and a page inside it is the same as the one from db.
+type PostCache struct {
+	cache       mycache.Cache
+	postStorage storage.PostStorage
+}
+
+func NewPostCache(cache mycache.Cache, postStorage storage.PostStorage) *PostCache {
+	if conf.Global() == nil {
+		log.Fatalf("conf.Global is not initialized")
+	}
+	return &PostCache{
+		cache:       cache,
+		postStorage: postStorage,
+	}
+}
+
+type postBasicCache struct {
+	PostID    int64     `json:"post_id"`
+	BoardID   int64     `json:"board_id"`
+	AuthorID  int64     `json:"author_id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	LikeNum   int64     `json:"like_num"` // may be stale, see LikeService.LikeNums
+	HotScore  float64   `json:"hot_score"`
+}
+
+const postCacheKeyN = 4
+
+func postCacheKeys(postID int64) []string {
+	return []string{
+		keys.PostBasic(postID),
+		keys.PostContent(postID),
+		keys.PostReplyNum(postID),
+		keys.PostReplyTime(postID),
+	}
+}
+
+func postCacheExpire() time.Duration {
+	return mycache.RandomExpire(conf.Global().App.Expire.PostInfo, conf.Global().App.Expire.Jitter)
+}
+
+// nil if the post not exists
+func (c *PostCache) Fetch(ctx context.Context, postID int64) (*model.Post, error) {
+	postMs, err := c.FetchMany(ctx, []int64{postID})
+	if err != nil || len(postMs) == 0 {
+		return nil, err
+	}
+	return postMs[0], nil
+}
+
+// posts in the order of postIDs, posts not exist are skipped
+func (c *PostCache) FetchMany(ctx context.Context, postIDs []int64) ([]*model.Post, error) {
+	if len(postIDs) == 0 {
+		return nil, nil
+	}
+	cacheKeys := make([]string, 0, len(postIDs)*postCacheKeyN)
+	for _, postID := range postIDs {
+		cacheKeys = append(cacheKeys, postCacheKeys(postID)...)
+	}
+	values, err := c.cache.MGet(ctx, cacheKeys...)
+	if err != nil || len(values) != len(cacheKeys) {
+		values = make([]interface{}, len(cacheKeys)) // treat all as missing
+	}
+
+	postByID := make(map[int64]*model.Post, len(postIDs))
+	var missIDs []int64
+	for i, postID := range postIDs {
+		postM := parsePostCache(values[i*postCacheKeyN : (i+1)*postCacheKeyN])
+		if postM == nil {
+			missIDs = append(missIDs, postID)
+			continue
+		}
+		postByID[postID] = postM
+	}
+	if len(missIDs) > 0 {
+		postMs, err := c.postStorage.FetchByPostIDs(ctx, missIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, postM := range postMs {
+			postByID[postM.PostID] = postM
+		}
+		c.write(ctx, postMs)
+	}
+
+	list := make([]*model.Post, 0, len(postIDs))
+	for _, postID := range postIDs {
+		if postM, ok := postByID[postID]; ok {
+			list = append(list, postM)
+		}
+	}
+	return list, nil
+}
+
+// nil if any part is missing
+func parsePostCache(values []interface{}) *model.Post {
+	var strs [postCacheKeyN]string
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil
+		}
+		strs[i] = s
+	}
+	basic := postBasicCache{}
+	if err := json.Unmarshal([]byte(strs[0]), &basic); err != nil {
+		return nil
+	}
+	replyNum, err := strconv.ParseInt(strs[2], 10, 64)
+	if err != nil {
+		return nil
+	}
+	replyTime, err := strconv.ParseInt(strs[3], 10, 64)
+	if err != nil {
+		return nil
+	}
+	postM := &model.Post{
+		PostID:    basic.PostID,
+		BoardID:   basic.BoardID,
+		AuthorID:  basic.AuthorID,
+		Title:     basic.Title,
+		Content:   strs[1],
+		ReplyNum:  replyNum,
+		ReplyTime: time.UnixMilli(replyTime),
+		LikeNum:   basic.LikeNum,
+		HotScore:  basic.HotScore,
+	}
+	postM.CreatedAt = basic.CreatedAt
+	return postM
+}
+
+// write posts read from db to cache.
+// it is not done in background, or it may overwrite an invalidation after the read in the same request.
+func (c *PostCache) write(ctx context.Context, postMs []*model.Post) {
+	for _, postM := range postMs {
+		basic, err := json.Marshal(postBasicCache{
+			PostID:    postM.PostID,
+			BoardID:   postM.BoardID,
+			AuthorID:  postM.AuthorID,
+			Title:     postM.Title,
+			CreatedAt: postM.CreatedAt,
+			LikeNum:   postM.LikeNum,
+			HotScore:  postM.HotScore,
+		})
+		if err != nil {
+			continue
+		}
+		expire := postCacheExpire()
+		// basic info last, a post is read from cache only if all parts are there
+		_ = c.cache.SetInt64(ctx, keys.PostReplyNum(postM.PostID), postM.ReplyNum, expire)
+		_ = c.cache.SetInt64(ctx, keys.PostReplyTime(postM.PostID), postM.ReplyTime.UnixMilli(), expire)
+		_ = c.cache.Set(ctx, keys.PostContent(postM.PostID), postM.Content, expire)
+		_ = c.cache.Set(ctx, keys.PostBasic(postM.PostID), string(basic), expire)
+	}
+}
+
+// invalidate reply num and reply time after the post is replied
+func (c *PostCache) InvalidateReply(ctx context.Context, postID int64) {
+	_ = c.cache.Del(ctx, keys.PostReplyNum(postID), keys.PostReplyTime(postID))
+}
+
+// invalidate basic info after like nums or hot scores of the posts are written to db
+func (c *PostCache) InvalidateCounters(ctx context.Context, postIDs ...int64) {
+	if len(postIDs) == 0 {
+		return
+	}
+	cacheKeys := make([]string, len(postIDs))
+	for i, postID := range postIDs {
+		cacheKeys[i] = keys.PostBasic(postID)
+	}
+	_ = c.cache.Del(ctx, cacheKeys...)
+}
+
+// evict a deleted post, and remove it from the timelines
+func (c *PostCache) Remove(ctx context.Context, postM *model.Post) error {
+	if err := c.cache.Del(ctx, postCacheKeys(postM.PostID)...); err != nil {
+		return err
+	}
+	for _, boardID := range timelineBoards(postM.BoardID) {
+		for _, key := range []string{keys.PostLatestCreated(boardID), keys.PostLatestReplied(boardID)} {
+			if err := c.cache.ZRem(ctx, key, funcs.Itoa(postM.PostID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add a new post to the timelines of its board and of all posts
+func (c *PostCache) AddToTimelines(ctx context.Context, postM *model.Post) {
+	for _, boardID := range timelineBoards(postM.BoardID) {
+		c.addToTimeline(ctx, keys.PostLatestCreated(boardID), postM.PostID, postM.CreatedAt)
+		c.addToTimeline(ctx, keys.PostLatestReplied(boardID), postM.PostID, postM.ReplyTime)
+	}
+}
+
+// move a replied post to the newest end of the replied timelines
+func (c *PostCache) TouchReplied(ctx context.Context, postM *model.Post, replyTime time.Time) {
+	for _, boardID := range timelineBoards(postM.BoardID) {
+		c.addToTimeline(ctx, keys.PostLatestReplied(boardID), postM.PostID, replyTime)
+	}
+}
+
+func timelineBoards(boardID int64) []int64 {
+	if boardID == 0 {
+		return []int64{0}
+	}
+	return []int64{0, boardID}
+}
+
+func (c *PostCache) addToTimeline(ctx context.Context, key string, postID int64, t time.Time) {
+	err := c.cache.ZAdd(ctx, key, float64(t.UnixMilli()), funcs.Itoa(postID))
+	if err != nil {
+		// a post missing in the middle breaks the timeline, rebuild it on next read
+		_ = c.cache.Del(ctx, key)
+		return
+	}
+	_ = c.cache.ZRemRangeByRank(ctx, key, 0, -int64(conf.Global().App.Timeline.Size)-1)
+}
+
+// page posts of a board ordered by created time or reply time desc, with the cursor format of PostStorage.List.
+// ok is false if the page is not fully inside the timeline, the caller should read from db instead.
+func (c *PostCache) ListTimeline(ctx context.Context, boardID int64, order string, cursor string, cnt int) (list []*model.Post, newCursor string, ok bool) {
+	var key string
+	switch order {
+	case storage.PostOrderCreateTimeDesc:
+		key = keys.PostLatestCreated(boardID)
+	case storage.PostOrderReplyTimeDesc:
+		key = keys.PostLatestReplied(boardID)
+	default:
+		return nil, "", false
+	}
+	filter := &storage.PostFilter{BoardID: boardID}
+	lastID, lastTime, err := storage.DecomposePostListCursor(filter, cursor)
+	if err != nil {
+		return nil, "", false
+	}
+	lastScore := float64(lastTime.UnixMilli())
+
+	postIDs, scores := c.readTimeline(ctx, key, cursor, lastScore, lastID, cnt)
+	if len(postIDs) == 0 && cursor == "" {
+		// the timeline is missing, a partial one is not rebuilt as the site may just have few posts
+		if err := c.rebuildTimeline(ctx, key, boardID, order); err != nil {
+			return nil, "", false
+		}
+		postIDs, scores = c.readTimeline(ctx, key, cursor, lastScore, lastID, cnt)
+	}
+	if len(postIDs) < cnt {
+		return nil, "", false
+	}
+
+	list, err = c.FetchMany(ctx, postIDs)
+	if err != nil || len(list) == 0 {
+		return nil, "", false
+	}
+	n := len(postIDs)
+	newCursor = storage.ComposePostListCursor(filter, postIDs[n-1], time.UnixMilli(int64(scores[n-1])))
+	return list, newCursor, true
+}
+
+// read at most cnt posts after (lastScore, lastID) in the timeline
+func (c *PostCache) readTimeline(ctx context.Context, key string, cursor string, lastScore float64, lastID int64, cnt int) (postIDs []int64, scores []float64) {
+	max := "+inf"
+	if cursor != "" {
+		max = strconv.FormatFloat(lastScore, 'f', -1, 64)
+	}
+	// read some more, for posts with the same score as the cursor
+	fetchN := cnt + 16
+	members, err := c.cache.ZRevRangeByScore(ctx, key, max, "-inf", 0, int64(fetchN))
+	if err != nil {
+		return nil, nil
+	}
+	if len(members) == fetchN {
+		// posts with the lowest score may be cut off in the middle,
+		// and the order of the same score is not guaranteed to be the same as db
+		lowest := members[len(members)-1].Score
+		for len(members) > 0 && members[len(members)-1].Score == lowest {
+			members = members[:len(members)-1]
+		}
+	}
+	type entry struct {
+		postID int64
+		score  float64
+	}
+	entries := make([]entry, 0, len(members))
+	for _, member := range members {
+		postID, err := funcs.Atoi(member.Member)
+		if err != nil {
+			continue
+		}
+		if cursor != "" && member.Score == lastScore && postID >= lastID {
+			continue
+		}
+		entries = append(entries, entry{postID: postID, score: member.Score})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].score != entries[j].score {
+			return entries[i].score > entries[j].score
+		}
+		return entries[i].postID > entries[j].postID
+	})
+	for i := 0; i < len(entries) && i < cnt; i++ {
+		postIDs = append(postIDs, entries[i].postID)
+		scores = append(scores, entries[i].score)
+	}
+	return postIDs, scores
+}
+
+// fill the timeline with latest posts in db
+func (c *PostCache) rebuildTimeline(ctx context.Context, key string, boardID int64, order string) error {
+	size := conf.Global().App.Timeline.Size
+	filter := &storage.PostFilter{BoardID: boardID}
+	cursor := ""
+	for n := 0; n < size; {
+		postMs, newCursor, err := c.postStorage.List(ctx, filter, order, cursor, size-n)
+		if err != nil {
+			return err
+		}
+		if len(postMs) == 0 {
+			break
+		}
+		for _, postM := range postMs {
+			t := postM.CreatedAt
+			if order == storage.PostOrderReplyTimeDesc {
+				t = postM.ReplyTime
+			}
+			if err := c.cache.ZAdd(ctx, key, float64(t.UnixMilli()), funcs.Itoa(postM.PostID)); err != nil {
+				return err
+			}
+		}
+		n += len(postMs)
+		cursor = newCursor
+	}
+	return nil
+}
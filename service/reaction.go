@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"hoyobar/storage"
+	"hoyobar/util/mycache"
+	"hoyobar/util/mycache/keys"
+	"hoyobar/util/myerr"
+	"log"
+)
+
+// ReactionService manages emoji reactions on posts and replies.
+// Counts of each target are cached as a whole, so a page of content needs one cache read.
+type ReactionService struct {
+	cache           mycache.Cache
+	reactionStorage storage.ReactionStorage
+	postStorage     storage.PostStorage
+	replyStorage    storage.PostReplyStorage
+}
+
+func NewReactionService(
+	cache mycache.Cache,
+	reactionStorage storage.ReactionStorage,
+	postStorage storage.PostStorage,
+	replyStorage storage.PostReplyStorage,
+) *ReactionService {
+	if conf.Global() == nil {
+		log.Fatalf("conf.Global is not initialized")
+	}
+	return &ReactionService{
+		cache:           cache,
+		reactionStorage: reactionStorage,
+		postStorage:     postStorage,
+		replyStorage:    replyStorage,
+	}
+}
+
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int64  `json:"count"`
+	Reacted bool   `json:"reacted"` // reacted by current user
+}
+
+type ReactionState struct {
+	Reacted   bool            `json:"reacted"`
+	Reactions []ReactionCount `json:"reactions"`
+}
+
+// emojis allowed in a board
+func AllowedReactions(boardID int64) []string {
+	if emojis, ok := conf.Global().App.Reaction.Boards[boardID]; ok {
+		return emojis
+	}
+	return conf.Global().App.Reaction.Default
+}
+
+// add the reaction if the user has not reacted with the emoji, otherwise remove it
+func (r *ReactionService) Toggle(ctx context.Context, userID int64, targetType string, targetID int64, emoji string) (*ReactionState, error) {
+	boardID, err := r.targetBoardID(ctx, targetType, targetID)
+	if err != nil {
+		return nil, err
+	}
+	allowed := false
+	for _, e := range AllowedReactions(boardID) {
+		allowed = allowed || e == emoji
+	}
+	if !allowed {
+		return nil, myerr.ErrBadReqBody.WithEmsg("该版块不支持此表情")
+	}
+
+	reacted, err := r.reactionStorage.Create(ctx, &model.Reaction{
+		TargetID:   targetID,
+		UserID:     userID,
+		Emoji:      emoji,
+		TargetType: targetType,
+	})
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to create reaction")
+	}
+	if !reacted {
+		_, err = r.reactionStorage.Delete(ctx, targetID, userID, emoji)
+		if err != nil {
+			return nil, myerr.OtherErrWarpf(err, "fail to delete reaction")
+		}
+	}
+
+	// write the new counts to cache, so readers never see the stale ones
+	counts, err := r.reactionStorage.CountByTargets(ctx, []int64{targetID})
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to count reactions")
+	}
+	r.writeCacheCounts(ctx, counts)
+	summaries := r.summarize(ctx, userID, map[int64]int64{targetID: boardID}, counts)
+	return &ReactionState{Reacted: reacted, Reactions: summaries[targetID]}, nil
+}
+
+// board of the target, or ErrResourceNotFound if target not exists
+func (r *ReactionService) targetBoardID(ctx context.Context, targetType string, targetID int64) (int64, error) {
+	postID := targetID
+	switch targetType {
+	case model.LikeTargetPost:
+	case model.LikeTargetReply:
+		replyM, err := r.replyStorage.FetchByReplyID(ctx, targetID)
+		if err != nil {
+			return 0, myerr.OtherErrWarpf(err, "fail to query reply %v", targetID)
+		}
+		if replyM == nil {
+			return 0, myerr.ErrResourceNotFound.WithEmsg("回复不存在")
+		}
+		postID = replyM.PostID
+	default:
+		return 0, myerr.ErrBadReqBody.WithEmsg("不支持回应的内容")
+	}
+	postM, err := r.postStorage.FetchByPostID(ctx, postID)
+	if err != nil {
+		return 0, myerr.OtherErrWarpf(err, "fail to query post %v", postID)
+	}
+	if postM == nil {
+		return 0, myerr.ErrResourceNotFound.WithEmsg("帖子不存在")
+	}
+	return postM.BoardID, nil
+}
+
+// reaction summaries of targets.
+// boardIDs: target ID -> board ID, emojis not allowed in the board are hidden.
+func (r *ReactionService) Summaries(ctx context.Context, viewerID int64, boardIDs map[int64]int64) map[int64][]ReactionCount {
+	if len(boardIDs) == 0 {
+		return map[int64][]ReactionCount{}
+	}
+	return r.summarize(ctx, viewerID, boardIDs, r.readCounts(ctx, boardIDs))
+}
+
+func (r *ReactionService) summarize(ctx context.Context, viewerID int64, boardIDs map[int64]int64, counts map[int64]map[string]int64) map[int64][]ReactionCount {
+	targetIDs := make([]int64, 0, len(boardIDs))
+	for targetID := range boardIDs {
+		targetIDs = append(targetIDs, targetID)
+	}
+	mine := map[int64][]string{}
+	if viewerID != 0 {
+		var err error
+		mine, err = r.reactionStorage.UserReactions(ctx, viewerID, targetIDs)
+		if err != nil {
+			// minor err, show as not reacted
+			log.Printf("fails to query user reactions, user_id = %v, err = %v\n", viewerID, err)
+			mine = map[int64][]string{}
+		}
+	}
+
+	summaries := make(map[int64][]ReactionCount, len(boardIDs))
+	for targetID, boardID := range boardIDs {
+		reacted := make(map[string]bool)
+		for _, emoji := range mine[targetID] {
+			reacted[emoji] = true
+		}
+		for _, emoji := range AllowedReactions(boardID) {
+			cnt := counts[targetID][emoji]
+			if cnt == 0 && !reacted[emoji] {
+				continue
+			}
+			summaries[targetID] = append(summaries[targetID], ReactionCount{
+				Emoji:   emoji,
+				Count:   cnt,
+				Reacted: reacted[emoji],
+			})
+		}
+	}
+	return summaries
+}
+
+// read counts from cache, the missing ones are counted in db with one query
+func (r *ReactionService) readCounts(ctx context.Context, boardIDs map[int64]int64) map[int64]map[string]int64 {
+	targetIDs := make([]int64, 0, len(boardIDs))
+	cacheKeys := make([]string, 0, len(boardIDs))
+	for targetID := range boardIDs {
+		targetIDs = append(targetIDs, targetID)
+		cacheKeys = append(cacheKeys, keys.ReactionCounts(targetID))
+	}
+	values, err := r.cache.MGet(ctx, cacheKeys...)
+	if err != nil || len(values) != len(targetIDs) {
+		values = make([]interface{}, len(targetIDs)) // treat all as missing
+	}
+
+	counts := make(map[int64]map[string]int64, len(targetIDs))
+	var missIDs []int64
+	for i, targetID := range targetIDs {
+		if s, ok := values[i].(string); ok {
+			cnt := map[string]int64{}
+			if err := json.Unmarshal([]byte(s), &cnt); err == nil {
+				counts[targetID] = cnt
+				continue
+			}
+		}
+		missIDs = append(missIDs, targetID)
+	}
+	if len(missIDs) == 0 {
+		return counts
+	}
+
+	missCounts, err := r.reactionStorage.CountByTargets(ctx, missIDs)
+	if err != nil {
+		// minor err, show as no reactions
+		log.Printf("fails to count reactions, err = %v\n", err)
+		return counts
+	}
+	r.writeCacheCounts(ctx, missCounts)
+	for targetID, cnt := range missCounts {
+		counts[targetID] = cnt
+	}
+	return counts
+}
+
+func (r *ReactionService) writeCacheCounts(ctx context.Context, counts map[int64]map[string]int64) {
+	expire := conf.Global().App.Expire.PostInfo
+	for targetID, cnt := range counts {
+		value, err := json.Marshal(cnt)
+		if err != nil {
+			continue
+		}
+		_ = r.cache.Set(ctx, keys.ReactionCounts(targetID), string(value), expire)
+	}
+}
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"context"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"hoyobar/search"
+	"hoyobar/storage"
+	"hoyobar/util/funcs"
+	"hoyobar/util/myerr"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SearchService keeps the search index updated and serves searches.
+// The index only returns IDs, contents are read from db, so deleted ones are never shown.
+type SearchService struct {
+	index        search.Index
+	postStorage  storage.PostStorage
+	replyStorage storage.PostReplyStorage
+}
+
+func NewSearchService(
+	index search.Index,
+	postStorage storage.PostStorage,
+	replyStorage storage.PostReplyStorage,
+) *SearchService {
+	if conf.Global() == nil {
+		log.Fatalf("conf.Global is not initialized")
+	}
+	return &SearchService{
+		index:        index,
+		postStorage:  postStorage,
+		replyStorage: replyStorage,
+	}
+}
+
+type SearchArgs struct {
+	Text      string
+	Type      string // "post", "reply" or empty for both
+	BoardID   int64
+	AuthorID  int64
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+type SearchHit struct {
+	Type      string    `json:"type"`
+	PostID    int64     `json:"post_id,string"`
+	ReplyID   int64     `json:"reply_id,string,omitempty"`
+	BoardID   int64     `json:"board_id,string"`
+	AuthorID  int64     `json:"author_id,string"`
+	Title     string    `json:"title"` // title of the post, also for replies
+	Snippet   string    `json:"snippet"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SearchResult struct {
+	List   []SearchHit `json:"list"`
+	Total  int         `json:"total"`
+	Cursor string      `json:"cursor"`
+}
+
+const (
+	snippetLen       = 100 // max runes of SearchHit.Snippet
+	rebuildBatchSize = 500
+)
+
+// add a post to index in background
+func (s *SearchService) IndexPost(postM *model.Post) {
+	doc := &search.Document{
+		DocID:     postM.PostID,
+		Type:      search.DocTypePost,
+		PostID:    postM.PostID,
+		BoardID:   postM.BoardID,
+		AuthorID:  postM.AuthorID,
+		Title:     postM.Title,
+		Content:   postM.Content,
+		CreatedAt: postM.CreatedAt,
+	}
+	s.add(doc)
+}
+
+// add a reply to index in background, boardID is the board of its post
+func (s *SearchService) IndexReply(replyM *model.PostReply, boardID int64) {
+	doc := &search.Document{
+		DocID:     replyM.ReplyID,
+		Type:      search.DocTypeReply,
+		PostID:    replyM.PostID,
+		BoardID:   boardID,
+		AuthorID:  replyM.AuthorID,
+		Content:   replyM.Content,
+		CreatedAt: replyM.CreatedAt,
+	}
+	s.add(doc)
+}
+
+func (s *SearchService) add(doc *search.Document) {
+	funcs.Go(func() {
+		if err := s.index.Add(context.Background(), doc); err != nil {
+			log.Printf("fails to index %v %v, err = %v\n", doc.Type, doc.DocID, err)
+		}
+	})
+}
+
+// remove posts or replies from index in background
+func (s *SearchService) Remove(docIDs ...int64) {
+	funcs.Go(func() {
+		for _, docID := range docIDs {
+			if err := s.index.Delete(context.Background(), docID); err != nil {
+				log.Printf("fails to remove %v from index, err = %v\n", docID, err)
+			}
+		}
+	})
+}
+
+// cursor: the cursor returned by last call with the same args
+func (s *SearchService) Search(ctx context.Context, args *SearchArgs, cursor string, pageSize int) (*SearchResult, error) {
+	if strings.TrimSpace(args.Text) == "" {
+		return nil, myerr.ErrBadReqBody.WithEmsg("搜索内容不能为空")
+	}
+	if pageSize <= 0 {
+		return nil, myerr.ErrBadReqBody.WithEmsg("页为空")
+	}
+	pageSize = funcs.Min(pageSize, conf.Global().App.MaxPageSize)
+	var offset int
+	if cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 {
+			return nil, myerr.ErrBadReqBody.WithEmsg("不合法的游标")
+		}
+	}
+
+	hits, total, err := s.index.Search(ctx, &search.Query{
+		Text:      args.Text,
+		Type:      args.Type,
+		BoardID:   args.BoardID,
+		AuthorID:  args.AuthorID,
+		StartTime: args.StartTime,
+		EndTime:   args.EndTime,
+		Offset:    offset,
+		Limit:     pageSize,
+	})
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to search %q", args.Text)
+	}
+	if len(hits) == 0 {
+		return nil, myerr.ErrNoMoreEntry.WithEmsg("没有更多结果了")
+	}
+
+	list, err := s.hydrate(ctx, hits)
+	if err != nil {
+		return nil, err
+	}
+	return &SearchResult{
+		List:   list,
+		Total:  total,
+		Cursor: strconv.Itoa(offset + len(hits)),
+	}, nil
+}
+
+// read contents of hits from db, keep the order of hits
+func (s *SearchService) hydrate(ctx context.Context, hits []search.Hit) ([]SearchHit, error) {
+	postIDs := make([]int64, 0, len(hits))
+	replyIDs := make([]int64, 0, len(hits))
+	for _, hit := range hits {
+		postIDs = append(postIDs, hit.PostID)
+		if hit.Type == search.DocTypeReply {
+			replyIDs = append(replyIDs, hit.DocID)
+		}
+	}
+	postMs, err := s.postStorage.FetchByPostIDs(ctx, postIDs)
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to query posts")
+	}
+	replyMs, err := s.replyStorage.FetchByReplyIDs(ctx, replyIDs)
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to query replies")
+	}
+	postByID := make(map[int64]*model.Post, len(postMs))
+	for _, postM := range postMs {
+		postByID[postM.PostID] = postM
+	}
+	replyByID := make(map[int64]*model.PostReply, len(replyMs))
+	for _, replyM := range replyMs {
+		replyByID[replyM.ReplyID] = replyM
+	}
+
+	list := make([]SearchHit, 0, len(hits))
+	for _, hit := range hits {
+		postM, ok := postByID[hit.PostID]
+		if !ok { // deleted
+			continue
+		}
+		item := SearchHit{
+			Type:      hit.Type,
+			PostID:    postM.PostID,
+			BoardID:   postM.BoardID,
+			AuthorID:  postM.AuthorID,
+			Title:     postM.Title,
+			Snippet:   snippet(postM.Content),
+			CreatedAt: postM.CreatedAt,
+		}
+		if hit.Type == search.DocTypeReply {
+			replyM, ok := replyByID[hit.DocID]
+			if !ok { // deleted
+				continue
+			}
+			item.ReplyID = replyM.ReplyID
+			item.AuthorID = replyM.AuthorID
+			item.Snippet = snippet(replyM.Content)
+			item.CreatedAt = replyM.CreatedAt
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+func snippet(content string) string {
+	runes := []rune(content)
+	if len(runes) <= snippetLen {
+		return content
+	}
+	return string(runes[:snippetLen]) + "..."
+}
+
+// rebuild the whole index from db
+func (s *SearchService) Rebuild(ctx context.Context) error {
+	if err := s.index.Reset(ctx); err != nil {
+		return myerr.OtherErrWarpf(err, "fail to reset search index")
+	}
+	batchSize := rebuildBatchSize
+	boardIDs := make(map[int64]int64) // post ID -> board ID, for replies
+
+	var afterID int64
+	for {
+		postIDs, err := s.postStorage.ListIDs(ctx, afterID, batchSize)
+		if err != nil {
+			return myerr.OtherErrWarpf(err, "fail to list posts")
+		}
+		if len(postIDs) == 0 {
+			break
+		}
+		postMs, err := s.postStorage.FetchByPostIDs(ctx, postIDs)
+		if err != nil {
+			return myerr.OtherErrWarpf(err, "fail to query posts")
+		}
+		for _, postM := range postMs {
+			boardIDs[postM.PostID] = postM.BoardID
+			err = s.index.Add(ctx, &search.Document{
+				DocID:     postM.PostID,
+				Type:      search.DocTypePost,
+				PostID:    postM.PostID,
+				BoardID:   postM.BoardID,
+				AuthorID:  postM.AuthorID,
+				Title:     postM.Title,
+				Content:   postM.Content,
+				CreatedAt: postM.CreatedAt,
+			})
+			if err != nil {
+				return myerr.OtherErrWarpf(err, "fail to index post %v", postM.PostID)
+			}
+		}
+		afterID = postIDs[len(postIDs)-1]
+	}
+
+	afterID = 0
+	for {
+		replyIDs, err := s.replyStorage.ListIDs(ctx, afterID, batchSize)
+		if err != nil {
+			return myerr.OtherErrWarpf(err, "fail to list replies")
+		}
+		if len(replyIDs) == 0 {
+			break
+		}
+		replyMs, err := s.replyStorage.FetchByReplyIDs(ctx, replyIDs)
+		if err != nil {
+			return myerr.OtherErrWarpf(err, "fail to query replies")
+		}
+		for _, replyM := range replyMs {
+			err = s.index.Add(ctx, &search.Document{
+				DocID:     replyM.ReplyID,
+				Type:      search.DocTypeReply,
+				PostID:    replyM.PostID,
+				BoardID:   boardIDs[replyM.PostID],
+				AuthorID:  replyM.AuthorID,
+				Content:   replyM.Content,
+				CreatedAt: replyM.CreatedAt,
+			})
+			if err != nil {
+				return myerr.OtherErrWarpf(err, "fail to index reply %v", replyM.ReplyID)
+			}
+		}
+		afterID = replyIDs[len(replyIDs)-1]
+	}
+	return s.Flush(ctx)
+}
+
+func (s *SearchService) Flush(ctx context.Context) error {
+	if err := s.index.Flush(ctx); err != nil {
+		return myerr.OtherErrWarpf(err, "fail to flush search index")
+	}
+	return nil
+}
+
+// flush the index periodically until ctx is done
+func (s *SearchService) Run(ctx context.Context) {
+	ticker := time.NewTicker(conf.Global().Search.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(context.Background()); err != nil {
+				log.Println(err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.Flush(ctx); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"hoyobar/storage"
+	"hoyobar/util/mycache"
+	"hoyobar/util/mycache/keys"
+	"hoyobar/util/myerr"
+	"hoyobar/util/regexes"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/width"
+)
+
+const maxTagLen = 20 // in runes
+
+// TagService manages tags of posts.
+// Tags are normalized before stored, so "Genshin", "ＧＥＮＳＨＩＮ" and " genshin " are the same tag.
+type TagService struct {
+	cache       mycache.Cache
+	tagStorage  storage.TagStorage
+	userStorage storage.UserStorage
+}
+
+func NewTagService(
+	cache mycache.Cache,
+	tagStorage storage.TagStorage,
+	userStorage storage.UserStorage,
+) *TagService {
+	if conf.Global() == nil {
+		log.Fatalf("conf.Global is not initialized")
+	}
+	return &TagService{
+		cache:       cache,
+		tagStorage:  tagStorage,
+		userStorage: userStorage,
+	}
+}
+
+// fold full-width chars to half-width, lower the case and collapse whitespaces.
+// returns "" if the tag is empty or too long.
+func NormalizeTag(tag string) string {
+	tag = width.Fold.String(tag)
+	tag = strings.ToLower(tag)
+	tag = strings.Join(strings.FieldsFunc(tag, unicode.IsSpace), " ")
+	if utf8.RuneCountInString(tag) > maxTagLen {
+		return ""
+	}
+	return tag
+}
+
+// normalized "#tag#" in text, in order of appearance
+func ParseHashtags(text string) []string {
+	var tags []string
+	for _, match := range regexes.Hashtag.FindAllStringSubmatch(text, -1) {
+		if tag := NormalizeTag(match[1]); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// tags of a new post: explicit tags first, then hashtags in title and content.
+// duplicates are removed and at most App.Tag.MaxN are kept.
+func (t *TagService) tagsOfPost(explicit []string, title string, content string) ([]string, error) {
+	maxN := conf.Global().App.Tag.MaxN
+	var tags []string
+	seen := make(map[string]bool)
+	add := func(tag string) {
+		if tag != "" && !seen[tag] && len(tags) < maxN {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(explicit) > maxN {
+		return nil, myerr.ErrBadReqBody.WithEmsg("标签数量过多")
+	}
+	for _, tag := range explicit {
+		normalized := NormalizeTag(tag)
+		if normalized == "" {
+			return nil, myerr.ErrBadReqBody.WithEmsg("不合法的标签")
+		}
+		add(normalized)
+	}
+	for _, tag := range ParseHashtags(title) {
+		add(tag)
+	}
+	for _, tag := range ParseHashtags(content) {
+		add(tag)
+	}
+	return tags, nil
+}
+
+// save tags of a created post
+func (t *TagService) save(ctx context.Context, postM *model.Post, tags []string) error {
+	rows := make([]*model.PostTag, len(tags))
+	for i, tag := range tags {
+		rows[i] = &model.PostTag{
+			PostID:    postM.PostID,
+			Tag:       tag,
+			BoardID:   postM.BoardID,
+			CreatedAt: postM.CreatedAt,
+		}
+	}
+	return t.tagStorage.Create(ctx, rows)
+}
+
+// post ID -> tags, failures are logged and ignored
+func (t *TagService) tagsOfPosts(ctx context.Context, postIDs []int64) map[int64][]string {
+	tags, err := t.tagStorage.TagsOfPosts(ctx, postIDs)
+	if err != nil {
+		log.Printf("fails to query post tags: %v\n", err)
+		return nil
+	}
+	return tags
+}
+
+// popular tags of posts created recently in the board, 0 means all boards
+func (t *TagService) Cloud(ctx context.Context, boardID int64) ([]storage.TagCount, error) {
+	key := keys.TagCloud(boardID)
+	if data, err := t.cache.Get(ctx, key); err == nil {
+		var cloud []storage.TagCount
+		if err := json.Unmarshal([]byte(data), &cloud); err == nil {
+			return cloud, nil
+		}
+	}
+
+	since := model.Now().Add(-conf.Global().App.Tag.CloudWindow)
+	cloud, err := t.tagStorage.Popular(ctx, boardID, since, conf.Global().App.Tag.CloudSize)
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to query popular tags")
+	}
+	if cloud == nil {
+		cloud = []storage.TagCount{}
+	}
+	if data, err := json.Marshal(cloud); err == nil {
+		_ = t.cache.Set(ctx, key, string(data), conf.Global().App.Tag.CloudExpire)
+	}
+	return cloud, nil
+}
+
+// rename a tag, the new name must not be used by any post
+func (t *TagService) Rename(ctx context.Context, userID int64, from string, to string) error {
+	return t.move(ctx, userID, from, to, false)
+}
+
+// merge a tag into an existing one, posts with either tag will have the latter
+func (t *TagService) Merge(ctx context.Context, userID int64, from string, to string) error {
+	return t.move(ctx, userID, from, to, true)
+}
+
+// cached tag clouds are not invalidated, they will expire soon
+func (t *TagService) move(ctx context.Context, userID int64, from string, to string, toExist bool) error {
+	if err := t.checkAdmin(ctx, userID); err != nil {
+		return err
+	}
+	from, to = NormalizeTag(from), NormalizeTag(to)
+	if from == "" || to == "" {
+		return myerr.ErrBadReqBody.WithEmsg("不合法的标签")
+	}
+	if from == to {
+		return myerr.ErrBadReqBody.WithEmsg("标签相同")
+	}
+	exist, err := t.tagStorage.HasTag(ctx, from)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to query tag %q", from)
+	}
+	if !exist {
+		return myerr.ErrResourceNotFound.WithEmsg("标签不存在")
+	}
+	exist, err = t.tagStorage.HasTag(ctx, to)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to query tag %q", to)
+	}
+	if exist && !toExist {
+		return myerr.ErrBadReqBody.WithEmsg("新标签已存在，请使用合并")
+	}
+	if !exist && toExist {
+		return myerr.ErrResourceNotFound.WithEmsg("目标标签不存在")
+	}
+	err = t.tagStorage.Merge(ctx, from, to)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to move tag %q to %q", from, to)
+	}
+	return nil
+}
+
+func (t *TagService) checkAdmin(ctx context.Context, userID int64) error {
+	user, err := t.userStorage.FetchByUserID(ctx, userID)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to query user %v", userID)
+	}
+	if user == nil || user.Role != model.RoleAdmin {
+		return myerr.ErrAuth.WithEmsg("无操作权限")
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"hoyobar/conf"
 	"hoyobar/model"
 	"hoyobar/storage"
+	"hoyobar/util/ctxuser"
 	"hoyobar/util/funcs"
 	"hoyobar/util/idgen"
 	"hoyobar/util/mycache"
@@ -17,35 +18,83 @@ import (
 	"hoyobar/util/regexes"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
 )
 
 type UserService struct {
-	cache       mycache.Cache
-	userStorage storage.UserStorage
+	cache          mycache.Cache
+	userStorage    storage.UserStorage
+	sessionStorage storage.SessionStorage // auth tokens when the cache is unavailable
+	loadGroup      singleflight.Group     // coalesces cache-miss loads by cache key
+
+	nicknameRebuilding int32 // 1 during RebuildNicknameIndex in background
 }
 
 func NewUserService(
 	cache mycache.Cache,
 	userStorage storage.UserStorage,
+	sessionStorage storage.SessionStorage,
 ) *UserService {
 	userService := &UserService{
-		cache:       cache,
-		userStorage: userStorage,
+		cache:          cache,
+		userStorage:    userStorage,
+		sessionStorage: sessionStorage,
 	}
 	return userService
 }
 
+// rebuild the nickname index if it is not ready,
+// and delete expired db sessions periodically until ctx is done
+func (u *UserService) Run(ctx context.Context) {
+	u.ensureNicknameIndex()
+	grace := conf.Global().App.Expire.DBSession
+	if grace <= 0 {
+		return
+	}
+	ticker := time.NewTicker(grace)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := u.sessionStorage.DeleteExpired(ctx, time.Now())
+			if err != nil {
+				log.Printf("fails to delete expired sessions: %v\n", err)
+			} else if n > 0 {
+				log.Printf("deleted %d expired sessions\n", n)
+			}
+		}
+	}
+}
+
 type UserBasic struct {
 	UserID    int64  `json:"user_id,string"`
 	Phone     string `json:"phone"`
 	Email     string `json:"email"`
 	Nickname  string `json:"nickname"`
+	Avatar    string `json:"avatar"`
+	Level     int    `json:"level"`
+	Locked    bool   `json:"locked,omitempty"`
 	AuthToken string `json:"auth_token"`
 }
 
+func userBasicOf(userModel *model.User) *UserBasic {
+	return &UserBasic{
+		UserID:   userModel.UserID,
+		Phone:    userModel.Phone.String,
+		Email:    userModel.Email.String,
+		Nickname: userModel.Nickname,
+		Avatar:   userModel.Avatar,
+		Level:    userModel.Level,
+		Locked:   userModel.Locked,
+	}
+}
+
 type RegisterInfo struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -83,6 +132,32 @@ func (u *UserService) checkVcode(username string, vcode string) (bool, error) {
 }
 
 func (u *UserService) Register(ctx context.Context, args *RegisterInfo) (*UserBasic, error) {
+	vcodeOK, err := u.checkVcode(args.Username, args.Vcode)
+	if err != nil {
+		return nil, err
+	}
+	if !vcodeOK {
+		return nil, myerr.ErrWrongVcode
+	}
+
+	userBasic, err := u.create(ctx, args, "")
+	if err != nil {
+		return nil, err
+	}
+	authToken, err := u.genAndStoreAuthToken(ctx, userBasic.UserID)
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to write auth token").WithEmsg("请稍后尝试登录")
+	}
+	userBasic.AuthToken = authToken
+	return userBasic, nil
+}
+
+// create an admin without verification code, for operators
+func (u *UserService) CreateAdmin(ctx context.Context, args *RegisterInfo) (*UserBasic, error) {
+	return u.create(ctx, args, model.RoleAdmin)
+}
+
+func (u *UserService) create(ctx context.Context, args *RegisterInfo, role string) (*UserBasic, error) {
 	var err error
 	username, rawPass := args.Username, args.Password
 
@@ -94,14 +169,6 @@ func (u *UserService) Register(ctx context.Context, args *RegisterInfo) (*UserBa
 		return nil, myerr.OtherErrWarpf(err, "fail to hash password")
 	}
 
-	vcodeOK, err := u.checkVcode(username, args.Vcode)
-	if err != nil {
-		return nil, err
-	}
-	if !vcodeOK {
-		return nil, myerr.ErrWrongVcode
-	}
-
 	err = u.checkUserExist(ctx, args)
 	if err != nil {
 		return nil, err
@@ -114,6 +181,8 @@ func (u *UserService) Register(ctx context.Context, args *RegisterInfo) (*UserBa
 		UserID:   userID,
 		Password: passhash,
 		Nickname: args.Nickname,
+		Role:     role,
+		Level:    1,
 	}
 	switch usernameType {
 	case UsernameTypePhone:
@@ -129,27 +198,20 @@ func (u *UserService) Register(ctx context.Context, args *RegisterInfo) (*UserBa
 		return nil, myerr.OtherErrWarpf(err, "fail to create user %q", username).
 			WithEmsg("注册失败")
 	}
-	u.writeCacheUserNames(userModel)
+	// negative entries were written when checking existence
+	u.forgetUserIDs(ctx, userNameKeys(&userModel)...)
+	u.writeCacheUserIDs(ctx, userModel.UserID, userNameKeys(&userModel)...)
+	u.indexNickname(userModel.UserID, userModel.Nickname)
 
-	userBasic := &UserBasic{
-		UserID:   userModel.UserID,
-		Phone:    userModel.Phone.String,
-		Email:    userModel.Email.String,
-		Nickname: userModel.Nickname,
-	}
+	userBasic := userBasicOf(&userModel)
 	u.writeCacheUserBasic(ctx, *userBasic)
-
-	authToken, err := u.genAndStoreAuthToken(ctx, userID)
-	if err != nil {
-		return nil, myerr.OtherErrWarpf(err, "fail to write auth token").WithEmsg("请稍后尝试登录")
-	}
-	userBasic.AuthToken = authToken
 	return userBasic, nil
 }
 
 func (u *UserService) checkUserExist(ctx context.Context, args *RegisterInfo) error {
 	// check if user exist by username and nickname
-	checkUserExistChan := make(chan error)
+	// buffered, so the other check does not block forever after the first error returns
+	checkUserExistChan := make(chan error, 2)
 
 	checkUserExistFuncs := make([]func(), 0)
 	checkUserExistFuncs = append(checkUserExistFuncs, func() {
@@ -193,10 +255,25 @@ func (u *UserService) checkUserExist(ctx context.Context, args *RegisterInfo) er
 func (u *UserService) genAndStoreAuthToken(ctx context.Context, userID int64) (string, error) {
 	token := strings.ReplaceAll(uuid.NewString(), "-", "")
 	key := keys.AuthToken(token)
-	expire := conf.Global.App.Expire.AuthToken
-	if err := u.cache.SetInt64(ctx, key, userID, expire); err != nil {
+	expire := conf.Global().App.Expire.AuthToken
+	err := u.cache.SetInt64(ctx, key, userID, expire)
+	if err == nil {
+		return token, nil
+	}
+	// degraded: the token is valid in db for a short grace period
+	grace := conf.Global().App.Expire.DBSession
+	if grace <= 0 {
 		return "", errors.Wrapf(err, "fail to write auth token to cache")
 	}
+	log.Printf("fail to write auth token to cache, write it to db: %v\n", err)
+	err = u.sessionStorage.Create(ctx, &model.Session{
+		Token:    token,
+		UserID:   userID,
+		ExpireAt: time.Now().Add(grace),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "fail to write auth token to db")
+	}
 	return token, nil
 }
 
@@ -205,7 +282,7 @@ func (u *UserService) writeCacheUserBasic(ctx context.Context, user UserBasic) {
 		return
 	}
 	funcs.Go(func() {
-		timeout := conf.Global.App.Timeout.Default
+		timeout := conf.Global().App.Timeout.Default
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 		key := keys.UserBasic(user.UserID)
@@ -214,40 +291,21 @@ func (u *UserService) writeCacheUserBasic(ctx context.Context, user UserBasic) {
 		if err != nil {
 			return
 		}
-		expire := conf.Global.App.Expire.UserInfo
+		expire := conf.Global().App.Expire.UserInfo
 		_ = u.cache.Set(ctx, key, string(value), expire)
 	})
 }
 
-func (u *UserService) writeCacheUserNames(userModel model.User) {
-	userInfoExpire := conf.Global.App.Expire.UserInfo
-	userID := userModel.UserID
-
-	// we don't really care if this will be done
-	tmpUserModel := userModel // copy one to avoid possible problems
-	funcs.Go(func() {
-		timeout := conf.Global.App.Timeout.Default
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-		if userModel.Email.Valid {
-			_ = u.cache.SetInt64(ctx,
-				keys.EmailToUserID(tmpUserModel.Email.String), userID,
-				userInfoExpire,
-			)
-		}
-
-		if userModel.Phone.Valid {
-			_ = u.cache.SetInt64(ctx,
-				keys.PhoneToUserID(tmpUserModel.Phone.String), userID,
-				userInfoExpire,
-			)
-		}
-
-		_ = u.cache.SetInt64(ctx,
-			keys.NicknameToUserID(userModel.Nickname), userID,
-			userInfoExpire,
-		)
-	})
+// names of a user to cache keys of user ID lookups
+func userNameKeys(userModel *model.User) []string {
+	cacheKeys := []string{keys.NicknameToUserID(userModel.Nickname)}
+	if userModel.Email.Valid {
+		cacheKeys = append(cacheKeys, keys.EmailToUserID(userModel.Email.String))
+	}
+	if userModel.Phone.Valid {
+		cacheKeys = append(cacheKeys, keys.PhoneToUserID(userModel.Phone.String))
+	}
+	return cacheKeys
 }
 
 func (u *UserService) readCacheUserBasic(ctx context.Context, userID int64) *UserBasic {
@@ -265,19 +323,103 @@ func (u *UserService) readCacheUserBasic(ctx context.Context, userID int64) *Use
 	return value
 }
 
+// public info of users, users not exist are skipped.
+// all users are read from cache with one MGet, and the missing ones from db with one query per shard.
+func (u *UserService) Summaries(ctx context.Context, userIDs []int64) map[int64]UserSummary {
+	summaries := make(map[int64]UserSummary, len(userIDs))
+	userIDs = funcs.UniqueInt64(userIDs)
+	if len(userIDs) == 0 {
+		return summaries
+	}
+	cacheKeys := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		cacheKeys[i] = keys.UserBasic(userID)
+	}
+	values, err := u.cache.MGet(ctx, cacheKeys...)
+	if err != nil || len(values) != len(userIDs) {
+		values = make([]interface{}, len(userIDs)) // treat all as missing
+	}
+
+	var missIDs []int64
+	for i, userID := range userIDs {
+		data, ok := values[i].(string)
+		userBasic := UserBasic{}
+		if !ok || json.Unmarshal([]byte(data), &userBasic) != nil {
+			missIDs = append(missIDs, userID)
+			continue
+		}
+		summaries[userID] = userBasic.summary()
+	}
+	if len(missIDs) == 0 {
+		return summaries
+	}
+	userModels, err := u.userStorage.FetchByUserIDs(ctx, missIDs)
+	if err != nil {
+		// minor err, show without author info
+		log.Printf("fails to query users, user_ids = %v, err = %v\n", missIDs, err)
+		return summaries
+	}
+	for _, userModel := range userModels {
+		userBasic := userBasicOf(userModel)
+		summaries[userModel.UserID] = userBasic.summary()
+		u.writeCacheUserBasic(ctx, *userBasic)
+	}
+	return summaries
+}
+
+func (b *UserBasic) summary() UserSummary {
+	return UserSummary{
+		UserID:   b.UserID,
+		Nickname: b.Nickname,
+		Avatar:   b.Avatar,
+		Level:    b.Level,
+	}
+}
+
 // convert auth token to user ID, also refresh cache
 func (u *UserService) AuthTokenToUserID(ctx context.Context, authToken string) (userID int64, err error) {
 	key := keys.AuthToken(authToken)
 
 	// get user ID from cache
 	userID, err = u.cache.GetInt64(ctx, key)
-	if err == mycache.ErrNotFound {
-		return 0, myerr.ErrNotLogin
+	if err == nil {
+		return userID, u.checkLocked(ctx, userID)
 	}
-	if err != nil {
+	if conf.Global().App.Expire.DBSession <= 0 {
+		if err == mycache.ErrNotFound {
+			return 0, myerr.ErrNotLogin
+		}
 		return 0, myerr.OtherErrWarpf(err, "fail to query auth token cache key %q", key)
 	}
-	return userID, nil
+	// the token may be issued while the cache was unavailable
+	userID, dbErr := u.sessionStorage.UserIDOf(ctx, authToken)
+	if dbErr != nil {
+		return 0, myerr.OtherErrWarpf(dbErr, "fail to query auth token %q in db, cache err: %v", authToken, err)
+	}
+	if userID == 0 {
+		return 0, myerr.ErrNotLogin
+	}
+	return userID, u.checkLocked(ctx, userID)
+}
+
+// tokens issued before the user is locked are rejected, the user basic is usually cached
+func (u *UserService) checkLocked(ctx context.Context, userID int64) error {
+	userBasic := u.readCacheUserBasic(ctx, userID)
+	if userBasic == nil {
+		userModel, err := u.userStorage.FetchByUserID(ctx, userID)
+		if err != nil {
+			return myerr.OtherErrWarpf(err, "fail to find user")
+		}
+		if userModel == nil {
+			return myerr.ErrUserNotFound
+		}
+		userBasic = userBasicOf(userModel)
+		u.writeCacheUserBasic(ctx, *userBasic)
+	}
+	if userBasic.Locked {
+		return myerr.ErrUserLocked
+	}
+	return nil
 }
 
 func (u *UserService) Login(ctx context.Context, username, password string) (*UserBasic, error) {
@@ -290,27 +432,23 @@ func (u *UserService) Login(ctx context.Context, username, password string) (*Us
 	if userID == 0 {
 		return nil, myerr.ErrUserNotFound
 	}
+	// reads of a user registered just now go to the primary
+	ctx = ctxuser.With(ctx, userID)
 
-	var userBasic *UserBasic
-	userBasic = u.readCacheUserBasic(ctx, userID)
-	if userBasic == nil {
-		userModel, err := u.userStorage.FetchByUserID(ctx, userID)
-		if err != nil {
-			return nil, myerr.OtherErrWarpf(err, "fail to find user")
-		}
-		if userModel == nil {
-			return nil, myerr.ErrOther.WithEmsg("未找到用户数据，请联系客服")
-		}
-
-		if !myhash.CompareHashAndPassword(userModel.Password, password) {
-			return nil, myerr.ErrWrongPassword
-		}
-		userBasic = &UserBasic{
-			UserID:   userModel.UserID,
-			Phone:    userModel.Phone.String,
-			Email:    userModel.Email.String,
-			Nickname: userModel.Nickname,
-		}
+	// the password hash is not cached, the user is always read from db
+	userModel, err := u.userStorage.FetchByUserID(ctx, userID)
+	if err != nil {
+		return nil, myerr.OtherErrWarpf(err, "fail to find user")
+	}
+	if userModel == nil {
+		return nil, myerr.ErrOther.WithEmsg("未找到用户数据，请联系客服")
+	}
+	if !myhash.CompareHashAndPassword(userModel.Password, password) {
+		return nil, myerr.ErrWrongPassword
+	}
+	userBasic := userBasicOf(userModel)
+	if userBasic.Locked {
+		return nil, myerr.ErrUserLocked
 	}
 	authToken, err := u.genAndStoreAuthToken(ctx, userBasic.UserID)
 	if err != nil {
@@ -327,33 +465,15 @@ func (u *UserService) UsernameToUserID(ctx context.Context, username string) (in
 	var err error
 
 	usernameType := GetUsernameType(username)
-	expire := conf.Global.App.Expire.UserInfo
-
 	switch usernameType {
 	case UsernameTypePhone:
-		key := keys.PhoneToUserID(username)
-		userID, err = u.cache.GetInt64(ctx, key)
-		if err == nil {
-			log.Printf("success query phone %v from cache\n", username)
-			return userID, err
-		}
-		// err != nil, but we don't care
-		userID, err = u.userStorage.PhoneToUserID(ctx, username)
-		if err == nil && userID != 0 {
-			_ = u.cache.SetInt64(ctx, key, userID, expire)
-		}
+		userID, err = u.loadUserID(ctx, keys.PhoneToUserID(username), func(ctx context.Context) (int64, error) {
+			return u.userStorage.PhoneToUserID(ctx, username)
+		})
 	case UsernameTypeEmail:
-		key := keys.EmailToUserID(username)
-		userID, err = u.cache.GetInt64(ctx, key)
-		if err == nil {
-			log.Printf("success query email %v from cache\n", username)
-			return userID, err
-		}
-		// err != nil, but we don't care
-		userID, err = u.userStorage.EmailToUserID(ctx, username)
-		if err == nil && userID != 0 {
-			_ = u.cache.SetInt64(ctx, key, userID, expire)
-		}
+		userID, err = u.loadUserID(ctx, keys.EmailToUserID(username), func(ctx context.Context) (int64, error) {
+			return u.userStorage.EmailToUserID(ctx, username)
+		})
 	default:
 		return 0, myerr.OtherErrWarpf(fmt.Errorf(""), "not support username type %v", usernameType).
 			WithEmsg("账号不是合法的邮箱或手机号")
@@ -368,20 +488,51 @@ func (u *UserService) UsernameToUserID(ctx context.Context, username string) (in
 // transform nickname to user ID.
 // attenion: if nickname not exist, return 0, nil
 func (u *UserService) NicknameToUserID(ctx context.Context, nickname string) (int64, error) {
-	key := keys.NicknameToUserID(nickname)
-	userID, err := u.cache.GetInt64(ctx, key)
-	if err == nil {
-		log.Printf("success query nickname %v from cache\n", nickname)
-		return userID, err
-	}
-	// err != nil, but we don't care
-	userID, err = u.userStorage.NicknameToUserID(ctx, nickname)
+	userID, err := u.loadUserID(ctx, keys.NicknameToUserID(nickname), func(ctx context.Context) (int64, error) {
+		return u.userStorage.NicknameToUserID(ctx, nickname)
+	})
 	if err != nil {
 		return 0, myerr.OtherErrWarpf(err, "fail to check nickname existence")
 	}
-	if userID != 0 {
-		expire := conf.Global.App.Expire.UserInfo
-		_ = u.cache.SetInt64(ctx, key, userID, expire)
-	}
 	return userID, nil
 }
+
+// set role of a user, for operators. role: model.RoleAdmin, or empty for a normal user
+func (u *UserService) SetRole(ctx context.Context, userID int64, role string) error {
+	if role != "" && role != model.RoleAdmin {
+		return myerr.ErrBadReqBody.WithEmsg(fmt.Sprintf("未知角色 %q", role))
+	}
+	if err := u.checkUserExistByID(ctx, userID); err != nil {
+		return err
+	}
+	if err := u.userStorage.UpdateRole(ctx, userID, role); err != nil {
+		return myerr.OtherErrWarpf(err, "fail to update role of user %v", userID)
+	}
+	return nil
+}
+
+// lock or unlock a user, for operators. A locked user can not log in, and its tokens are rejected.
+func (u *UserService) SetLocked(ctx context.Context, userID int64, locked bool) error {
+	if err := u.checkUserExistByID(ctx, userID); err != nil {
+		return err
+	}
+	if err := u.userStorage.UpdateLocked(ctx, userID, locked); err != nil {
+		return myerr.OtherErrWarpf(err, "fail to update locked of user %v", userID)
+	}
+	// reloaded with the new state by the next request of the user
+	if err := u.cache.Del(ctx, keys.UserBasic(userID)); err != nil && locked {
+		return myerr.OtherErrWarpf(err, "fail to evict user %v from cache, tokens are valid until it expires", userID)
+	}
+	return nil
+}
+
+func (u *UserService) checkUserExistByID(ctx context.Context, userID int64) error {
+	exist, err := u.userStorage.HasUser(ctx, userID)
+	if err != nil {
+		return myerr.OtherErrWarpf(err, "fail to check user %v", userID)
+	}
+	if !exist {
+		return myerr.ErrUserNotFound
+	}
+	return nil
+}
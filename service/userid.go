@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"hoyobar/conf"
+	"hoyobar/util/mycache"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Lookups from email/phone/nickname to user ID are cached as "userID,expireAtMs,deltaMs".
+//
+//   - userID 0 is a negative entry: the name does not exist. It expires in Expire.NotFound,
+//     and is deleted when the name is registered.
+//   - deltaMs is how long the db query took. Before expireAt, a reader refreshes the entry early
+//     with probability growing as it approaches expireAt (XFetch), so a hot key is reloaded
+//     by one reader before it expires, instead of by all readers after it expires.
+//   - concurrent loads of the same key are coalesced into one db query.
+//   - a load finding no user does not overwrite a positive entry, which is written right after
+//     the name is registered, so a load started before the register can not hide the new user.
+
+const earlyRefreshBeta = 1.0 // larger means earlier refresh
+
+type cachedUserID struct {
+	userID   int64
+	expireAt time.Time
+	delta    time.Duration
+}
+
+func (c cachedUserID) encode() string {
+	return fmt.Sprintf("%d,%d,%d", c.userID, c.expireAt.UnixMilli(), c.delta.Milliseconds())
+}
+
+func decodeCachedUserID(s string) (c cachedUserID, ok bool) {
+	segs := strings.Split(s, ",")
+	if len(segs) != 3 {
+		return c, false
+	}
+	var nums [3]int64
+	for i, seg := range segs {
+		num, err := strconv.ParseInt(seg, 10, 64)
+		if err != nil {
+			return c, false
+		}
+		nums[i] = num
+	}
+	return cachedUserID{
+		userID:   nums[0],
+		expireAt: time.UnixMilli(nums[1]),
+		delta:    time.Duration(nums[2]) * time.Millisecond,
+	}, true
+}
+
+// XFetch: refresh if now - delta * beta * ln(rand) >= expireAt
+func (c cachedUserID) shouldRefresh(now time.Time) bool {
+	gap := time.Duration(-float64(c.delta) * earlyRefreshBeta * math.Log(rand.Float64()))
+	return !now.Add(gap).Before(c.expireAt)
+}
+
+func userIDCacheExpire(userID int64) time.Duration {
+	if userID == 0 {
+		return conf.Global().App.Expire.NotFound
+	}
+	return mycache.RandomExpire(conf.Global().App.Expire.UserInfo, conf.Global().App.Expire.Jitter)
+}
+
+// write a user ID to cache, userID 0 means not found
+func (u *UserService) writeCacheUserID(ctx context.Context, key string, userID int64, delta time.Duration) error {
+	expire := userIDCacheExpire(userID)
+	value := cachedUserID{
+		userID:   userID,
+		expireAt: time.Now().Add(expire),
+		delta:    delta,
+	}
+	return u.cache.Set(ctx, key, value.encode(), expire)
+}
+
+// read a user ID from cache, or load it from db on miss or early refresh.
+// returns 0 if the name does not exist.
+func (u *UserService) loadUserID(ctx context.Context, key string, load func(ctx context.Context) (int64, error)) (int64, error) {
+	var stale *cachedUserID
+	if data, err := u.cache.Get(ctx, key); err == nil {
+		if cached, ok := decodeCachedUserID(data); ok {
+			if !cached.shouldRefresh(time.Now()) {
+				return cached.userID, nil
+			}
+			stale = &cached
+		}
+	}
+
+	// the load is shared by callers, so it is not bound to the ctx of the first one
+	resChan := u.loadGroup.DoChan(key, func() (interface{}, error) {
+		timeout := conf.Global().App.Timeout.Default
+		loadCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		start := time.Now()
+		userID, err := load(loadCtx)
+		if err != nil {
+			return int64(0), err
+		}
+		if userID == 0 && u.cachedPositive(loadCtx, key) {
+			// the name is registered after the query, keep the entry written by the register
+			return int64(0), nil
+		}
+		_ = u.writeCacheUserID(loadCtx, key, userID, time.Since(start))
+		return userID, nil
+	})
+	var res singleflight.Result
+	select {
+	case res = <-resChan:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	if res.Err != nil {
+		if stale != nil {
+			// early refresh failed, the cached one is still valid
+			return stale.userID, nil
+		}
+		return 0, res.Err
+	}
+	return res.Val.(int64), nil
+}
+
+func (u *UserService) cachedPositive(ctx context.Context, key string) bool {
+	data, err := u.cache.Get(ctx, key)
+	if err != nil {
+		return false
+	}
+	cached, ok := decodeCachedUserID(data)
+	return ok && cached.userID != 0
+}
+
+// delete entries of the names, and stop sharing loads in flight with later callers.
+// a load in flight still writes its result, so a registered name should be written with
+// writeCacheUserIDs after this, which such a load does not overwrite with a negative entry.
+func (u *UserService) forgetUserIDs(ctx context.Context, cacheKeys ...string) {
+	for _, key := range cacheKeys {
+		u.loadGroup.Forget(key)
+	}
+	_ = u.cache.Del(ctx, cacheKeys...)
+}
+
+// write names to cache synchronously, e.g. after they are registered
+func (u *UserService) writeCacheUserIDs(ctx context.Context, userID int64, cacheKeys ...string) {
+	for _, key := range cacheKeys {
+		_ = u.writeCacheUserID(ctx, key, userID, 0)
+	}
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"hoyobar/util/dbmetrics"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const pingTimeout = 2 * time.Second
+
+// Cluster is the main database and databases holding ranges of shards.
+// Tables not sharded and shards not in any range are in the main database.
+// Tables of a shard have the same name in whichever database, e.g. "user5".
+type Cluster struct {
+	dbs    []*clusterDB            // the main database first
+	ranges map[string][]shardRange // by shard group, e.g. model.ShardGroupUser
+}
+
+type clusterDB struct {
+	name string
+	db   *DBRouter
+}
+
+type shardRange struct {
+	from, to int64 // inclusive
+	db       *clusterDB
+}
+
+func NewCluster(main *DBRouter) *Cluster {
+	return &Cluster{
+		dbs:    []*clusterDB{{name: "main", db: main}},
+		ranges: make(map[string][]shardRange),
+	}
+}
+
+// shards [from, to] of the group are in the database, a database is opened once for all its ranges,
+// so db is only used for the first range of the name
+func (c *Cluster) AddRange(group string, from, to int64, name string, db *gorm.DB) error {
+	if from < 0 || to < from {
+		return errors.Errorf("wrong range [%v, %v] of %v shards", from, to, group)
+	}
+	for _, r := range c.ranges[group] {
+		if from <= r.to && r.from <= to {
+			return errors.Errorf("range [%v, %v] of %v shards overlaps [%v, %v] in %v",
+				from, to, group, r.from, r.to, r.db.name)
+		}
+	}
+	var cdb *clusterDB
+	for _, d := range c.dbs {
+		if d.name == name {
+			cdb = d
+		}
+	}
+	if cdb == nil {
+		cdb = &clusterDB{name: name, db: NewDBRouter(db)}
+		c.dbs = append(c.dbs, cdb)
+	}
+	c.ranges[group] = append(c.ranges[group], shardRange{from: from, to: to, db: cdb})
+	return nil
+}
+
+func (c *Cluster) Main() *DBRouter {
+	return c.dbs[0].db
+}
+
+// database of the shard
+func (c *Cluster) Shard(group string, shardIdx int64) *DBRouter {
+	for _, r := range c.ranges[group] {
+		if r.from <= shardIdx && shardIdx <= r.to {
+			return r.db.db
+		}
+	}
+	return c.Main()
+}
+
+// f is called with each database and the shards of [0, shardN) in it, e.g. to migrate tables
+func (c *Cluster) EachDB(group string, shardN int, f func(db *gorm.DB, shardIdxs []int64)) {
+	shards := make(map[*DBRouter][]int64)
+	for i := int64(0); i < int64(shardN); i++ {
+		db := c.Shard(group, i)
+		shards[db] = append(shards[db], i)
+	}
+	for _, d := range c.dbs {
+		if shardIdxs, ok := shards[d.db]; ok {
+			f(d.db.primary, shardIdxs)
+		}
+	}
+}
+
+// ping each database
+func (c *Cluster) Status(ctx context.Context) []dbmetrics.DBStatus {
+	res := make([]dbmetrics.DBStatus, len(c.dbs))
+	for i, d := range c.dbs {
+		res[i] = dbmetrics.DBStatus{Name: d.name, Shards: c.describe(d)}
+		sqlDB, err := d.db.primary.DB()
+		if err == nil {
+			pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+			err = sqlDB.PingContext(pingCtx)
+			cancel()
+			res[i].Pool = sqlDB.Stats()
+		}
+		res[i].Up = err == nil
+		if err != nil {
+			res[i].Err = err.Error()
+		}
+	}
+	return res
+}
+
+// e.g. "user 0-3, post 0-3", "others" for the main database
+func (c *Cluster) describe(d *clusterDB) string {
+	if d == c.dbs[0] {
+		return "others"
+	}
+	var segs []string
+	for group, ranges := range c.ranges {
+		for _, r := range ranges {
+			if r.db == d {
+				segs = append(segs, fmt.Sprintf("%v %v-%v", group, r.from, r.to))
+			}
+		}
+	}
+	sort.Strings(segs)
+	return strings.Join(segs, ", ")
+}
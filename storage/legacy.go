@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"log"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const legacyMoveBatch = 1000
+
+// Posts and replies were in the single tables post and post_reply of the main database before
+// they were sharded. Up moves their rows to the shard tables by PostShardIdx(post_id), then renames
+// the old tables with a _legacy suffix, so it is done once. Rows are copied idempotently,
+// an interrupted move continues on the next Up.
+//
+// IDs of the old rows were not generated to locate shards, e.g. a reply is looked up by
+// PostShardIdx(reply_id) and a board is listed in BoardShardIdx(board_id), which only agree
+// with PostShardIdx(post_id) if there is one shard. So old rows are only moved with
+// sharding.post_shard_n 1.
+func (m *Migrator) moveLegacyPosts(ctx context.Context) error {
+	main := m.cluster.Main().primary.WithContext(ctx)
+	postTable, replyTable := model.Post{}.TableName(), model.PostReply{}.TableName()
+	hasPost, hasReply := main.Migrator().HasTable(postTable), main.Migrator().HasTable(replyTable)
+	if !hasPost && !hasReply {
+		return nil
+	}
+	if shardN := conf.Global().Sharding.PostShardN; shardN != 1 {
+		var n int64
+		for table, has := range map[string]bool{postTable: hasPost, replyTable: hasReply} {
+			if !has {
+				continue
+			}
+			var count int64
+			if err := main.Table(table).Count(&count).Error; err != nil {
+				return errors.Wrapf(err, "fail to count rows of legacy table %v", table)
+			}
+			n += count
+		}
+		if n > 0 {
+			return errors.Errorf("legacy tables %v and %v have %v rows, they can only be moved to shards with sharding.post_shard_n 1, got %v",
+				postTable, replyTable, n, shardN)
+		}
+	}
+
+	if hasPost {
+		err := m.moveLegacyRows(ctx, postTable, func(db *gorm.DB, afterID uint64) (uint64, int, error) {
+			var posts []*model.Post
+			err := db.Unscoped().Table(postTable).Where("id > ?", afterID).Order("id").Limit(legacyMoveBatch).Find(&posts).Error
+			if err != nil || len(posts) == 0 {
+				return 0, 0, err
+			}
+			lastID := posts[len(posts)-1].ID
+			byShard := make(map[int64][]*model.Post)
+			for _, post := range posts {
+				shardIdx := model.PostShardIdx(post.PostID)
+				post.ID = 0 // assigned by the shard table
+				byShard[shardIdx] = append(byShard[shardIdx], post)
+			}
+			for shardIdx, rows := range byShard {
+				err := m.cluster.Shard(model.ShardGroupPost, shardIdx).Primary(ctx).Table(model.PostShardTable(shardIdx)).
+					Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error
+				if err != nil {
+					return 0, 0, errors.Wrapf(err, "fail to copy posts to shard %v", shardIdx)
+				}
+			}
+			return lastID, len(posts), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if hasReply {
+		err := m.moveLegacyRows(ctx, replyTable, func(db *gorm.DB, afterID uint64) (uint64, int, error) {
+			var replies []*model.PostReply
+			err := db.Unscoped().Table(replyTable).Where("id > ?", afterID).Order("id").Limit(legacyMoveBatch).Find(&replies).Error
+			if err != nil || len(replies) == 0 {
+				return 0, 0, err
+			}
+			lastID := replies[len(replies)-1].ID
+			byShard := make(map[int64][]*model.PostReply)
+			for _, reply := range replies {
+				shardIdx := model.PostShardIdx(reply.PostID)
+				reply.ID = 0
+				byShard[shardIdx] = append(byShard[shardIdx], reply)
+			}
+			for shardIdx, rows := range byShard {
+				err := m.cluster.Shard(model.ShardGroupPost, shardIdx).Primary(ctx).Table(model.PostReplyShardTable(shardIdx)).
+					Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error
+				if err != nil {
+					return 0, 0, errors.Wrapf(err, "fail to copy replies to shard %v", shardIdx)
+				}
+			}
+			return lastID, len(replies), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy rows of the legacy table in batches of ascending id, then rename it.
+// copyBatch copies the rows after afterID, returns the last id and the number copied.
+func (m *Migrator) moveLegacyRows(ctx context.Context, table string,
+	copyBatch func(db *gorm.DB, afterID uint64) (lastID uint64, n int, err error)) error {
+	main := m.cluster.Main().primary.WithContext(ctx)
+	var afterID uint64
+	var total int
+	for {
+		if err := m.refreshLock(ctx); err != nil {
+			return err
+		}
+		lastID, n, err := copyBatch(main, afterID)
+		if err != nil {
+			return errors.Wrapf(err, "fail to move legacy table %v", table)
+		}
+		if n == 0 {
+			break
+		}
+		afterID = lastID
+		total += n
+	}
+	if err := main.Migrator().RenameTable(table, table+"_legacy"); err != nil {
+		return errors.Wrapf(err, "fail to rename legacy table %v", table)
+	}
+	log.Printf("migrate: moved %v rows of legacy table %v to shards, renamed it to %v_legacy\n", total, table, table)
+	return nil
+}
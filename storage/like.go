@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"hoyobar/model"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type LikeStorageMySQL struct {
+	db *gorm.DB
+}
+
+var _ = LikeStorage(new(LikeStorageMySQL))
+
+func NewLikeStorageMySQL(db *gorm.DB) *LikeStorageMySQL {
+	return &LikeStorageMySQL{
+		db: db,
+	}
+}
+
+// Create implements LikeStorage
+func (l *LikeStorageMySQL) Create(ctx context.Context, like *model.Like) (bool, error) {
+	err := l.db.WithContext(ctx).Create(like).Error
+	if isDuplicateKeyErr(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "fail to create like")
+	}
+	return true, nil
+}
+
+// Delete implements LikeStorage
+func (l *LikeStorageMySQL) Delete(ctx context.Context, targetID int64, userID int64) (bool, error) {
+	// hard delete, or the unique index will reject liking again
+	res := l.db.WithContext(ctx).Unscoped().
+		Where("target_id = ? AND user_id = ?", targetID, userID).
+		Delete(&model.Like{})
+	if res.Error != nil {
+		return false, errors.Wrapf(res.Error, "fail to delete like")
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// LikedTargets implements LikeStorage
+func (l *LikeStorageMySQL) LikedTargets(ctx context.Context, userID int64, targetIDs []int64) (map[int64]bool, error) {
+	liked := make(map[int64]bool, len(targetIDs))
+	if userID == 0 || len(targetIDs) == 0 {
+		return liked, nil
+	}
+	var likedIDs []int64
+	err := l.db.WithContext(ctx).Model(&model.Like{}).
+		Where("target_id IN ? AND user_id = ?", targetIDs, userID).
+		Pluck("target_id", &likedIDs).Error
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query liked targets")
+	}
+	for _, id := range likedIDs {
+		liked[id] = true
+	}
+	return liked, nil
+}
+
+// CountByTargets implements LikeStorage
+func (l *LikeStorageMySQL) CountByTargets(ctx context.Context, targetIDs []int64) (map[int64]int64, error) {
+	counts := make(map[int64]int64, len(targetIDs))
+	if len(targetIDs) == 0 {
+		return counts, nil
+	}
+	var rows []struct {
+		TargetID int64
+		Cnt      int64
+	}
+	err := l.db.WithContext(ctx).Model(&model.Like{}).
+		Select("target_id, COUNT(*) AS cnt").
+		Where("target_id IN ?", targetIDs).
+		Group("target_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to count likes")
+	}
+	for _, id := range targetIDs {
+		counts[id] = 0
+	}
+	for _, row := range rows {
+		counts[row.TargetID] = row.Cnt
+	}
+	return counts, nil
+}
@@ -0,0 +1,468 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+var errMigrationLockLost = errors.New("migration lock is lost")
+
+const (
+	migrationLockTTL     = 10 * time.Minute
+	migrationLockRefresh = migrationLockTTL / 3 // while migrating, a statement may run longer than the TTL
+	migrationLockWait    = time.Second
+)
+
+// Migrator applies model.Migrations to the cluster. Each database records the migrations
+// applied to its targets, the main tables and each shard. A migration of a shard scope is applied
+// to each shard in one transaction, with its history row (mysql commits DDL implicitly,
+// so a failed shard may be left half changed, statements had better be one per file there).
+// Only the process holding the lock in the main database migrates.
+type Migrator struct {
+	cluster    *Cluster
+	migrations []*model.Migration
+	owner      string
+}
+
+// a part of the schema migrated together, the main tables or a shard
+type migrationTarget struct {
+	name     string // "main", or a shard, e.g. "user3"
+	scope    string
+	shardIdx int64 // -1 for the main tables
+	db       *gorm.DB
+}
+
+type MigrationStatus struct {
+	Version int64
+	Name    string
+	Applied int // targets the migration is applied to
+	Targets int // the main tables, and shards with statements of the migration
+}
+
+func NewMigrator(cluster *Cluster) (*Migrator, error) {
+	migrations, err := model.Migrations(cluster.Main().primary.Dialector.Name())
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &Migrator{
+		cluster:    cluster,
+		migrations: migrations,
+		owner:      fmt.Sprintf("%v:%v", host, os.Getpid()),
+	}, nil
+}
+
+// the newest version known to the binary
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies all migrations
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down reverts the newest applied migration
+func (m *Migrator) Down(ctx context.Context) error {
+	current, err := m.current(ctx)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		log.Println("migrate: no migration to revert")
+		return nil
+	}
+	var prev int64
+	for _, migration := range m.migrations {
+		if migration.Version < current {
+			prev = migration.Version
+		}
+	}
+	return m.To(ctx, prev)
+}
+
+// To applies migrations up to the version and reverts newer ones, 0 reverts all
+func (m *Migrator) To(ctx context.Context, version int64) error {
+	if version != 0 && m.find(version) == nil {
+		return errors.Errorf("unknown migration version %v", version)
+	}
+	return m.withLock(ctx, func(ctx context.Context) error {
+		targets, err := m.targets(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := m.migrate(ctx, targets, version); err != nil {
+			return err
+		}
+		if version != m.Latest() {
+			return nil
+		}
+		return m.moveLegacyPosts(ctx)
+	})
+}
+
+// UpShards brings shards [0, shardN) of the group to the version of the main tables,
+// e.g. before resharding to more shards
+func (m *Migrator) UpShards(ctx context.Context, group string, shardN int) error {
+	return m.withLock(ctx, func(ctx context.Context) error {
+		current, err := m.current(ctx)
+		if err != nil {
+			return err
+		}
+		targets, err := m.targets(ctx, map[string]int{group: shardN})
+		if err != nil {
+			return err
+		}
+		var shards []migrationTarget
+		for _, target := range targets {
+			if target.scope == group {
+				shards = append(shards, target)
+			}
+		}
+		return m.migrate(ctx, shards, current)
+	})
+}
+
+// Status of each migration over all targets
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	targets, err := m.targets(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx, targets)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		res[i] = MigrationStatus{Version: migration.Version, Name: migration.Name}
+		for _, target := range targets {
+			if !target.has(migration) {
+				continue
+			}
+			res[i].Targets++
+			if applied[target.name][migration.Version] {
+				res[i].Applied++
+			}
+		}
+	}
+	return res, nil
+}
+
+func (m *Migrator) migrate(ctx context.Context, targets []migrationTarget, version int64) error {
+	applied, err := m.applied(ctx, targets)
+	if err != nil {
+		return err
+	}
+	// up in order, main tables before shards
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			break
+		}
+		for _, target := range targets {
+			if !target.has(migration) || applied[target.name][migration.Version] {
+				continue
+			}
+			if err := m.apply(ctx, target, migration, migration.Up[target.scope], true); err != nil {
+				return err
+			}
+		}
+	}
+	// down in reverse, shards before main tables
+	for i := len(m.migrations) - 1; i >= 0 && m.migrations[i].Version > version; i-- {
+		migration := m.migrations[i]
+		for j := len(targets) - 1; j >= 0; j-- {
+			target := targets[j]
+			if !target.has(migration) || !applied[target.name][migration.Version] {
+				continue
+			}
+			if err := m.apply(ctx, target, migration, migration.Down[target.scope], false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// every version is recorded on the main tables, so the newest one there is the current version
+func (t migrationTarget) has(migration *model.Migration) bool {
+	_, ok := migration.Up[t.scope]
+	return ok || t.scope == model.MigrationScopeMain
+}
+
+// run statements of the target and record it in one transaction
+func (m *Migrator) apply(ctx context.Context, target migrationTarget, migration *model.Migration, statements []string, up bool) error {
+	if err := m.refreshLock(ctx); err != nil {
+		return err
+	}
+	direction := "up"
+	if !up {
+		direction = "down"
+	}
+	err := target.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, statement := range model.ShardStatements(statements, target.shardIdx) {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		if !up {
+			return tx.Where("version = ? AND target = ?", migration.Version, target.name).
+				Delete(&model.SchemaMigration{}).Error
+		}
+		return tx.Create(&model.SchemaMigration{
+			Version:   migration.Version,
+			Target:    target.name,
+			Name:      migration.Name,
+			AppliedAt: model.Now(),
+		}).Error
+	})
+	if err != nil {
+		return errors.Wrapf(err, "fail to migrate %v of %v_%v %v", direction, migration.Version, migration.Name, target.name)
+	}
+	log.Printf("migrate: %v_%v %v on %v\n", migration.Version, migration.Name, direction, target.name)
+	return nil
+}
+
+// the main tables, then shards of each group in their databases.
+// Shard counts are the most ever recorded by shard maps, or from config before any.
+func (m *Migrator) targets(ctx context.Context, shardNs map[string]int) ([]migrationTarget, error) {
+	main := m.cluster.Main().primary
+	targets := []migrationTarget{{name: model.MigrationScopeMain, scope: model.MigrationScopeMain, shardIdx: -1, db: main}}
+	if shardNs == nil {
+		userShardN, err := m.recordedShardN(ctx, model.ShardGroupUser, conf.Global().Sharding.UserShardN)
+		if err != nil {
+			return nil, err
+		}
+		// tables of a changed post_shard_n are not created, it is refused by RecordShardN
+		postShardN, err := m.recordedShardN(ctx, model.ShardGroupPost, conf.Global().Sharding.PostShardN)
+		if err != nil {
+			return nil, err
+		}
+		shardNs = map[string]int{
+			model.ShardGroupUser: userShardN,
+			model.ShardGroupPost: postShardN,
+		}
+	}
+	for _, group := range []string{model.ShardGroupUser, model.ShardGroupPost} {
+		m.cluster.EachDB(group, shardNs[group], func(db *gorm.DB, shardIdxs []int64) {
+			for _, shardIdx := range shardIdxs {
+				targets = append(targets, migrationTarget{
+					name:     group + strconv.FormatInt(shardIdx, 10),
+					scope:    group,
+					shardIdx: shardIdx,
+					db:       db,
+				})
+			}
+		})
+	}
+	return targets, nil
+}
+
+func (m *Migrator) recordedShardN(ctx context.Context, name string, defaultN int) (int, error) {
+	main := m.cluster.Main().primary.WithContext(ctx)
+	if !main.Migrator().HasTable(&model.ShardMap{}) {
+		return defaultN, nil
+	}
+	var shardN sql.NullInt64
+	err := main.Model(&model.ShardMap{}).Where("name = ?", name).Select("MAX(shard_n)").Scan(&shardN).Error
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to read shard map %v", name)
+	}
+	if !shardN.Valid {
+		return defaultN, nil
+	}
+	return int(shardN.Int64), nil
+}
+
+// target name -> versions applied, history tables are created if missing
+func (m *Migrator) applied(ctx context.Context, targets []migrationTarget) (map[string]map[int64]bool, error) {
+	applied := make(map[string]map[int64]bool)
+	read := make(map[*gorm.DB]bool)
+	for _, target := range targets {
+		if applied[target.name] == nil {
+			applied[target.name] = make(map[int64]bool)
+		}
+		if read[target.db] {
+			continue
+		}
+		read[target.db] = true
+		if err := createTableIfMissing(target.db.WithContext(ctx), &model.SchemaMigration{}); err != nil {
+			return nil, err
+		}
+		var rows []model.SchemaMigration
+		if err := target.db.WithContext(ctx).Find(&rows).Error; err != nil {
+			return nil, errors.Wrapf(err, "fail to read migration history")
+		}
+		for _, row := range rows {
+			if applied[row.Target] == nil {
+				applied[row.Target] = make(map[int64]bool)
+			}
+			applied[row.Target][row.Version] = true
+		}
+	}
+	return applied, nil
+}
+
+// the newest version applied to the main tables
+func (m *Migrator) current(ctx context.Context) (int64, error) {
+	main := m.cluster.Main().primary.WithContext(ctx)
+	if err := createTableIfMissing(main, &model.SchemaMigration{}); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err := main.Model(&model.SchemaMigration{}).Where("target = ?", model.MigrationScopeMain).
+		Select("MAX(version)").Scan(&version).Error
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to read migration history")
+	}
+	return version.Int64, nil
+}
+
+func (m *Migrator) find(version int64) *model.Migration {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return migration
+		}
+	}
+	return nil
+}
+
+// run f holding the lock, wait for it if another process holds it
+// f runs with the lock, its ctx is canceled if the lock is lost
+func (m *Migrator) withLock(ctx context.Context, f func(ctx context.Context) error) error {
+	main := m.cluster.Main().primary.WithContext(ctx)
+	if err := createTableIfMissing(main, &model.MigrationLock{}); err != nil {
+		return err
+	}
+	for waiting := false; ; waiting = true {
+		ok, err := m.tryLock(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		if !waiting {
+			log.Println("migrate: waiting for the lock held by another process")
+		}
+		if err := sleepCtx(ctx, migrationLockWait); err != nil {
+			return errors.Wrap(err, "fail to wait for migration lock")
+		}
+	}
+	defer func() {
+		// released even if ctx is done
+		err := m.cluster.Main().primary.Where("id = ? AND owner = ?", 1, m.owner).Delete(&model.MigrationLock{}).Error
+		if err != nil {
+			log.Printf("migrate: fails to release lock: %v\n", err)
+		}
+	}()
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lost := make(chan error, 1)
+	go func() {
+		err := m.keepLock(lockCtx)
+		if err != nil {
+			cancel()
+		}
+		lost <- err
+	}()
+	err := f(lockCtx)
+	cancel()
+	if lockErr := <-lost; lockErr != nil {
+		return lockErr
+	}
+	return err
+}
+
+// refresh the lock until ctx is done, returns an error if the lock is lost.
+// Failed refreshes are retried until the lock expires.
+func (m *Migrator) keepLock(ctx context.Context) error {
+	ticker := time.NewTicker(migrationLockRefresh)
+	defer ticker.Stop()
+	refreshed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		err := m.refreshLock(ctx)
+		if err == nil {
+			refreshed = time.Now()
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errMigrationLockLost) || time.Since(refreshed) >= migrationLockTTL {
+			return err
+		}
+		log.Printf("migrate: %v, retry later\n", err)
+	}
+}
+
+func (m *Migrator) tryLock(ctx context.Context) (bool, error) {
+	main := m.cluster.Main().primary.WithContext(ctx)
+	now := model.Now()
+	err := main.Create(&model.MigrationLock{ID: 1, Owner: m.owner, ExpireAt: now.Add(migrationLockTTL)}).Error
+	if err == nil {
+		return true, nil
+	}
+	if !isDuplicateKeyErr(err) {
+		return false, errors.Wrap(err, "fail to lock migration")
+	}
+	// take over the lock of a dead process
+	res := main.Model(&model.MigrationLock{}).Where("id = ? AND expire_at < ?", 1, now).
+		Updates(map[string]interface{}{"owner": m.owner, "expire_at": now.Add(migrationLockTTL)})
+	if res.Error != nil {
+		return false, errors.Wrap(res.Error, "fail to lock migration")
+	}
+	return res.RowsAffected > 0, nil
+}
+
+func (m *Migrator) refreshLock(ctx context.Context) error {
+	main := m.cluster.Main().primary.WithContext(ctx)
+	err := main.Model(&model.MigrationLock{}).
+		Where("id = ? AND owner = ?", 1, m.owner).
+		Update("expire_at", model.Now().Add(migrationLockTTL)).Error
+	if err != nil {
+		return errors.Wrap(err, "fail to refresh migration lock")
+	}
+	// not by rows affected, mysql does not count a row updated to the same value
+	var count int64
+	err = main.Model(&model.MigrationLock{}).Where("id = ? AND owner = ?", 1, m.owner).Count(&count).Error
+	if err != nil {
+		return errors.Wrap(err, "fail to refresh migration lock")
+	}
+	if count == 0 {
+		return errMigrationLockLost
+	}
+	return nil
+}
+
+// bookkeeping tables of migrations, not migrated themselves
+func createTableIfMissing(db *gorm.DB, value interface{}) error {
+	if db.Migrator().HasTable(value) {
+		return nil
+	}
+	err := db.Migrator().CreateTable(value)
+	// another process may have created it
+	if err != nil && !db.Migrator().HasTable(value) {
+		return errors.Wrapf(err, "fail to create table of %T", value)
+	}
+	return nil
+}
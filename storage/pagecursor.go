@@ -12,7 +12,7 @@ var pageCursorTimeFormat = "2006-01-02-15-04-05.000" // pricision: ms
 
 func decomposePageCursor(cursor string) (ID int64, t time.Time, err error) {
 	if cursor == "" {
-		return math.MaxInt64, time.Now(), nil
+		return math.MaxInt64, time.Now().UTC(), nil
 	}
 	segs := strings.SplitN(cursor, "_", 2)
 	if len(segs) != 2 {
@@ -41,3 +41,64 @@ func composePageCursor(ID int64, t time.Time) (cursor string) {
 	cursor = fmt.Sprintf("%v_%v", t.UTC().Format(pageCursorTimeFormat), ID) // UTC
 	return cursor
 }
+
+// decompose cursor composed by composeFilteredPageCursor,
+// a cursor from another filter (or from no filter) is rejected.
+func decomposeFilteredPageCursor(cursor string, filter string) (ID int64, t time.Time, err error) {
+	cursor, err = stripCursorFilter(cursor, filter)
+	if err != nil {
+		return ID, t, err
+	}
+	return decomposePageCursor(cursor)
+}
+
+// compose cursor bound to a filter, e.g. "a123" for author_id = 123
+func composeFilteredPageCursor(ID int64, t time.Time, filter string) (cursor string) {
+	return withCursorFilter(composePageCursor(ID, t), filter)
+}
+
+func withCursorFilter(cursor string, filter string) string {
+	if cursor == "" || filter == "" {
+		return cursor
+	}
+	return cursor + "_" + filter
+}
+
+func stripCursorFilter(cursor string, filter string) (string, error) {
+	if cursor == "" || filter == "" {
+		return cursor, nil
+	}
+	suffix := "_" + filter
+	if !strings.HasSuffix(cursor, suffix) {
+		return "", fmt.Errorf("wrong page cursor format, expect filter %v, got %v", filter, cursor)
+	}
+	return strings.TrimSuffix(cursor, suffix), nil
+}
+
+// decompose cursor composed by composeScorePageCursor
+func decomposeScorePageCursor(cursor string) (ID int64, score float64, err error) {
+	if cursor == "" {
+		return math.MaxInt64, math.MaxFloat64, nil
+	}
+	segs := strings.SplitN(cursor, "_", 2)
+	if len(segs) != 2 {
+		return ID, score, fmt.Errorf("Wrong page cursor format: %v", cursor)
+	}
+
+	score, err = strconv.ParseFloat(segs[0], 64)
+	if err != nil {
+		return ID, score, fmt.Errorf("wrong page cursor format, expect first part a float, got %v", segs[0])
+	}
+
+	ID, err = strconv.ParseInt(segs[1], 10, 64)
+	if err != nil {
+		return ID, score, fmt.Errorf("wrong page cursor format, expect second part a int, got %v", segs[1])
+	}
+
+	return ID, score, nil
+}
+
+// compose cursor for lists ordered by (score, ID)
+func composeScorePageCursor(ID int64, score float64) (cursor string) {
+	return fmt.Sprintf("%v_%v", strconv.FormatFloat(score, 'g', -1, 64), ID)
+}
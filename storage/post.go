@@ -6,34 +6,46 @@ import (
 	"hoyobar/conf"
 	"hoyobar/model"
 	"hoyobar/util/funcs"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
 )
 
+// post shards are in the databases of their ranges, other tables are in the main database
 type PostStorageMySQL struct {
-	db *gorm.DB
+	db      *DBRouter
+	cluster *Cluster
 }
 
 var _ = PostStorage(new(PostStorageMySQL))
 
-func NewPostStorageMySQL(db *gorm.DB) *PostStorageMySQL {
+func NewPostStorageMySQL(cluster *Cluster) *PostStorageMySQL {
 	return &PostStorageMySQL{
-		db: db,
+		db:      cluster.Main(),
+		cluster: cluster,
 	}
 }
 
+// database of the shard of the post
+func (p *PostStorageMySQL) shardDB(postID int64) *DBRouter {
+	return p.cluster.Shard(model.ShardGroupPost, model.PostShardIdx(postID))
+}
+
 // Create implements PostStorage
 func (p *PostStorageMySQL) Create(ctx context.Context, post *model.Post) error {
-	err := p.db.Create(post).Error
+	err := p.shardDB(post.PostID).Write(ctx).Scopes(model.TableOfPost(post, post.PostID)).Create(post).Error
 	return errors.Wrapf(err, "fail to create post data")
 }
 
 // FetchByPostID implements PostStorage
 func (p *PostStorageMySQL) FetchByPostID(ctx context.Context, postID int64) (*model.Post, error) {
 	postM := model.Post{}
-	err := p.db.Model(&model.Post{}).Where("post_id = ?", postID).First(&postM).Error
+	err := p.shardDB(postID).Read(ctx).Scopes(model.TableOfPost(&postM, postID)).
+		Where("post_id = ?", postID).First(&postM).Error
 	if err == gorm.ErrRecordNotFound {
 		return nil, nil
 	}
@@ -46,7 +58,7 @@ func (p *PostStorageMySQL) FetchByPostID(ctx context.Context, postID int64) (*mo
 // HasPost implements PostStorage
 func (p *PostStorageMySQL) HasPost(ctx context.Context, postID int64) (bool, error) {
 	var count int64
-	err := p.db.Model(&model.Post{}).
+	err := p.shardDB(postID).Read(ctx).Model(&model.Post{}).Scopes(model.TableOfPost(&model.Post{}, postID)).
 		Where("post_id = ?", postID).Count(&count).Error
 	if err != nil {
 		return false, errors.Wrap(err, "fails to check postID existence")
@@ -54,36 +66,95 @@ func (p *PostStorageMySQL) HasPost(ctx context.Context, postID int64) (bool, err
 	return count > 0, nil
 }
 
+// FetchByPostIDs implements PostStorage
+func (p *PostStorageMySQL) FetchByPostIDs(ctx context.Context, postIDs []int64) ([]*model.Post, error) {
+	var list []*model.Post
+	if len(postIDs) == 0 {
+		return list, nil
+	}
+	shards := make(map[int64][]int64)
+	for _, postID := range postIDs {
+		shardIdx := model.PostShardIdx(postID)
+		shards[shardIdx] = append(shards[shardIdx], postID)
+	}
+	for shardIdx, shardPostIDs := range shards {
+		var shardList []*model.Post
+		err := p.cluster.Shard(model.ShardGroupPost, shardIdx).Read(ctx).Table(model.PostShardTable(shardIdx)).
+			Where("post_id IN ?", shardPostIDs).
+			Find(&shardList).Error
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to query posts in shard %v", shardIdx)
+		}
+		list = append(list, shardList...)
+	}
+	return list, nil
+}
+
 // List implements PostStorage
-func (p *PostStorageMySQL) List(ctx context.Context, order string, cursor string, cnt int) (list []*model.Post, newCursor string, err error) {
-	cnt = funcs.Clip(cnt, 1, conf.Global.App.MaxPageSize)
+func (p *PostStorageMySQL) List(ctx context.Context, filter *PostFilter, order string, cursor string, cnt int) (list []*model.Post, newCursor string, err error) {
+	cnt = funcs.Clip(cnt, 1, conf.Global().App.MaxPageSize)
+
+	if filter != nil && filter.Tag != "" && order != PostOrderCreateTimeDesc {
+		return nil, "", errors.Errorf("unsupported post list order with tag: %v", order)
+	}
+	filterTag := postFilterTag(filter)
+	cursor, err = stripCursorFilter(cursor, filterTag)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "wrong cursor: %v", cursor)
+	}
+
+	if filter != nil && filter.Tag != "" {
+		list, newCursor, err = p.listByTag(ctx, filter, cursor, cnt)
+		if err != nil || len(list) == 0 {
+			return nil, withCursorFilter(cursor, filterTag), err
+		}
+		return list, withCursorFilter(newCursor, filterTag), nil
+	}
+
+	if order == PostOrderHotDesc {
+		list, newCursor, err = p.listHot(ctx, filter, cursor, cnt)
+		if err != nil || len(list) == 0 {
+			return nil, withCursorFilter(cursor, filterTag), err
+		}
+		return list, withCursorFilter(newCursor, filterTag), nil
+	}
+
 	lastID, lastTime, err := decomposePageCursor(cursor)
 	if err != nil {
 		return nil, "", errors.Wrapf(err, "wrong cursor: %v", cursor)
 	}
 
 	var orderField string
+	var orderTime func(post *model.Post) time.Time
 	switch order {
 	case PostOrderCreateTimeDesc:
 		orderField = "created_at"
+		orderTime = func(post *model.Post) time.Time { return post.CreatedAt }
 	case PostOrderReplyTimeDesc:
 		orderField = "reply_time"
+		orderTime = func(post *model.Post) time.Time { return post.ReplyTime }
 	default:
 		return nil, "", errors.Errorf("unsupported post list order: %v", order)
 	}
 
-	err = p.db.Model(&model.Post{}).
-		Where(fmt.Sprintf("%v <= ?", orderField), lastTime).
-		Where("post_id < ?", lastID).
-		Order(fmt.Sprintf("%v DESC", orderField)).
-		Order("post_id DESC").
-		Limit(cnt).
-		Find(&list).Error
+	list, err = p.fanOut(ctx, filter, cnt, func(query *gorm.DB) *gorm.DB {
+		return query.
+			Where(fmt.Sprintf("%v <= ?", orderField), lastTime).
+			Where("post_id < ?", lastID).
+			Order(fmt.Sprintf("%v DESC", orderField)).
+			Order("post_id DESC")
+	}, func(a, b *model.Post) bool {
+		ta, tb := orderTime(a), orderTime(b)
+		if !ta.Equal(tb) {
+			return ta.After(tb)
+		}
+		return a.PostID > b.PostID
+	})
 	if err != nil {
 		return nil, "", errors.Wrap(err, "fail to query post")
 	}
 	if len(list) == 0 {
-		return nil, cursor, nil
+		return nil, withCursorFilter(cursor, filterTag), nil
 	}
 
 	n := len(list)
@@ -95,17 +166,251 @@ func (p *PostStorageMySQL) List(ctx context.Context, order string, cursor string
 	default:
 		return nil, "", errors.Errorf("unsupported post list order (2): %v", order)
 	}
-	return list, newCursor, nil
+	return list, withCursorFilter(newCursor, filterTag), nil
+}
+
+func postFilterTag(filter *PostFilter) string {
+	var filterTags []string
+	if filter != nil && filter.BoardID != 0 {
+		filterTags = append(filterTags, "b"+funcs.Itoa(filter.BoardID))
+	}
+	if filter != nil && filter.Tag != "" {
+		filterTags = append(filterTags, "t"+filter.Tag)
+	}
+	return strings.Join(filterTags, "_")
+}
+
+// ComposePostListCursor composes the cursor of List ordered by time,
+// so a list served from cache can be continued by List and vice versa.
+func ComposePostListCursor(filter *PostFilter, postID int64, t time.Time) string {
+	return composeFilteredPageCursor(postID, t, postFilterTag(filter))
+}
+
+// DecomposePostListCursor decomposes the cursor of List ordered by time,
+// an empty cursor returns (math.MaxInt64, time.Now()).
+func DecomposePostListCursor(filter *PostFilter, cursor string) (postID int64, t time.Time, err error) {
+	return decomposeFilteredPageCursor(cursor, postFilterTag(filter))
+}
+
+// page by (created_at, post_id) desc over the tag index
+func (p *PostStorageMySQL) listByTag(ctx context.Context, filter *PostFilter, cursor string, cnt int) (list []*model.Post, newCursor string, err error) {
+	lastID, lastTime, err := decomposePageCursor(cursor)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "wrong cursor: %v", cursor)
+	}
+	query := p.db.Read(ctx).Model(&model.PostTag{}).Where("tag = ?", filter.Tag)
+	if filter.BoardID != 0 {
+		query = query.Where("board_id = ?", filter.BoardID)
+	}
+	var postTags []*model.PostTag
+	err = query.
+		Select("post_id, created_at").
+		Where("created_at <= ?", lastTime).
+		Where("post_id < ?", lastID).
+		Order("created_at DESC").
+		Order("post_id DESC").
+		Limit(cnt).
+		Find(&postTags).Error
+	if err != nil {
+		return nil, "", errors.Wrap(err, "fail to query post tag")
+	}
+	if len(postTags) == 0 {
+		return nil, cursor, nil
+	}
+
+	postIDs := make([]int64, len(postTags))
+	for i, postTag := range postTags {
+		postIDs[i] = postTag.PostID
+	}
+	postMs, err := p.FetchByPostIDs(ctx, postIDs)
+	if err != nil {
+		return nil, "", err
+	}
+	postByID := make(map[int64]*model.Post, len(postMs))
+	for _, postM := range postMs {
+		postByID[postM.PostID] = postM
+	}
+	for _, postID := range postIDs {
+		if postM, ok := postByID[postID]; ok { // may be deleted
+			list = append(list, postM)
+		}
+	}
+	last := postTags[len(postTags)-1]
+	return list, composePageCursor(last.PostID, last.CreatedAt), nil
+}
+
+// page by (hot_score, post_id) desc.
+// the score of a post changes over time, so a post may be skipped or repeated between pages.
+func (p *PostStorageMySQL) listHot(ctx context.Context, filter *PostFilter, cursor string, cnt int) (list []*model.Post, newCursor string, err error) {
+	lastID, lastScore, err := decomposeScorePageCursor(cursor)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "wrong cursor: %v", cursor)
+	}
+	list, err = p.fanOut(ctx, filter, cnt, func(query *gorm.DB) *gorm.DB {
+		return query.
+			Where("hot_score < ? OR (hot_score = ? AND post_id < ?)", lastScore, lastScore, lastID).
+			Order("hot_score DESC").
+			Order("post_id DESC")
+	}, func(a, b *model.Post) bool {
+		if a.HotScore != b.HotScore {
+			return a.HotScore > b.HotScore
+		}
+		return a.PostID > b.PostID
+	})
+	if err != nil {
+		return nil, "", errors.Wrap(err, "fail to query hot post")
+	}
+	if len(list) == 0 {
+		return nil, cursor, nil
+	}
+	n := len(list)
+	return list, composeScorePageCursor(list[n-1].PostID, list[n-1].HotScore), nil
+}
+
+// Posts of a board are in one shard, otherwise all shards are queried in parallel.
+// Each shard returns its first cnt posts by the cursor, the merged first cnt of them are the page,
+// so cursors are the same as with a single table.
+func (p *PostStorageMySQL) fanOut(ctx context.Context, filter *PostFilter, cnt int,
+	scope func(query *gorm.DB) *gorm.DB, less func(a, b *model.Post) bool) ([]*model.Post, error) {
+	var shardIdxs []int64
+	if filter != nil && filter.BoardID != 0 {
+		shardIdxs = []int64{model.BoardShardIdx(filter.BoardID)}
+	} else {
+		for i := 0; i < conf.Global().Sharding.PostShardN; i++ {
+			shardIdxs = append(shardIdxs, int64(i))
+		}
+	}
+
+	lists := make([][]*model.Post, len(shardIdxs))
+	errs := make([]error, len(shardIdxs))
+	var wg sync.WaitGroup
+	for i, shardIdx := range shardIdxs {
+		wg.Add(1)
+		go func(i int, shardIdx int64) {
+			defer wg.Done()
+			query := p.cluster.Shard(model.ShardGroupPost, shardIdx).Read(ctx).Table(model.PostShardTable(shardIdx))
+			if filter != nil && filter.BoardID != 0 {
+				query = query.Where("board_id = ?", filter.BoardID)
+			}
+			errs[i] = scope(query).Limit(cnt).Find(&lists[i]).Error
+		}(i, shardIdx)
+	}
+	wg.Wait()
+
+	var list []*model.Post
+	for i, shardIdx := range shardIdxs {
+		if errs[i] != nil {
+			return nil, errors.Wrapf(errs[i], "fail to query %v", model.PostShardTable(shardIdx))
+		}
+		list = append(list, lists[i]...)
+	}
+	if len(shardIdxs) > 1 {
+		sort.Slice(list, func(i, j int) bool { return less(list[i], list[j]) })
+	}
+	if len(list) > cnt {
+		list = list[:cnt]
+	}
+	return list, nil
 }
 
 // IncrementReplyNum implements PostStorage
-func (p *PostStorageMySQL) IncrementReplyNum(ctx context.Context, postID int64, incr int) error {
-	now := time.Now()
-	err := p.db.Model(&model.Post{}).Where("post_id = ?", postID).
+func (p *PostStorageMySQL) IncrementReplyNum(ctx context.Context, postID int64, incr int) (replyTime time.Time, err error) {
+	now := model.Now()
+	updates := map[string]interface{}{
+		"updated_at": now,
+		"reply_num":  gorm.Expr("reply_num + ?", incr),
+	}
+	if incr > 0 {
+		updates["reply_time"] = now
+	}
+	err = p.shardDB(postID).Write(ctx).Model(&model.Post{}).Scopes(model.TableOfPost(&model.Post{}, postID)).
+		Where("post_id = ?", postID).
+		Updates(updates).Error
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "fails to increment reply num")
+	}
+	if incr > 0 {
+		replyTime = now
+	}
+	return replyTime, nil
+}
+
+// UpdateReplyTime implements PostStorage
+func (p *PostStorageMySQL) UpdateReplyTime(ctx context.Context, postID int64) (replyTime time.Time, err error) {
+	now := model.Now()
+	err = p.shardDB(postID).Write(ctx).Model(&model.Post{}).Scopes(model.TableOfPost(&model.Post{}, postID)).
+		Where("post_id = ?", postID).
 		Updates(map[string]interface{}{
 			"reply_time": now,
 			"updated_at": now,
-			"reply_num":  gorm.Expr("reply_num + ?", incr),
 		}).Error
-	return errors.Wrapf(err, "fails to increment reply num")
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "fails to update reply time")
+	}
+	return now, nil
+}
+
+// UpdateLikeNum implements PostStorage
+func (p *PostStorageMySQL) UpdateLikeNum(ctx context.Context, likeNums map[int64]int64) error {
+	if len(likeNums) == 0 {
+		return nil
+	}
+	// one transaction in each database
+	byDB := make(map[*DBRouter][]int64)
+	for id := range likeNums {
+		db := p.shardDB(id)
+		byDB[db] = append(byDB[db], id)
+	}
+	for db, ids := range byDB {
+		err := db.Write(ctx).Transaction(func(tx *gorm.DB) error {
+			for _, id := range ids {
+				err := tx.Model(&model.Post{}).Scopes(model.TableOfPost(&model.Post{}, id)).Where("post_id = ?", id).
+					Update("like_num", likeNums[id]).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "fails to update like num")
+		}
+	}
+	return nil
+}
+
+// ListIDs implements PostStorage
+func (p *PostStorageMySQL) ListIDs(ctx context.Context, afterID int64, cnt int) ([]int64, error) {
+	var ids []int64
+	for i := 0; i < conf.Global().Sharding.PostShardN; i++ {
+		var shardIDs []int64
+		err := p.cluster.Shard(model.ShardGroupPost, int64(i)).Read(ctx).Model(&model.Post{}).Table(model.PostShardTable(int64(i))).
+			Where("post_id > ?", afterID).
+			Order("post_id ASC").
+			Limit(cnt).
+			Pluck("post_id", &shardIDs).Error
+		if err != nil {
+			return nil, errors.Wrapf(err, "fails to list post_id in shard %v", i)
+		}
+		ids = append(ids, shardIDs...)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > cnt {
+		ids = ids[:cnt]
+	}
+	return ids, nil
+}
+
+// UpdateHotScore implements PostStorage
+func (p *PostStorageMySQL) UpdateHotScore(ctx context.Context, postID int64, score float64) error {
+	err := p.shardDB(postID).Write(ctx).Model(&model.Post{}).Scopes(model.TableOfPost(&model.Post{}, postID)).
+		Where("post_id = ?", postID).UpdateColumn("hot_score", score).Error
+	return errors.Wrapf(err, "fails to update hot score")
+}
+
+// Delete implements PostStorage
+func (p *PostStorageMySQL) Delete(ctx context.Context, postID int64) error {
+	err := p.shardDB(postID).Write(ctx).Scopes(model.TableOfPost(&model.Post{}, postID)).
+		Where("post_id = ?", postID).Delete(&model.Post{}).Error
+	return errors.Wrapf(err, "fails to delete post %v", postID)
 }
@@ -5,36 +5,99 @@ import (
 	"hoyobar/conf"
 	"hoyobar/model"
 	"hoyobar/util/funcs"
+	"sort"
+	"time"
 
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
 )
 
+// replies are in the post shards, which are in the databases of their ranges
 type PostReplyStorageMySQL struct {
-	db *gorm.DB
+	cluster *Cluster
 }
 
 var _ = PostReplyStorage(new(PostReplyStorageMySQL))
 
-func NewPostReplyStorageMySQL(db *gorm.DB) *PostReplyStorageMySQL {
+func NewPostReplyStorageMySQL(cluster *Cluster) *PostReplyStorageMySQL {
 	return &PostReplyStorageMySQL{
-		db: db,
+		cluster: cluster,
 	}
 }
 
+// database of the shard of the post, id is a post, reply or parent id
+func (p *PostReplyStorageMySQL) shardDB(id int64) *DBRouter {
+	return p.cluster.Shard(model.ShardGroupPost, model.PostShardIdx(id))
+}
+
 // Create implements PostReplyStorage
 func (p *PostReplyStorageMySQL) Create(ctx context.Context, reply *model.PostReply) error {
-	err := p.db.Model(reply).Create(reply).Error
+	err := p.shardDB(reply.PostID).Write(ctx).Scopes(model.TableOfPostReply(reply, reply.PostID)).Create(reply).Error
 	if err != nil {
 		return errors.Wrapf(err, "fail to create post reply")
 	}
 	return nil
 }
 
+// FetchByReplyID implements PostReplyStorage
+func (p *PostReplyStorageMySQL) FetchByReplyID(ctx context.Context, replyID int64) (*model.PostReply, error) {
+	replyM := model.PostReply{}
+	err := p.shardDB(replyID).Primary(ctx).Scopes(model.TableOfPostReply(&replyM, replyID)).
+		Where("reply_id = ?", replyID).First(&replyM).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query post reply %v", replyID)
+	}
+	return &replyM, nil
+}
+
+// FetchByReplyIDs implements PostReplyStorage
+func (p *PostReplyStorageMySQL) FetchByReplyIDs(ctx context.Context, replyIDs []int64) ([]*model.PostReply, error) {
+	var list []*model.PostReply
+	if len(replyIDs) == 0 {
+		return list, nil
+	}
+	shards := make(map[int64][]int64)
+	for _, replyID := range replyIDs {
+		shardIdx := model.PostShardIdx(replyID)
+		shards[shardIdx] = append(shards[shardIdx], replyID)
+	}
+	for shardIdx, shardReplyIDs := range shards {
+		var shardList []*model.PostReply
+		err := p.cluster.Shard(model.ShardGroupPost, shardIdx).Primary(ctx).Table(model.PostReplyShardTable(shardIdx)).
+			Where("reply_id IN ?", shardReplyIDs).
+			Find(&shardList).Error
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to query post replies in shard %v", shardIdx)
+		}
+		list = append(list, shardList...)
+	}
+	return list, nil
+}
+
 // List implements PostReplyStorage
 func (p *PostReplyStorageMySQL) List(ctx context.Context, postID int64, order string, cursor string, cnt int) (list []*model.PostReply, newCursor string, err error) {
-	cnt = funcs.Clip(cnt, 1, conf.Global.App.MaxPageSize)
-	lastID, lastTime, err := decomposePageCursor(cursor)
+	return p.listFloor(ctx, postID, 0, order, cursor, cnt)
+}
+
+// ListByAuthor implements PostReplyStorage
+func (p *PostReplyStorageMySQL) ListByAuthor(ctx context.Context, postID int64, authorID int64, order string, cursor string, cnt int) (list []*model.PostReply, newCursor string, err error) {
+	if authorID == 0 {
+		return nil, "", errors.New("author id of filter is empty")
+	}
+	return p.listFloor(ctx, postID, authorID, order, cursor, cnt)
+}
+
+// list floors, authorID == 0 means no author filter
+func (p *PostReplyStorageMySQL) listFloor(ctx context.Context, postID int64, authorID int64, order string, cursor string, cnt int) (list []*model.PostReply, newCursor string, err error) {
+	cnt = funcs.Clip(cnt, 1, conf.Global().App.MaxPageSize)
+	var filter string
+	if authorID != 0 {
+		filter = "a" + funcs.Itoa(authorID)
+	}
+	lastID, lastTime, err := decomposeFilteredPageCursor(cursor, filter)
 	if err != nil {
 		return nil, "", errors.Wrapf(err, "wrong cursor: %v", cursor)
 	}
@@ -44,12 +107,17 @@ func (p *PostReplyStorageMySQL) List(ctx context.Context, postID int64, order st
 	}
 
 	// find replies
-	err = p.db.Model(&model.PostReply{}).
-		Where("post_id = ?", postID).
+	query := p.shardDB(postID).Primary(ctx).Model(&model.PostReply{}).Scopes(model.TableOfPostReply(&model.PostReply{}, postID)).
+		Where("post_id = ?", postID)
+	if authorID != 0 {
+		query = query.Where("author_id = ?", authorID)
+	}
+	err = query.
+		Where("parent_id = 0").
 		Where("created_at <= ?", lastTime).
 		Where("reply_id < ?", lastID).
 		Order("created_at DESC").
-		Order("post_id DESC").
+		Order("reply_id DESC").
 		Limit(cnt).
 		Find(&list).Error
 	if err != nil {
@@ -59,7 +127,185 @@ func (p *PostReplyStorageMySQL) List(ctx context.Context, postID int64, order st
 		return nil, cursor, nil
 	}
 
+	n := len(list)
+	newCursor = composeFilteredPageCursor(list[n-1].ReplyID, list[n-1].CreatedAt, filter)
+	return list, newCursor, nil
+}
+
+// ListHot implements PostReplyStorage
+func (p *PostReplyStorageMySQL) ListHot(ctx context.Context, postID int64, cnt int) ([]*model.PostReply, error) {
+	var list []*model.PostReply
+	err := p.shardDB(postID).Primary(ctx).Model(&model.PostReply{}).Scopes(model.TableOfPostReply(&model.PostReply{}, postID)).
+		Where("post_id = ?", postID).
+		Where("parent_id = 0").
+		Where("like_num > 0").
+		Order("like_num DESC").
+		Order("reply_id DESC").
+		Limit(cnt).
+		Find(&list).Error
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query hot post reply")
+	}
+	return list, nil
+}
+
+// ListSub implements PostReplyStorage
+func (p *PostReplyStorageMySQL) ListSub(ctx context.Context, parentID int64, order string, cursor string, cnt int) (list []*model.PostReply, newCursor string, err error) {
+	cnt = funcs.Clip(cnt, 1, conf.Global().App.MaxPageSize)
+
+	query := p.shardDB(parentID).Primary(ctx).Model(&model.PostReply{}).Scopes(model.TableOfPostReply(&model.PostReply{}, parentID)).
+		Where("parent_id = ?", parentID)
+	switch order {
+	case PostReplyOrderCreateTimeAsc:
+		// sub-replies are read in chronological order, so the first page starts from the oldest
+		var lastID int64
+		var lastTime time.Time
+		if cursor != "" {
+			lastID, lastTime, err = decomposePageCursor(cursor)
+			if err != nil {
+				return nil, "", errors.Wrapf(err, "wrong cursor: %v", cursor)
+			}
+		}
+		query = query.
+			Where("created_at >= ?", lastTime).
+			Where("reply_id > ?", lastID).
+			Order("created_at ASC").
+			Order("reply_id ASC")
+	case PostReplyOrderCreateTimeDesc:
+		lastID, lastTime, err := decomposePageCursor(cursor)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "wrong cursor: %v", cursor)
+		}
+		query = query.
+			Where("created_at <= ?", lastTime).
+			Where("reply_id < ?", lastID).
+			Order("created_at DESC").
+			Order("reply_id DESC")
+	default:
+		return nil, "", errors.Errorf("unsupported sub-reply list order: %v", order)
+	}
+
+	err = query.Limit(cnt).Find(&list).Error
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "fail to query sub-reply list")
+	}
+	if len(list) == 0 {
+		return nil, cursor, nil
+	}
+
 	n := len(list)
 	newCursor = composePageCursor(list[n-1].ReplyID, list[n-1].CreatedAt)
 	return list, newCursor, nil
 }
+
+// ListSubPreview implements PostReplyStorage
+func (p *PostReplyStorageMySQL) ListSubPreview(ctx context.Context, postID int64, parentIDs []int64, cnt int) (map[int64][]*model.PostReply, error) {
+	byParent := make(map[int64][]*model.PostReply)
+	if len(parentIDs) == 0 || cnt <= 0 {
+		return byParent, nil
+	}
+	db := p.shardDB(postID).Primary(ctx)
+	// first cnt rows of each parent in one query, instead of one query per floor
+	ranked := db.Model(&model.PostReply{}).Scopes(model.TableOfPostReply(&model.PostReply{}, postID)).
+		Select("*, ROW_NUMBER() OVER (PARTITION BY parent_id ORDER BY created_at ASC, reply_id ASC) AS rn").
+		Where("parent_id IN ?", parentIDs)
+	var list []*model.PostReply
+	err := db.Table("(?) AS ranked", ranked).
+		Where("rn <= ?", cnt).
+		Order("parent_id").
+		Order("created_at ASC").
+		Order("reply_id ASC").
+		Find(&list).Error
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query sub-reply previews")
+	}
+	for _, reply := range list {
+		byParent[reply.ParentID] = append(byParent[reply.ParentID], reply)
+	}
+	return byParent, nil
+}
+
+// HasSubReplyBy implements PostReplyStorage
+func (p *PostReplyStorageMySQL) HasSubReplyBy(ctx context.Context, parentID int64, authorID int64) (bool, error) {
+	var count int64
+	err := p.shardDB(parentID).Primary(ctx).Model(&model.PostReply{}).Scopes(model.TableOfPostReply(&model.PostReply{}, parentID)).
+		Where("parent_id = ? AND author_id = ?", parentID, authorID).Limit(1).Count(&count).Error
+	if err != nil {
+		return false, errors.Wrapf(err, "fail to check sub-replies of user %v", authorID)
+	}
+	return count > 0, nil
+}
+
+// IncrementSubReplyNum implements PostReplyStorage
+func (p *PostReplyStorageMySQL) IncrementSubReplyNum(ctx context.Context, replyID int64, incr int) error {
+	err := p.shardDB(replyID).Write(ctx).Model(&model.PostReply{}).Scopes(model.TableOfPostReply(&model.PostReply{}, replyID)).
+		Where("reply_id = ?", replyID).
+		Updates(map[string]interface{}{
+			"updated_at":    model.Now(),
+			"sub_reply_num": gorm.Expr("sub_reply_num + ?", incr),
+		}).Error
+	return errors.Wrapf(err, "fails to increment sub-reply num")
+}
+
+// Delete implements PostReplyStorage
+func (p *PostReplyStorageMySQL) Delete(ctx context.Context, replyID int64) (deleted int64, err error) {
+	// soft delete, sub-replies of a floor are hidden together with it
+	result := p.shardDB(replyID).Write(ctx).Scopes(model.TableOfPostReply(&model.PostReply{}, replyID)).
+		Where("reply_id = ? OR parent_id = ?", replyID, replyID).
+		Delete(&model.PostReply{})
+	if result.Error != nil {
+		return 0, errors.Wrapf(result.Error, "fails to delete post reply %v", replyID)
+	}
+	return result.RowsAffected, nil
+}
+
+// UpdateLikeNum implements PostReplyStorage
+func (p *PostReplyStorageMySQL) UpdateLikeNum(ctx context.Context, likeNums map[int64]int64) error {
+	if len(likeNums) == 0 {
+		return nil
+	}
+	// one transaction in each database
+	byDB := make(map[*DBRouter][]int64)
+	for id := range likeNums {
+		db := p.shardDB(id)
+		byDB[db] = append(byDB[db], id)
+	}
+	for db, ids := range byDB {
+		err := db.Write(ctx).Transaction(func(tx *gorm.DB) error {
+			for _, id := range ids {
+				err := tx.Model(&model.PostReply{}).Scopes(model.TableOfPostReply(&model.PostReply{}, id)).Where("reply_id = ?", id).
+					Update("like_num", likeNums[id]).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "fails to update like num")
+		}
+	}
+	return nil
+}
+
+// ListIDs implements PostReplyStorage
+func (p *PostReplyStorageMySQL) ListIDs(ctx context.Context, afterID int64, cnt int) ([]int64, error) {
+	var ids []int64
+	for i := 0; i < conf.Global().Sharding.PostShardN; i++ {
+		var shardIDs []int64
+		err := p.cluster.Shard(model.ShardGroupPost, int64(i)).Primary(ctx).Model(&model.PostReply{}).Table(model.PostReplyShardTable(int64(i))).
+			Where("reply_id > ?", afterID).
+			Order("reply_id ASC").
+			Limit(cnt).
+			Pluck("reply_id", &shardIDs).Error
+		if err != nil {
+			return nil, errors.Wrapf(err, "fails to list reply_id in shard %v", i)
+		}
+		ids = append(ids, shardIDs...)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > cnt {
+		ids = ids[:cnt]
+	}
+	return ids, nil
+}
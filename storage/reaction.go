@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"hoyobar/model"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type ReactionStorageMySQL struct {
+	db *gorm.DB
+}
+
+var _ = ReactionStorage(new(ReactionStorageMySQL))
+
+func NewReactionStorageMySQL(db *gorm.DB) *ReactionStorageMySQL {
+	return &ReactionStorageMySQL{
+		db: db,
+	}
+}
+
+// Create implements ReactionStorage
+func (r *ReactionStorageMySQL) Create(ctx context.Context, reaction *model.Reaction) (bool, error) {
+	err := r.db.WithContext(ctx).Create(reaction).Error
+	if isDuplicateKeyErr(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "fail to create reaction")
+	}
+	return true, nil
+}
+
+// Delete implements ReactionStorage
+func (r *ReactionStorageMySQL) Delete(ctx context.Context, targetID int64, userID int64, emoji string) (bool, error) {
+	// hard delete, or the unique index will reject reacting again
+	res := r.db.WithContext(ctx).Unscoped().
+		Where("target_id = ? AND user_id = ? AND emoji = ?", targetID, userID, emoji).
+		Delete(&model.Reaction{})
+	if res.Error != nil {
+		return false, errors.Wrapf(res.Error, "fail to delete reaction")
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// CountByTargets implements ReactionStorage
+func (r *ReactionStorageMySQL) CountByTargets(ctx context.Context, targetIDs []int64) (map[int64]map[string]int64, error) {
+	counts := make(map[int64]map[string]int64, len(targetIDs))
+	if len(targetIDs) == 0 {
+		return counts, nil
+	}
+	var rows []struct {
+		TargetID int64
+		Emoji    string
+		Cnt      int64
+	}
+	err := r.db.WithContext(ctx).Model(&model.Reaction{}).
+		Select("target_id, emoji, COUNT(*) AS cnt").
+		Where("target_id IN ?", targetIDs).
+		Group("target_id, emoji").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to count reactions")
+	}
+	for _, id := range targetIDs {
+		counts[id] = map[string]int64{}
+	}
+	for _, row := range rows {
+		counts[row.TargetID][row.Emoji] = row.Cnt
+	}
+	return counts, nil
+}
+
+// UserReactions implements ReactionStorage
+func (r *ReactionStorageMySQL) UserReactions(ctx context.Context, userID int64, targetIDs []int64) (map[int64][]string, error) {
+	reactions := make(map[int64][]string, len(targetIDs))
+	if userID == 0 || len(targetIDs) == 0 {
+		return reactions, nil
+	}
+	var rows []model.Reaction
+	err := r.db.WithContext(ctx).Model(&model.Reaction{}).
+		Select("target_id, emoji").
+		Where("target_id IN ? AND user_id = ?", targetIDs, userID).
+		Find(&rows).Error
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query user reactions")
+	}
+	for _, row := range rows {
+		reactions[row.TargetID] = append(reactions[row.TargetID], row.Emoji)
+	}
+	return reactions, nil
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"hoyobar/model"
+	"hoyobar/util/ctxuser"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DBRouter sends writes to the primary and reads to healthy replicas in turn.
+//
+//   - read-your-writes: reads of a user go to the primary for stickyWindow after the user writes.
+//     writes are remembered by a WriteTracker, which is shared by processes if it is in cache.
+//   - a replica is skipped if it fails to answer a health check, or its lag is over maxLag.
+//     lag is measured by a heartbeat row written to the primary and read from replicas
+//     in the next check, so it is accurate to the check interval.
+//   - without healthy replicas, reads go to the primary.
+type DBRouter struct {
+	primary      *gorm.DB
+	replicas     []*replica
+	stickyWindow time.Duration
+	maxLag       time.Duration
+	next         uint32 // round robin
+	lastBeat     int64  // unix ms, only used by Run
+	tracker      WriteTracker
+}
+
+type replica struct {
+	name    string // for logs
+	db      *gorm.DB
+	healthy int32 // atomic bool, 0 until the first check passes
+}
+
+// a router without replicas routes everything to the primary
+func NewDBRouter(primary *gorm.DB) *DBRouter {
+	return &DBRouter{
+		primary: primary,
+	}
+}
+
+func (r *DBRouter) WithReplicas(replicas map[string]*gorm.DB, stickyWindow, maxLag time.Duration) *DBRouter {
+	for name, db := range replicas {
+		r.replicas = append(r.replicas, &replica{name: name, db: db})
+	}
+	r.stickyWindow = stickyWindow
+	r.maxLag = maxLag
+	if r.tracker == nil {
+		r.tracker = NewMemoryWriteTracker(stickyWindow)
+	}
+	return r
+}
+
+// tracker: where writes of users are remembered, for read-your-writes across processes
+func (r *DBRouter) WithWriteTracker(tracker WriteTracker) *DBRouter {
+	r.tracker = tracker
+	return r
+}
+
+// for writes, reads of the user in ctx go to the primary for a while
+func (r *DBRouter) Write(ctx context.Context) *gorm.DB {
+	if userID := ctxuser.From(ctx); userID != 0 && len(r.replicas) > 0 {
+		r.tracker.MarkWritten(ctx, userID)
+	}
+	return r.primary.WithContext(ctx)
+}
+
+// for reads which must see the latest writes of all users
+func (r *DBRouter) Primary(ctx context.Context) *gorm.DB {
+	return r.primary.WithContext(ctx)
+}
+
+// for reads which can be a little stale
+func (r *DBRouter) Read(ctx context.Context) *gorm.DB {
+	if len(r.replicas) == 0 {
+		return r.primary.WithContext(ctx)
+	}
+	if userID := ctxuser.From(ctx); userID != 0 && r.tracker.RecentlyWritten(ctx, userID) {
+		return r.primary.WithContext(ctx)
+	}
+	start := atomic.AddUint32(&r.next, 1)
+	for i := range r.replicas {
+		rep := r.replicas[(int(start)+i)%len(r.replicas)]
+		if atomic.LoadInt32(&rep.healthy) == 1 {
+			return rep.db.WithContext(ctx)
+		}
+	}
+	return r.primary.WithContext(ctx)
+}
+
+// check replicas every interval until ctx is done
+func (r *DBRouter) Run(ctx context.Context, interval time.Duration) {
+	if len(r.replicas) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *DBRouter) check(ctx context.Context) {
+	// compare with the last heartbeat, which should have been replicated in an interval
+	if r.lastBeat != 0 {
+		for _, rep := range r.replicas {
+			lag, err := replicaLag(ctx, rep.db, r.lastBeat)
+			healthy := err == nil && lag <= r.maxLag
+			var state int32
+			if healthy {
+				state = 1
+			}
+			if old := atomic.SwapInt32(&rep.healthy, state); old != state {
+				log.Printf("replica %v healthy: %v, lag: %v, err: %v\n", rep.name, healthy, lag, err)
+			}
+		}
+	}
+	beat := time.Now().UnixMilli()
+	err := r.primary.WithContext(ctx).
+		Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(&model.Heartbeat{ID: 1, BeatAt: beat}).Error
+	if err != nil {
+		log.Printf("fails to write heartbeat to primary: %v\n", err)
+		return
+	}
+	r.lastBeat = beat
+}
+
+// how far the replica is behind the heartbeat written to the primary
+func replicaLag(ctx context.Context, db *gorm.DB, beat int64) (time.Duration, error) {
+	var heartbeats []model.Heartbeat
+	err := db.WithContext(ctx).Where("id = ?", 1).Limit(1).Find(&heartbeats).Error
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to read heartbeat")
+	}
+	if len(heartbeats) == 0 {
+		return 0, errors.New("no heartbeat replicated")
+	}
+	lag := time.Duration(beat-heartbeats[0].BeatAt) * time.Millisecond
+	if lag < 0 {
+		lag = 0
+	}
+	return lag, nil
+}
@@ -0,0 +1,405 @@
+package storage
+
+import (
+	"context"
+	"hoyobar/model"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const reshardBatchSize = 500
+
+// a table sharded by a shard map, tables of a shard are "<name><shard index>"
+type shardedTable struct {
+	name string
+	key  string // column the table is sharded by
+	byID bool   // key is a snowflake ID, otherwise a string
+}
+
+type shardGroup struct {
+	tables []shardedTable
+}
+
+var shardGroups = map[string]shardGroup{
+	model.ShardGroupUser: {
+		tables: []shardedTable{
+			{name: model.User{}.TableName(), key: "user_id", byID: true},
+			{name: model.UserEmail{}.TableName(), key: "email"},
+			{name: model.UserPhone{}.TableName(), key: "phone"},
+			{name: model.UserNickname{}.TableName(), key: "nickname"},
+		},
+	},
+}
+
+func (g shardGroup) table(name string) (shardedTable, bool) {
+	for _, t := range g.tables {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return shardedTable{}, false
+}
+
+func (t shardedTable) shard(shardIdx int64) string {
+	return t.name + strconv.FormatInt(shardIdx, 10)
+}
+
+func (t shardedTable) keyOf(row map[string]interface{}) (shardKey, error) {
+	v := row[t.key]
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	switch v := v.(type) {
+	case string:
+		if !t.byID {
+			return strShardKey(v), nil
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		return idShardKey(id), errors.Wrapf(err, "wrong %v of %v", t.key, t.name)
+	case int64:
+		if t.byID {
+			return idShardKey(v), nil
+		}
+	}
+	return shardKey{}, errors.Errorf("unexpected %v of %v: %#v", t.key, t.name, v)
+}
+
+// Reshard moves rows to shardN shards by consistent hashing with vnodes points per shard,
+// while other processes keep serving (their routers must be Run with an interval less than settle / 2):
+//
+//  1. record the new version as copying, copy rows which move to their new shards, newer rows are kept.
+//  2. switch to dual_read and wait for all processes to see it, so new writes go to the new shards.
+//  3. copy again to catch up writes to the old shards, and verify every moved row is in its new shard.
+//  4. make the new version active, wait for all processes to see it, and delete moved rows from old shards.
+//
+// It can be run again after a failure, it resumes the resharding in progress.
+// Updates to a row between step 1 and all processes seeing dual_read may be lost if the row
+// is also updated later in the same window. Updates during dual_read copy the row to its new
+// shard first if it is not there yet (see copyForWrite).
+func (r *ShardRouter) Reshard(ctx context.Context, shardN int, vnodes int, settle time.Duration) error {
+	group, ok := shardGroups[r.name]
+	if !ok {
+		return errors.Errorf("unknown shard map %v", r.name)
+	}
+	if err := r.refresh(ctx); err != nil {
+		return err
+	}
+	r.mu.RLock()
+	active, next := r.active, r.next
+	r.mu.RUnlock()
+
+	if next != nil && (next.ShardN != shardN || next.VNodes != vnodes) {
+		return errors.Errorf("resharding to version %v with %v shards and %v vnodes is in progress",
+			next.Version, next.ShardN, next.VNodes)
+	}
+	if next == nil {
+		if active.Kind == model.ShardMapKindRing && active.ShardN == shardN && active.VNodes == vnodes {
+			log.Printf("shard map %v: version %v already has %v shards\n", r.name, active.Version, shardN)
+			return nil
+		}
+		// tables of new shards
+		migrator, err := NewMigrator(r.cluster)
+		if err != nil {
+			return err
+		}
+		if err := migrator.UpShards(ctx, r.name, shardN); err != nil {
+			return err
+		}
+		m := model.ShardMap{
+			Name:    r.name,
+			Version: active.Version + 1,
+			Kind:    model.ShardMapKindRing,
+			ShardN:  shardN,
+			VNodes:  vnodes,
+			State:   model.ShardMapStateCopying,
+		}
+		if err := r.db.WithContext(ctx).Create(&m).Error; err != nil {
+			return errors.Wrapf(err, "fail to record version %v of shard map %v", m.Version, r.name)
+		}
+		next = newShardPlacement(m)
+	}
+	log.Printf("shard map %v: resharding from version %v (%v shards) to version %v (%v shards)\n",
+		r.name, active.Version, active.ShardN, next.Version, next.ShardN)
+
+	if next.State == model.ShardMapStateCopying {
+		if err := r.copyGroup(ctx, group, active, next, false); err != nil {
+			return err
+		}
+		if err := r.setState(ctx, next.Version, model.ShardMapStateDualRead); err != nil {
+			return err
+		}
+	}
+	log.Printf("shard map %v: dual read, waiting %v for all processes\n", r.name, settle)
+	if err := sleepCtx(ctx, settle); err != nil {
+		return err
+	}
+	if err := r.copyGroup(ctx, group, active, next, true); err != nil {
+		return err
+	}
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.ShardMap{}).Where("name = ? AND version = ?", r.name, active.Version).
+			Update("state", model.ShardMapStateRetired).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&model.ShardMap{}).Where("name = ? AND version = ?", r.name, next.Version).
+			Update("state", model.ShardMapStateActive).Error
+	})
+	if err != nil {
+		return errors.Wrapf(err, "fail to cut over to version %v of shard map %v", next.Version, r.name)
+	}
+	log.Printf("shard map %v: version %v is active, waiting %v before cleaning up\n", r.name, next.Version, settle)
+	if err := sleepCtx(ctx, settle); err != nil {
+		return err
+	}
+	return r.cleanGroup(ctx, group, active, next)
+}
+
+// copy the row of the key from its active shard to the shard it is written to, if they differ.
+// During dual_read, a row created or changed in the active shard after the first copy is not
+// in its new shard until the verify copy, an update there would miss it and be overwritten by the copy.
+// Returns if the row is in the shard it is written to.
+func (r *ShardRouter) copyForWrite(ctx context.Context, table string, key shardKey) (bool, error) {
+	t, ok := shardGroups[r.name].table(table)
+	if !ok {
+		return false, errors.Errorf("unknown table %v of shard map %v", table, r.name)
+	}
+	r.mu.RLock()
+	from := r.active.locate(key)
+	r.mu.RUnlock()
+	dest := r.writeShard(key)
+	if dest == from {
+		return false, nil
+	}
+	var value interface{} = key.str
+	if t.byID {
+		value = key.id
+	}
+	var rows []map[string]interface{}
+	err := r.shardDB(from).Primary(ctx).Table(t.shard(from)).Where(t.key+" = ?", value).Find(&rows).Error
+	if err != nil {
+		return false, errors.Wrapf(err, "fail to read %v", t.shard(from))
+	}
+	if len(rows) == 0 {
+		return false, nil
+	}
+	if err := r.copyRows(ctx, t, dest, rows, false); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *ShardRouter) setState(ctx context.Context, version int64, state string) error {
+	err := r.db.WithContext(ctx).Model(&model.ShardMap{}).
+		Where("name = ? AND version = ?", r.name, version).
+		Update("state", state).Error
+	return errors.Wrapf(err, "fail to set version %v of shard map %v to %v", version, r.name, state)
+}
+
+func (r *ShardRouter) copyGroup(ctx context.Context, group shardGroup, from, to *shardPlacement, verify bool) error {
+	for _, t := range group.tables {
+		var moved int64
+		for shardIdx := int64(0); shardIdx < int64(from.ShardN); shardIdx++ {
+			n, err := r.copyShard(ctx, t, shardIdx, from, to, verify)
+			if err != nil {
+				return err
+			}
+			moved += n
+		}
+		if verify {
+			log.Printf("shard map %v: %v rows of %v moved and verified\n", r.name, moved, t.name)
+		} else {
+			log.Printf("shard map %v: %v rows of %v copied\n", r.name, moved, t.name)
+		}
+	}
+	return nil
+}
+
+// copy rows of the shard which move by the new placement, returns the number of them.
+// Rows in the shard which do not belong to it by the old placement are copies, they are skipped.
+func (r *ShardRouter) copyShard(ctx context.Context, t shardedTable, shardIdx int64,
+	from, to *shardPlacement, verify bool) (moved int64, err error) {
+	var lastID uint64
+	for {
+		var rows []map[string]interface{}
+		err = r.shardDB(shardIdx).Primary(ctx).Table(t.shard(shardIdx)).
+			Where("id > ?", lastID).Order("id ASC").Limit(reshardBatchSize).
+			Find(&rows).Error
+		if err != nil {
+			return moved, errors.Wrapf(err, "fail to read %v", t.shard(shardIdx))
+		}
+		if len(rows) == 0 {
+			return moved, nil
+		}
+		lastID, err = rowID(rows[len(rows)-1])
+		if err != nil {
+			return moved, errors.Wrapf(err, "wrong id of %v", t.shard(shardIdx))
+		}
+
+		dests := make(map[int64][]map[string]interface{})
+		for _, row := range rows {
+			key, err := t.keyOf(row)
+			if err != nil {
+				return moved, err
+			}
+			if from.locate(key) != shardIdx {
+				continue
+			}
+			if dest := to.locate(key); dest != shardIdx {
+				dests[dest] = append(dests[dest], row)
+			}
+		}
+		for dest, destRows := range dests {
+			if err = r.copyRows(ctx, t, dest, destRows, verify); err != nil {
+				return moved, err
+			}
+			moved += int64(len(destRows))
+		}
+	}
+}
+
+// insert rows into the shard, or update the existing ones older than them
+func (r *ShardRouter) copyRows(ctx context.Context, t shardedTable, shardIdx int64, rows []map[string]interface{}, verify bool) error {
+	table := t.shard(shardIdx)
+	db := r.shardDB(shardIdx)
+	keys := make([]interface{}, len(rows))
+	for i, row := range rows {
+		delete(row, "id") // ids are per table
+		keys[i] = row[t.key]
+	}
+	var existing []map[string]interface{}
+	err := db.Primary(ctx).Table(table).
+		Select(t.key, "updated_at").Where(t.key+" IN ?", keys).
+		Find(&existing).Error
+	if err != nil {
+		return errors.Wrapf(err, "fail to read %v", table)
+	}
+	updatedAt := make(map[interface{}]time.Time, len(existing))
+	for _, row := range existing {
+		updatedAt[keyValue(row[t.key])] = rowTime(row["updated_at"])
+	}
+
+	var inserts []map[string]interface{}
+	for _, row := range rows {
+		existingAt, ok := updatedAt[keyValue(row[t.key])]
+		switch {
+		case !ok:
+			inserts = append(inserts, row)
+		case rowTime(row["updated_at"]).After(existingAt):
+			err = db.Primary(ctx).Table(table).Where(t.key+" = ?", row[t.key]).Updates(row).Error
+			if err != nil {
+				return errors.Wrapf(err, "fail to update %v", table)
+			}
+		}
+	}
+	if len(inserts) > 0 {
+		if err = db.Primary(ctx).Table(table).Create(&inserts).Error; err != nil {
+			return errors.Wrapf(err, "fail to insert into %v", table)
+		}
+	}
+
+	if !verify {
+		return nil
+	}
+	var count int64
+	err = db.Primary(ctx).Table(table).Where(t.key+" IN ?", keys).Count(&count).Error
+	if err != nil {
+		return errors.Wrapf(err, "fail to count %v", table)
+	}
+	if count != int64(len(rows)) {
+		return errors.Errorf("%v of %v moved rows are in %v, run it again", count, len(rows), table)
+	}
+	return nil
+}
+
+// delete rows from shards they do not belong to by the new placement
+func (r *ShardRouter) cleanGroup(ctx context.Context, group shardGroup, from, to *shardPlacement) error {
+	shardN := from.ShardN
+	if to.ShardN > shardN {
+		shardN = to.ShardN
+	}
+	for _, t := range group.tables {
+		var deleted int64
+		for shardIdx := int64(0); shardIdx < int64(shardN); shardIdx++ {
+			var lastID uint64
+			for {
+				var rows []map[string]interface{}
+				err := r.shardDB(shardIdx).Primary(ctx).Table(t.shard(shardIdx)).
+					Select("id", t.key).Where("id > ?", lastID).Order("id ASC").Limit(reshardBatchSize).
+					Find(&rows).Error
+				if err != nil {
+					return errors.Wrapf(err, "fail to read %v", t.shard(shardIdx))
+				}
+				if len(rows) == 0 {
+					break
+				}
+				var ids []uint64
+				for _, row := range rows {
+					id, err := rowID(row)
+					if err != nil {
+						return errors.Wrapf(err, "wrong id of %v", t.shard(shardIdx))
+					}
+					lastID = id
+					key, err := t.keyOf(row)
+					if err != nil {
+						return err
+					}
+					if to.locate(key) != shardIdx {
+						ids = append(ids, id)
+					}
+				}
+				if len(ids) == 0 {
+					continue
+				}
+				err = r.shardDB(shardIdx).Primary(ctx).
+					Exec("DELETE FROM ? WHERE id IN ?", clause.Table{Name: t.shard(shardIdx)}, ids).Error
+				if err != nil {
+					return errors.Wrapf(err, "fail to delete moved rows from %v", t.shard(shardIdx))
+				}
+				deleted += int64(len(ids))
+			}
+		}
+		log.Printf("shard map %v: %v moved rows of %v deleted from old shards\n", r.name, deleted, t.name)
+	}
+	return nil
+}
+
+func rowID(row map[string]interface{}) (uint64, error) {
+	switch id := row["id"].(type) {
+	case int64:
+		return uint64(id), nil
+	case uint64:
+		return id, nil
+	case []byte:
+		return strconv.ParseUint(string(id), 10, 64)
+	}
+	return 0, errors.Errorf("unexpected id: %#v", row["id"])
+}
+
+// comparable value of a key read from db
+func keyValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+func rowTime(v interface{}) time.Time {
+	t, _ := v.(time.Time)
+	return t
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
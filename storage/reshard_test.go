@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hoyobar/conf"
+	"hoyobar/model"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// users sharded by modulo over userShardN shards of a migrated sqlite db
+func newTestUserStorage(t *testing.T, userShardN int) (*ShardRouter, *UserStorageMySQL) {
+	ctx := context.Background()
+	_, err := conf.Load(conf.Source{Path: "../config.yaml", Sets: []string{
+		"db.type=sqlite3",
+		"cache.type=memory",
+		fmt.Sprintf("sharding.user_shard_n=%v", userShardN),
+	}})
+	if err != nil {
+		t.Fatalf("fail to load config: %v", err)
+	}
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{
+		Logger:  logger.Default.LogMode(logger.Silent),
+		NowFunc: model.Now,
+	})
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	cluster := NewCluster(NewDBRouter(db))
+	migrator, err := NewMigrator(cluster)
+	if err != nil {
+		t.Fatalf("fail to load migrations: %v", err)
+	}
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("fail to migrate: %v", err)
+	}
+	router := NewShardRouter(cluster, model.ShardGroupUser)
+	if err := router.Load(ctx, userShardN); err != nil {
+		t.Fatalf("fail to load shard map: %v", err)
+	}
+	return router, NewUserStorageMySQL(router)
+}
+
+func testUser(userID int64) *model.User {
+	return &model.User{
+		UserID:   userID,
+		Email:    sql.NullString{String: fmt.Sprintf("u%v@test.com", userID), Valid: true},
+		Nickname: fmt.Sprintf("u%v", userID),
+		Password: "hash",
+	}
+}
+
+func createTestUsers(t *testing.T, users *UserStorageMySQL, from, to int64) {
+	for userID := from; userID < to; userID++ {
+		if err := users.Create(context.Background(), testUser(userID)); err != nil {
+			t.Fatalf("fail to create user %v: %v", userID, err)
+		}
+	}
+}
+
+func idRange(from, to int64) []int64 {
+	var ids []int64
+	for id := from; id < to; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// users of testUser readable by each of their keys, and each row only in its shard
+func checkUsers(t *testing.T, router *ShardRouter, users *UserStorageMySQL, userIDs []int64) {
+	ctx := context.Background()
+	for _, userID := range userIDs {
+		user, err := users.FetchByUserID(ctx, userID)
+		if err != nil || user == nil {
+			t.Fatalf("user %v: %v, %v", userID, user, err)
+		}
+		if id, err := users.EmailToUserID(ctx, user.Email.String); err != nil || id != userID {
+			t.Errorf("email of user %v: %v, %v", userID, id, err)
+		}
+		if id, err := users.NicknameToUserID(ctx, user.Nickname); err != nil || id != userID {
+			t.Errorf("nickname of user %v: %v, %v", userID, id, err)
+		}
+	}
+	active := router.activePlacement()
+	for _, table := range shardGroups[model.ShardGroupUser].tables {
+		var total int64
+		for _, shardIdx := range router.allShards() {
+			var rows []map[string]interface{}
+			err := router.shardDB(shardIdx).Primary(ctx).Table(table.shard(shardIdx)).Find(&rows).Error
+			if err != nil {
+				t.Fatalf("fail to read %v: %v", table.shard(shardIdx), err)
+			}
+			for _, row := range rows {
+				key, err := table.keyOf(row)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if active.locate(key) != shardIdx {
+					t.Errorf("%v of %v is in shard %v, want %v", row[table.key], table.name, shardIdx, active.locate(key))
+				}
+			}
+			total += int64(len(rows))
+		}
+		want := int64(len(userIDs))
+		if table.name == (model.UserPhone{}).TableName() {
+			want = 0 // test users have no phone
+		}
+		if total != want {
+			t.Errorf("%v rows of %v, want %v", total, table.name, want)
+		}
+	}
+}
+
+func TestReshard(t *testing.T) {
+	ctx := context.Background()
+	router, users := newTestUserStorage(t, 2)
+	createTestUsers(t, users, 1000, 1100)
+
+	if err := router.Reshard(ctx, 3, 16, 0); err != nil {
+		t.Fatalf("fail to reshard: %v", err)
+	}
+	if err := router.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if active := router.activePlacement(); active.ShardN != 3 || active.Kind != model.ShardMapKindRing {
+		t.Fatalf("active version after resharding: %+v", active.ShardMap)
+	}
+	checkUsers(t, router, users, idRange(1000, 1100))
+
+	// again with the same shards is a no-op
+	if err := router.Reshard(ctx, 3, 16, 0); err != nil {
+		t.Fatalf("fail to reshard again: %v", err)
+	}
+	checkUsers(t, router, users, idRange(1000, 1100))
+}
+
+func TestCopyRowsKeepsNewerRows(t *testing.T) {
+	ctx := context.Background()
+	router, users := newTestUserStorage(t, 2)
+	createTestUsers(t, users, 1000, 1001)
+	table, _ := shardGroups[model.ShardGroupUser].table(model.User{}.TableName())
+	shardIdx := router.activePlacement().locate(idShardKey(1000))
+	user, err := users.FetchByUserID(ctx, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copyNickname := func(nickname string, updatedAt time.Time) {
+		t.Helper()
+		row := map[string]interface{}{
+			"id": 1, "user_id": int64(1000), "nickname": nickname,
+			"created_at": user.CreatedAt, "updated_at": updatedAt,
+		}
+		if err := router.copyRows(ctx, table, shardIdx, []map[string]interface{}{row}, true); err != nil {
+			t.Fatalf("fail to copy: %v", err)
+		}
+	}
+	copyNickname("older", user.UpdatedAt.Add(-time.Second))
+	if got, _ := users.FetchByUserID(ctx, 1000); got.Nickname != user.Nickname {
+		t.Errorf("nickname after copying an older row: %v, want %v", got.Nickname, user.Nickname)
+	}
+	copyNickname("newer", user.UpdatedAt.Add(time.Second))
+	if got, _ := users.FetchByUserID(ctx, 1000); got.Nickname != "newer" {
+		t.Errorf("nickname after copying a newer row: %v, want newer", got.Nickname)
+	}
+
+	// a missing row is inserted
+	row := map[string]interface{}{"user_id": int64(2000), "nickname": "u2000", "updated_at": model.Now()}
+	if err := router.copyRows(ctx, table, shardIdx, []map[string]interface{}{row}, true); err != nil {
+		t.Fatalf("fail to copy: %v", err)
+	}
+	var count int64
+	router.shardDB(shardIdx).Primary(ctx).Table(table.shard(shardIdx)).Where("user_id = ?", 2000).Count(&count)
+	if count != 1 {
+		t.Errorf("%v rows of the copied user, want 1", count)
+	}
+}
+
+// a row created in the active shard after the first copy is updated during dual_read,
+// the update must survive the verify copy, the cut-over and the clean-up
+func TestReshardKeepsUpdatesOfRowsNotCopied(t *testing.T) {
+	ctx := context.Background()
+	router, users := newTestUserStorage(t, 2)
+	createTestUsers(t, users, 1000, 1050)
+
+	// step 1 of Reshard by hand, then stop at dual_read
+	migrator, err := NewMigrator(router.cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.UpShards(ctx, model.ShardGroupUser, 3); err != nil {
+		t.Fatal(err)
+	}
+	m := model.ShardMap{Name: model.ShardGroupUser, Version: 1, Kind: model.ShardMapKindRing,
+		ShardN: 3, VNodes: 16, State: model.ShardMapStateCopying}
+	if err := router.db.Create(&m).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := router.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	active, next := router.active, router.next
+	if err := router.copyGroup(ctx, shardGroups[model.ShardGroupUser], active, next, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// users moving to other shards, created after the copy by processes not seeing dual_read yet
+	var moving []int64
+	for userID := int64(5000); len(moving) < 3; userID++ {
+		if active.locate(idShardKey(userID)) != next.locate(idShardKey(userID)) {
+			moving = append(moving, userID)
+		}
+	}
+	for _, userID := range moving {
+		if err := users.Create(ctx, testUser(userID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := router.setState(ctx, m.Version, model.ShardMapStateDualRead); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.UpdateLocked(ctx, moving[0], true); err != nil {
+		t.Fatalf("fail to lock: %v", err)
+	}
+	if err := users.UpdateRole(ctx, moving[1], model.RoleAdmin); err != nil {
+		t.Fatalf("fail to set role: %v", err)
+	}
+	if err := users.UpdateNickname(ctx, moving[2], fmt.Sprintf("u%v", moving[2]), "renamed"); err != nil {
+		t.Fatalf("fail to rename: %v", err)
+	}
+	if err := users.UpdateLocked(ctx, 9999, true); err == nil {
+		t.Errorf("locking a user not existing: no error")
+	}
+
+	// resumes from dual_read: verify, cut over and clean up
+	if err := router.Reshard(ctx, 3, 16, 0); err != nil {
+		t.Fatalf("fail to reshard: %v", err)
+	}
+	if err := router.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkUsers(t, router, users, append(idRange(1000, 1050), moving...))
+	if user, err := users.FetchByUserID(ctx, moving[0]); err != nil || !user.Locked {
+		t.Errorf("user locked during dual_read: %+v, %v", user, err)
+	}
+	if user, err := users.FetchByUserID(ctx, moving[1]); err != nil || user.Role != model.RoleAdmin {
+		t.Errorf("role set during dual_read: %+v, %v", user, err)
+	}
+	if user, err := users.FetchByUserID(ctx, moving[2]); err != nil || user.Nickname != "renamed" {
+		t.Errorf("user renamed during dual_read: %+v, %v", user, err)
+	}
+	if id, err := users.NicknameToUserID(ctx, "renamed"); err != nil || id != moving[2] {
+		t.Errorf("new nickname: %v, %v", id, err)
+	}
+}
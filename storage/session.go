@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"hoyobar/model"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type SessionStorageMySQL struct {
+	db *gorm.DB
+}
+
+var _ = SessionStorage(new(SessionStorageMySQL))
+
+func NewSessionStorageMySQL(db *gorm.DB) *SessionStorageMySQL {
+	return &SessionStorageMySQL{
+		db: db,
+	}
+}
+
+// Create implements SessionStorage
+func (s *SessionStorageMySQL) Create(ctx context.Context, session *model.Session) error {
+	err := s.db.WithContext(ctx).Create(session).Error
+	return errors.Wrapf(err, "fail to create session")
+}
+
+// UserIDOf implements SessionStorage
+func (s *SessionStorageMySQL) UserIDOf(ctx context.Context, token string) (int64, error) {
+	var sessions []model.Session
+	err := s.db.WithContext(ctx).Where("token = ? AND expire_at > ?", token, time.Now()).
+		Limit(1).Find(&sessions).Error
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to query session")
+	}
+	if len(sessions) == 0 {
+		return 0, nil
+	}
+	return sessions[0].UserID, nil
+}
+
+// DeleteExpired implements SessionStorage
+func (s *SessionStorageMySQL) DeleteExpired(ctx context.Context, t time.Time) (int64, error) {
+	res := s.db.WithContext(ctx).Unscoped().Where("expire_at < ?", t).Delete(&model.Session{})
+	return res.RowsAffected, errors.Wrapf(res.Error, "fail to delete expired sessions")
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"context"
+	"hoyobar/model"
+	"hoyobar/util/hashring"
+	"hoyobar/util/myhash"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// ShardRouter tells the shards of rows of a group of sharded tables by the shard maps recorded in db.
+// The maps are reloaded periodically, so all processes follow a resharding (see Reshard):
+//
+//   - copying: rows are read from and written to the active version.
+//   - dual_read: rows are written to the new version, and read from the new version first, then the active one.
+//   - the new version becomes active.
+//
+// Deletes go to every shard a row may be in, so a deleted row is not copied back.
+type ShardRouter struct {
+	db      *gorm.DB // shard maps are in the primary of the main database
+	cluster *Cluster
+	name    string
+
+	mu       sync.RWMutex
+	active   *shardPlacement
+	next     *shardPlacement // nil if not resharding
+	dualRead bool            // next is in dual_read state
+}
+
+// placement of keys by a shard map version
+type shardPlacement struct {
+	model.ShardMap
+	ring *hashring.Ring // nil for model.ShardMapKindModulo
+}
+
+func newShardPlacement(m model.ShardMap) *shardPlacement {
+	p := &shardPlacement{ShardMap: m}
+	if m.Kind == model.ShardMapKindRing {
+		p.ring = hashring.New(m.ShardN, m.VNodes)
+	}
+	return p
+}
+
+// a row is sharded by a snowflake ID or a string
+type shardKey struct {
+	id  int64
+	str string
+}
+
+func idShardKey(id int64) shardKey {
+	return shardKey{id: id}
+}
+
+func strShardKey(s string) shardKey {
+	return shardKey{str: s}
+}
+
+func (p *shardPlacement) locate(key shardKey) int64 {
+	switch {
+	case p.ring != nil && key.str != "":
+		return p.ring.Locate(myhash.StringKey(key.str))
+	case p.ring != nil:
+		return p.ring.Locate(myhash.SnowflakeKey(key.id))
+	case key.str != "":
+		return myhash.HashString(key.str, int64(p.ShardN))
+	}
+	return myhash.HashSnowflakeID(key.id, int64(p.ShardN))
+}
+
+func NewShardRouter(cluster *Cluster, name string) *ShardRouter {
+	return &ShardRouter{db: cluster.Main().primary, cluster: cluster, name: name}
+}
+
+// RecordShardN records the shard count of a group placed by ShardMapKindModulo without resharding,
+// e.g. posts, when it is first used. Rows are looked for in wrong shards if it changes later,
+// so a count different from the recorded one is an error.
+func RecordShardN(ctx context.Context, cluster *Cluster, name string, shardN int) error {
+	db := cluster.Main().primary.WithContext(ctx)
+	var m model.ShardMap
+	err := db.Where("name = ?", name).
+		Attrs(model.ShardMap{
+			Name:    name,
+			Version: 0,
+			Kind:    model.ShardMapKindModulo,
+			ShardN:  shardN,
+			State:   model.ShardMapStateActive,
+		}).
+		FirstOrCreate(&m).Error
+	if isDuplicateKeyErr(err) {
+		// recorded by another process
+		err = db.Where("name = ?", name).First(&m).Error
+	}
+	if err != nil {
+		return errors.Wrapf(err, "fail to record shard count of %v", name)
+	}
+	if m.ShardN != shardN {
+		return errors.Errorf("%v has %v shards recorded, got %v, rows are not moved by changing it", name, m.ShardN, shardN)
+	}
+	return nil
+}
+
+// database of the shard
+func (r *ShardRouter) shardDB(shardIdx int64) *DBRouter {
+	return r.cluster.Shard(r.name, shardIdx)
+}
+
+// shards with tables, of the active version and the one being resharded to
+func (r *ShardRouter) ShardN() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.next != nil && r.next.ShardN > r.active.ShardN {
+		return r.next.ShardN
+	}
+	return r.active.ShardN
+}
+
+// Load reads the shard maps, if none is recorded, rows are assumed to be placed by
+// model.ShardMapKindModulo over shardN shards, which is recorded as version 0.
+func (r *ShardRouter) Load(ctx context.Context, shardN int) error {
+	err := r.db.WithContext(ctx).
+		Where("name = ?", r.name).
+		Attrs(model.ShardMap{
+			Name:    r.name,
+			Version: 0,
+			Kind:    model.ShardMapKindModulo,
+			ShardN:  shardN,
+			State:   model.ShardMapStateActive,
+		}).
+		FirstOrCreate(&model.ShardMap{}).Error
+	if err != nil {
+		return errors.Wrapf(err, "fail to init shard map %v", r.name)
+	}
+	err = r.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	if active := r.activePlacement(); active.ShardN != shardN {
+		log.Printf("shard count %v of %v is ignored, version %v of the shard map has %v shards, reshard to change it\n",
+			shardN, r.name, active.Version, active.ShardN)
+	}
+	return nil
+}
+
+// reload shard maps every interval until ctx is done
+func (r *ShardRouter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.refresh(ctx); err != nil {
+			log.Printf("fails to refresh shard map %v: %v\n", r.name, err)
+		}
+	}
+}
+
+func (r *ShardRouter) refresh(ctx context.Context) error {
+	var maps []model.ShardMap
+	err := r.db.WithContext(ctx).
+		Where("name = ? AND state <> ?", r.name, model.ShardMapStateRetired).
+		Order("version ASC").
+		Find(&maps).Error
+	if err != nil {
+		return errors.Wrapf(err, "fail to read shard map %v", r.name)
+	}
+	var active, next *shardPlacement
+	var dualRead bool
+	for _, m := range maps {
+		switch m.State {
+		case model.ShardMapStateActive:
+			active = newShardPlacement(m)
+		case model.ShardMapStateCopying, model.ShardMapStateDualRead:
+			next = newShardPlacement(m)
+			dualRead = m.State == model.ShardMapStateDualRead
+		}
+	}
+	if active == nil {
+		return errors.Errorf("no active version of shard map %v", r.name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active == nil || r.active.Version != active.Version {
+		log.Printf("shard map %v: version %v with %v shards is active\n", r.name, active.Version, active.ShardN)
+	}
+	if next != nil && (r.next == nil || r.next.Version != next.Version || r.dualRead != dualRead) {
+		log.Printf("shard map %v: resharding to version %v, %v\n", r.name, next.Version, next.State)
+	}
+	r.active, r.next, r.dualRead = active, next, dualRead
+	return nil
+}
+
+func (r *ShardRouter) activePlacement() *shardPlacement {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.active
+}
+
+// shard to write the row to
+func (r *ShardRouter) writeShard(key shardKey) int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.next != nil && r.dualRead {
+		return r.next.locate(key)
+	}
+	return r.active.locate(key)
+}
+
+// shards to read the row from, in order
+func (r *ShardRouter) readShards(key shardKey) []int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.next != nil && r.dualRead {
+		return distinctShards(r.next.locate(key), r.active.locate(key))
+	}
+	return []int64{r.active.locate(key)}
+}
+
+// shards the row may be in, to delete it
+func (r *ShardRouter) deleteShards(key shardKey) []int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.next != nil {
+		return distinctShards(r.next.locate(key), r.active.locate(key))
+	}
+	return []int64{r.active.locate(key)}
+}
+
+// all shards to read, for scans
+func (r *ShardRouter) allShards() []int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n := r.active.ShardN
+	if r.next != nil && r.dualRead && r.next.ShardN > n {
+		n = r.next.ShardN
+	}
+	shards := make([]int64, n)
+	for i := range shards {
+		shards[i] = int64(i)
+	}
+	return shards
+}
+
+func distinctShards(a, b int64) []int64 {
+	if a == b {
+		return []int64{a}
+	}
+	return []int64{a, b}
+}
@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"context"
+	"hoyobar/model"
+	"testing"
+)
+
+func TestRecordShardN(t *testing.T) {
+	ctx := context.Background()
+	router, _ := newTestUserStorage(t, 2)
+	for _, shardN := range []int{8, 8} {
+		if err := RecordShardN(ctx, router.cluster, model.ShardGroupPost, shardN); err != nil {
+			t.Fatalf("record %v shards: %v", shardN, err)
+		}
+	}
+	if err := RecordShardN(ctx, router.cluster, model.ShardGroupPost, 16); err == nil {
+		t.Errorf("changing 8 shards to 16: no error")
+	}
+}
@@ -2,36 +2,136 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"hoyobar/model"
+	"time"
 )
 
 type UserStorage interface {
 	Create(ctx context.Context, user *model.User) error
 	FetchByUserID(ctx context.Context, userID int64) (*model.User, error)
+	// users not exist are skipped, one query per shard
+	FetchByUserIDs(ctx context.Context, userIDs []int64) ([]*model.User, error)
 	HasUser(ctx context.Context, userID int64) (bool, error)
 	PhoneToUserID(ctx context.Context, phone string) (int64, error)
 	EmailToUserID(ctx context.Context, email string) (int64, error)
 	NicknameToUserID(ctx context.Context, nickname string) (int64, error)
+	UpdateNickname(ctx context.Context, userID int64, oldNickname string, newNickname string) error
+	UpdateRole(ctx context.Context, userID int64, role string) error
+	UpdateLocked(ctx context.Context, userID int64, locked bool) error
+	// nicknames containing keyword, at most cnt ones from each shard
+	SearchNickname(ctx context.Context, keyword string, cnt int) ([]*model.UserNickname, error)
+	// list nicknames greater than after in asc order, for batch jobs
+	ListNicknames(ctx context.Context, after string, cnt int) ([]*model.UserNickname, error)
 }
 
+// a unique value is taken, e.g. a nickname of UpdateNickname
+var ErrDuplicate = errors.New("duplicate key")
+
 const (
 	PostOrderCreateTimeDesc = "create_time"
 	PostOrderReplyTimeDesc  = "reply_time"
+	PostOrderHotDesc        = "hot"
 )
 
+// conditions of post list, zero value means no filter
+type PostFilter struct {
+	BoardID int64
+	Tag     string // normalized tag, only supports PostOrderCreateTimeDesc
+}
+
 const (
 	PostReplyOrderCreateTimeDesc = "create_time"
+	PostReplyOrderCreateTimeAsc  = "create_time_asc"
 )
 
 type PostStorage interface {
 	Create(ctx context.Context, post *model.Post) error
 	FetchByPostID(ctx context.Context, postID int64) (*model.Post, error)
 	HasPost(ctx context.Context, postID int64) (bool, error)
-	List(ctx context.Context, order string, cursor string, cnt int) (list []*model.Post, newCursor string, err error)
-	IncrementReplyNum(ctx context.Context, postID int64, incr int) error
+	FetchByPostIDs(ctx context.Context, postIDs []int64) ([]*model.Post, error)
+	// filter: optional, nil means all posts. cursor is bound to the filter.
+	List(ctx context.Context, filter *PostFilter, order string, cursor string, cnt int) (list []*model.Post, newCursor string, err error)
+	// reply_time is updated if incr > 0, the written one is returned, otherwise zero
+	IncrementReplyNum(ctx context.Context, postID int64, incr int) (replyTime time.Time, err error)
+	// return the written reply_time
+	UpdateReplyTime(ctx context.Context, postID int64) (replyTime time.Time, err error)
+	UpdateHotScore(ctx context.Context, postID int64, score float64) error
+	// soft delete, replies are left, as they are only reached through the post
+	Delete(ctx context.Context, postID int64) error
+	// overwrite like num of posts, key is post ID
+	UpdateLikeNum(ctx context.Context, likeNums map[int64]int64) error
+	// list post IDs greater than afterID in asc order, for batch jobs
+	ListIDs(ctx context.Context, afterID int64, cnt int) ([]int64, error)
 }
 
 type PostReplyStorage interface {
 	Create(ctx context.Context, reply *model.PostReply) error
+	FetchByReplyID(ctx context.Context, replyID int64) (*model.PostReply, error)
+	FetchByReplyIDs(ctx context.Context, replyIDs []int64) ([]*model.PostReply, error)
+	// list floors of a post, sub-replies are excluded
 	List(ctx context.Context, postID int64, order string, cursor string, cnt int) (list []*model.PostReply, newCursor string, err error)
+	// list floors of a post written by authorID, cursor is not interchangeable with List
+	ListByAuthor(ctx context.Context, postID int64, authorID int64, order string, cursor string, cnt int) (list []*model.PostReply, newCursor string, err error)
+	// list the most liked floors of a post, floors without likes are excluded
+	ListHot(ctx context.Context, postID int64, cnt int) ([]*model.PostReply, error)
+	// list sub-replies under a floor
+	ListSub(ctx context.Context, parentID int64, order string, cursor string, cnt int) (list []*model.PostReply, newCursor string, err error)
+	// the oldest cnt sub-replies of each floor, floors must be of the same post. key is floor ID
+	ListSubPreview(ctx context.Context, postID int64, parentIDs []int64, cnt int) (map[int64][]*model.PostReply, error)
+	// check if authorID has written a sub-reply under the floor
+	HasSubReplyBy(ctx context.Context, parentID int64, authorID int64) (bool, error)
+	IncrementSubReplyNum(ctx context.Context, replyID int64, incr int) error
+	// delete a reply, if it is a floor, its sub-replies are deleted too. 0 if it is already deleted
+	Delete(ctx context.Context, replyID int64) (deleted int64, err error)
+	// overwrite like num of replies, key is reply ID
+	UpdateLikeNum(ctx context.Context, likeNums map[int64]int64) error
+	// list reply IDs greater than afterID in asc order, for batch jobs
+	ListIDs(ctx context.Context, afterID int64, cnt int) ([]int64, error)
+}
+
+type LikeStorage interface {
+	// return false if the user has liked the target already
+	Create(ctx context.Context, like *model.Like) (created bool, err error)
+	// return false if the user has not liked the target
+	Delete(ctx context.Context, targetID int64, userID int64) (deleted bool, err error)
+	// which targets among targetIDs are liked by user
+	LikedTargets(ctx context.Context, userID int64, targetIDs []int64) (map[int64]bool, error)
+	// count likes of each target, targets without likes are 0
+	CountByTargets(ctx context.Context, targetIDs []int64) (map[int64]int64, error)
+}
+
+type ReactionStorage interface {
+	// return false if the user has reacted with the emoji already
+	Create(ctx context.Context, reaction *model.Reaction) (created bool, err error)
+	// return false if the user has not reacted with the emoji
+	Delete(ctx context.Context, targetID int64, userID int64, emoji string) (deleted bool, err error)
+	// count reactions of each target by emoji, targets without reactions are empty maps
+	CountByTargets(ctx context.Context, targetIDs []int64) (map[int64]map[string]int64, error)
+	// emojis the user reacted with, by target
+	UserReactions(ctx context.Context, userID int64, targetIDs []int64) (map[int64][]string, error)
+}
+
+type TagCount struct {
+	Tag string `json:"tag"`
+	Cnt int64  `json:"cnt"`
+}
+
+type TagStorage interface {
+	Create(ctx context.Context, tags []*model.PostTag) error
+	// tags by post ID
+	TagsOfPosts(ctx context.Context, postIDs []int64) (map[int64][]string, error)
+	HasTag(ctx context.Context, tag string) (bool, error)
+	// most used tags in a board (0 for all boards) of posts created after since
+	Popular(ctx context.Context, boardID int64, since time.Time, cnt int) ([]TagCount, error)
+	// move posts of tag from to tag to, from disappears
+	Merge(ctx context.Context, from string, to string) error
+}
+
+type SessionStorage interface {
+	Create(ctx context.Context, session *model.Session) error
+	// user ID of an unexpired session, 0 if not found
+	UserIDOf(ctx context.Context, token string) (int64, error)
+	// delete sessions expired before t
+	DeleteExpired(ctx context.Context, t time.Time) (int64, error)
 }
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"hoyobar/model"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type TagStorageMySQL struct {
+	db *gorm.DB
+}
+
+var _ = TagStorage(new(TagStorageMySQL))
+
+func NewTagStorageMySQL(db *gorm.DB) *TagStorageMySQL {
+	return &TagStorageMySQL{
+		db: db,
+	}
+}
+
+// Create implements TagStorage
+func (t *TagStorageMySQL) Create(ctx context.Context, tags []*model.PostTag) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	err := t.db.WithContext(ctx).Create(&tags).Error
+	return errors.Wrapf(err, "fail to create post tags")
+}
+
+// TagsOfPosts implements TagStorage
+func (t *TagStorageMySQL) TagsOfPosts(ctx context.Context, postIDs []int64) (map[int64][]string, error) {
+	tags := make(map[int64][]string, len(postIDs))
+	if len(postIDs) == 0 {
+		return tags, nil
+	}
+	var rows []model.PostTag
+	err := t.db.WithContext(ctx).Model(&model.PostTag{}).
+		Select("post_id, tag").
+		Where("post_id IN ?", postIDs).
+		Order("id ASC").
+		Find(&rows).Error
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query post tags")
+	}
+	for _, row := range rows {
+		tags[row.PostID] = append(tags[row.PostID], row.Tag)
+	}
+	return tags, nil
+}
+
+// HasTag implements TagStorage
+func (t *TagStorageMySQL) HasTag(ctx context.Context, tag string) (bool, error) {
+	var count int64
+	err := t.db.WithContext(ctx).Model(&model.PostTag{}).Where("tag = ?", tag).Limit(1).Count(&count).Error
+	if err != nil {
+		return false, errors.Wrap(err, "fails to check tag existence")
+	}
+	return count > 0, nil
+}
+
+// Popular implements TagStorage
+func (t *TagStorageMySQL) Popular(ctx context.Context, boardID int64, since time.Time, cnt int) ([]TagCount, error) {
+	var list []TagCount
+	query := t.db.WithContext(ctx).Model(&model.PostTag{})
+	if boardID != 0 {
+		query = query.Where("board_id = ?", boardID)
+	}
+	err := query.
+		Select("tag, COUNT(*) AS cnt").
+		Where("created_at >= ?", since).
+		Group("tag").
+		Order("cnt DESC").
+		Order("tag ASC").
+		Limit(cnt).
+		Scan(&list).Error
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query popular tags")
+	}
+	return list, nil
+}
+
+// Merge implements TagStorage
+func (t *TagStorageMySQL) Merge(ctx context.Context, from string, to string) error {
+	err := t.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// posts with both tags keep only one row, or the unique index is violated
+		var dupPostIDs []int64
+		err := tx.Model(&model.PostTag{}).Where("tag = ?", to).Pluck("post_id", &dupPostIDs).Error
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(dupPostIDs); start += 500 {
+			end := start + 500
+			if end > len(dupPostIDs) {
+				end = len(dupPostIDs)
+			}
+			err = tx.Unscoped().
+				Where("tag = ? AND post_id IN ?", from, dupPostIDs[start:end]).
+				Delete(&model.PostTag{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Model(&model.PostTag{}).Where("tag = ?", from).Update("tag", to).Error
+	})
+	return errors.Wrapf(err, "fail to merge tag %q into %q", from, to)
+}
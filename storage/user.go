@@ -3,28 +3,52 @@ package storage
 import (
 	"context"
 	"hoyobar/model"
+	"hoyobar/util/ctxuser"
+	"hoyobar/util/funcs"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
 )
 
+// all user tables are sharded, each shard is in the database of its range
 type UserStorageMySQL struct {
-	db *gorm.DB
+	shards *ShardRouter
 }
 
 var _ = UserStorage(new(UserStorageMySQL))
 
-func NewUserStorageMySQL(db *gorm.DB) *UserStorageMySQL {
+func NewUserStorageMySQL(shards *ShardRouter) *UserStorageMySQL {
 	return &UserStorageMySQL{
-		db: db,
+		shards: shards,
 	}
 }
 
+// first row of the key in its shards, tried in order during resharding.
+// primary: read from the primary, e.g. credentials which are looked up right after registering,
+// when the user is not known to read-your-writes.
+func (u *UserStorageMySQL) first(ctx context.Context, primary bool, key shardKey,
+	table func(shardIdx int64) func(db *gorm.DB) *gorm.DB,
+	dest interface{}, query string, args ...interface{}) error {
+	var err error
+	for _, shardIdx := range u.shards.readShards(key) {
+		db := u.shards.shardDB(shardIdx).Read(ctx)
+		if primary {
+			db = u.shards.shardDB(shardIdx).Primary(ctx)
+		}
+		err = db.Scopes(table(shardIdx)).Where(query, args...).First(dest).Error
+		if err != gorm.ErrRecordNotFound {
+			return err
+		}
+	}
+	return err
+}
+
 // FetchUser implements UserStorage
 func (u *UserStorageMySQL) FetchByUserID(ctx context.Context, userID int64) (*model.User, error) {
 	var userModel model.User
-	err := u.db.Scopes(model.TableOfUser(&userModel, userID)).
-		Where("user_id = ?", userID).First(&userModel).Error
+	err := u.first(ctx, false, idShardKey(userID), model.TableOfUser, &userModel, "user_id = ?", userID)
 	if err == gorm.ErrRecordNotFound {
 		return nil, nil
 	}
@@ -34,29 +58,75 @@ func (u *UserStorageMySQL) FetchByUserID(ctx context.Context, userID int64) (*mo
 	return &userModel, nil
 }
 
+// FetchByUserIDs implements UserStorage
+func (u *UserStorageMySQL) FetchByUserIDs(ctx context.Context, userIDs []int64) ([]*model.User, error) {
+	var list []*model.User
+	// users not found in their first shard are looked for in the next one during resharding
+	for try := 0; len(userIDs) > 0; try++ {
+		shards := make(map[int64][]int64)
+		for _, userID := range userIDs {
+			if shardIdxs := u.shards.readShards(idShardKey(userID)); try < len(shardIdxs) {
+				shards[shardIdxs[try]] = append(shards[shardIdxs[try]], userID)
+			}
+		}
+		if len(shards) == 0 {
+			break
+		}
+		found := make(map[int64]bool)
+		for shardIdx, shardUserIDs := range shards {
+			var shardList []*model.User
+			err := u.shards.shardDB(shardIdx).Read(ctx).Scopes(model.TableOfUser(shardIdx)).
+				Where("user_id IN ?", shardUserIDs).
+				Find(&shardList).Error
+			if err != nil {
+				return nil, errors.Wrapf(err, "fail to fetch users in shard %v", shardIdx)
+			}
+			for _, user := range shardList {
+				found[user.UserID] = true
+			}
+			list = append(list, shardList...)
+		}
+		var notFound []int64
+		for _, userID := range userIDs {
+			if !found[userID] {
+				notFound = append(notFound, userID)
+			}
+		}
+		userIDs = notFound
+	}
+	return list, nil
+}
+
 // HasUser implements UserStorage
 func (u *UserStorageMySQL) HasUser(ctx context.Context, userID int64) (bool, error) {
-	var count int64
-	err := u.db.Scopes(model.TableOfUser(&model.User{}, userID)).
-		Where("user_id = ?", userID).Count(&count).Error
-	if err != nil {
-		return false, errors.Wrap(err, "fails to check user existence")
+	for _, shardIdx := range u.shards.readShards(idShardKey(userID)) {
+		var count int64
+		err := u.shards.shardDB(shardIdx).Read(ctx).Model(&model.User{}).Scopes(model.TableOfUser(shardIdx)).
+			Where("user_id = ?", userID).Count(&count).Error
+		if err != nil {
+			return false, errors.Wrap(err, "fails to check user existence")
+		}
+		if count > 0 {
+			return true, nil
+		}
 	}
-	return count > 0, nil
+	return false, nil
 }
 
 // CreateUser implements UserStorage
 func (u *UserStorageMySQL) Create(ctx context.Context, user *model.User) error {
 	var err error
 	userID := user.UserID
+	// the user is not logged in yet, reads of the new user go to the primary for a while
+	ctx = ctxuser.With(ctx, userID)
 
-	err = u.createNickname(user.Nickname, userID)
+	err = u.createNickname(ctx, user.Nickname, userID)
 	if err != nil {
 		return errors.Wrapf(err, "fail to create nickname for userID=%v", userID)
 	}
 
 	if user.Phone.Valid {
-		err = u.createPhone(user.Phone.String, userID)
+		err = u.createPhone(ctx, user.Phone.String, userID)
 		if err != nil {
 			return errors.Wrapf(err,
 				"fail to create phone for userID=%v, but nickname success", userID,
@@ -65,7 +135,7 @@ func (u *UserStorageMySQL) Create(ctx context.Context, user *model.User) error {
 	}
 
 	if user.Email.Valid {
-		err = u.createEmail(user.Email.String, userID)
+		err = u.createEmail(ctx, user.Email.String, userID)
 		if err != nil {
 			return errors.Wrapf(err,
 				"fail to create email for userID=%v, but phone/nickname success", userID,
@@ -73,7 +143,8 @@ func (u *UserStorageMySQL) Create(ctx context.Context, user *model.User) error {
 		}
 	}
 
-	err = u.db.Scopes(model.TableOfUser(user, userID)).Create(user).Error
+	shardIdx := u.shards.writeShard(idShardKey(userID))
+	err = u.shards.shardDB(shardIdx).Write(ctx).Scopes(model.TableOfUser(shardIdx)).Create(user).Error
 	if err != nil {
 		return errors.Wrapf(err,
 			"fail to create user for userID=%v, but nickname/phone/email success", userID,
@@ -88,8 +159,7 @@ func (u *UserStorageMySQL) PhoneToUserID(ctx context.Context, phone string) (int
 	var err error
 
 	userPhoneM := model.UserPhone{}
-	err = u.db.Scopes(model.TableOfUserPhone(&userPhoneM, phone)).
-		Where("phone = ?", phone).First(&userPhoneM).Error
+	err = u.first(ctx, true, strShardKey(phone), model.TableOfUserPhone, &userPhoneM, "phone = ?", phone)
 	userID = userPhoneM.UserID
 
 	if err == gorm.ErrRecordNotFound {
@@ -107,8 +177,7 @@ func (u *UserStorageMySQL) EmailToUserID(ctx context.Context, email string) (int
 	var err error
 
 	userEmailM := model.UserEmail{}
-	err = u.db.Scopes(model.TableOfUserEmail(&userEmailM, email)).
-		Where("email = ?", email).First(&userEmailM).Error
+	err = u.first(ctx, true, strShardKey(email), model.TableOfUserEmail, &userEmailM, "email = ?", email)
 	userID = userEmailM.UserID
 
 	if err == gorm.ErrRecordNotFound {
@@ -126,8 +195,7 @@ func (u *UserStorageMySQL) NicknameToUserID(ctx context.Context, nickname string
 	var err error
 
 	nicknameM := model.UserNickname{}
-	err = u.db.Scopes(model.TableOfUserNickname(&nicknameM, nickname)).
-		Where("nickname = ?", nickname).First(&nicknameM).Error
+	err = u.first(ctx, true, strShardKey(nickname), model.TableOfUserNickname, &nicknameM, "nickname = ?", nickname)
 	userID = nicknameM.UserID
 
 	if err == gorm.ErrRecordNotFound {
@@ -139,20 +207,183 @@ func (u *UserStorageMySQL) NicknameToUserID(ctx context.Context, nickname string
 	return userID, nil
 }
 
-func (u *UserStorageMySQL) createPhone(phone string, userID int64) error {
-	err := u.db.Scopes(model.TableOfUserPhone(&model.UserPhone{}, phone)).
+// UpdateNickname implements UserStorage
+func (u *UserStorageMySQL) UpdateNickname(ctx context.Context, userID int64, oldNickname string, newNickname string) error {
+	// during resharding, the user row is updated in its new shard, copy it there first
+	if _, err := u.shards.copyForWrite(ctx, model.User{}.TableName(), idShardKey(userID)); err != nil {
+		return errors.Wrapf(err, "fail to update nickname for userID=%v", userID)
+	}
+	newShard := u.shards.writeShard(strShardKey(newNickname))
+	userShard := u.shards.writeShard(idShardKey(userID))
+	oldShards := u.shards.deleteShards(strShardKey(oldNickname))
+	deleteOld := func(db *gorm.DB, shardIdx int64) error {
+		// hard delete, so the old nickname can be used by others
+		err := db.Scopes(model.TableOfUserNickname(shardIdx)).
+			Unscoped().Where("nickname = ? AND user_id = ?", oldNickname, userID).
+			Delete(&model.UserNickname{}).Error
+		return errors.Wrapf(err, "fails to delete old nickname")
+	}
+	update := func(dbOf func(shardIdx int64) *gorm.DB) error {
+		// a user has one nickname in a shard, the old one is deleted first if it is in the same shard
+		if funcs.ContainsInt64(oldShards, newShard) {
+			if err := deleteOld(dbOf(newShard), newShard); err != nil {
+				return err
+			}
+		}
+		err := dbOf(newShard).Scopes(model.TableOfUserNickname(newShard)).
+			Create(&model.UserNickname{Nickname: newNickname, UserID: userID}).Error
+		if isDuplicateKeyErr(err) {
+			// taken by another user after the check of the caller
+			return ErrDuplicate
+		}
+		if err != nil {
+			return errors.Wrapf(err, "fails to create nickname")
+		}
+		err = dbOf(userShard).Model(&model.User{}).Scopes(model.TableOfUser(userShard)).
+			Where("user_id = ?", userID).Update("nickname", newNickname).Error
+		if err != nil {
+			return errors.Wrapf(err, "fails to update user")
+		}
+		for _, shardIdx := range oldShards {
+			if shardIdx == newShard {
+				continue
+			}
+			if err := deleteOld(dbOf(shardIdx), shardIdx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// writes to the database of the new nickname are in a transaction, there is no transaction
+	// across databases, a failure may leave the new nickname taken
+	db := u.shards.shardDB(newShard)
+	err := db.Write(ctx).Transaction(func(tx *gorm.DB) error {
+		return update(func(shardIdx int64) *gorm.DB {
+			if u.shards.shardDB(shardIdx) == db {
+				return tx
+			}
+			return u.shards.shardDB(shardIdx).Write(ctx)
+		})
+	})
+	return errors.Wrapf(err, "fail to update nickname for userID=%v", userID)
+}
+
+// UpdateRole implements UserStorage
+func (u *UserStorageMySQL) UpdateRole(ctx context.Context, userID int64, role string) error {
+	return errors.Wrapf(u.updateUser(ctx, userID, "role", role), "fail to update role for userID=%v", userID)
+}
+
+// UpdateLocked implements UserStorage
+func (u *UserStorageMySQL) UpdateLocked(ctx context.Context, userID int64, locked bool) error {
+	return errors.Wrapf(u.updateUser(ctx, userID, "locked", locked), "fail to update locked for userID=%v", userID)
+}
+
+func (u *UserStorageMySQL) updateUser(ctx context.Context, userID int64, column string, value interface{}) error {
+	key := idShardKey(userID)
+	update := func() (int64, error) {
+		shardIdx := u.shards.writeShard(key)
+		res := u.shards.shardDB(shardIdx).Write(ctx).Model(&model.User{}).Scopes(model.TableOfUser(shardIdx)).
+			Where("user_id = ?", userID).Update(column, value)
+		return res.RowsAffected, res.Error
+	}
+	n, err := update()
+	if err != nil || n > 0 {
+		return err
+	}
+	// during resharding, the row may not be copied to the shard it is written to yet
+	copied, err := u.shards.copyForWrite(ctx, model.User{}.TableName(), key)
+	if err != nil {
+		return err
+	}
+	if !copied {
+		// mysql does not count a row updated to the same value
+		if has, err := u.HasUser(ctx, userID); err != nil || has {
+			return err
+		}
+		return errors.Errorf("user %v is not found", userID)
+	}
+	_, err = update()
+	return err
+}
+
+// SearchNickname implements UserStorage
+func (u *UserStorageMySQL) SearchNickname(ctx context.Context, keyword string, cnt int) ([]*model.UserNickname, error) {
+	// nickname is sharded by hash, so every shard is scanned.
+	// LIKE of postgres is case sensitive, lower both sides to match as mysql and sqlite
+	pattern := "%" + escapeLike(strings.ToLower(keyword)) + "%"
+	var list []*model.UserNickname
+	seen := make(map[string]bool)
+	for _, shardIdx := range u.shards.allShards() {
+		var shardList []*model.UserNickname
+		err := u.shards.shardDB(shardIdx).Read(ctx).Scopes(model.TableOfUserNickname(shardIdx)).
+			Where("LOWER(nickname) LIKE ? ESCAPE ?", pattern, `\`).
+			Limit(cnt).
+			Find(&shardList).Error
+		if err != nil {
+			return nil, errors.Wrapf(err, "fails to search nickname in shard %v", shardIdx)
+		}
+		for _, nickname := range shardList {
+			// during resharding, a nickname may be in two shards, or copied to a shard not used yet
+			if seen[nickname.Nickname] || !funcs.ContainsInt64(u.shards.readShards(strShardKey(nickname.Nickname)), shardIdx) {
+				continue
+			}
+			seen[nickname.Nickname] = true
+			list = append(list, nickname)
+		}
+	}
+	return list, nil
+}
+
+// ListNicknames implements UserStorage
+func (u *UserStorageMySQL) ListNicknames(ctx context.Context, after string, cnt int) ([]*model.UserNickname, error) {
+	var list []*model.UserNickname
+	for _, shardIdx := range u.shards.allShards() {
+		var shardList []*model.UserNickname
+		err := u.shards.shardDB(shardIdx).Read(ctx).Scopes(model.TableOfUserNickname(shardIdx)).
+			Where("nickname > ?", after).
+			Order("nickname ASC").
+			Limit(cnt).
+			Find(&shardList).Error
+		if err != nil {
+			return nil, errors.Wrapf(err, "fails to list nicknames in shard %v", shardIdx)
+		}
+		for _, nickname := range shardList {
+			// during resharding, a nickname may be in two shards, or copied to a shard not used yet
+			if funcs.ContainsInt64(u.shards.readShards(strShardKey(nickname.Nickname)), shardIdx) {
+				list = append(list, nickname)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Nickname < list[j].Nickname })
+	if len(list) > cnt {
+		list = list[:cnt]
+	}
+	return list, nil
+}
+
+func (u *UserStorageMySQL) createPhone(ctx context.Context, phone string, userID int64) error {
+	shardIdx := u.shards.writeShard(strShardKey(phone))
+	err := u.shards.shardDB(shardIdx).Write(ctx).Scopes(model.TableOfUserPhone(shardIdx)).
 		Create(&model.UserPhone{Phone: phone, UserID: userID}).Error
 	return errors.Wrapf(err, "fails to create phone")
 }
 
-func (u *UserStorageMySQL) createEmail(email string, userID int64) error {
-	err := u.db.Scopes(model.TableOfUserEmail(&model.UserEmail{}, email)).
+func (u *UserStorageMySQL) createEmail(ctx context.Context, email string, userID int64) error {
+	shardIdx := u.shards.writeShard(strShardKey(email))
+	err := u.shards.shardDB(shardIdx).Write(ctx).Scopes(model.TableOfUserEmail(shardIdx)).
 		Create(&model.UserEmail{Email: email, UserID: userID}).Error
 	return errors.Wrapf(err, "fails to create email")
 }
 
-func (u *UserStorageMySQL) createNickname(nickname string, userID int64) error {
-	err := u.db.Scopes(model.TableOfUserNickname(&model.UserNickname{}, nickname)).
+func (u *UserStorageMySQL) createNickname(ctx context.Context, nickname string, userID int64) error {
+	shardIdx := u.shards.writeShard(strShardKey(nickname))
+	err := u.shards.shardDB(shardIdx).Write(ctx).Scopes(model.TableOfUserNickname(shardIdx)).
 		Create(&model.UserNickname{Nickname: nickname, UserID: userID}).Error
 	return errors.Wrapf(err, "fails to create nickname")
 }
+
+// escape wildcards in a LIKE pattern, use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"hoyobar/util/mycache"
+	"hoyobar/util/mycache/keys"
+	"sync"
+	"time"
+)
+
+// WriteTracker remembers users who wrote in the sticky window, their reads go to the primary
+type WriteTracker interface {
+	MarkWritten(ctx context.Context, userID int64)
+	RecentlyWritten(ctx context.Context, userID int64) bool
+}
+
+// MemoryWriteTracker only knows writes of this process,
+// a user whose requests are served by several processes may read stale data from a replica.
+type MemoryWriteTracker struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	writtenAt map[int64]time.Time // user ID -> time of the last write
+	prunedAt  time.Time
+}
+
+var _ WriteTracker = (*MemoryWriteTracker)(nil)
+
+func NewMemoryWriteTracker(window time.Duration) *MemoryWriteTracker {
+	return &MemoryWriteTracker{
+		window:    window,
+		writtenAt: make(map[int64]time.Time),
+		prunedAt:  time.Now(),
+	}
+}
+
+// MarkWritten implements WriteTracker
+func (m *MemoryWriteTracker) MarkWritten(ctx context.Context, userID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.writtenAt[userID] = now
+	// drop writers out of the window, so the map does not grow forever
+	if now.Sub(m.prunedAt) >= m.window {
+		for id, t := range m.writtenAt {
+			if now.Sub(t) >= m.window {
+				delete(m.writtenAt, id)
+			}
+		}
+		m.prunedAt = now
+	}
+}
+
+// RecentlyWritten implements WriteTracker
+func (m *MemoryWriteTracker) RecentlyWritten(ctx context.Context, userID int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.writtenAt[userID]
+	return ok && time.Since(t) < m.window
+}
+
+// CacheWriteTracker keeps a key for each user who wrote, which expires after the window,
+// so all processes sharing the cache see the writes.
+// The cache is asked once per user in a request with WithWriteMemo.
+// If the cache fails, the user is taken as written, reads are correct but all go to the primary.
+type CacheWriteTracker struct {
+	cache  mycache.Cache
+	window time.Duration
+}
+
+var _ WriteTracker = (*CacheWriteTracker)(nil)
+
+func NewCacheWriteTracker(cache mycache.Cache, window time.Duration) *CacheWriteTracker {
+	return &CacheWriteTracker{
+		cache:  cache,
+		window: window,
+	}
+}
+
+// MarkWritten implements WriteTracker
+func (c *CacheWriteTracker) MarkWritten(ctx context.Context, userID int64) {
+	memo := writeMemoFrom(ctx)
+	if memo != nil && !memo.mark(userID) {
+		return
+	}
+	_ = c.cache.Set(ctx, keys.UserWritten(userID), "1", c.window)
+}
+
+// RecentlyWritten implements WriteTracker
+func (c *CacheWriteTracker) RecentlyWritten(ctx context.Context, userID int64) bool {
+	memo := writeMemoFrom(ctx)
+	if memo != nil {
+		if written, ok := memo.get(userID); ok {
+			return written
+		}
+	}
+	_, err := c.cache.Get(ctx, keys.UserWritten(userID))
+	written := err != mycache.ErrNotFound
+	if memo != nil {
+		memo.set(userID, written)
+	}
+	return written
+}
+
+type writeMemoKey struct{}
+
+// writes of users known in a request
+type writeMemo struct {
+	mu      sync.Mutex
+	written map[int64]bool
+	marked  map[int64]bool
+}
+
+// for a request, CacheWriteTracker asks the cache once per user in it
+func WithWriteMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, writeMemoKey{}, &writeMemo{
+		written: make(map[int64]bool),
+		marked:  make(map[int64]bool),
+	})
+}
+
+func writeMemoFrom(ctx context.Context) *writeMemo {
+	memo, _ := ctx.Value(writeMemoKey{}).(*writeMemo)
+	return memo
+}
+
+func (m *writeMemo) get(userID int64) (written bool, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	written, ok = m.written[userID]
+	return written, ok
+}
+
+func (m *writeMemo) set(userID int64, written bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.written[userID] = written
+}
+
+// return false if the user is marked in the request already
+func (m *writeMemo) mark(userID int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.written[userID] = true
+	if m.marked[userID] {
+		return false
+	}
+	m.marked[userID] = true
+	return true
+}
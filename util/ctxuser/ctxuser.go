@@ -0,0 +1,19 @@
+// ID of the logged in user carried in context, for layers below handlers
+package ctxuser
+
+import "context"
+
+type ctxKey struct{}
+
+func With(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, ctxKey{}, userID)
+}
+
+// 0 if not logged in
+func From(ctx context.Context) int64 {
+	if ctx == nil {
+		return 0
+	}
+	userID, _ := ctx.Value(ctxKey{}).(int64)
+	return userID
+}
@@ -0,0 +1,235 @@
+// gorm plugin to record latency, rows and errors of statements by table, and log slow ones
+package dbmetrics
+
+import (
+	"database/sql"
+	"errors"
+	"hoyobar/util/reqid"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	startKey = "dbmetrics:start"
+	redacted = "***"
+)
+
+var (
+	// column list of INSERT, vars are in the order of columns row by row
+	insertColumnsRe = regexp.MustCompile("(?is)^\\s*INSERT\\s+INTO\\s+\\S+\\s*\\(([^)]*)\\)\\s*VALUES")
+	// the column compared with a placeholder at the end, e.g. "`email` = ", `"phone" IN ($1,`
+	compareColumnRe = regexp.MustCompile("(?i)[`\"]?(\\w+)[`\"]?\\s*(?:=|<>|!=|<=|>=|<|>|\\bLIKE|\\bIN\\s*\\()(?:[\\s?,]|\\$\\d+)*$")
+)
+
+type StatKey struct {
+	DB    string // name of the database, see Plugin.For
+	Table string // with shard suffix, e.g. "user3"
+	Op    string // create, query, update, delete, row or raw
+}
+
+type Stat struct {
+	Count   int64
+	Errors  int64 // gorm.ErrRecordNotFound is not an error
+	Rows    int64 // affected or returned
+	Slow    int64
+	Seconds float64 // total latency
+}
+
+type TableStat struct {
+	StatKey
+	Stat
+}
+
+// status of a database, for health checks
+type DBStatus struct {
+	Name   string      `json:"name"`
+	Shards string      `json:"shards"` // shards in the database, e.g. "user 0-3, post 0-3"
+	Up     bool        `json:"up"`
+	Err    string      `json:"err,omitempty"`
+	Pool   sql.DBStats `json:"-"`
+}
+
+// Plugin collects stats of databases, register it to each of them by For
+type Plugin struct {
+	slowThreshold time.Duration // negative disables slow query log
+	redactColumns map[string]bool
+
+	mu    sync.Mutex
+	stats map[StatKey]*Stat
+}
+
+// plugin of a database
+type dbPlugin struct {
+	*Plugin
+	database string
+}
+
+var _ gorm.Plugin = (*dbPlugin)(nil)
+
+// values of redactColumns are replaced with "***" in slow query logs
+func New(slowThreshold time.Duration, redactColumns []string) *Plugin {
+	columns := make(map[string]bool, len(redactColumns))
+	for _, column := range redactColumns {
+		columns[strings.ToLower(column)] = true
+	}
+	return &Plugin{
+		slowThreshold: slowThreshold,
+		redactColumns: columns,
+		stats:         make(map[StatKey]*Stat),
+	}
+}
+
+// for db.Use, stats of the database are labeled by the name
+func (p *Plugin) For(database string) gorm.Plugin {
+	return &dbPlugin{Plugin: p, database: database}
+}
+
+// Name implements gorm.Plugin
+func (p *dbPlugin) Name() string {
+	return "dbmetrics"
+}
+
+// Initialize implements gorm.Plugin
+func (p *dbPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	errs := []error{
+		cb.Create().Before("gorm:create").Register("dbmetrics:before_create", p.before),
+		cb.Create().After("gorm:create").Register("dbmetrics:after_create", p.after("create")),
+		cb.Query().Before("gorm:query").Register("dbmetrics:before_query", p.before),
+		cb.Query().After("gorm:query").Register("dbmetrics:after_query", p.after("query")),
+		cb.Update().Before("gorm:update").Register("dbmetrics:before_update", p.before),
+		cb.Update().After("gorm:update").Register("dbmetrics:after_update", p.after("update")),
+		cb.Delete().Before("gorm:delete").Register("dbmetrics:before_delete", p.before),
+		cb.Delete().After("gorm:delete").Register("dbmetrics:after_delete", p.after("delete")),
+		cb.Row().Before("gorm:row").Register("dbmetrics:before_row", p.before),
+		cb.Row().After("gorm:row").Register("dbmetrics:after_row", p.after("row")),
+		cb.Raw().Before("gorm:raw").Register("dbmetrics:before_raw", p.before),
+		cb.Raw().After("gorm:raw").Register("dbmetrics:after_raw", p.after("raw")),
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *dbPlugin) before(db *gorm.DB) {
+	db.InstanceSet(startKey, time.Now())
+}
+
+func (p *dbPlugin) after(op string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		value, ok := db.InstanceGet(startKey)
+		if !ok {
+			return
+		}
+		elapsed := time.Since(value.(time.Time))
+		table := db.Statement.Table
+		if table == "" {
+			table = "unknown"
+		}
+		failed := db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound)
+		slow := p.slowThreshold > 0 && elapsed >= p.slowThreshold
+
+		p.mu.Lock()
+		key := StatKey{DB: p.database, Table: table, Op: op}
+		stat, ok := p.stats[key]
+		if !ok {
+			stat = &Stat{}
+			p.stats[key] = stat
+		}
+		stat.Count++
+		stat.Rows += db.Statement.RowsAffected
+		stat.Seconds += elapsed.Seconds()
+		if failed {
+			stat.Errors++
+		}
+		if slow {
+			stat.Slow++
+		}
+		p.mu.Unlock()
+
+		if slow {
+			sql := db.Statement.SQL.String()
+			sql = db.Dialector.Explain(sql, p.redact(db.Dialector, sql, db.Statement.Vars)...)
+			log.Printf("slow query: %v, db: %v, table: %v, rows: %v, err: %v, request_id: %v, sql: %v\n",
+				elapsed, p.database, table, db.Statement.RowsAffected, db.Error, reqid.From(db.Statement.Context), sql)
+		}
+	}
+}
+
+// copy of vars with values of redactColumns replaced,
+// placeholders of vars are written by the dialector, e.g. "?" of mysql, "$1" of postgres
+func (p *Plugin) redact(dialector gorm.Dialector, sql string, vars []interface{}) []interface{} {
+	res := make([]interface{}, len(vars))
+	copy(res, vars)
+	if m := insertColumnsRe.FindStringSubmatch(sql); m != nil {
+		columns := strings.Split(m[1], ",")
+		for i := range res {
+			if p.isRedacted(columns[i%len(columns)]) {
+				res[i] = redacted
+			}
+		}
+		return res
+	}
+	i := 0
+	placeholder := bindVar(dialector, i)
+	for pos := 0; pos < len(sql) && i < len(res); pos++ {
+		if !strings.HasPrefix(sql[pos:], placeholder) {
+			continue
+		}
+		// "$1" is not the prefix of "$12"
+		if end := pos + len(placeholder); len(placeholder) > 1 && end < len(sql) && sql[end] >= '0' && sql[end] <= '9' {
+			continue
+		}
+		start := pos - 200
+		if start < 0 {
+			start = 0
+		}
+		if m := compareColumnRe.FindStringSubmatch(sql[start:pos]); m != nil && p.isRedacted(m[1]) {
+			res[i] = redacted
+		}
+		i++
+		placeholder = bindVar(dialector, i)
+	}
+	return res
+}
+
+// placeholder of the ith var
+func bindVar(dialector gorm.Dialector, i int) string {
+	var b strings.Builder
+	dialector.BindVarTo(&b, &gorm.Statement{Vars: make([]interface{}, i+1)}, nil)
+	return b.String()
+}
+
+func (p *Plugin) isRedacted(column string) bool {
+	column = strings.Trim(strings.TrimSpace(column), "`\"")
+	return p.redactColumns[strings.ToLower(column)]
+}
+
+// stats since the process started, ordered by db, table and op
+func (p *Plugin) Stats() []TableStat {
+	p.mu.Lock()
+	res := make([]TableStat, 0, len(p.stats))
+	for key, stat := range p.stats {
+		res = append(res, TableStat{StatKey: key, Stat: *stat})
+	}
+	p.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].DB != res[j].DB {
+			return res[i].DB < res[j].DB
+		}
+		if res[i].Table != res[j].Table {
+			return res[i].Table < res[j].Table
+		}
+		return res[i].Op < res[j].Op
+	})
+	return res
+}
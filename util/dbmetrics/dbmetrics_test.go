@@ -0,0 +1,107 @@
+package dbmetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type account struct {
+	ID       uint64
+	Email    string
+	Phone    string
+	Password string
+	Nickname string
+}
+
+// statements are only built, not executed, so no database server is needed
+func dryRunDBs(t *testing.T) map[string]*gorm.DB {
+	dialectors := map[string]gorm.Dialector{
+		"mysql":    mysql.New(mysql.Config{DSN: "root:password@tcp(localhost:3306)/hoyobar_test", SkipInitializeWithVersion: true}),
+		"postgres": postgres.New(postgres.Config{DSN: "host=localhost port=5432 user=postgres dbname=hoyobar_test"}),
+		"sqlite3":  sqlite.Open("file::memory:"),
+	}
+	dbs := make(map[string]*gorm.DB, len(dialectors))
+	for name, dialector := range dialectors {
+		db, err := gorm.Open(dialector, &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+		if err != nil {
+			t.Fatalf("fail to open %v: %v", name, err)
+		}
+		dbs[name] = db
+	}
+	return dbs
+}
+
+func TestRedact(t *testing.T) {
+	p := New(time.Second, []string{"password", "phone", "email"})
+	cases := []struct {
+		name  string
+		build func(db *gorm.DB) *gorm.DB
+		want  []interface{}
+	}{
+		{
+			name: "where",
+			build: func(db *gorm.DB) *gorm.DB {
+				return db.Where("email = ? AND nickname = ?", "a@b.c", "alice").Find(&[]account{})
+			},
+			want: []interface{}{redacted, "alice"},
+		},
+		{
+			name: "in",
+			build: func(db *gorm.DB) *gorm.DB {
+				return db.Where("id > ?", 1).Where("phone IN ?", []string{"123", "456"}).Find(&[]account{})
+			},
+			want: []interface{}{1, redacted, redacted},
+		},
+		{
+			name: "struct conditions",
+			build: func(db *gorm.DB) *gorm.DB {
+				return db.Where(&account{Nickname: "alice", Phone: "123"}).Find(&[]account{})
+			},
+			want: []interface{}{redacted, "alice"},
+		},
+		{
+			name: "update",
+			build: func(db *gorm.DB) *gorm.DB {
+				return db.Model(&account{}).Where("id = ?", 1).Updates(map[string]interface{}{"password": "secret", "nickname": "bob"})
+			},
+			want: []interface{}{"bob", redacted, 1},
+		},
+		{
+			name: "insert",
+			build: func(db *gorm.DB) *gorm.DB {
+				return db.Create(&[]account{
+					{ID: 1, Email: "a@b.c", Phone: "123", Password: "secret", Nickname: "alice"},
+					{ID: 2, Email: "d@e.f", Phone: "456", Password: "secret", Nickname: "bob"},
+				})
+			},
+			want: []interface{}{redacted, redacted, redacted, "alice", uint64(1), redacted, redacted, redacted, "bob", uint64(2)},
+		},
+		{
+			name: "more than 9 vars",
+			build: func(db *gorm.DB) *gorm.DB {
+				return db.Where("id IN ?", []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}).Where("email = ?", "a@b.c").Find(&[]account{})
+			},
+			want: []interface{}{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, redacted},
+		},
+	}
+	for name, db := range dryRunDBs(t) {
+		for _, c := range cases {
+			tx := c.build(db.Session(&gorm.Session{}))
+			if tx.Error != nil {
+				t.Fatalf("%v %v: %v", name, c.name, tx.Error)
+			}
+			stmt := tx.Statement
+			sql := stmt.SQL.String()
+			got := p.redact(db.Dialector, sql, stmt.Vars)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%v %v: redact(%v) = %v, want %v", name, c.name, sql, got, c.want)
+			}
+		}
+	}
+}
@@ -3,11 +3,17 @@ package funcs
 import (
 	"log"
 	"runtime/debug"
+	"sync"
+	"time"
 )
 
+var running sync.WaitGroup
+
 // 捕获panic
 func Go(f func()) {
+	running.Add(1)
 	go func() {
+		defer running.Done()
 		defer func() {
 			if err := recover(); err != nil {
 				log.Printf("panic %v\n", err)
@@ -17,3 +23,19 @@ func Go(f func()) {
 		f()
 	}()
 }
+
+// wait at most timeout for functions started by Go to return, e.g. cache writes before a command exits.
+// false if some are still running.
+func Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
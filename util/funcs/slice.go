@@ -0,0 +1,23 @@
+package funcs
+
+// remove duplicates and keep the first occurrence
+func UniqueInt64(a []int64) []int64 {
+	seen := make(map[int64]bool, len(a))
+	res := make([]int64, 0, len(a))
+	for _, v := range a {
+		if !seen[v] {
+			seen[v] = true
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func ContainsInt64(a []int64, v int64) bool {
+	for _, x := range a {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+// consistent hashing with virtual nodes
+package hashring
+
+import (
+	"hoyobar/util/myhash"
+	"sort"
+	"strconv"
+)
+
+// Ring places each shard at vnodes points of the ring, a key belongs to the shard
+// of the first point clockwise from its hash.
+// Growing from n to m shards moves about (m-n)/m of keys, all of them to the new shards.
+type Ring struct {
+	points []point // sorted by hash
+}
+
+type point struct {
+	hash  uint64
+	shard int64
+}
+
+// shardN and vnodes should > 0
+func New(shardN int, vnodes int) *Ring {
+	points := make([]point, 0, shardN*vnodes)
+	for shard := 0; shard < shardN; shard++ {
+		for v := 0; v < vnodes; v++ {
+			points = append(points, point{
+				hash:  myhash.StringKey("shard-" + strconv.Itoa(shard) + "-" + strconv.Itoa(v)),
+				shard: int64(shard),
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].shard < points[j].shard // same on every node
+	})
+	return &Ring{points: points}
+}
+
+// shard of the key, hash is from myhash.SnowflakeKey or myhash.StringKey
+func (r *Ring) Locate(hash uint64) int64 {
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
@@ -0,0 +1,57 @@
+package hashring
+
+import (
+	"hoyobar/util/myhash"
+	"strconv"
+	"testing"
+)
+
+const keyN = 100000
+
+func TestLocateIsStable(t *testing.T) {
+	a, b := New(8, 64), New(8, 64)
+	for i := int64(0); i < keyN; i++ {
+		hash := myhash.SnowflakeKey(i)
+		if a.Locate(hash) != b.Locate(hash) {
+			t.Fatalf("key %v is placed in shard %v and %v by two rings", i, a.Locate(hash), b.Locate(hash))
+		}
+	}
+}
+
+func TestLocateIsBalanced(t *testing.T) {
+	const shardN = 8
+	r := New(shardN, 64)
+	counts := make([]int, shardN)
+	for i := 0; i < keyN; i++ {
+		counts[r.Locate(myhash.StringKey("key-"+strconv.Itoa(i)))]++
+	}
+	for shard, n := range counts {
+		// 64 vnodes keep each shard within about 25% of the mean
+		if mean := keyN / shardN; n < mean*3/4 || n > mean*5/4 {
+			t.Errorf("shard %v has %v of %v keys: %v", shard, n, keyN, counts)
+		}
+	}
+}
+
+func TestGrowMovesKeysToNewShardsOnly(t *testing.T) {
+	for _, c := range []struct{ from, to int }{{1, 2}, {4, 5}, {8, 16}} {
+		old, grown := New(c.from, 64), New(c.to, 64)
+		moved := 0
+		for i := int64(0); i < keyN; i++ {
+			hash := myhash.SnowflakeKey(i)
+			from, to := old.Locate(hash), grown.Locate(hash)
+			if from == to {
+				continue
+			}
+			moved++
+			if to < int64(c.from) {
+				t.Fatalf("%v -> %v shards: key %v moves from shard %v to old shard %v", c.from, c.to, i, from, to)
+			}
+		}
+		// about (to-from)/to of keys move
+		want := float64(keyN) * float64(c.to-c.from) / float64(c.to)
+		if got := float64(moved); got < want*0.75 || got > want*1.25 {
+			t.Errorf("%v -> %v shards: %v of %v keys move, want about %v", c.from, c.to, moved, keyN, int(want))
+		}
+	}
+}
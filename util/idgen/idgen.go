@@ -1,6 +1,7 @@
 package idgen
 
 import (
+	"hoyobar/util/myhash"
 	"log"
 	"time"
 
@@ -29,3 +30,15 @@ func Init(startTime string, machineID int64) {
 func New() int64 {
 	return node.Generate().Int64()
 }
+
+// new ID which myhash.HashSnowflakeID(ID, shardN) == shardIdx,
+// so the shard of a row can be told from its ID as well as from the ID it is sharded by.
+// It takes about shardN tries.
+func NewInShard(shardIdx int64, shardN int64) int64 {
+	for {
+		id := New()
+		if myhash.HashSnowflakeID(id, shardN) == shardIdx {
+			return id
+		}
+	}
+}
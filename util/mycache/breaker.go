@@ -0,0 +1,442 @@
+package mycache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls go to the cache
+	BreakerOpen                         // calls fail fast with ErrUnavailable
+	BreakerHalfOpen                     // one trial call goes to the cache
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// BreakerCache is a circuit breaker around a Cache.
+// After maxFailures consecutive errors (ErrNotFound and canceled calls are not counted) it opens, and all calls
+// fail fast with ErrUnavailable, so a down Redis does not slow down every request by its timeouts.
+// After cooldown one trial call is let through, it closes the breaker if it succeeds.
+// Only the trial closes it, calls let in before it opened do not, whatever their results.
+//
+// Keys of failed or rejected writes (Set, SetInt64, IncrBy, Del and DelPrefix) may keep stale values,
+// so they are recorded and deleted once the cache is reachable again. After a trial call succeeds,
+// the breaker stays half open and rejects reads until they are deleted, so stale values are never read.
+// Writes are let through meanwhile, or keys rejected during the deletion would have to be deleted again.
+// Sorted sets are not recorded, as deleting one may lose data not in db, callers rebuilding them from db
+// should Del them on a failed write.
+type BreakerCache struct {
+	cache       Cache
+	maxFailures int
+	cooldown    time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int       // consecutive
+	openedAt time.Time // of the last open
+	trying   bool      // a trial call or the replay after it is in flight in half open state
+	stats    BreakerStats
+
+	pending         map[string]struct{} // keys to delete
+	pendingPrefixes map[string]struct{} // prefixes to delete, also key families when there are too many keys
+	replaying       bool
+	replayTrial     bool // the replay finishes a trial, it closes the breaker if it succeeds
+}
+
+const (
+	maxPendingKeys = 10000
+	replayBatch    = 500
+	replayTimeout  = time.Minute
+)
+
+var _ Cache = (*BreakerCache)(nil)
+
+// counters since the process started, for metrics
+type BreakerStats struct {
+	Opened   int64 // times the breaker opened
+	Failures int64 // errors returned by the cache
+	Rejected int64 // calls failed fast
+	Replayed int64 // keys and prefixes deleted after writes to them were lost
+}
+
+func NewBreakerCache(cache Cache, maxFailures int, cooldown time.Duration) *BreakerCache {
+	return &BreakerCache{
+		cache:           cache,
+		maxFailures:     maxFailures,
+		cooldown:        cooldown,
+		pending:         make(map[string]struct{}),
+		pendingPrefixes: make(map[string]struct{}),
+	}
+}
+
+func (b *BreakerCache) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *BreakerCache) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// check if a call can go to the cache, and if it is the trial of half open state.
+// write: writes are let through while the replay after a trial deletes keys of lost writes.
+func (b *BreakerCache) allow(write bool) (ok bool, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+	}
+	switch {
+	case b.state == BreakerClosed:
+		return true, false
+	case b.state == BreakerHalfOpen && !b.trying:
+		b.trying = true
+		return true, true
+	case b.state == BreakerHalfOpen && write && b.replaying && b.replayTrial:
+		return true, false
+	}
+	b.stats.Rejected++
+	return false, false
+}
+
+// record the result of a call, trial: it is the trial of half open state
+func (b *BreakerCache) done(trial bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if errors.Is(err, context.Canceled) {
+		// the caller gave up, not a fault of the cache
+		if trial {
+			b.trying = false
+		}
+		return
+	}
+	if err == nil || err == ErrNotFound {
+		switch {
+		case trial && (b.hasPending() || b.replaying):
+			// trying is kept set, so reads still fail fast until the replay is done
+			b.replayTrial = true
+			b.startReplay()
+		case trial:
+			b.trying = false
+			b.state = BreakerClosed
+			b.failures = 0
+			log.Println("cache is available again, close breaker")
+		case b.state == BreakerClosed:
+			b.failures = 0
+			if b.hasPending() {
+				// keys of writes failed while closed
+				b.startReplay()
+			}
+		}
+		// a late success of a call let in before the breaker opened does not close it
+		return
+	}
+	b.stats.Failures++
+	switch {
+	case trial:
+		b.trying = false
+		b.open()
+	case b.state == BreakerClosed:
+		b.failures++
+		if b.failures >= b.maxFailures {
+			log.Printf("cache failed %d times, open breaker: %v\n", b.failures, err)
+			b.open()
+		}
+	}
+}
+
+// lock should be held
+func (b *BreakerCache) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.stats.Opened++
+}
+
+// lock should be held
+func (b *BreakerCache) startReplay() {
+	if !b.replaying {
+		b.replaying = true
+		go b.replay()
+	}
+}
+
+func (b *BreakerCache) hasPending() bool {
+	return len(b.pending) > 0 || len(b.pendingPrefixes) > 0
+}
+
+// record keys whose writes are lost, lock should not be held
+func (b *BreakerCache) drop(keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range keys {
+		if len(b.pending) >= maxPendingKeys {
+			b.pendingPrefixes[keyFamily(key)] = struct{}{}
+			continue
+		}
+		b.pending[key] = struct{}{}
+	}
+}
+
+func (b *BreakerCache) dropPrefix(prefix string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pendingPrefixes[prefix] = struct{}{}
+}
+
+// "project:part1:", e.g. all cache of posts
+func keyFamily(key string) string {
+	segs := strings.SplitN(key, ":", 3)
+	if len(segs) < 3 {
+		return key
+	}
+	return segs[0] + ":" + segs[1] + ":"
+}
+
+// delete recorded keys and prefixes, the result is recorded as a call, so a failure opens the breaker again
+func (b *BreakerCache) replay() {
+	b.mu.Lock()
+	keys := make([]string, 0, len(b.pending))
+	for key := range b.pending {
+		keys = append(keys, key)
+	}
+	prefixes := make([]string, 0, len(b.pendingPrefixes))
+	for prefix := range b.pendingPrefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	b.pending = make(map[string]struct{})
+	b.pendingPrefixes = make(map[string]struct{})
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), replayTimeout)
+	defer cancel()
+	var err error
+	var n int64
+	var lostKeys, lostPrefixes []string
+	for start := 0; start < len(keys); start += replayBatch {
+		end := start + replayBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err == nil {
+			err = b.cache.Del(ctx, keys[start:end]...)
+		}
+		if err != nil {
+			lostKeys = append(lostKeys, keys[start:end]...)
+			continue
+		}
+		n += int64(end - start)
+	}
+	for _, prefix := range prefixes {
+		if err == nil {
+			_, err = b.cache.DelPrefix(ctx, prefix)
+		}
+		if err != nil {
+			lostPrefixes = append(lostPrefixes, prefix)
+			continue
+		}
+		n++
+	}
+
+	if err != nil {
+		log.Printf("fails to delete keys of lost cache writes, retry later: %v\n", err)
+		b.drop(lostKeys...)
+		for _, prefix := range lostPrefixes {
+			b.dropPrefix(prefix)
+		}
+	}
+	b.mu.Lock()
+	b.replaying = false
+	trial := b.replayTrial
+	b.replayTrial = false
+	b.stats.Replayed += n
+	b.mu.Unlock()
+	// keys of writes failed during the replay are deleted by another one before closing
+	b.done(trial, err)
+}
+
+func (b *BreakerCache) do(f func() error) error {
+	return b.call(false, f)
+}
+
+func (b *BreakerCache) call(write bool, f func() error) error {
+	ok, trial := b.allow(write)
+	if !ok {
+		return ErrUnavailable
+	}
+	err := f()
+	b.done(trial, err)
+	return err
+}
+
+// a write to keys, they are recorded if it fails
+func (b *BreakerCache) write(keys []string, f func() error) error {
+	err := b.call(true, f)
+	if err != nil && err != ErrNotFound {
+		b.drop(keys...)
+	}
+	return err
+}
+
+// Get implements Cache
+func (b *BreakerCache) Get(ctx context.Context, key string) (res string, err error) {
+	err = b.do(func() error {
+		res, err = b.cache.Get(ctx, key)
+		return err
+	})
+	return res, err
+}
+
+// MGet implements Cache
+func (b *BreakerCache) MGet(ctx context.Context, keys ...string) (res []interface{}, err error) {
+	err = b.do(func() error {
+		res, err = b.cache.MGet(ctx, keys...)
+		return err
+	})
+	return res, err
+}
+
+// MGetTTL implements Cache
+func (b *BreakerCache) MGetTTL(ctx context.Context, keys ...string) (values []interface{}, ttls []time.Duration, err error) {
+	err = b.do(func() error {
+		values, ttls, err = b.cache.MGetTTL(ctx, keys...)
+		return err
+	})
+	return values, ttls, err
+}
+
+// Del implements Cache
+func (b *BreakerCache) Del(ctx context.Context, keys ...string) error {
+	return b.write(keys, func() error {
+		return b.cache.Del(ctx, keys...)
+	})
+}
+
+// DelPrefix implements Cache
+func (b *BreakerCache) DelPrefix(ctx context.Context, prefix string) (n int64, err error) {
+	err = b.call(true, func() error {
+		n, err = b.cache.DelPrefix(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		b.dropPrefix(prefix)
+	}
+	return n, err
+}
+
+// Set implements Cache
+func (b *BreakerCache) Set(ctx context.Context, key string, value string, d time.Duration) error {
+	return b.write([]string{key}, func() error {
+		return b.cache.Set(ctx, key, value, d)
+	})
+}
+
+// GetInt64 implements Cache
+func (b *BreakerCache) GetInt64(ctx context.Context, key string) (res int64, err error) {
+	err = b.do(func() error {
+		res, err = b.cache.GetInt64(ctx, key)
+		return err
+	})
+	return res, err
+}
+
+// SetInt64 implements Cache
+func (b *BreakerCache) SetInt64(ctx context.Context, key string, value int64, d time.Duration) error {
+	return b.write([]string{key}, func() error {
+		return b.cache.SetInt64(ctx, key, value, d)
+	})
+}
+
+// IncrBy implements Cache
+func (b *BreakerCache) IncrBy(ctx context.Context, key string, delta int64) (res int64, err error) {
+	err = b.write([]string{key}, func() error {
+		res, err = b.cache.IncrBy(ctx, key, delta)
+		return err
+	})
+	return res, err
+}
+
+// ZAdd implements Cache
+func (b *BreakerCache) ZAdd(ctx context.Context, key string, score float64, member string) error {
+	return b.do(func() error {
+		return b.cache.ZAdd(ctx, key, score, member)
+	})
+}
+
+// ZRevRange implements Cache
+func (b *BreakerCache) ZRevRange(ctx context.Context, key string, start, stop int64) (res []string, err error) {
+	err = b.do(func() error {
+		res, err = b.cache.ZRevRange(ctx, key, start, stop)
+		return err
+	})
+	return res, err
+}
+
+// ZRemRangeByRank implements Cache
+func (b *BreakerCache) ZRemRangeByRank(ctx context.Context, key string, start, stop int64) error {
+	return b.do(func() error {
+		return b.cache.ZRemRangeByRank(ctx, key, start, stop)
+	})
+}
+
+// ZRem implements Cache
+func (b *BreakerCache) ZRem(ctx context.Context, key string, members ...string) error {
+	return b.do(func() error {
+		return b.cache.ZRem(ctx, key, members...)
+	})
+}
+
+// ZIncrBy implements Cache
+func (b *BreakerCache) ZIncrBy(ctx context.Context, key string, incr float64, member string) error {
+	return b.do(func() error {
+		return b.cache.ZIncrBy(ctx, key, incr, member)
+	})
+}
+
+// ZMScore implements Cache
+func (b *BreakerCache) ZMScore(ctx context.Context, key string, members ...string) (res []float64, err error) {
+	err = b.do(func() error {
+		res, err = b.cache.ZMScore(ctx, key, members...)
+		return err
+	})
+	return res, err
+}
+
+// ZRangeByLex implements Cache
+func (b *BreakerCache) ZRangeByLex(ctx context.Context, key string, min, max string, offset, count int64) (res []string, err error) {
+	err = b.do(func() error {
+		res, err = b.cache.ZRangeByLex(ctx, key, min, max, offset, count)
+		return err
+	})
+	return res, err
+}
+
+// ZRevRangeByScore implements Cache
+func (b *BreakerCache) ZRevRangeByScore(ctx context.Context, key string, max, min string, offset, count int64) (res []ZMember, err error) {
+	err = b.do(func() error {
+		res, err = b.cache.ZRevRangeByScore(ctx, key, max, min, offset, count)
+		return err
+	})
+	return res, err
+}
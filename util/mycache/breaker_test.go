@@ -0,0 +1,218 @@
+package mycache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCooldown = 20 * time.Millisecond
+
+var errDown = errors.New("cache is down")
+
+// a memory cache failing with err, whose Del waits for delGate if set
+type faultyCache struct {
+	*MemoryCache
+	mu      sync.Mutex
+	err     error
+	delGate chan struct{}
+}
+
+func newFaultyBreaker() (*faultyCache, *BreakerCache) {
+	f := &faultyCache{MemoryCache: NewMemoryCache(100)}
+	return f, NewBreakerCache(f, 3, testCooldown)
+}
+
+func (f *faultyCache) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *faultyCache) fault() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *faultyCache) Get(ctx context.Context, key string) (string, error) {
+	if err := f.fault(); err != nil {
+		return "", err
+	}
+	return f.MemoryCache.Get(ctx, key)
+}
+
+func (f *faultyCache) Set(ctx context.Context, key string, value string, d time.Duration) error {
+	if err := f.fault(); err != nil {
+		return err
+	}
+	return f.MemoryCache.Set(ctx, key, value, d)
+}
+
+func (f *faultyCache) Del(ctx context.Context, keys ...string) error {
+	f.mu.Lock()
+	gate := f.delGate
+	f.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	if err := f.fault(); err != nil {
+		return err
+	}
+	return f.MemoryCache.Del(ctx, keys...)
+}
+
+// fails reads until the breaker opens, at most maxFailures
+func openBreaker(t *testing.T, f *faultyCache, b *BreakerCache) {
+	t.Helper()
+	f.setErr(errDown)
+	for i := 0; b.State() == BreakerClosed; i++ {
+		if i == 3 {
+			t.Fatalf("state after 3 failures: %v", b.State())
+		}
+		if _, err := b.Get(context.Background(), "x"); err != errDown {
+			t.Fatalf("get %v while down: %v", i, err)
+		}
+	}
+	if b.State() != BreakerOpen {
+		t.Fatalf("state after failures: %v", b.State())
+	}
+	f.setErr(nil)
+}
+
+func waitState(t *testing.T, b *BreakerCache, want BreakerState) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); b.State() != want; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("state: %v, want %v", b.State(), want)
+		}
+	}
+}
+
+func TestBreakerClosesAfterTrial(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFaultyBreaker()
+	openBreaker(t, f, b)
+	if _, err := b.Get(ctx, "x"); err != ErrUnavailable {
+		t.Fatalf("get while open: %v", err)
+	}
+
+	waitState(t, b, BreakerHalfOpen)
+	if _, err := b.Get(ctx, "x"); err != ErrNotFound {
+		t.Fatalf("trial get: %v", err)
+	}
+	if b.State() != BreakerClosed {
+		t.Fatalf("state after a successful trial: %v", b.State())
+	}
+	if stats := b.Stats(); stats.Opened != 1 || stats.Failures != 3 || stats.Rejected != 1 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
+func TestBreakerReopensAfterFailedTrial(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFaultyBreaker()
+	openBreaker(t, f, b)
+
+	f.setErr(errDown)
+	waitState(t, b, BreakerHalfOpen)
+	if _, err := b.Get(ctx, "x"); err != errDown {
+		t.Fatalf("trial get: %v", err)
+	}
+	if b.State() != BreakerOpen {
+		t.Fatalf("state after a failed trial: %v", b.State())
+	}
+	if _, err := b.Get(ctx, "x"); err != ErrUnavailable {
+		t.Fatalf("get after a failed trial: %v", err)
+	}
+	if stats := b.Stats(); stats.Opened != 2 {
+		t.Errorf("opened %v times, want 2", stats.Opened)
+	}
+}
+
+// a call let in while closed and finishing after the breaker opened does not change its state
+func TestBreakerIgnoresLateResults(t *testing.T) {
+	for _, lateErr := range []error{nil, errDown} {
+		f, b := newFaultyBreaker()
+		started, release := make(chan struct{}), make(chan struct{})
+		finished := make(chan error)
+		go func() {
+			finished <- b.do(func() error {
+				close(started)
+				<-release
+				return lateErr
+			})
+		}()
+		<-started
+		openBreaker(t, f, b)
+
+		close(release)
+		if err := <-finished; err != lateErr {
+			t.Fatalf("late call: %v", err)
+		}
+		if b.State() != BreakerOpen {
+			t.Errorf("state after a late result %v: %v", lateErr, b.State())
+		}
+		if stats := b.Stats(); stats.Opened != 1 {
+			t.Errorf("opened %v times after a late result %v, want 1", stats.Opened, lateErr)
+		}
+	}
+}
+
+// writes lost while the cache is down are deleted before reads are let through again
+func TestBreakerReplaysLostWrites(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFaultyBreaker()
+	if err := b.Set(ctx, "failed", "v1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(ctx, "rejected", "v1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write may still reach the cache, e.g. on a timeout, so the value of the key is unknown
+	f.setErr(errDown)
+	if err := b.Set(ctx, "failed", "v2", time.Minute); err != errDown {
+		t.Fatalf("set while down: %v", err)
+	}
+	openBreaker(t, f, b)
+	if err := b.Set(ctx, "rejected", "v2", time.Minute); err != ErrUnavailable {
+		t.Fatalf("set while open: %v", err)
+	}
+
+	gate := make(chan struct{})
+	f.mu.Lock()
+	f.delGate = gate
+	f.mu.Unlock()
+	waitState(t, b, BreakerHalfOpen)
+	if _, err := b.Get(ctx, "x"); err != ErrNotFound {
+		t.Fatalf("trial get: %v", err)
+	}
+
+	// the replay waits for the gate, reads are rejected and writes let through meanwhile
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("state during the replay: %v", b.State())
+	}
+	if _, err := b.Get(ctx, "failed"); err != ErrUnavailable {
+		t.Errorf("get during the replay: %v", err)
+	}
+	if err := b.Set(ctx, "written", "v", time.Minute); err != nil {
+		t.Errorf("set during the replay: %v", err)
+	}
+
+	close(gate)
+	waitState(t, b, BreakerClosed)
+	for _, key := range []string{"failed", "rejected"} {
+		if value, err := b.Get(ctx, key); err != ErrNotFound {
+			t.Errorf("get %v after the replay: %q, %v", key, value, err)
+		}
+	}
+	if value, err := b.Get(ctx, "written"); err != nil || value != "v" {
+		t.Errorf("get a key written during the replay: %q, %v", value, err)
+	}
+	if stats := b.Stats(); stats.Replayed != 2 {
+		t.Errorf("replayed %v keys, want 2", stats.Replayed)
+	}
+}
@@ -0,0 +1,106 @@
+package mycache
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBus broadcasts invalidated cache keys to all processes over a Redis pub/sub channel.
+// Pub/sub is fire-and-forget, messages sent while a process is disconnected are lost,
+// so a process should drop all its local entries after it reconnects.
+type RedisBus struct {
+	rdb     redis.UniversalClient
+	channel string
+	nodeID  string // messages from this process are ignored
+}
+
+type invalidation struct {
+	NodeID string   `json:"node_id"`
+	Keys   []string `json:"keys"`
+	Prefix string   `json:"prefix,omitempty"` // all keys with the prefix are changed
+}
+
+func NewRedisBus(rdb redis.UniversalClient, channel string) *RedisBus {
+	return &RedisBus{
+		rdb:     rdb,
+		channel: channel,
+		nodeID:  strings.ReplaceAll(uuid.NewString(), "-", ""),
+	}
+}
+
+// tell other processes the keys are changed
+func (b *RedisBus) Publish(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return b.publish(ctx, invalidation{NodeID: b.nodeID, Keys: keys})
+}
+
+// tell other processes all keys with the prefix are changed
+func (b *RedisBus) PublishPrefix(ctx context.Context, prefix string) error {
+	return b.publish(ctx, invalidation{NodeID: b.nodeID, Prefix: prefix})
+}
+
+func (b *RedisBus) publish(ctx context.Context, inv invalidation) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return errors.Wrapf(err, "fail to encode invalidation")
+	}
+	err = b.rdb.Publish(ctx, b.channel, data).Err()
+	err = errors.Wrapf(err, "fail to publish invalidation %s", data)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// receive invalidations of other processes until ctx is done.
+// onReset is called on every (re)subscription and receive error, when messages may be missed.
+func (b *RedisBus) Run(ctx context.Context, onKeys func(keys []string), onPrefix func(prefix string), onReset func()) {
+	pubsub := b.rdb.Subscribe(ctx, b.channel)
+	defer pubsub.Close()
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// the connection is re-established by the next Receive
+			log.Printf("fail to receive invalidation, reset local cache: %v\n", err)
+			onReset()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" {
+				onReset()
+			}
+		case *redis.Message:
+			var inv invalidation
+			if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+				log.Printf("fail to decode invalidation %q: %v\n", msg.Payload, err)
+				continue
+			}
+			if inv.NodeID == b.nodeID {
+				continue
+			}
+			if inv.Prefix != "" {
+				onPrefix(inv.Prefix)
+			} else {
+				onKeys(inv.Keys)
+			}
+		}
+	}
+}
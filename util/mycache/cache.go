@@ -11,12 +11,40 @@ type Cache interface {
 	Set(ctx context.Context, key string, value string, d time.Duration) error
 	Get(ctx context.Context, key string) (string, error)
 	MGet(ctx context.Context, keys ...string) ([]interface{}, error)
+	// MGet with the remaining TTL of each key, 0 for keys without expiry or not found
+	MGetTTL(ctx context.Context, keys ...string) (values []interface{}, ttls []time.Duration, err error)
+	Del(ctx context.Context, keys ...string) error
+	// delete all keys starting with prefix, return the number deleted. It scans all keys, only for maintenance.
+	DelPrefix(ctx context.Context, prefix string) (int64, error)
 	SetInt64(ctx context.Context, key string, value int64, d time.Duration) error
 	GetInt64(ctx context.Context, key string) (int64, error)
+	// add delta to an existing int64 value, return ErrNotFound if key not exists
+	IncrBy(ctx context.Context, key string, delta int64) (int64, error)
+	// sorted set, members are ranked by score desc in ZRevRange
+	ZAdd(ctx context.Context, key string, score float64, member string) error
+	ZRevRange(ctx context.Context, key string, start, stop int64) ([]string, error)
+	ZRemRangeByRank(ctx context.Context, key string, start, stop int64) error
+	ZRem(ctx context.Context, key string, members ...string) error
+	ZIncrBy(ctx context.Context, key string, incr float64, member string) error
+	// scores of members, 0 for members not in the set
+	ZMScore(ctx context.Context, key string, members ...string) ([]float64, error)
+	// members in lexicographical range, all members should have the same score.
+	// min/max: "[a" for inclusive, "(a" for exclusive, "-"/"+" for infinity
+	ZRangeByLex(ctx context.Context, key string, min, max string, offset, count int64) ([]string, error)
+	// members with score in [min, max] by score desc.
+	// min/max: "1.5" for inclusive, "(1.5" for exclusive, "-inf"/"+inf" for infinity
+	ZRevRangeByScore(ctx context.Context, key string, max, min string, offset, count int64) ([]ZMember, error)
+}
+
+type ZMember struct {
+	Member string
+	Score  float64
 }
 
 var (
 	ErrNotFound = errors.New("cache key not found")
+	// the cache is skipped by BreakerCache, callers should treat it as a miss
+	ErrUnavailable = errors.New("cache is unavailable")
 )
 
 func RandomExpire(d time.Duration, jitter float64) time.Duration {
@@ -24,6 +24,16 @@ func Key(parts ...interface{}) string {
 	return strings.Join(strs, ":")
 }
 
+// parts of a post share a hash tag, so they are in the same redis cluster slot and read by one MGET
+func hashTag(id interface{}) string {
+	return fmt.Sprintf("{%v}", id)
+}
+
+// set for a while after the user writes db, for read-your-writes of replicas
+func UserWritten(userID int64) string {
+	return Key("written", userID)
+}
+
 func UserBasic(userID int64) string {
 	return Key("user", userID, "basic")
 }
@@ -41,25 +51,77 @@ func NicknameToUserID(nickname string) string {
 }
 
 func PostBasic(postID int64) string {
-	return Key("post", postID, "basic")
+	return Key("post", hashTag(postID), "basic")
 }
 
 func PostContent(postID int64) string {
-	return Key("post", postID, "content")
+	return Key("post", hashTag(postID), "content")
 }
 
 func PostReplyNum(postID int64) string {
-	return Key("post", postID, "reply_num")
+	return Key("post", hashTag(postID), "reply_num")
 }
 
 func PostReplyTime(postID int64) string {
-	return Key("post", postID, "reply_time")
+	return Key("post", hashTag(postID), "reply_time")
+}
+
+// sorted set of latest created posts in a board, board 0 is for all posts
+func PostLatestCreated(boardID int64) string {
+	return Key("post", "latest_created", boardID)
+}
+
+// sorted set of latest replied posts in a board, board 0 is for all posts
+func PostLatestReplied(boardID int64) string {
+	return Key("post", "latest_replied", boardID)
+}
+
+// like num of a post or a reply
+func LikeNum(targetID int64) string {
+	return Key("like", targetID, "num")
+}
+
+// sorted set of hot posts in a board, board 0 is for all posts
+func PostHot(boardID int64) string {
+	return Key("post", "hot", boardID)
+}
+
+// set after PostHot of the board is built from db, the list may miss posts without it
+func PostHotReady(boardID int64) string {
+	return Key("post", "hot", "ready", boardID)
+}
+
+// a frozen page-able copy of hot posts
+func PostHotSnapshot(snapshotID string) string {
+	return Key("post", "hot", "snapshot", snapshotID)
+}
+
+// reaction counts of a post or a reply, by emoji
+func ReactionCounts(targetID int64) string {
+	return Key("reaction", targetID, "counts")
+}
+
+// lexicographical sorted set of nickname suffixes, for nickname search
+func NicknameIndex() string {
+	return Key("nickname", "index")
+}
+
+// set after all nicknames are added to NicknameIndex, the index is not used without it
+func NicknameIndexReady() string {
+	return Key("nickname", "index", "ready")
+}
+
+// sorted set of user activity, score is number of posts and replies
+func UserActivity() string {
+	return Key("user", "activity")
 }
 
-func PostLatestCreated() string {
-	return Key("post", "latest_created")
+// popular tags of a board, board 0 is for all posts
+func TagCloud(boardID int64) string {
+	return Key("tag", "cloud", boardID)
 }
 
-func PostLatestReplied() string {
-	return Key("post", "latest_replied")
+// pub/sub channel of keys to evict from local caches
+func InvalidateChannel() string {
+	return Key("invalidate")
 }
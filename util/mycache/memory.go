@@ -1,42 +1,466 @@
 package mycache
 
-// import (
-// 	"context"
-// 	"fmt"
-// 	"time"
-
-// 	gocache "github.com/patrickmn/go-cache"
-// )
-
-// type MemoryCache struct {
-// 	cache *gocache.Cache
-// }
-
-// var _ Cache = (*MemoryCache)(nil)
-
-// func NewMemoryCache() *MemoryCache {
-// 	return &MemoryCache{
-// 		cache: gocache.New(30*time.Minute, 30*time.Minute),
-// 	}
-// }
-
-// func (c *MemoryCache) Set(ctx context.Context, key string, value interface{}, d time.Duration) error {
-// 	c.cache.Set(key, value, d)
-// 	return nil
-// }
-
-// func (c *MemoryCache) Get(ctx context.Context, key string) (interface{}, error) {
-// 	item, _ := c.cache.Get(key)
-// 	return item, nil
-// }
-
-// func (c *MemoryCache) GetString(ctx context.Context, key string) (string, error) {
-// 	item, _ := c.cache.Get(key)
-// 	if item == nil {
-// 		return "", nil
-// 	}
-// 	if s, ok := item.(string); ok {
-// 		return s, nil
-// 	}
-// 	return "", fmt.Errorf("cache value type is wrong")
-// }
+import (
+	"container/list"
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryCache is a per-process Cache, for running without Redis and as the L1 of TieredCache.
+// String values are evicted in LRU order when there are more than maxEntries of them.
+// Sorted sets are never evicted, as they are used as indexes (e.g. nickname index)
+// which are not rebuilt on miss.
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	lru        *list.List               // front is the most recently used, of *memoryEntry
+	entries    map[string]*list.Element // string values
+	zsets      map[string]*memoryZSet
+}
+
+var _ Cache = (*MemoryCache)(nil)
+
+type memoryEntry struct {
+	key      string
+	value    string
+	expireAt time.Time // zero means never expire
+}
+
+// maxEntries <= 0 means no limit
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		zsets:      make(map[string]*memoryZSet),
+	}
+}
+
+// get a live entry and mark it used, lock should be held
+func (m *MemoryCache) get(key string) (*memoryEntry, bool) {
+	elem, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*memoryEntry)
+	if !entry.expireAt.IsZero() && time.Now().After(entry.expireAt) {
+		m.lru.Remove(elem)
+		delete(m.entries, key)
+		return nil, false
+	}
+	m.lru.MoveToFront(elem)
+	return entry, true
+}
+
+// set an entry and evict the least recently used ones, lock should be held
+func (m *MemoryCache) set(key string, value string, d time.Duration) {
+	var expireAt time.Time
+	if d > 0 {
+		expireAt = time.Now().Add(d)
+	}
+	if elem, ok := m.entries[key]; ok {
+		entry := elem.Value.(*memoryEntry)
+		entry.value, entry.expireAt = value, expireAt
+		m.lru.MoveToFront(elem)
+		return
+	}
+	m.entries[key] = m.lru.PushFront(&memoryEntry{key: key, value: value, expireAt: expireAt})
+	for m.maxEntries > 0 && m.lru.Len() > m.maxEntries {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryEntry).key)
+	}
+}
+
+// remove all string values and sorted sets
+func (m *MemoryCache) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.Init()
+	m.entries = make(map[string]*list.Element)
+	m.zsets = make(map[string]*memoryZSet)
+}
+
+// Set implements Cache
+func (m *MemoryCache) Set(ctx context.Context, key string, value string, d time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(key, value, d)
+	return nil
+}
+
+// Get implements Cache
+func (m *MemoryCache) Get(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.get(key)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return entry.value, nil
+}
+
+// MGet implements Cache
+func (m *MemoryCache) MGet(ctx context.Context, keys ...string) ([]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if entry, ok := m.get(key); ok {
+			res[i] = entry.value
+		}
+	}
+	return res, nil
+}
+
+// MGetTTL implements Cache
+func (m *MemoryCache) MGetTTL(ctx context.Context, keys ...string) ([]interface{}, []time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := make([]interface{}, len(keys))
+	ttls := make([]time.Duration, len(keys))
+	for i, key := range keys {
+		if entry, ok := m.get(key); ok {
+			values[i] = entry.value
+			if !entry.expireAt.IsZero() {
+				ttls[i] = time.Until(entry.expireAt)
+			}
+		}
+	}
+	return values, ttls, nil
+}
+
+// Del implements Cache
+func (m *MemoryCache) Del(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := m.entries[key]; ok {
+			m.lru.Remove(elem)
+			delete(m.entries, key)
+		}
+		delete(m.zsets, key)
+	}
+	return nil
+}
+
+// DelPrefix implements Cache
+func (m *MemoryCache) DelPrefix(ctx context.Context, prefix string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for key, elem := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			m.lru.Remove(elem)
+			delete(m.entries, key)
+			n++
+		}
+	}
+	for key := range m.zsets {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.zsets, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// SetInt64 implements Cache
+func (m *MemoryCache) SetInt64(ctx context.Context, key string, value int64, d time.Duration) error {
+	return m.Set(ctx, key, strconv.FormatInt(value, 10), d)
+}
+
+// GetInt64 implements Cache
+func (m *MemoryCache) GetInt64(ctx context.Context, key string) (int64, error) {
+	value, err := m.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	res, err := strconv.ParseInt(value, 10, 64)
+	return res, errors.Wrapf(err, "fail to get int64 with key %v", key)
+}
+
+// IncrBy implements Cache
+func (m *MemoryCache) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.get(key)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	value, err := strconv.ParseInt(entry.value, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to incr int64 with key %v", key)
+	}
+	value += delta
+	entry.value = strconv.FormatInt(value, 10)
+	return value, nil
+}
+
+// sorted set, members are kept in (score, member) asc order
+type memoryZSet struct {
+	members []ZMember
+	scores  map[string]float64
+}
+
+func zMemberLess(a, b ZMember) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return a.Member < b.Member
+}
+
+// index of the first member not less than z
+func (z *memoryZSet) search(target ZMember) int {
+	return sort.Search(len(z.members), func(i int) bool {
+		return !zMemberLess(z.members[i], target)
+	})
+}
+
+func (z *memoryZSet) add(member string, score float64) {
+	z.remove(member)
+	target := ZMember{Member: member, Score: score}
+	i := z.search(target)
+	z.members = append(z.members, ZMember{})
+	copy(z.members[i+1:], z.members[i:])
+	z.members[i] = target
+	z.scores[member] = score
+}
+
+func (z *memoryZSet) remove(member string) {
+	score, ok := z.scores[member]
+	if !ok {
+		return
+	}
+	i := z.search(ZMember{Member: member, Score: score})
+	z.members = append(z.members[:i], z.members[i+1:]...)
+	delete(z.scores, member)
+}
+
+// convert redis style rank range to [start, end) of members, negative rank counts from the end
+func (z *memoryZSet) rankRange(start, stop int64) (int, int) {
+	n := int64(len(z.members))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return int(start), int(stop) + 1
+}
+
+// zset of the key, create it if create is true, lock should be held
+func (m *MemoryCache) zset(key string, create bool) *memoryZSet {
+	z, ok := m.zsets[key]
+	if !ok && create {
+		z = &memoryZSet{scores: make(map[string]float64)}
+		m.zsets[key] = z
+	}
+	return z
+}
+
+// ZAdd implements Cache
+func (m *MemoryCache) ZAdd(ctx context.Context, key string, score float64, member string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.zset(key, true).add(member, score)
+	return nil
+}
+
+// ZRevRange implements Cache
+func (m *MemoryCache) ZRevRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z := m.zset(key, false)
+	if z == nil {
+		return []string{}, nil
+	}
+	n := len(z.members)
+	// rank i in desc order is n-1-i in asc order
+	from, to := z.rankRange(start, stop)
+	res := make([]string, 0, to-from)
+	for i := from; i < to; i++ {
+		res = append(res, z.members[n-1-i].Member)
+	}
+	return res, nil
+}
+
+// ZRemRangeByRank implements Cache
+func (m *MemoryCache) ZRemRangeByRank(ctx context.Context, key string, start, stop int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z := m.zset(key, false)
+	if z == nil {
+		return nil
+	}
+	from, to := z.rankRange(start, stop)
+	for _, member := range z.members[from:to] {
+		delete(z.scores, member.Member)
+	}
+	z.members = append(z.members[:from], z.members[to:]...)
+	return nil
+}
+
+// ZRem implements Cache
+func (m *MemoryCache) ZRem(ctx context.Context, key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z := m.zset(key, false)
+	if z == nil {
+		return nil
+	}
+	for _, member := range members {
+		z.remove(member)
+	}
+	return nil
+}
+
+// ZIncrBy implements Cache
+func (m *MemoryCache) ZIncrBy(ctx context.Context, key string, incr float64, member string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z := m.zset(key, true)
+	z.add(member, z.scores[member]+incr)
+	return nil
+}
+
+// ZMScore implements Cache
+func (m *MemoryCache) ZMScore(ctx context.Context, key string, members ...string) ([]float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]float64, len(members))
+	z := m.zset(key, false)
+	if z == nil {
+		return res, nil
+	}
+	for i, member := range members {
+		res[i] = z.scores[member]
+	}
+	return res, nil
+}
+
+// ZRangeByLex implements Cache
+func (m *MemoryCache) ZRangeByLex(ctx context.Context, key string, min, max string, offset, count int64) ([]string, error) {
+	inMin, err := lexBound(min, true)
+	if err != nil {
+		return nil, err
+	}
+	inMax, err := lexBound(max, false)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := []string{}
+	z := m.zset(key, false)
+	if z == nil {
+		return res, nil
+	}
+	// all members have the same score, so they are in lexicographical order
+	for _, member := range z.members {
+		if !inMin(member.Member) {
+			continue
+		}
+		if !inMax(member.Member) || (count >= 0 && int64(len(res)) >= count) {
+			break
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		res = append(res, member.Member)
+	}
+	return res, nil
+}
+
+// parse "[a", "(a", "-" and "+" to a check of members
+func lexBound(bound string, isMin bool) (func(member string) bool, error) {
+	switch {
+	case bound == "-":
+		return func(string) bool { return true }, nil
+	case bound == "+":
+		return func(string) bool { return true }, nil
+	case strings.HasPrefix(bound, "["):
+		v := bound[1:]
+		if isMin {
+			return func(member string) bool { return member >= v }, nil
+		}
+		return func(member string) bool { return member <= v }, nil
+	case strings.HasPrefix(bound, "("):
+		v := bound[1:]
+		if isMin {
+			return func(member string) bool { return member > v }, nil
+		}
+		return func(member string) bool { return member < v }, nil
+	}
+	return nil, errors.Errorf("invalid lex range %q", bound)
+}
+
+// ZRevRangeByScore implements Cache
+func (m *MemoryCache) ZRevRangeByScore(ctx context.Context, key string, max, min string, offset, count int64) ([]ZMember, error) {
+	minScore, minExclusive, err := scoreBound(min)
+	if err != nil {
+		return nil, err
+	}
+	maxScore, maxExclusive, err := scoreBound(max)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := []ZMember{}
+	z := m.zset(key, false)
+	if z == nil {
+		return res, nil
+	}
+	for i := len(z.members) - 1; i >= 0; i-- {
+		member := z.members[i]
+		if member.Score > maxScore || (maxExclusive && member.Score == maxScore) {
+			continue
+		}
+		if member.Score < minScore || (minExclusive && member.Score == minScore) {
+			break
+		}
+		if count >= 0 && int64(len(res)) >= count {
+			break
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		res = append(res, member)
+	}
+	return res, nil
+}
+
+// parse "1.5", "(1.5", "-inf" and "+inf"
+func scoreBound(bound string) (score float64, exclusive bool, err error) {
+	switch bound {
+	case "-inf":
+		return math.Inf(-1), false, nil
+	case "+inf", "inf":
+		return math.Inf(1), false, nil
+	}
+	if strings.HasPrefix(bound, "(") {
+		exclusive = true
+		bound = bound[1:]
+	}
+	score, err = strconv.ParseFloat(bound, 64)
+	return score, exclusive, errors.Wrapf(err, "invalid score range %q", bound)
+}
@@ -3,19 +3,32 @@ package mycache
 import (
 	"context"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/redis/go-redis/v9"
 )
 
+// INCRBY only if the key exists, so a missing counter is not created with a wrong base
+var incrByIfExists = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("INCRBY", KEYS[1], ARGV[1])
+end
+return false
+`)
+
+// RedisCache works with a standalone, sentinel or cluster client.
+// In cluster mode, multi-key commands are split by hash tag of keys and pipelined,
+// as keys of one command must be in the same slot.
 type RedisCache struct {
-	rdb *redis.Client
+	rdb redis.UniversalClient
 }
 
 var _ Cache = (*RedisCache)(nil)
 
-func NewRedisCache(rdb *redis.Client) *RedisCache {
+func NewRedisCache(rdb redis.UniversalClient) *RedisCache {
 	return &RedisCache{
 		rdb: rdb,
 	}
@@ -36,7 +49,13 @@ func (r *RedisCache) Get(ctx context.Context, key string) (string, error) {
 
 // Multi get
 func (r *RedisCache) MGet(ctx context.Context, keys ...string) ([]interface{}, error) {
-	res, err := r.rdb.MGet(ctx, keys...).Result()
+	var res []interface{}
+	var err error
+	if r.isCluster() && len(keys) > 1 {
+		res, err = r.mgetByHashTag(ctx, keys)
+	} else {
+		res, err = r.rdb.MGet(ctx, keys...).Result()
+	}
 	err = errors.Wrapf(err, "fail to mget %v from redis", keys)
 	if err != nil {
 		log.Println(err)
@@ -44,6 +63,161 @@ func (r *RedisCache) MGet(ctx context.Context, keys ...string) ([]interface{}, e
 	return res, err
 }
 
+// MGetTTL implements Cache
+func (r *RedisCache) MGetTTL(ctx context.Context, keys ...string) ([]interface{}, []time.Duration, error) {
+	// GET and PTTL of each key, pipelined, so keys of different slots are fine in cluster mode
+	getCmds := make([]*redis.StringCmd, len(keys))
+	ttlCmds := make([]*redis.DurationCmd, len(keys))
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			getCmds[i] = pipe.Get(ctx, key)
+			ttlCmds[i] = pipe.PTTL(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		err = errors.Wrapf(err, "fail to mget %v with ttl from redis", keys)
+		log.Println(err)
+		return nil, nil, err
+	}
+	values := make([]interface{}, len(keys))
+	ttls := make([]time.Duration, len(keys))
+	for i := range keys {
+		if value, err := getCmds[i].Result(); err == nil {
+			values[i] = value
+		}
+		// -1 for no expiry and -2 for not found
+		if ttl := ttlCmds[i].Val(); ttl > 0 {
+			ttls[i] = ttl
+		}
+	}
+	return values, ttls, nil
+}
+
+func (r *RedisCache) mgetByHashTag(ctx context.Context, keys []string) ([]interface{}, error) {
+	groups := groupByHashTag(keys)
+	cmds := make([]*redis.SliceCmd, len(groups))
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, group := range groups {
+			cmds[i] = pipe.MGet(ctx, pick(keys, group)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := make([]interface{}, len(keys))
+	for i, group := range groups {
+		for j, value := range cmds[i].Val() {
+			res[group[j]] = value
+		}
+	}
+	return res, nil
+}
+
+func (r *RedisCache) isCluster() bool {
+	_, ok := r.rdb.(*redis.ClusterClient)
+	return ok
+}
+
+// hash tag of a key, keys with the same hash tag are in the same cluster slot
+func hashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+// indexes of keys grouped by hash tag, in order of first appearance
+func groupByHashTag(keys []string) [][]int {
+	var groups [][]int
+	groupIdx := make(map[string]int)
+	for i, key := range keys {
+		tag := hashTag(key)
+		j, ok := groupIdx[tag]
+		if !ok {
+			j = len(groups)
+			groupIdx[tag] = j
+			groups = append(groups, nil)
+		}
+		groups[j] = append(groups[j], i)
+	}
+	return groups
+}
+
+func pick(keys []string, idxs []int) []string {
+	res := make([]string, len(idxs))
+	for i, idx := range idxs {
+		res[i] = keys[idx]
+	}
+	return res
+}
+
+// Del implements Cache
+func (r *RedisCache) Del(ctx context.Context, keys ...string) error {
+	var err error
+	if r.isCluster() && len(keys) > 1 {
+		_, err = r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, group := range groupByHashTag(keys) {
+				pipe.Del(ctx, pick(keys, group)...)
+			}
+			return nil
+		})
+	} else {
+		err = r.rdb.Del(ctx, keys...).Err()
+	}
+	err = errors.Wrapf(err, "fail to del %v from redis", keys)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// DelPrefix implements Cache
+func (r *RedisCache) DelPrefix(ctx context.Context, prefix string) (int64, error) {
+	match := globEscaper.Replace(prefix) + "*"
+	var n int64
+	delNode := func(ctx context.Context, node redis.UniversalClient) error {
+		iter := node.Scan(ctx, 0, match, 1000).Iterator()
+		var batch []string
+		for iter.Next(ctx) {
+			batch = append(batch, iter.Val())
+			if len(batch) == 1000 {
+				if err := r.Del(ctx, batch...); err != nil {
+					return err
+				}
+				n += int64(len(batch))
+				batch = batch[:0]
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return errors.Wrapf(err, "fail to scan %v in redis", match)
+		}
+		if len(batch) > 0 {
+			if err := r.Del(ctx, batch...); err != nil {
+				return err
+			}
+			n += int64(len(batch))
+		}
+		return nil
+	}
+	if cluster, ok := r.rdb.(*redis.ClusterClient); ok {
+		// nodes are called concurrently, they share n
+		var mu sync.Mutex
+		err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return delNode(ctx, node)
+		})
+		return n, err
+	}
+	return n, delNode(ctx, r.rdb)
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
 // Set implements Cache
 func (r *RedisCache) Set(ctx context.Context, key string, value string, d time.Duration) error {
 	err := r.rdb.Set(ctx, key, value, d).Err()
@@ -84,3 +258,117 @@ func (r *RedisCache) SetInt64(ctx context.Context, key string, value int64, d ti
 	}
 	return err
 }
+
+// IncrBy implements Cache
+func (r *RedisCache) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	value, err := incrByIfExists.Run(ctx, r.rdb, []string{key}, delta).Int64()
+	if err == redis.Nil {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "fail to incr int64 with key %v", key)
+		log.Println(err)
+		return 0, err
+	}
+	return value, nil
+}
+
+// ZAdd implements Cache
+func (r *RedisCache) ZAdd(ctx context.Context, key string, score float64, member string) error {
+	err := r.rdb.ZAdd(ctx, key, redis.Z{Score: score, Member: member}).Err()
+	err = errors.Wrapf(err, "fail to zadd %v to %v", member, key)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// ZRevRange implements Cache
+func (r *RedisCache) ZRevRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	res, err := r.rdb.ZRevRange(ctx, key, start, stop).Result()
+	err = errors.Wrapf(err, "fail to zrevrange %v", key)
+	if err != nil {
+		log.Println(err)
+	}
+	return res, err
+}
+
+// ZRemRangeByRank implements Cache
+func (r *RedisCache) ZRemRangeByRank(ctx context.Context, key string, start, stop int64) error {
+	err := r.rdb.ZRemRangeByRank(ctx, key, start, stop).Err()
+	err = errors.Wrapf(err, "fail to zremrangebyrank %v", key)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// ZRem implements Cache
+func (r *RedisCache) ZRem(ctx context.Context, key string, members ...string) error {
+	args := make([]interface{}, len(members))
+	for i, member := range members {
+		args[i] = member
+	}
+	err := r.rdb.ZRem(ctx, key, args...).Err()
+	err = errors.Wrapf(err, "fail to zrem from %v", key)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// ZIncrBy implements Cache
+func (r *RedisCache) ZIncrBy(ctx context.Context, key string, incr float64, member string) error {
+	err := r.rdb.ZIncrBy(ctx, key, incr, member).Err()
+	err = errors.Wrapf(err, "fail to zincrby %v of %v", member, key)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// ZMScore implements Cache
+func (r *RedisCache) ZMScore(ctx context.Context, key string, members ...string) ([]float64, error) {
+	res, err := r.rdb.ZMScore(ctx, key, members...).Result()
+	err = errors.Wrapf(err, "fail to zmscore %v", key)
+	if err != nil {
+		log.Println(err)
+	}
+	return res, err
+}
+
+// ZRangeByLex implements Cache
+func (r *RedisCache) ZRangeByLex(ctx context.Context, key string, min, max string, offset, count int64) ([]string, error) {
+	res, err := r.rdb.ZRangeByLex(ctx, key, &redis.ZRangeBy{
+		Min:    min,
+		Max:    max,
+		Offset: offset,
+		Count:  count,
+	}).Result()
+	err = errors.Wrapf(err, "fail to zrangebylex %v", key)
+	if err != nil {
+		log.Println(err)
+	}
+	return res, err
+}
+
+// ZRevRangeByScore implements Cache
+func (r *RedisCache) ZRevRangeByScore(ctx context.Context, key string, max, min string, offset, count int64) ([]ZMember, error) {
+	res, err := r.rdb.ZRevRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min:    min,
+		Max:    max,
+		Offset: offset,
+		Count:  count,
+	}).Result()
+	err = errors.Wrapf(err, "fail to zrevrangebyscore %v", key)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	members := make([]ZMember, len(res))
+	for i, z := range res {
+		member, _ := z.Member.(string)
+		members[i] = ZMember{Member: member, Score: z.Score}
+	}
+	return members, nil
+}
@@ -0,0 +1,203 @@
+package mycache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TieredCache puts a small per-process MemoryCache (L1) in front of another Cache (L2, e.g. Redis).
+// Only string values of keys with one of the prefixes are kept in L1, for at most l1TTL
+// and never longer than they live in L2, so a short-lived entry (e.g. a negative one) is not
+// served from L1 after it expires in L2.
+// Writes go to L2 and update the key in local L1, then the key is evicted from L1 of other
+// processes through the bus. Without a bus, L1 of other processes may be stale until l1TTL.
+// All other operations go to L2 directly.
+type TieredCache struct {
+	Cache    // L2
+	l1       *MemoryCache
+	l1TTL    time.Duration
+	prefixes []string
+	bus      *RedisBus // optional
+}
+
+var _ Cache = (*TieredCache)(nil)
+
+// bus: nil if only one process is running
+func NewTieredCache(l2 Cache, l1MaxEntries int, l1TTL time.Duration, prefixes []string, bus *RedisBus) *TieredCache {
+	return &TieredCache{
+		Cache:    l2,
+		l1:       NewMemoryCache(l1MaxEntries),
+		l1TTL:    l1TTL,
+		prefixes: prefixes,
+		bus:      bus,
+	}
+}
+
+// evict L1 entries changed by other processes until ctx is done
+func (t *TieredCache) Run(ctx context.Context) {
+	if t.bus == nil {
+		return
+	}
+	t.bus.Run(ctx, func(keys []string) {
+		_ = t.l1.Del(ctx, keys...)
+	}, func(prefix string) {
+		_, _ = t.l1.DelPrefix(ctx, prefix)
+	}, t.l1.Flush)
+}
+
+// tell other processes to evict the keys in L1
+func (t *TieredCache) publish(ctx context.Context, keys ...string) {
+	if t.bus == nil {
+		return
+	}
+	var l1Keys []string
+	for _, key := range keys {
+		if t.inL1(key) {
+			l1Keys = append(l1Keys, key)
+		}
+	}
+	_ = t.bus.Publish(ctx, l1Keys...)
+}
+
+func (t *TieredCache) inL1(key string) bool {
+	for _, prefix := range t.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// L1 TTL never exceeds the one in L2
+func (t *TieredCache) l1Expire(d time.Duration) time.Duration {
+	if d > 0 && d < t.l1TTL {
+		return d
+	}
+	return t.l1TTL
+}
+
+// Get implements Cache
+func (t *TieredCache) Get(ctx context.Context, key string) (string, error) {
+	if !t.inL1(key) {
+		return t.Cache.Get(ctx, key)
+	}
+	if value, err := t.l1.Get(ctx, key); err == nil {
+		return value, nil
+	}
+	return t.getL2(ctx, key)
+}
+
+// read a key from L2 and keep it in L1 for its remaining TTL in L2
+func (t *TieredCache) getL2(ctx context.Context, key string) (string, error) {
+	values, ttls, err := t.Cache.MGetTTL(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	value, ok := values[0].(string)
+	if !ok {
+		return "", ErrNotFound
+	}
+	_ = t.l1.Set(ctx, key, value, t.l1Expire(ttls[0]))
+	return value, nil
+}
+
+// MGet implements Cache
+func (t *TieredCache) MGet(ctx context.Context, keys ...string) ([]interface{}, error) {
+	res := make([]interface{}, len(keys))
+	var missKeys []string
+	var missIdx []int
+	for i, key := range keys {
+		if t.inL1(key) {
+			if value, err := t.l1.Get(ctx, key); err == nil {
+				res[i] = value
+				continue
+			}
+		}
+		missKeys = append(missKeys, key)
+		missIdx = append(missIdx, i)
+	}
+	if len(missKeys) == 0 {
+		return res, nil
+	}
+	values, ttls, err := t.Cache.MGetTTL(ctx, missKeys...)
+	if err != nil {
+		return nil, err
+	}
+	for j, value := range values {
+		res[missIdx[j]] = value
+		if s, ok := value.(string); ok && t.inL1(missKeys[j]) {
+			_ = t.l1.Set(ctx, missKeys[j], s, t.l1Expire(ttls[j]))
+		}
+	}
+	return res, nil
+}
+
+// GetInt64 implements Cache
+func (t *TieredCache) GetInt64(ctx context.Context, key string) (int64, error) {
+	if !t.inL1(key) {
+		return t.Cache.GetInt64(ctx, key)
+	}
+	if value, err := t.l1.GetInt64(ctx, key); err == nil {
+		return value, nil
+	}
+	value, err := t.getL2(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		_ = t.l1.Del(ctx, key)
+		return 0, errors.Wrapf(err, "fail to parse int64 with key %v", key)
+	}
+	return n, nil
+}
+
+// Set implements Cache
+func (t *TieredCache) Set(ctx context.Context, key string, value string, d time.Duration) error {
+	err := t.Cache.Set(ctx, key, value, d)
+	if err != nil || !t.inL1(key) {
+		_ = t.l1.Del(ctx, key)
+		return err
+	}
+	_ = t.l1.Set(ctx, key, value, t.l1Expire(d))
+	t.publish(ctx, key)
+	return nil
+}
+
+// SetInt64 implements Cache
+func (t *TieredCache) SetInt64(ctx context.Context, key string, value int64, d time.Duration) error {
+	_ = t.l1.Del(ctx, key)
+	err := t.Cache.SetInt64(ctx, key, value, d)
+	t.publish(ctx, key)
+	return err
+}
+
+// IncrBy implements Cache
+func (t *TieredCache) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	_ = t.l1.Del(ctx, key)
+	value, err := t.Cache.IncrBy(ctx, key, delta)
+	t.publish(ctx, key)
+	return value, err
+}
+
+// Del implements Cache
+func (t *TieredCache) Del(ctx context.Context, keys ...string) error {
+	_ = t.l1.Del(ctx, keys...)
+	err := t.Cache.Del(ctx, keys...)
+	t.publish(ctx, keys...)
+	return err
+}
+
+// DelPrefix implements Cache
+func (t *TieredCache) DelPrefix(ctx context.Context, prefix string) (int64, error) {
+	_, _ = t.l1.DelPrefix(ctx, prefix)
+	n, err := t.Cache.DelPrefix(ctx, prefix)
+	if t.bus != nil {
+		_ = t.bus.PublishPrefix(ctx, prefix)
+	}
+	return n, err
+}
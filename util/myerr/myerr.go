@@ -23,6 +23,7 @@ var (
 	ErrWrongPassword = newError("2001", "用户名或密码错误")
 	ErrNotLogin      = newError("2002", "未登录")
 	ErrWrongVcode    = newError("2003", "验证码错误")
+	ErrUserLocked    = newError("2004", "账号已被锁定")
 
 	ErrOther            = newError("3000", "服务器内部错误") // 通用的其他错误
 	ErrDupUser          = newError("3001", "该用户已存在")
@@ -40,6 +41,11 @@ func (e *MyError) Cause() error {
 	return e.cause
 }
 
+// for errors.Is, e.g. to find context.DeadlineExceeded in the cause
+func (e *MyError) Unwrap() error {
+	return e.cause
+}
+
 // wrap a cause error with ErrOther.
 // imsg is for inner message print.
 func OtherErrWarpf(cause error, imsg string, args ...interface{}) *MyError {
@@ -1,12 +1,14 @@
 package myhash
 
 import (
+	"encoding/binary"
 	"hash/fnv"
 	"math"
 )
 
 // mod should > 0
 // non-cryptographic
+// Only for shard map version 0 (see model.ShardMapKindModulo), existing rows are placed by it.
 func HashString(s string, mod int64) int64 {
 	h := fnv.New64()
 	h.Write([]byte(s))               // ignore err, impossible to fail
@@ -14,34 +16,41 @@ func HashString(s string, mod int64) int64 {
 	return int64(res) % mod
 }
 
-const (
-	move0 = 8 * iota
-	move1
-	move2
-	move3
-	move4
-	move5
-	move6
-	move7
-)
-
 // mod should > 0
 // non-cryptographic
+// Only for shard map version 0 (see model.ShardMapKindModulo) and post shards, existing rows are placed by it,
+// so it must not change: it is the ID with high bits mixed in modulo mod, no hash is involved.
 func HashSnowflakeID(i int64, mod int64) int64 {
 	// necessary: mix high bits, 23 is for 2ms position for snowflake id
 	// we use 23 instead of 22 is because it seems on some machine, time in ms tend to be even
 	i ^= (i >> 23)
-
-	h := fnv.New64()
-	h.Write([]byte{
-		byte((i >> move0) & 0xff),
-		byte((i >> move1) & 0xff),
-		byte((i >> move2) & 0xff),
-		byte((i >> move3) & 0xff),
-		byte((i >> move4) & 0xff),
-		byte((i >> move5) & 0xff),
-		byte((i >> move6) & 0xff),
-		byte((i >> move7) & 0xff),
-	})
 	return i % mod
 }
+
+// 64-bit hash for consistent hashing, FNV-1a with a final mix, as FNV alone spreads
+// short keys (e.g. 8 bytes of an ID) unevenly over the high bits.
+func Sum64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b) // ignore err, impossible to fail
+	return mix64(h.Sum64())
+}
+
+func SnowflakeKey(i int64) uint64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(i))
+	return Sum64(b[:])
+}
+
+func StringKey(s string) uint64 {
+	return Sum64([]byte(s))
+}
+
+// finalizer of splitmix64
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -8,8 +8,8 @@ import (
 
 func HashPassword(password string) (string, error) {
 	cost := 10
-	if conf.Global != nil {
-		cost = conf.Global.App.BcrytpCost
+	if conf.Global() != nil {
+		cost = conf.Global().App.BcrytpCost
 	}
 	h, err := bcrypt.GenerateFromPassword([]byte(password), cost)
 	return string(h), err
@@ -7,3 +7,6 @@ var Password = regexp.MustCompile(`^[0-9A-Za-z\W_]*([0-9][A-Za-z\W_]*[a-zA-Z]|[a
 var Email = regexp.MustCompile(`^[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\.[a-zA-Z0-9-.]+$`)
 
 var Phone = regexp.MustCompile(`^1[2-9]\d{9}$`)
+
+// "#tag#" in post title and content
+var Hashtag = regexp.MustCompile(`#([^#\n]{1,20})#`)
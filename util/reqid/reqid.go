@@ -0,0 +1,19 @@
+// request ID carried in context, for logs of a request across layers
+package reqid
+
+import "context"
+
+type ctxKey struct{}
+
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// empty if ctx is not from a request
+func From(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}